@@ -2,12 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
@@ -15,17 +23,46 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Return the config. With "effective=true", the defaults in effect are filled
+// in for any settings left unset.
 func getConfig(w http.ResponseWriter, r *http.Request) {
-	w.Write(marshal(Registry.Config()))
+	var effective bool
+	if param := r.FormValue("effective"); param != "" {
+		var err error
+		effective, err = strconv.ParseBool(param)
+		if err != nil {
+			http.Error(w, "invalid effective", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if effective {
+		w.Write(marshal(Registry.EffectiveConfig().Redact()))
+		return
+	}
+	w.Write(marshal(Registry.Config().Redact()))
 }
 
 func getStats(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") == "graphite" {
+		writeGraphite(w, Registry.Stats())
+		return
+	}
+
 	if len(Registry.Config().Services) == 0 {
 		w.WriteHeader(503)
 	}
 	w.Write(marshal(Registry.Stats()))
 }
 
+// Write the stats in Graphite's plaintext format, one metric per line.
+func writeGraphite(w http.ResponseWriter, stats []ServiceStat) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range graphiteMetrics(graphitePrefix, stats, time.Now()) {
+		io.WriteString(w, line+"\n")
+	}
+}
+
 func getServiceStats(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -35,9 +72,34 @@ func getServiceStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.FormValue("format") == "graphite" {
+		writeGraphite(w, []ServiceStat{serviceStats})
+		return
+	}
+
 	w.Write(marshal(serviceStats))
 }
 
+// Zero the cumulative counters, for everything, a service, or a backend
+// depending on the path, and return the new stats.
+func resetStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := Registry.ResetStats(vars["service"], vars["backend"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case vars["backend"] != "":
+		getBackend(w, r)
+	case vars["service"] != "":
+		getServiceStats(w, r)
+	default:
+		w.Write(marshal(Registry.Stats()))
+	}
+}
+
 func getServiceConfig(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -47,7 +109,82 @@ func getServiceConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Write(marshal(serviceStats))
+	w.Write(marshal(serviceStats.Redact()))
+}
+
+// Runtime information about the shuttle process
+type RuntimeStat struct {
+	Version      string    `json:"version"`
+	GoVersion    string    `json:"go_version"`
+	GOOS         string    `json:"goos"`
+	GOARCH       string    `json:"goarch"`
+	NumCPU       int       `json:"num_cpu"`
+	Goroutines   int       `json:"goroutines"`
+	HeapAlloc    uint64    `json:"heap_alloc"`
+	HeapSys      uint64    `json:"heap_sys"`
+	HeapObjects  uint64    `json:"heap_objects"`
+	NumGC        uint32    `json:"num_gc"`
+	PauseTotalNs uint64    `json:"gc_pause_total_ns"`
+	LastGC       time.Time `json:"last_gc"`
+}
+
+func getRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStat{
+		Version:      buildVersion,
+		GoVersion:    runtime.Version(),
+		GOOS:         runtime.GOOS,
+		GOARCH:       runtime.GOARCH,
+		NumCPU:       runtime.NumCPU(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapSys:      mem.HeapSys,
+		HeapObjects:  mem.HeapObjects,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		LastGC:       time.Unix(0, int64(mem.LastGC)),
+	}
+
+	w.Write(marshal(stats))
+}
+
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	health := Registry.Health()
+	startup.Check(&health)
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(marshal(health))
+}
+
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(Registry.Maintenance()))
+}
+
+// Turn global maintenance mode on or off with the "enabled" parameter. The
+// optional "tcp" parameter also closes new TCP connections while enabled.
+func postMaintenance(w http.ResponseWriter, r *http.Request) {
+	var m MaintenanceStatus
+	var err error
+
+	m.Enabled, err = strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled", http.StatusBadRequest)
+		return
+	}
+
+	if param := r.FormValue("tcp"); param != "" {
+		m.TCP, err = strconv.ParseBool(param)
+		if err != nil {
+			http.Error(w, "invalid tcp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	Registry.SetMaintenance(m)
+	getMaintenance(w, r)
 }
 
 // Update the global config
@@ -69,12 +206,78 @@ func postConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := cfg.Validate(); err != nil {
+		writeConfigErrors(w, err)
+		return
+	}
+
 	if err := Registry.UpdateConfig(cfg); err != nil {
 		log.Errorln(err)
 		// TODO: differentiate between ServerError and BadRequest
+		http.Error(w, err.Error(), updateErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+}
+
+// The status for an error from UpdateConfig. Exceeding the -max-services
+// limit is a 409, and anything else uses the given default status.
+func updateErrorStatus(err error, status int) int {
+	if hasError(err, ErrMaxServices) {
+		return http.StatusConflict
+	}
+	return status
+}
+
+// Reject a config with a 400, and a json list of errors for each service.
+func writeConfigErrors(w http.ResponseWriter, err error) {
+	log.Error(err)
+
+	errs, ok := err.(client.ConfigErrors)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(marshal(client.ConfigErrorResponse{Errors: errs}))
+}
+
+// Update only the global defaults, leaving all services unchanged
+func patchConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := client.Config{}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer r.Body.Close()
+
+	err = json.Unmarshal(body, &cfg)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(cfg.Services) > 0 {
+		errMsg := "services cannot be updated with PATCH"
+		log.Error(errMsg)
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		writeConfigErrors(w, err)
+		return
+	}
+
+	Registry.UpdateGlobals(cfg)
+	go writeStateConfig()
+
+	w.Write(marshal(Registry.Config().Redact()))
 }
 
 // Update a service and/or backends.
@@ -105,6 +308,11 @@ func postService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := svcCfg.Validate(); err != nil {
+		writeConfigErrors(w, client.ConfigErrors{svcCfg.Name: err.Error()})
+		return
+	}
+
 	cfg := client.Config{
 		Services: []client.ServiceConfig{svcCfg},
 	}
@@ -113,23 +321,35 @@ func postService(w http.ResponseWriter, r *http.Request) {
 	//FIXME: this doesn't return an error for an empty or broken service
 	if err != nil {
 		log.Error(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), updateErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(Registry.Config().Redact()))
 }
 
+// Remove a service. The optional "drain" parameter sets how long in
+// milliseconds to wait for active connections after closing its listeners.
 func deleteService(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	err := Registry.RemoveService(vars["service"])
+	var drain time.Duration
+	if param := r.FormValue("drain"); param != "" {
+		ms, err := strconv.Atoi(param)
+		if err != nil || ms < 0 {
+			http.Error(w, "invalid drain", http.StatusBadRequest)
+			return
+		}
+		drain = time.Duration(ms) * time.Millisecond
+	}
+
+	err := Registry.RemoveServiceDrain(vars["service"], drain)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(Registry.Config().Redact()))
 }
 
 func getBackendStats(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +380,18 @@ func getBackend(w http.ResponseWriter, r *http.Request) {
 	w.Write(marshal(backend))
 }
 
+func getBackendConfig(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	backendCfg, err := Registry.BackendConfig(vars["service"], vars["backend"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Write(marshal(backendCfg.Redact()))
+}
+
 func postBackend(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -188,7 +420,209 @@ func postBackend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(Registry.Config().Redact()))
+}
+
+// Return a handler which forces a backend up or down. The optional "duration"
+// parameter is the time in milliseconds to hold the state, otherwise it's held
+// until cleared.
+func forceBackend(up bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var d time.Duration
+		if param := r.FormValue("duration"); param != "" {
+			ms, err := strconv.Atoi(param)
+			if err != nil || ms < 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			d = time.Duration(ms) * time.Millisecond
+		}
+
+		if err := Registry.ForceBackend(vars["service"], vars["backend"], up, d); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		getBackend(w, r)
+	}
+}
+
+// Update only the weight of a backend, from the "weight" parameter.
+func setBackendWeight(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight < 1 {
+		http.Error(w, "invalid weight", http.StatusBadRequest)
+		return
+	}
+
+	if err := Registry.SetBackendWeight(vars["service"], vars["backend"], weight); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	go writeStateConfig()
+	getBackend(w, r)
+}
+
+// Drain a backend, or return it to service with "enabled=false". The state is
+// saved, so the backend stays drained across restarts.
+func drainBackend(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	drain := true
+	if param := r.FormValue("enabled"); param != "" {
+		var err error
+		drain, err = strconv.ParseBool(param)
+		if err != nil {
+			http.Error(w, "invalid enabled", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := Registry.SetBackendDrain(vars["service"], vars["backend"], drain); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	go writeStateConfig()
+	getBackend(w, r)
+}
+
+// Return the "tag" parameters of a tagged backend request, writing an error if
+// there are none.
+func requestTags(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	r.ParseForm()
+	tags := filterEmpty(r.Form["tag"])
+	if len(tags) == 0 {
+		http.Error(w, "missing tag", http.StatusBadRequest)
+		return nil, false
+	}
+	return tags, true
+}
+
+// List the backends of all services which have every "tag" parameter.
+func getTaggedBackends(w http.ResponseWriter, r *http.Request) {
+	tags, ok := requestTags(w, r)
+	if !ok {
+		return
+	}
+
+	w.Write(marshal(Registry.TaggedBackends(tags)))
+}
+
+// Return a handler which forces up or down all backends which have every
+// "tag" parameter. The optional "duration" is the same as for forceBackend.
+func forceTaggedBackends(up bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tags, ok := requestTags(w, r)
+		if !ok {
+			return
+		}
+
+		var d time.Duration
+		if param := r.FormValue("duration"); param != "" {
+			ms, err := strconv.Atoi(param)
+			if err != nil || ms < 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			d = time.Duration(ms) * time.Millisecond
+		}
+
+		w.Write(marshal(Registry.ForceTaggedBackends(tags, up, d)))
+	}
+}
+
+// Clear the forced state of all backends which have every "tag" parameter.
+func clearForcedTaggedBackends(w http.ResponseWriter, r *http.Request) {
+	tags, ok := requestTags(w, r)
+	if !ok {
+		return
+	}
+
+	w.Write(marshal(Registry.ClearForcedTaggedBackends(tags)))
+}
+
+func clearForcedBackend(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := Registry.ClearForcedBackend(vars["service"], vars["backend"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	getBackend(w, r)
+}
+
+// Options for a service probe. Timeout is in milliseconds.
+type probeRequest struct {
+	Payload string `json:"payload"`
+	Timeout int    `json:"timeout"`
+}
+
+// Send a probe through a service to one of its backends, and return which
+// backend responded and the timing. The request body is optional.
+func probeService(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	service := Registry.GetService(vars["service"])
+	if service == nil {
+		http.Error(w, ErrNoService.Error(), http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	probe := probeRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &probe); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := service.Probe([]byte(probe.Payload), time.Duration(probe.Timeout)*time.Millisecond)
+	if res.Error != "" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	w.Write(marshal(res))
+}
+
+// Re-bind a service's listeners. The optional "drain" parameter sets how long
+// in milliseconds to wait for active connections before binding again.
+func restartService(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	drain := restartDrain
+	if param := r.FormValue("drain"); param != "" {
+		ms, err := strconv.Atoi(param)
+		if err != nil || ms < 0 {
+			http.Error(w, "invalid drain", http.StatusBadRequest)
+			return
+		}
+		drain = time.Duration(ms) * time.Millisecond
+	}
+
+	err := Registry.RestartService(vars["service"], drain)
+	switch {
+	case err == ErrNoService:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	getServiceStats(w, r)
 }
 
 func deleteBackend(w http.ResponseWriter, r *http.Request) {
@@ -203,25 +637,145 @@ func deleteBackend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(Registry.Config().Redact()))
+}
+
+// An admin endpoint, and the methods it accepts. A route without methods
+// accepts any method.
+type apiRoute struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+// List the admin endpoints, generated from the routes registered on the admin
+// router so it stays in sync with them.
+func getAPIIndex(w http.ResponseWriter, r *http.Request) {
+	routes := []*apiRoute{}
+	byPath := make(map[string]*apiRoute)
+
+	adminRouter.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		ar := byPath[path]
+		if ar == nil {
+			ar = &apiRoute{Path: path}
+			byPath[path] = ar
+			routes = append(routes, ar)
+		}
+
+		methods, _ := route.GetMethods()
+		ar.Methods = append(ar.Methods, methods...)
+		sort.Strings(ar.Methods)
+		return nil
+	})
+
+	w.Write(marshal(routes))
+}
+
+// The admin root returns the stats, or with an "index" parameter, the list of
+// admin endpoints.
+func getRoot(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["index"]; ok {
+		getAPIIndex(w, r)
+		return
+	}
+	getStats(w, r)
+}
+
+// The admin http handler. This is served directly rather than using the
+// DefaultServeMux, so that handlers registered on import by net/http/pprof are
+// only exposed when requested.
+var adminRouter *mux.Router
+
+// Networks allowed to use the admin server. Empty allows any client.
+var adminNets []*net.IPNet
+
+// Parse the comma separated CIDRs of the -admin-allow flag.
+func parseAdminAllow(allow string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	if allow == "" {
+		return nets, nil
+	}
+
+	for _, cidr := range strings.Split(allow, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin-allow: %s", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Wrap the admin handler so that every endpoint, including the pprof
+// handlers, only responds to clients in adminNets. Requests over a unix
+// socket are left to the socket's file permissions.
+func allowAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(remoteIP(r))
+		if len(adminNets) > 0 && ip != nil && !inNets(ip, adminNets) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func addHandlers() {
+	adminRouter = newAdminRouter()
+}
+
+func newAdminRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", getStats).Methods("GET")
+
+	// these need to be registered before the service and backend routes
+	r.Handle("/_debug/vars", expvar.Handler()).Methods("GET")
+	r.HandleFunc("/_runtime", getRuntime).Methods("GET")
+	r.HandleFunc("/_api", getAPIIndex).Methods("GET")
+	if enablePprof {
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	}
+
+	r.HandleFunc("/", getRoot).Methods("GET")
 	r.HandleFunc("/", postConfig).Methods("PUT", "POST")
 	r.HandleFunc("/_config", getConfig).Methods("GET")
 	r.HandleFunc("/_config", postConfig).Methods("PUT", "POST")
+	r.HandleFunc("/_config", patchConfig).Methods("PATCH")
 	r.HandleFunc("/_stats", getStats).Methods("GET")
+	r.HandleFunc("/_stats/reset", resetStats).Methods("POST")
+	r.HandleFunc("/_health", getHealth).Methods("GET")
+	r.HandleFunc("/_maintenance", getMaintenance).Methods("GET")
+	r.HandleFunc("/_maintenance", postMaintenance).Methods("POST")
+	r.HandleFunc("/_backends", getTaggedBackends).Methods("GET")
+	r.HandleFunc("/_backends/up", forceTaggedBackends(true)).Methods("POST")
+	r.HandleFunc("/_backends/down", forceTaggedBackends(false)).Methods("POST")
+	r.HandleFunc("/_backends/clear", clearForcedTaggedBackends).Methods("POST")
 	r.HandleFunc("/{service}", getServiceStats).Methods("GET")
 	r.HandleFunc("/{service}/_config", getServiceConfig).Methods("GET")
 	r.HandleFunc("/{service}/_stats", getServiceStats).Methods("GET")
+	r.HandleFunc("/{service}/_stats/reset", resetStats).Methods("POST")
 	r.HandleFunc("/{service}", postService).Methods("PUT", "POST")
 	r.HandleFunc("/{service}", deleteService).Methods("DELETE")
+	r.HandleFunc("/{service}/_probe", probeService).Methods("POST")
+	r.HandleFunc("/{service}/_restart", restartService).Methods("POST")
 	r.HandleFunc("/{service}/{backend}", getBackend).Methods("GET")
 	r.HandleFunc("/{service}/{backend}", postBackend).Methods("PUT", "POST")
 	r.HandleFunc("/{service}/{backend}", deleteBackend).Methods("DELETE")
-	http.Handle("/", r)
+	r.HandleFunc("/{service}/{backend}/_config", getBackendConfig).Methods("GET")
+	r.HandleFunc("/{service}/{backend}/up", forceBackend(true)).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/down", forceBackend(false)).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/clear", clearForcedBackend).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/weight", setBackendWeight).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/drain", drainBackend).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/_stats/reset", resetStats).Methods("POST")
+	return r
 }
 
 func startAdminHTTPServer(wg *sync.WaitGroup) {
@@ -249,5 +803,5 @@ func startAdminHTTPServer(wg *sync.WaitGroup) {
 		log.Fatalln(err)
 	}
 
-	http.Serve(listener, nil)
+	http.Serve(listener, allowAdmin(adminRouter))
 }
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/litl/shuttle/client"
 	. "gopkg.in/check.v1"
@@ -34,7 +48,7 @@ func (s *HTTPSuite) SetUpSuite(c *C) {
 	}
 
 	addHandlers()
-	s.httpSvr = httptest.NewServer(nil)
+	s.httpSvr = httptest.NewServer(allowAdmin(adminRouter))
 
 	httpServer := &http.Server{
 		Addr: "127.0.0.1:0",
@@ -112,6 +126,9 @@ func (s *HTTPSuite) TearDownTest(c *C) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.MaxURILength = 0
+	Registry.cfg.TrustedProxies = nil
+	Registry.trustedNets = nil
 
 	for _, s := range s.backendServers {
 		s.Close()
@@ -139,6 +156,667 @@ func (s *HTTPSuite) TestAddService(c *C) {
 	c.Assert(Registry.String(), DeepEquals, string(body))
 }
 
+// An unknown balance algorithm should be rejected before the service is created
+func (s *HTTPSuite) TestInvalidBalance(c *C) {
+	svcDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9000", "balance": "XYZ"}`))
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/badBalance", svcDef)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(Registry.GetService("badBalance"), IsNil)
+
+	// updating an existing service to an invalid balance is also an error
+	svcCfg := client.ServiceConfig{Name: "badBalance", Addr: "127.0.0.1:9000"}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("badBalance")
+
+	svcCfg.Balance = "XYZ"
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+	c.Assert(Registry.GetService("badBalance").Balance, Equals, client.RoundRobin)
+}
+
+// The client can fetch a single service or backend config
+func (s *HTTPSuite) TestClientGetService(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "GetTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.backendServers[0].addr, Tags: []string{"az=a"}},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+
+	got, err := cli.GetService("GetTest")
+	c.Assert(err, IsNil)
+	c.Assert(got.Name, Equals, "GetTest")
+	c.Assert(got.VirtualHosts, DeepEquals, []string{"test-vhost"})
+	c.Assert(got.Backends, HasLen, 1)
+
+	backend, err := cli.GetBackend("GetTest", "backend_0")
+	c.Assert(err, IsNil)
+	c.Assert(backend.Addr, Equals, s.backendServers[0].addr)
+	c.Assert(backend.Tags, DeepEquals, []string{"az=a"})
+
+	_, err = cli.GetService("missing")
+	c.Assert(err, Equals, client.ErrNotFound)
+	_, err = cli.GetBackend("GetTest", "missing")
+	c.Assert(err, Equals, client.ErrNotFound)
+	_, err = cli.GetBackend("missing", "backend_0")
+	c.Assert(err, Equals, client.ErrNotFound)
+}
+
+// The client retries idempotent requests after a 5xx, but nothing else
+func (s *HTTPSuite) TestClientRetry(c *C) {
+	var requests, failures int
+	var mu sync.Mutex
+	var lastBody string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		lastBody = string(body)
+		if requests <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer svr.Close()
+
+	reset := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = 0
+		failures = n
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	cli := client.NewClientWithOptions(svr.Listener.Addr().String(), client.ClientOptions{
+		Retries:       3,
+		RetryInterval: time.Millisecond,
+	})
+
+	reset(2)
+	_, err := cli.GetConfig()
+	c.Assert(err, IsNil)
+	c.Assert(count(), Equals, 3)
+
+	// the body is sent again with each retry
+	reset(1)
+	svcCfg := client.ServiceConfig{Name: "retried", Addr: "127.0.0.1:9000"}
+	c.Assert(cli.UpdateService(&svcCfg), IsNil)
+	c.Assert(count(), Equals, 2)
+	mu.Lock()
+	c.Assert(lastBody, Equals, string(svcCfg.Marshal()))
+	mu.Unlock()
+
+	// retries are exhausted
+	reset(10)
+	c.Assert(cli.RemoveService("retried"), NotNil)
+	c.Assert(count(), Equals, 4)
+
+	// a 4xx isn't retried
+	reset(0)
+	c.Assert(cli.RemoveService("missing"), NotNil)
+	c.Assert(count(), Equals, 1)
+
+	// a POST isn't retried
+	reset(10)
+	c.Assert(cli.ClearForcedBackend("retried", "backend"), NotNil)
+	c.Assert(count(), Equals, 1)
+}
+
+// All invalid services in a config upload should be reported together
+func (s *HTTPSuite) TestInvalidConfigErrors(c *C) {
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{Name: "goodService", Addr: "127.0.0.1:9000"},
+			{Name: "badBalance", Addr: "127.0.0.1:9001", Balance: "XYZ"},
+			{Name: "badTLS", Addr: "127.0.0.1:9002", TLSAddr: "127.0.0.1:9003"},
+		},
+	}
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	err := cli.UpdateConfig(&cfg)
+	c.Assert(err, NotNil)
+
+	errs, ok := err.(client.ConfigErrors)
+	c.Assert(ok, Equals, true)
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs["badBalance"], Not(Equals), "")
+	c.Assert(errs["badTLS"], Not(Equals), "")
+
+	// nothing is applied from a rejected config
+	c.Assert(Registry.GetService("goodService"), IsNil)
+}
+
+func (s *HTTPSuite) TestProbeService(c *C) {
+	srv := s.servers[0]
+	svcCfg := client.ServiceConfig{
+		Name: "probeService",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "probeBackend", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	probe := bytes.NewReader([]byte(`{"payload": "ping", "timeout": 1000}`))
+	resp, err := http.Post(s.httpSvr.URL+"/probeService/_probe", "application/json", probe)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	res := ProbeResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(res.Backend, Equals, "probeBackend")
+	c.Assert(res.Addr, Equals, srv.addr)
+	c.Assert(res.Response, Equals, srv.addr)
+	c.Assert(res.Error, Equals, "")
+
+	resp, err = http.Post(s.httpSvr.URL+"/noService/_probe", "application/json", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *HTTPSuite) TestRestartService(c *C) {
+	srv := s.servers[0]
+	svcCfg := client.ServiceConfig{
+		Name: "restartService",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "restartBackend", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkResp("127.0.0.1:9000", srv.addr, c)
+
+	// hold a connection open through the restart
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := http.Post(s.httpSvr.URL+"/restartService/_restart?drain=100", "application/json", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// the active connection was waited for, and is still proxied
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	io.WriteString(conn, "testing\n")
+	n, err := conn.Read(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(buff[:n]), Equals, srv.addr)
+
+	// the config is kept, and new connections are accepted
+	cfg, err := Registry.ServiceConfig("restartService")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Addr, Equals, "127.0.0.1:9000")
+	c.Assert(cfg.Backends, HasLen, 1)
+	checkResp("127.0.0.1:9000", srv.addr, c)
+
+	resp, err = http.Post(s.httpSvr.URL+"/restartService/_restart?drain=x", "application/json", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	resp, err = http.Post(s.httpSvr.URL+"/noService/_restart", "application/json", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+// If a listener can't be bound again on restart, the error is returned and
+// the old listeners keep accepting connections
+func (s *HTTPSuite) TestRestartServiceFailure(c *C) {
+	if !reusePortSupported {
+		c.Skip("SO_REUSEPORT is not supported")
+	}
+
+	dir := c.MkDir()
+	for _, ext := range []string{".pem", ".key"} {
+		data, err := ioutil.ReadFile("testdata/vhost1" + ext)
+		if err != nil {
+			c.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "vhost1"+ext), data, 0600); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	srv := s.servers[0]
+	svcCfg := client.ServiceConfig{
+		Name:    "restartFailService",
+		Addr:    "127.0.0.1:0",
+		TLSAddr: "127.0.0.1:0",
+		TLSCert: filepath.Join(dir, "vhost1.pem"),
+		TLSKey:  filepath.Join(dir, "vhost1.key"),
+		Backends: []client.BackendConfig{
+			{Name: "restartFailBackend", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("restartFailService")
+
+	svc := Registry.GetService("restartFailService")
+	addr, tlsAddr := svc.Addr, svc.TLSAddr
+	checkResp(addr, srv.addr, c)
+
+	// the TLS listener can't be bound again without its certificate
+	if err := os.Remove(filepath.Join(dir, "vhost1.pem")); err != nil {
+		c.Fatal(err)
+	}
+
+	resp, err := http.Post(s.httpSvr.URL+"/restartFailService/_restart?drain=0", "application/json", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusInternalServerError)
+
+	c.Assert(svc.Addr, Equals, addr)
+	c.Assert(svc.TLSAddr, Equals, tlsAddr)
+	checkResp(addr, srv.addr, c)
+
+	conn, err := tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	checkConnResp(conn, srv.addr, c)
+}
+
+func (s *HTTPSuite) TestRemoveServiceDrain(c *C) {
+	srv := s.servers[0]
+	svcCfg := client.ServiceConfig{
+		Name: "drainService",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "drainBackend", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkResp("127.0.0.1:9000", srv.addr, c)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("DELETE", s.httpSvr.URL+"/drainService?drain=x", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	// the connection finishes while the service drains
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	start := time.Now()
+	c.Assert(cli.RemoveServiceDrain("drainService", 5*time.Second), IsNil)
+	elapsed := time.Since(start)
+	c.Assert(elapsed >= 100*time.Millisecond, Equals, true)
+	c.Assert(elapsed < 5*time.Second, Equals, true)
+
+	_, err = Registry.ServiceConfig("drainService")
+	c.Assert(err, Equals, ErrNoService)
+	_, err = net.Dial("tcp", "127.0.0.1:9000")
+	c.Assert(err, NotNil)
+}
+
+// HTTP requests on a sniffing TCP service are routed by vhost
+func (s *HTTPSuite) TestSniffHTTP(c *C) {
+	httpCfg := client.ServiceConfig{
+		Name:         "httpService",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"sniff-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "httpBackend", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(httpCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	tcpCfg := client.ServiceConfig{
+		Name:         "sniffService",
+		Addr:         "127.0.0.1:9001",
+		SniffHTTP:    true,
+		SniffTimeout: 50,
+		Backends: []client.BackendConfig{
+			{Name: "tcpBackend", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(tcpCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkHTTP("http://127.0.0.1:9001/addr", "sniff-vhost", s.backendServers[0].addr, 200, c)
+	checkHTTP("http://127.0.0.1:9001/addr", "unknown-vhost", "Not found\n", 404, c)
+
+	// anything else is proxied to the backends, including data which starts
+	// like a method
+	checkResp("127.0.0.1:9001", s.servers[0].addr, c)
+	conn, err := net.Dial("tcp", "127.0.0.1:9001")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GETS")
+	buff := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// a client which doesn't send anything in time is treated as TCP
+	silent, err := net.Dial("tcp", "127.0.0.1:9001")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(silent, "GET / HTTP/1.0\r\n\r\n")
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = silent.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// the sniff timeout still applies after the handshake timeout, rather
+	// than the longer client timeout
+	tcpCfg.Name = "sniffHandshakeService"
+	tcpCfg.Addr = "127.0.0.1:9002"
+	tcpCfg.HandshakeTimeout = 1000
+	tcpCfg.ClientTimeout = 5000
+	if err := Registry.AddService(tcpCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	slow, err := net.Dial("tcp", "127.0.0.1:9002")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer slow.Close()
+	io.WriteString(slow, "G")
+	time.Sleep(200 * time.Millisecond)
+	io.WriteString(slow, "ET / HTTP/1.0\r\n\r\n")
+	slow.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = slow.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+}
+
+// A service with RemoveWhenEmpty is removed with its last backend
+func (s *HTTPSuite) TestRemoveWhenEmpty(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:            "emptyService",
+		Addr:            "127.0.0.1:9000",
+		RemoveWhenEmpty: true,
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.servers[0].addr},
+			{Name: "b2", Addr: s.servers[1].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	deleteBackend := func(name string) {
+		req, _ := http.NewRequest("DELETE", s.httpSvr.URL+"/emptyService/"+name, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	}
+
+	deleteBackend("b1")
+	c.Assert(Registry.GetService("emptyService"), NotNil)
+
+	deleteBackend("b2")
+	c.Assert(Registry.GetService("emptyService"), IsNil)
+
+	// the listener is closed
+	_, err := net.Dial("tcp", "127.0.0.1:9000")
+	c.Assert(err, NotNil)
+
+	// without the flag, the service stays with no backends
+	svcCfg.RemoveWhenEmpty = false
+	svcCfg.Backends = svcCfg.Backends[:1]
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	deleteBackend("b1")
+	c.Assert(Registry.GetService("emptyService"), NotNil)
+}
+
+// Services over the -max-services limit are rejected with a 409
+func (s *HTTPSuite) TestMaxServices(c *C) {
+	maxServices = 1
+	defer func() { maxServices = 0 }()
+
+	if err := Registry.AddService(client.ServiceConfig{Name: "first", Addr: "127.0.0.1:9000"}); err != nil {
+		c.Fatal(err)
+	}
+
+	err := Registry.AddService(client.ServiceConfig{Name: "second", Addr: "127.0.0.1:9001"})
+	c.Assert(err, Equals, ErrMaxServices)
+
+	svcCfg := client.ServiceConfig{Name: "second", Addr: "127.0.0.1:9001"}
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/second", bytes.NewReader(svcCfg.Marshal()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusConflict)
+	c.Assert(Registry.GetService("second"), IsNil)
+
+	// updating an existing service is still allowed
+	svcCfg = client.ServiceConfig{Name: "first", Addr: "127.0.0.1:9000", ClientTimeout: 1000}
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/first", bytes.NewReader(svcCfg.Marshal()))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// removing a service makes room for another
+	c.Assert(Registry.RemoveService("first"), IsNil)
+	c.Assert(Registry.AddService(client.ServiceConfig{Name: "second", Addr: "127.0.0.1:9001"}), IsNil)
+}
+
+// A config with an invalid service isn't partly applied
+func (s *HTTPSuite) TestUpdateConfigInvalid(c *C) {
+	if err := Registry.AddService(client.ServiceConfig{Name: "first", Addr: "127.0.0.1:9000"}); err != nil {
+		c.Fatal(err)
+	}
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{Name: "first", ClientTimeout: 1000},
+			{Name: "second", Addr: "127.0.0.1:9001"},
+			{Name: "third", Addr: "127.0.0.1:9002", Balance: "none"},
+		},
+	}
+	c.Assert(Registry.UpdateConfig(cfg), NotNil)
+
+	first, err := Registry.ServiceConfig("first")
+	c.Assert(err, IsNil)
+	c.Assert(first.ClientTimeout, Not(Equals), 1000)
+	c.Assert(Registry.GetService("second"), IsNil)
+	c.Assert(Registry.GetService("third"), IsNil)
+
+	// updates to existing services are checked as they'd be applied
+	cfg.Services = []client.ServiceConfig{
+		{Name: "first", Balance: "none"},
+		{Name: "second", Addr: "127.0.0.1:9001"},
+	}
+	c.Assert(Registry.UpdateConfig(cfg), NotNil)
+	c.Assert(Registry.GetService("second"), IsNil)
+
+	cfg.Services[0].Balance = client.LeastConn
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+	c.Assert(Registry.GetService("second"), NotNil)
+
+	// a maintenance file that can't be read is found before anything is applied
+	cfg.Services = []client.ServiceConfig{
+		{Name: "first", ClientTimeout: 1000},
+		{Name: "third", Addr: "127.0.0.1:9002", MaintenanceFile: filepath.Join(c.MkDir(), "missing.html")},
+	}
+	c.Assert(Registry.UpdateConfig(cfg), NotNil)
+
+	first, err = Registry.ServiceConfig("first")
+	c.Assert(err, IsNil)
+	c.Assert(first.ClientTimeout, Not(Equals), 1000)
+	c.Assert(Registry.GetService("third"), IsNil)
+}
+
+func (s *HTTPSuite) TestResetStats(c *C) {
+	srv := s.servers[0]
+	svcCfg := client.ServiceConfig{
+		Name: "resetService",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "resetBackend", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	// an active connection isn't reset
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		c.Fatal(err)
+	}
+
+	reset := func(path string, status int) {
+		resp, err := http.Post(s.httpSvr.URL+path, "", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status)
+	}
+
+	for _, path := range []string{"/_stats/reset", "/resetService/_stats/reset", "/resetService/resetBackend/_stats/reset"} {
+		checkResp("127.0.0.1:9000", srv.addr, c)
+
+		// wait for the checked connection to be closed
+		stats, err := Registry.BackendStats("resetService", "resetBackend")
+		for i := 0; i < 100 && stats.Active > 1; i++ {
+			time.Sleep(10 * time.Millisecond)
+			stats, err = Registry.BackendStats("resetService", "resetBackend")
+		}
+		c.Assert(err, IsNil)
+		c.Assert(stats.Conns > 0, Equals, true)
+		c.Assert(stats.Sent > 0, Equals, true)
+
+		reset(path, http.StatusOK)
+
+		stats, err = Registry.BackendStats("resetService", "resetBackend")
+		c.Assert(err, IsNil)
+		c.Assert(stats.Conns, Equals, int64(0))
+		c.Assert(stats.Sent, Equals, int64(0))
+		c.Assert(stats.Rcvd, Equals, int64(0))
+		c.Assert(stats.Active, Equals, int64(1))
+
+		svcStats, err := Registry.ServiceStats("resetService")
+		c.Assert(err, IsNil)
+		c.Assert(svcStats.Conns, Equals, int64(0))
+		c.Assert(svcStats.Active, Equals, int64(1))
+	}
+
+	// the active connection is still proxied
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(make([]byte, 1024)); err != nil {
+		c.Fatal(err)
+	}
+
+	reset("/noService/_stats/reset", http.StatusNotFound)
+	reset("/resetService/noBackend/_stats/reset", http.StatusNotFound)
+}
+
 func (s *HTTPSuite) TestAddBackend(c *C) {
 	svcDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9000"}`))
 	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/testService", svcDef)
@@ -147,121 +825,1233 @@ func (s *HTTPSuite) TestAddBackend(c *C) {
 		c.Fatal(err)
 	}
 
-	backendDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
-	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
-	resp, err := http.DefaultClient.Do(req)
+	backendDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Assert(Registry.String(), DeepEquals, string(body))
+}
+
+func (s *HTTPSuite) TestReAddBackend(c *C) {
+	svcDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9000"}`))
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/testService", svcDef)
+	_, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	backendDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
+	firstResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer firstResp.Body.Close()
+
+	firstBody, _ := ioutil.ReadAll(firstResp.Body)
+
+	backendDef = bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
+	secResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer secResp.Body.Close()
+
+	secBody, _ := ioutil.ReadAll(secResp.Body)
+
+	c.Assert(string(secBody), DeepEquals, string(firstBody))
+}
+
+func (s *HTTPSuite) TestSimulAdd(c *C) {
+	start := make(chan struct{})
+	testWG := new(sync.WaitGroup)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "TestService",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			client.BackendConfig{
+				Name: "vhost1",
+				Addr: "127.0.0.1:9001",
+			},
+			client.BackendConfig{
+				Name: "vhost2",
+				Addr: "127.0.0.1:9002",
+			},
+		},
+	}
+
+	for i := 0; i < 8; i++ {
+		testWG.Add(1)
+		go func() {
+			defer testWG.Done()
+			//wait to start all at once
+			<-start
+			svcDef := bytes.NewReader(svcCfg.Marshal())
+			req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/TestService", svcDef)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				c.Fatal(err)
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			respCfg := client.Config{}
+			err = json.Unmarshal(body, &respCfg)
+
+			// We're only checking to ensure we have 1 service with the proper number of backends
+			c.Assert(len(respCfg.Services), Equals, 1)
+			c.Assert(len(respCfg.Services[0].Backends), Equals, 2)
+			c.Assert(len(respCfg.Services[0].VirtualHosts), Equals, 1)
+		}()
+	}
+
+	close(start)
+	testWG.Wait()
+}
+
+func (s *HTTPSuite) TestRouter(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+	}
+
+	for _, srv := range s.backendServers {
+		cfg := client.BackendConfig{
+			Addr: srv.addr,
+			Name: srv.addr,
+		}
+		svcCfg.Backends = append(svcCfg.Backends, cfg)
+	}
+
+	err := Registry.AddService(svcCfg)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	for _, srv := range s.backendServers {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	}
+}
+
+// Hop-by-hop headers, and any headers listed in Connection, should be removed
+// in both directions.
+func (s *HTTPSuite) TestHopHeaders(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "hopHeaders",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/headers", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	req.Host = "test-vhost"
+	req.Header.Set("Connection", "X-Custom, Keep-Alive")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Custom", "hop")
+	req.Header.Set("X-End-To-End", "end")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("X-Backend-Hop"), Equals, "")
+	c.Assert(resp.Header.Get("Connection"), Equals, "")
+
+	upstream := http.Header{}
+	if err := json.NewDecoder(resp.Body).Decode(&upstream); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(upstream.Get("X-Custom"), Equals, "")
+	c.Assert(upstream.Get("Keep-Alive"), Equals, "")
+	c.Assert(upstream.Get("X-End-To-End"), Equals, "end")
+}
+
+// X-Real-IP is set to the client's address, replacing any sent by the client,
+// or to the forwarded address when the client is a trusted proxy.
+func (s *HTTPSuite) TestRealIP(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "realIP",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	upstream := func() http.Header {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/headers", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		req.Header.Set("X-Forwarded-For", "10.0.0.2")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		header := http.Header{}
+		if err := json.NewDecoder(resp.Body).Decode(&header); err != nil {
+			c.Fatal(err)
+		}
+		return header
+	}
+
+	header := upstream()
+	c.Assert(header["X-Real-Ip"], DeepEquals, []string{"127.0.0.1"})
+	c.Assert(header.Get("X-Forwarded-For"), Equals, "10.0.0.2, 127.0.0.1")
+
+	svcCfg.TrustedProxies = []string{"127.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	header = upstream()
+	c.Assert(header["X-Real-Ip"], DeepEquals, []string{"10.0.0.2"})
+}
+
+// A backend which resets the connection is counted, and with RetryReset a
+// request without a body is moved on to the next backend.
+func (s *HTTPSuite) TestRetryReset(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// wait for the request, then reset
+			conn.Read(make([]byte, 1024))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	srv := s.backendServers[0]
+	reset := l.Addr().String()
+	svcCfg := client.ServiceConfig{
+		Name:         "retryReset",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "reset", Addr: reset},
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	request := func(method string, body io.Reader) int {
+		req, err := http.NewRequest(method, "http://"+s.httpAddr+"/addr", body)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	resets := func() int64 {
+		return Registry.GetService("retryReset").get("reset").Stats().Resets
+	}
+
+	// round robin sends one of two requests to the reset backend
+	codes := map[int]int{}
+	for i := 0; i < 2; i++ {
+		codes[request("GET", nil)]++
+	}
+	c.Assert(codes, DeepEquals, map[int]int{http.StatusOK: 1, http.StatusBadGateway: 1})
+	c.Assert(resets() > 0, Equals, true)
+
+	svcCfg.RetryReset = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Assert(request("GET", nil), Equals, http.StatusOK)
+	}
+
+	// a request with a body isn't retried
+	codes = map[int]int{}
+	for i := 0; i < 2; i++ {
+		codes[request("POST", strings.NewReader("body"))]++
+	}
+	c.Assert(codes[http.StatusBadGateway], Equals, 1)
+}
+
+// Clients with a sticky cookie stay on the same backend
+func (s *HTTPSuite) TestStickyCookie(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "sticky",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		StickyCookie: true,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.backendServers[0].addr},
+			{Name: "backend_1", Addr: s.backendServers[1].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	// return the backend address and the sticky cookie set, if any
+	request := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		for _, set := range resp.Cookies() {
+			return string(body), set
+		}
+		return string(body), nil
+	}
+
+	addr, cookie := request(nil)
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Name, Equals, "SHUTTLEID")
+	c.Assert(cookie.MaxAge, Equals, 0)
+
+	// every request with the cookie goes to the same backend, without
+	// setting it again
+	for i := 0; i < 4; i++ {
+		pinned, set := request(cookie)
+		c.Assert(pinned, Equals, addr)
+		c.Assert(set, IsNil)
+	}
+
+	// without the cookie, requests are still balanced
+	other, _ := request(nil)
+	c.Assert(other, Not(Equals), addr)
+
+	// when the pinned backend is removed, the client is moved to another
+	removed := "backend_0"
+	if addr == s.backendServers[1].addr {
+		removed = "backend_1"
+	}
+	if err := Registry.RemoveBackend("sticky", removed); err != nil {
+		c.Fatal(err)
+	}
+
+	moved, set := request(cookie)
+	c.Assert(moved, Equals, other)
+	c.Assert(set, NotNil)
+	c.Assert(set.Value, Not(Equals), cookie.Value)
+
+	pinned, _ := request(set)
+	c.Assert(pinned, Equals, other)
+
+	svcCfg = Registry.GetService("sticky").Config()
+	svcCfg.StickyCookieName = "sid"
+	svcCfg.StickyCookieTTL = 60
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	_, cookie = request(nil)
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Name, Equals, "sid")
+	c.Assert(cookie.MaxAge, Equals, 60)
+
+	svcCfg.StickyCookieName = "bad name"
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+}
+
+// A sample of requests is copied to the mirror, without waiting for it
+func (s *HTTPSuite) TestMirror(c *C) {
+	type mirrored struct {
+		method, uri, host, body string
+	}
+	received := make(chan mirrored, 10)
+	release := make(chan struct{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- mirrored{r.Method, r.RequestURI, r.Host, string(body)}
+		<-release
+		http.Error(w, "mirror", http.StatusInternalServerError)
+	}))
+
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "mirrored",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		MirrorAddr:   l.Addr().String(),
+		MirrorSample: 1,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	request := func(body string) string {
+		req, err := http.NewRequest("POST", "http://"+s.httpAddr+"/addr?q=1", strings.NewReader(body))
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		return string(respBody)
+	}
+
+	// the client gets the real response while the mirror is still blocked
+	c.Assert(request("data"), Equals, srv.addr)
+
+	select {
+	case m := <-received:
+		c.Assert(m, Equals, mirrored{"POST", "/addr?q=1", "test-vhost", "data"})
+	case <-time.After(time.Second):
+		c.Fatal("request not mirrored")
+	}
+	close(release)
+
+	// the mirror's error is counted, but not returned to the client
+	svc := Registry.GetService("mirrored")
+	c.Assert(svc.Stats().MirrorRequests, Equals, int64(1))
+	for i := 0; svc.Stats().MirrorErrors == 0; i++ {
+		if i > 20 {
+			c.Fatal("mirror error not counted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a body over the limit isn't copied
+	c.Assert(request(strings.Repeat("x", mirrorMaxBody+1)), Equals, srv.addr)
+	c.Assert(svc.Stats().MirrorSkipped, Equals, int64(1))
+
+	svcCfg.MirrorSample = 0
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	request("data")
+	c.Assert(svc.Stats().MirrorRequests, Equals, int64(1))
+
+	svcCfg.MirrorSample = 2
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+}
+
+// A backend returning errors is ejected, while its health checks still pass
+func (s *HTTPSuite) TestEjectErrorRate(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:           "ejectTest",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"test-vhost"},
+		EjectErrorRate: 0.5,
+		EjectTime:      60000,
+		Backends: []client.BackendConfig{
+			{Name: "good", Addr: srv.addr},
+			{Name: "bad", Addr: l.Addr().String()},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("ejectTest")
+
+	request := func() int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	errors := 0
+	for i := 0; i < 2*ejectMinResponses; i++ {
+		if request() != http.StatusOK {
+			errors++
+		}
+	}
+	c.Assert(errors, Equals, ejectMinResponses)
+
+	stats, _ := Registry.BackendStats("ejectTest", "bad")
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.Ejected, Equals, true)
+	c.Assert(stats.EjectedUntil, NotNil)
+	c.Assert(stats.Ejections, Equals, int64(1))
+
+	// every request now goes to the good backend
+	for i := 0; i < 4; i++ {
+		c.Assert(request(), Equals, http.StatusOK)
+	}
+
+	stats, _ = Registry.BackendStats("ejectTest", "good")
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.Ejected, Equals, false)
+
+	svcCfg.EjectErrorRate = 1.5
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+}
+
+// A backend which can't be ejected while it's the only one up is ejected once
+// another backend comes up
+func (s *HTTPSuite) TestEjectRefused(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:           "ejectRefused",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"test-vhost"},
+		EjectErrorRate: 0.5,
+		EjectTime:      60000,
+		Backends: []client.BackendConfig{
+			{Name: "good", Addr: srv.addr},
+			{Name: "bad", Addr: l.Addr().String()},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("ejectRefused")
+
+	request := func() int {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	// with the good backend down, the bad one can't be ejected
+	c.Assert(Registry.ForceBackend("ejectRefused", "good", false, 0), IsNil)
+	for i := 0; i < 2*ejectMinResponses; i++ {
+		c.Assert(request(), Equals, http.StatusInternalServerError)
+	}
+
+	stats, _ := Registry.BackendStats("ejectRefused", "bad")
+	c.Assert(stats.Ejected, Equals, false)
+
+	// once it's up, the next error ejects the bad backend
+	c.Assert(Registry.ClearForcedBackend("ejectRefused", "good"), IsNil)
+	for i := 0; i < 2; i++ {
+		request()
+	}
+
+	stats, _ = Registry.BackendStats("ejectRefused", "bad")
+	c.Assert(stats.Ejected, Equals, true)
+	c.Assert(stats.Ejections, Equals, int64(1))
+	c.Assert(request(), Equals, http.StatusOK)
+}
+
+// The global TrustedProxies apply to services without their own
+func (s *HTTPSuite) TestGlobalTrustedProxies(c *C) {
+	srv := s.backendServers[0]
+	svcCfg := client.ServiceConfig{
+		Name:         "globalTrusted",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: srv.addr, Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	realIP := func() string {
+		req, err := http.NewRequest("GET", "http://"+s.httpAddr+"/headers", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+		req.Header.Set("X-Forwarded-For", "10.0.0.2")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		header := http.Header{}
+		if err := json.NewDecoder(resp.Body).Decode(&header); err != nil {
+			c.Fatal(err)
+		}
+		return header.Get("X-Real-IP")
+	}
+
+	c.Assert(realIP(), Equals, "127.0.0.1")
+
+	Registry.UpdateGlobals(client.Config{TrustedProxies: []string{"127.0.0.0/8"}})
+	c.Assert(realIP(), Equals, "10.0.0.2")
+	c.Assert(Registry.EffectiveConfig().Services[0].TrustedProxies, DeepEquals, []string{"127.0.0.0/8"})
+
+	// the service's own list replaces the global one
+	svcCfg.TrustedProxies = []string{"10.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(realIP(), Equals, "127.0.0.1")
+
+	c.Assert(client.Config{TrustedProxies: []string{"10.0.0.0"}}.Validate(), NotNil)
+}
+
+// Requests through the proxy should reuse backend connections
+func (s *HTTPSuite) TestBackendKeepAlive(c *C) {
+	srv := NewKeepAliveTestServer()
+	defer srv.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "KeepAliveTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "keepalive", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	}
+
+	c.Assert(srv.Requests(), Equals, 5)
+	c.Assert(srv.Conns(), Equals, 1)
+
+	// chunked responses are passed through intact
+	expected := strings.Repeat(srv.addr, 3)
+	srv.SetLatency(10 * time.Millisecond)
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/chunked?n=3", nil)
+	req.Host = "test-vhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(string(body), Equals, expected)
+
+	// injected errors are returned to the client
+	srv.SetFailEvery(1)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr+"\n", 500, c)
+}
+
+// A streamed response should reach the client in parts with a FlushInterval,
+// before the backend finishes the response
+func (s *HTTPSuite) TestFlushInterval(c *C) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second")
+	}))
+	defer srv.Close()
+	// don't leave the handler blocked if the test fails
+	defer close(release)
+
+	for _, interval := range []int{-1, 20} {
+		svcCfg := client.ServiceConfig{
+			Name:          "FlushTest",
+			Addr:          "127.0.0.1:9000",
+			VirtualHosts:  []string{"test-vhost"},
+			FlushInterval: interval,
+			Backends: []client.BackendConfig{
+				{Name: "flush", Addr: srv.Listener.Addr().String()},
+			},
+		}
+
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+
+		// without a flush, not even the response headers reach the client
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		req.Host = "test-vhost"
+		var resp *http.Response
+		first := make(chan string, 1)
+		go func() {
+			var err error
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				first <- err.Error()
+				return
+			}
+			buf := make([]byte, len("first"))
+			io.ReadFull(resp.Body, buf)
+			first <- string(buf)
+		}()
+
+		select {
+		case body := <-first:
+			c.Assert(body, Equals, "first", Commentf("flush_interval %d", interval))
+		case <-time.After(time.Second):
+			c.Fatalf("flush_interval %d: first part of the response wasn't flushed", interval)
+		}
+
+		release <- true
+		rest, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(string(rest), Equals, "second")
+
+		if err := Registry.RemoveService("FlushTest"); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+// Slow HTTP backends should return a 504 when a response timeout is exceeded
+func (s *HTTPSuite) TestResponseTimeouts(c *C) {
+	srv := NewKeepAliveTestServer()
+	defer srv.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:            "ResponseTimeoutTest",
+		Addr:            "127.0.0.1:9000",
+		VirtualHosts:    []string{"test-vhost"},
+		ResponseTimeout: 200,
+		Backends: []client.BackendConfig{
+			{Name: "slow", Addr: srv.addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	srv.SetLatency(100 * time.Millisecond)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+
+	srv.SetLatency(300 * time.Millisecond)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 504, c)
+
+	// a shorter header timeout fails the request sooner
+	svcCfg.ResponseHeaderTimeout = 50
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("ResponseTimeoutTest").Config().ResponseHeaderTimeout, Equals, 50)
+
+	srv.SetLatency(100 * time.Millisecond)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 504, c)
+
+	srv.SetLatency(0)
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+}
+
+// Force a backend down and back up through the client
+func (s *HTTPSuite) TestForceBackend(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "ForceTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.backendServers[0].addr},
+			{Name: "backend_1", Addr: s.backendServers[1].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	if err := cli.ForceBackend("ForceTest", "backend_0", false, 0); err != nil {
+		c.Fatal(err)
+	}
+
+	stats, _ := Registry.BackendStats("ForceTest", "backend_0")
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.Forced, Equals, true)
+	c.Assert(stats.ForcedUntil, IsNil)
+
+	for i := 0; i < 2; i++ {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[1].addr, 200, c)
+	}
+
+	if err := cli.ClearForcedBackend("ForceTest", "backend_0"); err != nil {
+		c.Fatal(err)
+	}
+
+	stats, _ = Registry.BackendStats("ForceTest", "backend_0")
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.Forced, Equals, false)
+
+	// a forced state expires after the duration
+	if err := cli.ForceBackend("ForceTest", "backend_0", false, 50*time.Millisecond); err != nil {
+		c.Fatal(err)
+	}
+	stats, _ = Registry.BackendStats("ForceTest", "backend_0")
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.ForcedUntil, NotNil)
+
+	time.Sleep(100 * time.Millisecond)
+	stats, _ = Registry.BackendStats("ForceTest", "backend_0")
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.Forced, Equals, false)
+
+	c.Assert(cli.ForceBackend("ForceTest", "nonexistent", false, 0), NotNil)
+}
+
+// Request bodies over MaxRequestBodyBytes are rejected with a 413, whether or
+// not the length is known up front
+func (s *HTTPSuite) TestMaxRequestBodyBytes(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:                "BodyLimitTest",
+		Addr:                "127.0.0.1:9000",
+		VirtualHosts:        []string{"test-vhost"},
+		MaxRequestBodyBytes: 16,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	post := func(body io.Reader) (int, string) {
+		req, err := http.NewRequest("POST", "http://"+s.httpAddr+"/echo", body)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	status, body := post(strings.NewReader("small body"))
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "small body")
+
+	// rejected before reaching the backend
+	before, _ := Registry.BackendStats("BodyLimitTest", "backend_0")
+	status, _ = post(strings.NewReader(strings.Repeat("x", 100)))
+	c.Assert(status, Equals, http.StatusRequestEntityTooLarge)
+	after, _ := Registry.BackendStats("BodyLimitTest", "backend_0")
+	c.Assert(after.Sent, Equals, before.Sent)
+
+	// a chunked body is cut off once it's too large
+	status, _ = post(io.MultiReader(strings.NewReader(strings.Repeat("x", 10)), strings.NewReader(strings.Repeat("y", 10))))
+	c.Assert(status, Equals, http.StatusRequestEntityTooLarge)
+
+	// and the service still works afterward
+	status, body = post(io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "chunked body")
+}
+
+// Stats can be served in Graphite's plaintext format, with names escaped into
+// single path nodes
+func (s *HTTPSuite) TestGraphiteStats(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "graphite.test",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "backend 0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	adminAddr := s.httpSvr.Listener.Addr().String()
+	for _, path := range []string{"/_stats", "/graphite.test"} {
+		resp, err := http.Get("http://" + adminAddr + path + "?format=graphite")
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+
+		metrics := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			fields := strings.Fields(line)
+			c.Assert(fields, HasLen, 3)
+			metrics[fields[0]] = fields[1]
+		}
+
+		c.Assert(metrics["shuttle.graphite_test.connections"], Equals, "0")
+		c.Assert(metrics["shuttle.graphite_test.backends_up"], Equals, "1")
+		c.Assert(metrics["shuttle.graphite_test.backends.backend_0.up"], Equals, "1")
+		c.Assert(metrics["shuttle.graphite_test.backends.backend_0.sent"], Equals, "0")
+	}
+
+	c.Assert(graphiteName("a.b c:d/e-f_g"), Equals, "a_b_c_d_e-f_g")
+}
+
+// Backends can be listed and forced up or down by tag, across services
+func (s *HTTPSuite) TestTaggedBackends(c *C) {
+	for i, name := range []string{"TagTest0", "TagTest1"} {
+		svcCfg := client.ServiceConfig{
+			Name: name,
+			Addr: fmt.Sprintf("127.0.0.1:%d", 9000+i),
+			Backends: []client.BackendConfig{
+				{Name: "backend_0", Addr: s.backendServers[0].addr, Tags: []string{"az=a", "version=1"}},
+				{Name: "backend_1", Addr: s.backendServers[1].addr, Tags: []string{"az=b", "version=1"}},
+			},
+		}
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	adminAddr := s.httpSvr.Listener.Addr().String()
+	tagged := func(query string) []string {
+		resp, err := http.Get("http://" + adminAddr + "/_backends?" + query)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		var stats []TaggedBackendStat
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			c.Fatal(err)
+		}
+		names := []string{}
+		for _, b := range stats {
+			names = append(names, b.Service+"/"+b.Name)
+		}
+		return names
+	}
+
+	c.Assert(tagged("tag=az=a"), DeepEquals, []string{"TagTest0/backend_0", "TagTest1/backend_0"})
+	c.Assert(tagged("tag=version=1&tag=az=b"), DeepEquals, []string{"TagTest0/backend_1", "TagTest1/backend_1"})
+	c.Assert(tagged("tag=az=c"), DeepEquals, []string{})
+
+	resp, err := http.Get("http://" + adminAddr + "/_backends")
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	// drain a whole zone
+	cli := client.NewClient(adminAddr)
+	if err := cli.ForceTaggedBackends([]string{"az=a"}, false, 0); err != nil {
+		c.Fatal(err)
+	}
+	for _, svc := range []string{"TagTest0", "TagTest1"} {
+		stats, _ := Registry.BackendStats(svc, "backend_0")
+		c.Assert(stats.Up, Equals, false)
+		c.Assert(stats.Forced, Equals, true)
+		c.Assert(stats.Tags, DeepEquals, []string{"az=a", "version=1"})
+
+		stats, _ = Registry.BackendStats(svc, "backend_1")
+		c.Assert(stats.Forced, Equals, false)
+	}
+
+	if err := cli.ClearForcedTaggedBackends([]string{"az=a"}); err != nil {
+		c.Fatal(err)
+	}
+	stats, _ := Registry.BackendStats("TagTest1", "backend_0")
+	c.Assert(stats.Forced, Equals, false)
+
+	// the index follows backend updates and removals
+	err = Registry.AddBackend("TagTest0", client.BackendConfig{
+		Name: "backend_0", Addr: s.backendServers[0].addr, Tags: []string{"az=c"},
+	})
 	if err != nil {
 		c.Fatal(err)
 	}
-	defer resp.Body.Close()
+	c.Assert(tagged("tag=az=a"), DeepEquals, []string{"TagTest1/backend_0"})
+	c.Assert(tagged("tag=az=c"), DeepEquals, []string{"TagTest0/backend_0"})
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	c.Assert(Registry.String(), DeepEquals, string(body))
+	if err := Registry.RemoveService("TagTest1"); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(tagged("tag=version=1"), DeepEquals, []string{"TagTest0/backend_1"})
 }
 
-func (s *HTTPSuite) TestReAddBackend(c *C) {
-	svcDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9000"}`))
-	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/testService", svcDef)
-	_, err := http.DefaultClient.Do(req)
-	if err != nil {
-		c.Fatal(err)
+// Update a backend's weight without replacing the backend
+func (s *HTTPSuite) TestSetBackendWeight(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "WeightTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.backendServers[0].addr},
+			{Name: "backend_1", Addr: s.backendServers[1].addr},
+		},
 	}
 
-	backendDef := bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
-	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
-	firstResp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	if err := Registry.AddService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
-	defer firstResp.Body.Close()
 
-	firstBody, _ := ioutil.ReadAll(firstResp.Body)
+	svc := Registry.GetService("WeightTest")
+	backend := svc.get("backend_0")
 
-	backendDef = bytes.NewReader([]byte(`{"address": "127.0.0.1:9001"}`))
-	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/testService/testBackend", backendDef)
-	secResp, err := http.DefaultClient.Do(req)
-	if err != nil {
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	if err := cli.SetBackendWeight("WeightTest", "backend_0", 2); err != nil {
 		c.Fatal(err)
 	}
-	defer secResp.Body.Close()
 
-	secBody, _ := ioutil.ReadAll(secResp.Body)
+	c.Assert(svc.get("backend_0"), Equals, backend)
+	stats, _ := Registry.BackendStats("WeightTest", "backend_0")
+	c.Assert(stats.Weight, Equals, 2)
 
-	c.Assert(string(secBody), DeepEquals, string(firstBody))
-}
+	// the next selection uses the new weight
+	svc.Lock()
+	svc.lastBackend, svc.lastCount = 0, 0
+	svc.Unlock()
+	for _, srv := range []*testHTTPServer{s.backendServers[0], s.backendServers[0], s.backendServers[1]} {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+	}
 
-func (s *HTTPSuite) TestSimulAdd(c *C) {
-	start := make(chan struct{})
-	testWG := new(sync.WaitGroup)
+	c.Assert(cli.SetBackendWeight("WeightTest", "backend_0", 0), NotNil)
+	c.Assert(cli.SetBackendWeight("WeightTest", "nonexistent", 1), NotNil)
+	c.Assert(cli.SetBackendWeight("nonexistent", "backend_0", 1), NotNil)
+}
 
+// A drained backend gets no new requests, and stays drained when its config
+// is loaded again.
+func (s *HTTPSuite) TestDrainBackend(c *C) {
 	svcCfg := client.ServiceConfig{
-		Name:         "TestService",
+		Name:         "DrainTest",
 		Addr:         "127.0.0.1:9000",
 		VirtualHosts: []string{"test-vhost"},
 		Backends: []client.BackendConfig{
-			client.BackendConfig{
-				Name: "vhost1",
-				Addr: "127.0.0.1:9001",
-			},
-			client.BackendConfig{
-				Name: "vhost2",
-				Addr: "127.0.0.1:9002",
-			},
+			{Name: "backend_0", Addr: s.backendServers[0].addr},
+			{Name: "backend_1", Addr: s.backendServers[1].addr},
 		},
 	}
 
-	for i := 0; i < 8; i++ {
-		testWG.Add(1)
-		go func() {
-			defer testWG.Done()
-			//wait to start all at once
-			<-start
-			svcDef := bytes.NewReader(svcCfg.Marshal())
-			req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/TestService", svcDef)
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				c.Fatal(err)
-			}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
 
-			body, _ := ioutil.ReadAll(resp.Body)
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	if err := cli.DrainBackend("DrainTest", "backend_0", true); err != nil {
+		c.Fatal(err)
+	}
 
-			respCfg := client.Config{}
-			err = json.Unmarshal(body, &respCfg)
+	stats, _ := Registry.BackendStats("DrainTest", "backend_0")
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.Drain, Equals, true)
+	for i := 0; i < 3; i++ {
+		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[1].addr, 200, c)
+	}
 
-			// We're only checking to ensure we have 1 service with the proper number of backends
-			c.Assert(len(respCfg.Services), Equals, 1)
-			c.Assert(len(respCfg.Services[0].Backends), Equals, 2)
-			c.Assert(len(respCfg.Services[0].VirtualHosts), Equals, 1)
-		}()
+	// the drain is kept in the saved config, and restored from it
+	saved, err := Registry.ServiceConfig("DrainTest")
+	c.Assert(err, IsNil)
+	c.Assert(saved.Backends[0].Drain, Equals, true)
+	c.Assert(saved.Backends[1].Drain, Equals, false)
+
+	c.Assert(Registry.RemoveService("DrainTest"), IsNil)
+	if err := Registry.UpdateConfig(client.Config{Services: []client.ServiceConfig{saved}}); err != nil {
+		c.Fatal(err)
 	}
+	stats, _ = Registry.BackendStats("DrainTest", "backend_0")
+	c.Assert(stats.Up, Equals, false)
 
-	close(start)
-	testWG.Wait()
+	if err := cli.DrainBackend("DrainTest", "backend_0", false); err != nil {
+		c.Fatal(err)
+	}
+	stats, _ = Registry.BackendStats("DrainTest", "backend_0")
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.Drain, Equals, false)
+
+	c.Assert(cli.DrainBackend("DrainTest", "nonexistent", true), NotNil)
 }
 
-func (s *HTTPSuite) TestRouter(c *C) {
-	svcCfg := client.ServiceConfig{
-		Name:         "VHostTest",
-		Addr:         "127.0.0.1:9000",
-		VirtualHosts: []string{"test-vhost"},
-	}
+// The admin endpoints are listed from the registered routes, at /_api and at
+// the root with "index"
+func (s *HTTPSuite) TestAPIIndex(c *C) {
+	getRoutes := func(path string) []apiRoute {
+		resp, err := http.Get(s.httpSvr.URL + path)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
 
-	for _, srv := range s.backendServers {
-		cfg := client.BackendConfig{
-			Addr: srv.addr,
-			Name: srv.addr,
+		routes := []apiRoute{}
+		if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+			c.Fatal(err)
 		}
-		svcCfg.Backends = append(svcCfg.Backends, cfg)
+		return routes
 	}
 
-	err := Registry.AddService(svcCfg)
-	if err != nil {
-		c.Fatal(err)
+	routes := getRoutes("/_api")
+	c.Assert(getRoutes("/?index"), DeepEquals, routes)
+
+	methods := make(map[string][]string)
+	for _, route := range routes {
+		methods[route.Path] = route.Methods
 	}
+	c.Assert(methods["/_config"], DeepEquals, []string{"GET", "PATCH", "POST", "PUT"})
+	c.Assert(methods["/_health"], DeepEquals, []string{"GET"})
+	c.Assert(methods["/_api"], DeepEquals, []string{"GET"})
+	c.Assert(methods["/{service}/{backend}/drain"], DeepEquals, []string{"POST"})
+	c.Assert(len(methods), Equals, len(routes))
+}
 
-	for _, srv := range s.backendServers {
-		checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+// The pprof handlers aren't registered without -pprof
+func (s *HTTPSuite) TestPprofDisabled(c *C) {
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"} {
+		resp, err := http.Get(s.httpSvr.URL + path)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound, Commentf("%s", path))
+	}
+}
+
+// The pprof handlers are behind the same -admin-allow check as the other
+// admin endpoints
+func (s *HTTPSuite) TestAdminAllow(c *C) {
+	enablePprof = true
+	defer func() { enablePprof = false }()
+
+	srv := httptest.NewServer(allowAdmin(newAdminRouter()))
+	defer srv.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
 	}
+
+	c.Assert(get("/debug/pprof/cmdline"), Equals, http.StatusOK)
+	c.Assert(get("/_config"), Equals, http.StatusOK)
+
+	nets, err := parseAdminAllow("10.0.0.0/8, 192.168.0.0/16")
+	c.Assert(err, IsNil)
+	adminNets = nets
+	defer func() { adminNets = nil }()
+
+	c.Assert(get("/debug/pprof/cmdline"), Equals, http.StatusForbidden)
+	c.Assert(get("/_config"), Equals, http.StatusForbidden)
+
+	adminNets, err = parseAdminAllow("10.0.0.0/8,127.0.0.0/8")
+	c.Assert(err, IsNil)
+	c.Assert(get("/debug/pprof/cmdline"), Equals, http.StatusOK)
+
+	_, err = parseAdminAllow("10.0.0.1")
+	c.Assert(err, NotNil)
 }
 
 func (s *HTTPSuite) TestAddRemoveVHosts(c *C) {
@@ -463,6 +2253,54 @@ func (s *HTTPSuite) TestHTTPAddRemoveBackends(c *C) {
 	}
 }
 
+// The CONNECT proxy auth isn't returned by the admin API, and sending it back
+// redacted keeps the real value
+func (s *HTTPSuite) TestRedactConnectProxyAuth(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "RedactTest",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{
+				Name:             "proxied",
+				Addr:             s.backendServers[0].addr,
+				ConnectProxy:     "127.0.0.1:3128",
+				ConnectProxyAuth: "Basic dGVzdDp0ZXN0",
+			},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("RedactTest")
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	cfg, err := cli.GetConfig()
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(cfg.Services[0].Backends[0].ConnectProxyAuth, Equals, client.Redacted)
+
+	backend, err := cli.GetBackend("RedactTest", "proxied")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(backend.ConnectProxyAuth, Equals, client.Redacted)
+
+	// the state config still has the real value
+	c.Assert(Registry.Config().Services[0].Backends[0].ConnectProxyAuth, Equals, "Basic dGVzdDp0ZXN0")
+
+	// a returned config can be sent back unchanged
+	if err := cli.UpdateConfig(cfg); err != nil {
+		c.Fatal(err)
+	}
+	if err := cli.UpdateBackend("RedactTest", backend); err != nil {
+		c.Fatal(err)
+	}
+	backendCfg, _ := Registry.BackendConfig("RedactTest", "proxied")
+	c.Assert(backendCfg.ConnectProxyAuth, Equals, "Basic dGVzdDp0ZXN0")
+}
+
 func (s *HTTPSuite) TestErrorPage(c *C) {
 	svcCfg := client.ServiceConfig{
 		Name:         "VHostTest",
@@ -513,6 +2351,72 @@ func (s *HTTPSuite) TestErrorPage(c *C) {
 	c.Assert(resp.Header.Get("Last-Modified"), Equals, errServer.addr)
 }
 
+// An error page which can't be fetched when it's added should be retried
+func (s *HTTPSuite) TestErrorPageRetry(c *C) {
+	// reserve an address for the error page server, which isn't up yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	errors := NewErrorResponse(nil, nil)
+	errors.SetRetries(10, 20*time.Millisecond)
+	errors.Update(map[string][]int{"http://" + addr + "/error": []int{503}}, nil)
+
+	errors.Lock()
+	page := errors.pages[503][0]
+	errors.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(page.Body(), IsNil)
+
+	errServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		w.Write([]byte("retried"))
+	}))
+	errServer.Listener.Close()
+	errServer.Listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	errServer.Start()
+	defer errServer.Close()
+
+	for i := 0; i < 100 && page.Body() == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(string(page.Body()), Equals, "retried")
+}
+
+// An error page with several URLs is fetched from the first one available
+func (s *HTTPSuite) TestErrorPageFallback(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	downAddr := l.Addr().String()
+	l.Close()
+
+	errServer := s.backendServers[1]
+	rule := client.ErrorPageConfig{
+		Location:    "http://" + downAddr + "/error",
+		Fallbacks:   []string{"http://" + errServer.addr + "/error"},
+		StatusCodes: []int{400, 503},
+	}
+
+	errors := NewErrorResponse(nil, []client.ErrorPageConfig{rule})
+	page := errors.Get(503, nil)
+	c.Assert(page, NotNil)
+	c.Assert(page.URLs(), DeepEquals, []string{"http://" + downAddr + "/error", "http://" + errServer.addr + "/error"})
+	c.Assert(page.Header().Get("Last-Modified"), Equals, errServer.addr)
+
+	// no page is cached when none of the URLs can be fetched
+	errors = NewErrorResponse(map[string][]int{"http://" + downAddr + "/error": []int{503}}, nil)
+	c.Assert(errors.Get(503, nil).Body(), IsNil)
+}
+
 func (s *HTTPSuite) TestUpdateServiceDefaults(c *C) {
 	svcCfg := client.ServiceConfig{
 		Name: "TestService",
@@ -615,6 +2519,106 @@ func (s *HTTPSuite) TestGlobalDefaults(c *C) {
 	c.Assert(globalCfg.DialTimeout, Equals, service.DialTimeout)
 }
 
+// The effective config fills in the defaults for unset values
+func (s *HTTPSuite) TestEffectiveConfig(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:      "EffectiveTest",
+		Addr:      "127.0.0.1:9000",
+		SniffHTTP: true,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr, MaxConnsServed: 10},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	Registry.UpdateGlobals(client.Config{MaxURILength: 1000})
+
+	getConfig := func(query string) client.Config {
+		resp, err := http.Get(s.httpSvr.URL + "/_config" + query)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		cfg := client.Config{}
+		if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+			c.Fatal(err)
+		}
+		return cfg
+	}
+
+	raw := getConfig("")
+	c.Assert(raw.Balance, Equals, "")
+	c.Assert(raw.Services[0].SniffTimeout, Equals, 0)
+	c.Assert(raw.Services[0].MaxURILength, Equals, 0)
+	c.Assert(raw.Services[0].Backends[0].RecycleCooldown, Equals, 0)
+
+	effective := getConfig("?effective=true")
+	c.Assert(effective.Balance, Equals, client.DefaultBalance)
+	c.Assert(effective.CheckInterval, Equals, client.DefaultCheckInterval)
+	c.Assert(effective.MaxURILength, Equals, 1000)
+
+	svc := effective.Services[0]
+	c.Assert(svc.Balance, Equals, client.DefaultBalance)
+	c.Assert(svc.SniffTimeout, Equals, client.DefaultSniffTimeout)
+	c.Assert(svc.MaxURILength, Equals, 1000)
+	c.Assert(svc.Backends[0].Weight, Equals, client.DefaultWeight)
+	c.Assert(svc.Backends[0].RecycleCooldown, Equals, client.DefaultRecycleCooldown)
+
+	resp, err := http.Get(s.httpSvr.URL + "/_config?effective=x")
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+// Patching the global config should only change the provided defaults
+func (s *HTTPSuite) TestPatchGlobalConfig(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "TestService",
+		Addr:          "127.0.0.1:9000",
+		ClientTimeout: 500,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	Registry.UpdateGlobals(client.Config{Rise: 8})
+
+	cli := client.NewClient(s.httpSvr.Listener.Addr().String())
+	err := cli.PatchGlobalConfig(&client.Config{ClientTimeout: 102, Fall: 7})
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	config := Registry.Config()
+	c.Assert(config.ClientTimeout, Equals, 102)
+	c.Assert(config.Fall, Equals, 7)
+	c.Assert(config.Rise, Equals, 8)
+
+	c.Assert(len(config.Services), Equals, 1)
+	c.Assert(config.Services[0].ClientTimeout, Equals, 500)
+
+	// services can't be sent in a patch
+	err = cli.PatchGlobalConfig(&client.Config{Services: []client.ServiceConfig{svcCfg}})
+	c.Assert(err, NotNil)
+
+	// invalid globals are rejected without changing anything
+	err = cli.PatchGlobalConfig(&client.Config{Balance: "XYZ", Fall: 9})
+	c.Assert(err, NotNil)
+	err = cli.PatchGlobalConfig(&client.Config{TrustedProxies: []string{"10.0.0.1"}})
+	c.Assert(err, NotNil)
+
+	config = Registry.Config()
+	c.Assert(config.Balance, Equals, "")
+	c.Assert(config.Fall, Equals, 7)
+	c.Assert(config.TrustedProxies, IsNil)
+}
+
 // Test that we can route to Vhosts based on SNI
 func (s *HTTPSuite) TestHTTPSRouter(c *C) {
 	srv1 := s.backendServers[0]
@@ -638,25 +2642,110 @@ func (s *HTTPSuite) TestHTTPSRouter(c *C) {
 		},
 	}
 
-	err := Registry.AddService(svcCfgOne)
+	err := Registry.AddService(svcCfgOne)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	err = Registry.AddService(svcCfgTwo)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	// Our router has 2 certs, each with name.test and alt.name.test as DNS names.
+	// checkHTTP has a fake dialer that resolves everything to 127.0.0.1.
+	checkHTTP("https://vhost1.test:"+s.httpsPort+"/addr", "vhost1.test", srv1.addr, 200, c)
+	checkHTTP("https://alt.vhost1.test:"+s.httpsPort+"/addr", "alt.vhost1.test", srv1.addr, 200, c)
+	checkHTTP("https://star.vhost1.test:"+s.httpsPort+"/addr", "star.vhost1.test", srv1.addr, 200, c)
+
+	checkHTTP("https://vhost2.test:"+s.httpsPort+"/addr", "vhost2.test", srv2.addr, 200, c)
+	checkHTTP("https://alt.vhost2.test:"+s.httpsPort+"/addr", "alt.vhost2.test", srv2.addr, 200, c)
+	checkHTTP("https://star.vhost2.test:"+s.httpsPort+"/addr", "star.vhost2.test", srv2.addr, 200, c)
+}
+
+// Write a self-signed ECDSA certificate and key for name into dir
+func writeECDSACert(dir, base, name string, c *C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		c.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".pem"), certPEM, 0644); err != nil {
+		c.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".key"), keyPEM, 0600); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// An RSA and ECDSA certificate for the same name should be chosen by what
+// the client supports
+func (s *HTTPSuite) TestMultipleCerts(c *C) {
+	dir := c.MkDir()
+	for _, ext := range []string{".pem", ".key"} {
+		data, err := ioutil.ReadFile("testdata/vhost1" + ext)
+		if err != nil {
+			c.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "vhost1"+ext), data, 0600); err != nil {
+			c.Fatal(err)
+		}
+	}
+	writeECDSACert(dir, "vhost1-ecdsa", "vhost1.test", c)
+
+	tlsCfg, err := loadCerts(dir)
 	if err != nil {
 		c.Fatal(err)
 	}
+	c.Assert(tlsCfg.Certificates, HasLen, 2)
 
-	err = Registry.AddService(svcCfgTwo)
-	if err != nil {
-		c.Fatal(err)
+	hello := func(sigs ...tls.SignatureScheme) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        "vhost1.test",
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SignatureSchemes:  sigs,
+		}
 	}
 
-	// Our router has 2 certs, each with name.test and alt.name.test as DNS names.
-	// checkHTTP has a fake dialer that resolves everything to 127.0.0.1.
-	checkHTTP("https://vhost1.test:"+s.httpsPort+"/addr", "vhost1.test", srv1.addr, 200, c)
-	checkHTTP("https://alt.vhost1.test:"+s.httpsPort+"/addr", "alt.vhost1.test", srv1.addr, 200, c)
-	checkHTTP("https://star.vhost1.test:"+s.httpsPort+"/addr", "star.vhost1.test", srv1.addr, 200, c)
+	cert, err := tlsCfg.GetCertificate(hello(tls.ECDSAWithP256AndSHA256))
+	c.Assert(err, IsNil)
+	_, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	c.Assert(ok, Equals, true)
 
-	checkHTTP("https://vhost2.test:"+s.httpsPort+"/addr", "vhost2.test", srv2.addr, 200, c)
-	checkHTTP("https://alt.vhost2.test:"+s.httpsPort+"/addr", "alt.vhost2.test", srv2.addr, 200, c)
-	checkHTTP("https://star.vhost2.test:"+s.httpsPort+"/addr", "star.vhost2.test", srv2.addr, 200, c)
+	cert, err = tlsCfg.GetCertificate(hello(tls.PSSWithSHA256))
+	c.Assert(err, IsNil)
+	_, ok = cert.PrivateKey.(*rsa.PrivateKey)
+	c.Assert(ok, Equals, true)
+
+	// unknown names fall back to a loaded certificate
+	unknown := hello(tls.PSSWithSHA256)
+	unknown.ServerName = "unknown.test"
+	cert, err = tlsCfg.GetCertificate(unknown)
+	c.Assert(err, IsNil)
+	c.Assert(cert, NotNil)
 }
 
 // Verify that Settting HTTPSRedirect on a service works as expected for https
@@ -715,6 +2804,188 @@ func (s *HTTPSuite) TestHTTPSRedirect(c *C) {
 	c.Assert(resp.StatusCode, Equals, http.StatusOK)
 }
 
+// Redirects keep the host, path and query, and a 308 keeps the method and body
+func (s *HTTPSuite) TestHTTPSRedirectLocation(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "VHostTest1",
+		Addr:          "127.0.0.1:9000",
+		HTTPSRedirect: true,
+		VirtualHosts:  []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/deep/link?a=1&b=two%20words", nil)
+	req.Host = "vhost1.test"
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMovedPermanently)
+	c.Assert(resp.Header.Get("Location"), Equals, "https://vhost1.test/deep/link?a=1&b=two%20words")
+
+	svcCfg.HTTPSRedirectCode = http.StatusPermanentRedirect
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("POST", "http://"+s.httpAddr+"/form?id=3", strings.NewReader("a=b"))
+	req.Host = "vhost1.test"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusPermanentRedirect)
+	c.Assert(resp.Header.Get("Location"), Equals, "https://vhost1.test/form?id=3")
+
+	// the client repeats the POST with the body to the new location
+	redirected := make(chan string, 1)
+	redirectClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			body, _ := req.GetBody()
+			b, _ := ioutil.ReadAll(body)
+			redirected <- req.Method + " " + string(b)
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ = http.NewRequest("POST", "http://"+s.httpAddr+"/form?id=3", strings.NewReader("a=b"))
+	req.Host = "vhost1.test"
+	resp, err = redirectClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(<-redirected, Equals, "POST a=b")
+
+	svcCfg.HTTPSRedirectCode = 200
+	c.Assert(svcCfg.Validate(), NotNil)
+}
+
+// Plaintext requests are rejected rather than redirected with RejectHTTP
+func (s *HTTPSuite) TestRejectHTTP(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "VHostTest1",
+		Addr:          "127.0.0.1:9000",
+		HTTPSRedirect: true,
+		RejectHTTP:    true,
+		VirtualHosts:  []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("VHostTest1")
+
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	request := func(proto string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "vhost1.test"
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := request("")
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(resp.Header.Get("Location"), Equals, "")
+	c.Assert(Registry.GetService("VHostTest1").Stats().HTTPErrors, Equals, int64(1))
+
+	// X-Forwarded-Proto isn't believed from a client that isn't a proxy
+	c.Assert(request("https").StatusCode, Equals, http.StatusForbidden)
+
+	// requests from a trusted TLS terminating proxy are still proxied
+	svcCfg.TrustedProxies = []string{"127.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(request("https").StatusCode, Equals, http.StatusOK)
+
+	// without RejectHTTP, the redirect is back
+	svcCfg.RejectHTTP = false
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(request("").StatusCode, Equals, http.StatusMovedPermanently)
+}
+
+// Long request URIs are rejected, with a per-service override
+func (s *HTTPSuite) TestMaxURILength(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	srvAddr := s.backendServers[0].addr
+	url := "http://" + s.httpAddr + "/addr?q="
+
+	// the request is rejected before the X-Request-Id is added
+	checkTooLong := func(url, host string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Host = host
+		req.Header.Set("X-Request-Id", "foo")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusRequestURITooLong)
+		c.Assert(resp.Header.Get("X-Request-Id"), Equals, "")
+	}
+	checkHTTP(url+strings.Repeat("a", 1000), "vhost1.test", srvAddr, 200, c)
+	checkTooLong(url+strings.Repeat("a", client.DefaultMaxURILength), "vhost1.test")
+
+	// unknown hosts are limited too
+	checkTooLong(url+strings.Repeat("a", client.DefaultMaxURILength), "none.test")
+
+	Registry.UpdateGlobals(client.Config{MaxURILength: 100})
+	checkTooLong(url+strings.Repeat("a", 200), "vhost1.test")
+
+	svcCfg.MaxURILength = 500
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP(url+strings.Repeat("a", 200), "vhost1.test", srvAddr, 200, c)
+	checkTooLong(url+strings.Repeat("a", 500), "vhost1.test")
+}
+
 func (s *HTTPSuite) TestMaintenanceMode(c *C) {
 	mainServer := s.backendServers[0]
 	errServer := s.backendServers[1]
@@ -766,3 +3037,297 @@ func (s *HTTPSuite) TestMaintenanceMode(c *C) {
 
 	checkHTTP("https://vhost1.test:"+s.httpsPort+"/addr", "vhost1.test", errServer.addr, 503, c)
 }
+
+// Error pages scoped by method and path should take precedence over the
+// service-wide error pages.
+func (s *HTTPSuite) TestScopedErrorPage(c *C) {
+	okServer := s.backendServers[0]
+	errServer := s.backendServers[1]
+	postErrServer := s.backendServers[2]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Addr: okServer.addr, Name: okServer.addr},
+		},
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=503": []int{503},
+		},
+		ErrorPageRules: []client.ErrorPageConfig{
+			{
+				Location:    "http://" + postErrServer.addr + "/error?code=503",
+				StatusCodes: []int{503},
+				Methods:     []string{"POST"},
+				PathPrefix:  "/error",
+			},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	getBody := func(method string) string {
+		req, err := http.NewRequest(method, "http://"+s.httpAddr+"/error?code=503", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		req.Host = "test-vhost"
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		c.Assert(resp.StatusCode, Equals, 503)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	c.Assert(getBody("GET"), Equals, errServer.addr)
+	c.Assert(getBody("POST"), Equals, postErrServer.addr)
+}
+
+// Global maintenance mode applies to every service, using the global body
+// unless a service has its own
+func (s *HTTPSuite) TestGlobalMaintenance(c *C) {
+	Registry.UpdateGlobals(client.Config{
+		MaintenanceBody:        "instance down",
+		MaintenanceContentType: "text/plain",
+	})
+	defer func() {
+		Registry.SetMaintenance(MaintenanceStatus{})
+		Registry.cfg.MaintenanceBody = ""
+		Registry.cfg.MaintenanceContentType = ""
+	}()
+
+	svcs := []client.ServiceConfig{
+		{
+			Name:         "VHostTest1",
+			Addr:         "127.0.0.1:9000",
+			VirtualHosts: []string{"vhost1.test"},
+			Backends: []client.BackendConfig{
+				{Addr: s.backendServers[0].addr},
+			},
+		},
+		{
+			Name:            "VHostTest2",
+			Addr:            "127.0.0.1:9001",
+			VirtualHosts:    []string{"vhost2.test"},
+			MaintenanceBody: "service down",
+			Backends: []client.BackendConfig{
+				{Addr: s.backendServers[1].addr},
+			},
+		},
+		{
+			Name: "TCPTest",
+			Addr: "127.0.0.1:9002",
+			Backends: []client.BackendConfig{
+				{Addr: s.servers[0].addr},
+			},
+		},
+	}
+	for _, svcCfg := range svcs {
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	url := "http://" + s.httpAddr + "/addr"
+	setMaintenance := func(params string, status int) {
+		resp, err := http.Post(s.httpSvr.URL+"/_maintenance?"+params, "", nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status)
+	}
+	checkHealth := func(maintenance bool) {
+		resp, err := http.Get(s.httpSvr.URL + "/_health")
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		health := HealthStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			c.Fatal(err)
+		}
+		c.Assert(health.Maintenance, Equals, maintenance)
+		if maintenance {
+			c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+			c.Assert(health.Healthy, Equals, false)
+		}
+	}
+
+	checkHTTP(url, "vhost1.test", s.backendServers[0].addr, 200, c)
+	checkHealth(false)
+
+	setMaintenance("enabled=true", http.StatusOK)
+	c.Assert(Registry.Maintenance(), Equals, MaintenanceStatus{Enabled: true})
+
+	// services use their own maintenance response, or the global one
+	checkHTTP(url, "vhost1.test", "instance down", 503, c)
+	checkHTTP(url, "vhost2.test", "service down", 503, c)
+	checkHealth(true)
+
+	// TCP services still accept connections, unless requested
+	checkResp("127.0.0.1:9002", s.servers[0].addr, c)
+
+	setMaintenance("enabled=true&tcp=true", http.StatusOK)
+	conn, err := net.Dial("tcp", "127.0.0.1:9002")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	setMaintenance("enabled=false", http.StatusOK)
+	c.Assert(Registry.Maintenance(), Equals, MaintenanceStatus{})
+
+	checkHTTP(url, "vhost1.test", s.backendServers[0].addr, 200, c)
+	checkHTTP(url, "vhost2.test", s.backendServers[1].addr, 200, c)
+	checkResp("127.0.0.1:9002", s.servers[0].addr, c)
+	checkHealth(false)
+
+	setMaintenance("enabled=maybe", http.StatusBadRequest)
+	setMaintenance("enabled=true&tcp=maybe", http.StatusBadRequest)
+}
+
+// Maintenance mode should return the inline body when there's no error page
+func (s *HTTPSuite) TestMaintenanceBody(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+		MaintenanceMode:        true,
+		MaintenanceBody:        `{"status": "maintenance"}`,
+		MaintenanceContentType: "application/json",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "vhost1.test", svcCfg.MaintenanceBody, 503, c)
+
+	// an error page for 503 replaces the inline body
+	errServer := s.backendServers[1]
+	svcCfg.ErrorPages = map[string][]int{
+		"http://" + errServer.addr + "/error?code=503": []int{503},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "vhost1.test", errServer.addr, 503, c)
+}
+
+// Serve the maintenance response from a file, re-reading it on update
+func (s *HTTPSuite) TestMaintenanceFile(c *C) {
+	path := filepath.Join(c.MkDir(), "maintenance.html")
+	if err := ioutil.WriteFile(path, []byte("<p>maintenance</p>"), 0644); err != nil {
+		c.Fatal(err)
+	}
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost1.test"},
+		Backends: []client.BackendConfig{
+			{Addr: s.backendServers[0].addr},
+		},
+		MaintenanceMode: true,
+		MaintenanceBody: "inline",
+		MaintenanceFile: path,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+	req.Host = "vhost1.test"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	c.Assert(resp.StatusCode, Equals, 503)
+	c.Assert(string(body), Equals, "<p>maintenance</p>")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+
+	// the file is read again on update
+	if err := ioutil.WriteFile(path, []byte("<p>updated</p>"), 0644); err != nil {
+		c.Fatal(err)
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "vhost1.test", "<p>updated</p>", 503, c)
+
+	// a missing file is a config error, and the cached content is kept
+	svcCfg.MaintenanceFile = path + ".missing"
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+	checkHTTP("http://"+s.httpAddr+"/addr", "vhost1.test", "<p>updated</p>", 503, c)
+
+	svcCfg.Name = "MissingFile"
+	svcCfg.Addr = "127.0.0.1:9001"
+	c.Assert(Registry.AddService(svcCfg), NotNil)
+	c.Assert(Registry.GetService("MissingFile"), IsNil)
+}
+
+// /_health isn't healthy until all the startup steps are done
+func (s *HTTPSuite) TestStartupHealth(c *C) {
+	defer func(st *startupState) {
+		startup = st
+	}(startup)
+	startup = &startupState{}
+
+	checkHealth := func(status int) HealthStatus {
+		resp, err := http.Get(s.httpSvr.URL + "/_health")
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, status)
+
+		health := HealthStatus{}
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			c.Fatal(err)
+		}
+		return health
+	}
+
+	startup.Begin("config")
+	startup.Begin("http")
+
+	health := checkHealth(503)
+	c.Assert(health.Healthy, Equals, false)
+	c.Assert(health.Starting, DeepEquals, []string{"config", "http"})
+
+	startup.Done("config", nil)
+	c.Assert(checkHealth(503).Starting, DeepEquals, []string{"http"})
+
+	startup.Done("http", nil)
+	health = checkHealth(200)
+	c.Assert(health.Healthy, Equals, true)
+	c.Assert(health.Starting, IsNil)
+
+	// a failed listener is reported, and never becomes healthy
+	startup.Begin("https")
+	startup.Done("https", fmt.Errorf("address in use"))
+	health = checkHealth(503)
+	c.Assert(health.Starting, IsNil)
+	c.Assert(health.StartupErrors, DeepEquals, map[string]string{"https": "address in use"})
+}
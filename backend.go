@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/litl/shuttle/client"
@@ -26,6 +37,18 @@ type Backend struct {
 	HTTPActive int64
 	Network    string
 
+	// Connections the backend closed without any data transferred
+	EmptyResponses int64
+
+	// Connections reset by the other end during a transfer
+	Resets int64
+
+	// Times the dial failure rate reached dialFailureAlert
+	DialFailureAlerts int64
+
+	// Times the backend was ejected for its HTTP error rate
+	Ejections int64
+
 	// these are loaded from the service, so a backend doesn't need to access
 	// the service struct at all.
 	dialTimeout   time.Duration
@@ -38,12 +61,101 @@ type Backend struct {
 	fallCount     int
 	checkFail     int
 
+	// failed checks are ignored until checkStart
+	checkDelay time.Duration
+	checkStart time.Time
+
+	// check times between checkFast and checkSlow reduce the healthFactor,
+	// which scales the weight used for balancing
+	checkFast    time.Duration
+	checkSlow    time.Duration
+	checkLatency time.Duration
+	healthFactor float64
+
+	// data to send in a health check, and the response required
+	checkSend   string
+	checkExpect string
+
 	startCheck sync.Once
 	// stop the health-check loop
 	stopCheck chan interface{}
+	// shared slots limiting the health checks in progress, or nil
+	checkSlots chan struct{}
 
 	// so we only need to ResolveUDPAddr once
 	udpAddr *net.UDPAddr
+
+	// periodically resolved addresses for a hostname Addr
+	resolveInterval time.Duration
+	endpoints       []string
+	lastEndpoint    int
+
+	// DSCP marking for backend connections
+	dscp int
+
+	// tcp4 or tcp6 to pin the address family of direct dials, or empty
+	dialNetwork string
+
+	// limit concurrent dials, and count those waiting on the limit
+	maxDials   int
+	dialSem    chan struct{}
+	dialQueued int64
+
+	// dials and their failures over the dialFailureWindow, warning when the
+	// failure rate reaches dialFailureAlert
+	dialRate          failureRate
+	dialFailureAlert  float64
+	dialFailureWindow time.Duration
+
+	// limit the concurrent connections, tracking the slots in use
+	maxConns int64
+	slots    int64
+
+	// stop sending connections after maxConnsServed, until recycleUntil
+	maxConnsServed  int64
+	recycleCooldown time.Duration
+	recycleBase     int64
+	recycleUntil    time.Time
+
+	// tunnel connections through an HTTP CONNECT proxy
+	connectProxy     string
+	connectProxyAuth string
+
+	// originate TLS to the backend when tlsConfig is set
+	tlsServerName         string
+	tlsInsecureSkipVerify bool
+	tlsConfig             *tls.Config
+
+	// expiry of the backend's TLS certificate, from the last handshake, and
+	// whether we've warned that it's expiring soon
+	certExpiry time.Time
+	certWarned bool
+
+	// the most recent check error, and the time the backend last changed
+	// state
+	lastError  string
+	lastChange time.Time
+
+	// a manually forced state, which overrides the health checks until
+	// forcedUntil, or until cleared if forcedUntil is zero.
+	forced      bool
+	forcedUp    bool
+	forcedUntil time.Time
+
+	// a drained backend receives no new connections, even when forced up
+	drain bool
+
+	// proxied HTTP responses and the 5xx errors among them, and the time an
+	// ejection for too many errors ends
+	responseRate failureRate
+	ejectedUntil time.Time
+
+	// labels for admin queries, which don't change once the backend is
+	// created
+	tags []string
+
+	// the group balanced separately from the others, for failover
+	group string
 }
 
 // The json stats we return for the backend
@@ -61,16 +173,117 @@ type BackendStat struct {
 	HTTPActive int64  `json:"http_active"`
 	CheckOK    int    `json:"check_success"`
 	CheckFail  int    `json:"check_fail"`
+
+	// Connections the backend closed without any data transferred
+	EmptyResponses int64 `json:"empty_responses"`
+
+	// Connections reset by the other end during a transfer
+	Resets int64 `json:"resets"`
+
+	// The fraction of dials which failed over the service's
+	// dial_failure_window, and the number of times this reached the
+	// dial_failure_alert rate.
+	DialFailureRate   float64 `json:"dial_failure_rate"`
+	DialFailureAlerts int64   `json:"dial_failure_alerts,omitempty"`
+
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	LastError  string    `json:"last_error,omitempty"`
+	LastChange time.Time `json:"last_change"`
+
+	// Forced is set when Up was set manually rather than by health checks.
+	Forced      bool       `json:"forced,omitempty"`
+	ForcedUntil *time.Time `json:"forced_until,omitempty"`
+
+	// Drain is set while the backend is drained, and isn't Up.
+	Drain bool `json:"drain,omitempty"`
+
+	// Ejected is set while the backend isn't Up because of its HTTP error
+	// rate, rather than its health checks. Ejections counts each time.
+	Ejected      bool       `json:"ejected,omitempty"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    int64      `json:"ejections,omitempty"`
+
+	Group string `json:"group,omitempty"`
+
+	// The time of the last successful health check in milliseconds, and the
+	// factor from 0 to 1 its weight is scaled by when the service sets
+	// check_slow.
+	CheckLatency float64 `json:"check_latency"`
+	HealthFactor float64 `json:"health_factor"`
+
+	MaxConns   int   `json:"max_conns,omitempty"`
+	MaxDials   int   `json:"max_dials,omitempty"`
+	DialQueued int64 `json:"dial_queued"`
+
+	// Recycling is set while the backend isn't receiving new connections
+	// after serving MaxConnsServed.
+	MaxConnsServed int        `json:"max_conns_served,omitempty"`
+	Recycling      bool       `json:"recycling,omitempty"`
+	RecycleUntil   *time.Time `json:"recycle_until,omitempty"`
+
+	// Expiry of the TLS certificate, for backends with TLS origination.
+	// CheckWarning is set when it expires within the -cert-warning window.
+	CertExpiry   *time.Time `json:"cert_expiry,omitempty"`
+	CheckWarning string     `json:"check_warning,omitempty"`
+
+	Tags []string `json:"tags,omitempty"`
 }
 
 func NewBackend(cfg client.BackendConfig) *Backend {
 	b := &Backend{
-		Name:      cfg.Name,
-		Addr:      cfg.Addr,
-		CheckAddr: cfg.CheckAddr,
-		Weight:    cfg.Weight,
-		Network:   cfg.Network,
-		stopCheck: make(chan interface{}),
+		Name:       cfg.Name,
+		Addr:       cfg.Addr,
+		CheckAddr:  cfg.CheckAddr,
+		Weight:     cfg.Weight,
+		Network:    cfg.Network,
+		stopCheck:  make(chan interface{}),
+		checkSlots: checkSlots,
+
+		checkSend:       cfg.CheckSend,
+		checkExpect:     cfg.CheckExpect,
+		resolveInterval: time.Duration(cfg.ResolveInterval) * time.Millisecond,
+		checkDelay:      time.Duration(cfg.CheckDelay) * time.Millisecond,
+		dscp:            cfg.DSCP,
+		dialNetwork:     cfg.DialNetwork,
+		maxDials:        cfg.MaxDials,
+		maxConns:        int64(cfg.MaxConns),
+		lastChange:      time.Now(),
+		healthFactor:    1,
+
+		maxConnsServed:  int64(cfg.MaxConnsServed),
+		recycleCooldown: time.Duration(cfg.RecycleCooldown) * time.Millisecond,
+
+		connectProxy:     cfg.ConnectProxy,
+		connectProxyAuth: cfg.ConnectProxyAuth,
+
+		tlsServerName:         cfg.TLSServerName,
+		tlsInsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+
+		tags:  cfg.Tags,
+		drain: cfg.Drain,
+		group: cfg.Group,
+	}
+
+	if cfg.TLS {
+		serverName := cfg.TLSServerName
+		if serverName == "" {
+			host, _, _ := net.SplitHostPort(cfg.Addr)
+			serverName, _ = splitZone(host)
+		}
+		b.tlsConfig = &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		}
+	}
+
+	if b.maxDials > 0 {
+		b.dialSem = make(chan struct{}, b.maxDials)
+	}
+
+	if b.dscp != 0 && !dscpSupported {
+		log.Warnf("WARN: DSCP marking is not supported on this platform, ignoring for backend %s", b.Name)
+		b.dscp = 0
 	}
 
 	// don't want a weight of 0
@@ -85,10 +298,11 @@ func NewBackend(cfg client.BackendConfig) *Backend {
 	switch b.Network {
 	case "udp", "udp4", "udp6":
 		var err error
-		b.udpAddr, err = net.ResolveUDPAddr(b.Network, b.Addr)
+		b.udpAddr, err = resolveUDPAddr(b.Network, b.Addr)
 		if err != nil {
 			log.Errorf("ERROR: %s", err.Error())
 			b.up = false
+			b.lastError = err.Error()
 		}
 	}
 
@@ -101,31 +315,211 @@ func (b *Backend) Stats() BackendStat {
 	defer b.Unlock()
 
 	stats := BackendStat{
-		Name:       b.Name,
-		Addr:       b.Addr,
-		CheckAddr:  b.CheckAddr,
-		Up:         b.up,
-		Weight:     b.Weight,
-		Sent:       atomic.LoadInt64(&b.Sent),
-		Rcvd:       atomic.LoadInt64(&b.Rcvd),
-		Errors:     atomic.LoadInt64(&b.Errors),
-		Conns:      atomic.LoadInt64(&b.Conns),
-		Active:     atomic.LoadInt64(&b.Active),
-		HTTPActive: atomic.LoadInt64(&b.HTTPActive),
-		CheckOK:    b.checkOK,
-		CheckFail:  b.checkFail,
+		Name:      b.Name,
+		Addr:      b.Addr,
+		CheckAddr: b.CheckAddr,
+		Up:        b.isUp(),
+		Weight:    b.Weight,
+		Sent:      atomic.LoadInt64(&b.Sent),
+		Rcvd:      atomic.LoadInt64(&b.Rcvd),
+		Errors:    atomic.LoadInt64(&b.Errors),
+
+		EmptyResponses: atomic.LoadInt64(&b.EmptyResponses),
+		Resets:         atomic.LoadInt64(&b.Resets),
+		Conns:          atomic.LoadInt64(&b.Conns),
+		Active:         atomic.LoadInt64(&b.Active),
+		HTTPActive:     atomic.LoadInt64(&b.HTTPActive),
+		CheckOK:        b.checkOK,
+		CheckFail:      b.checkFail,
+		Endpoints:      b.endpoints,
+		LastError:      b.lastError,
+		LastChange:     b.lastChange,
+		Forced:         b.forced,
+		Drain:          b.drain,
+		Group:          b.group,
+		CheckLatency:   float64(b.checkLatency) / float64(time.Millisecond),
+		HealthFactor:   b.healthFactor,
+		MaxConns:       int(b.maxConns),
+		MaxDials:       b.maxDials,
+		DialQueued:     atomic.LoadInt64(&b.dialQueued),
+
+		DialFailureRate:   b.dialRate.Rate(time.Now(), b.dialWindow()),
+		DialFailureAlerts: atomic.LoadInt64(&b.DialFailureAlerts),
+
+		Ejections: atomic.LoadInt64(&b.Ejections),
+
+		MaxConnsServed: int(b.maxConnsServed),
+
+		Tags: b.tags,
+	}
+
+	if b.recycling() {
+		until := b.recycleUntil
+		stats.Recycling = true
+		stats.RecycleUntil = &until
+	}
+
+	if b.forced && !b.forcedUntil.IsZero() {
+		until := b.forcedUntil
+		stats.ForcedUntil = &until
+	}
+
+	if b.ejected() {
+		until := b.ejectedUntil
+		stats.Ejected = true
+		stats.EjectedUntil = &until
+	}
+
+	if !b.certExpiry.IsZero() {
+		expiry := b.certExpiry
+		stats.CertExpiry = &expiry
+		stats.CheckWarning = b.certWarning()
 	}
 
 	return stats
 }
 
+// Zero the cumulative counters. The active connection counts are unchanged.
+func (b *Backend) ResetStats() {
+	atomic.StoreInt64(&b.Sent, 0)
+	atomic.StoreInt64(&b.Rcvd, 0)
+	atomic.StoreInt64(&b.Errors, 0)
+	atomic.StoreInt64(&b.EmptyResponses, 0)
+	atomic.StoreInt64(&b.Resets, 0)
+	atomic.StoreInt64(&b.DialFailureAlerts, 0)
+	atomic.StoreInt64(&b.Ejections, 0)
+
+	// keep counting towards maxConnsServed from where we were
+	b.Lock()
+	b.recycleBase -= atomic.SwapInt64(&b.Conns, 0)
+	b.Unlock()
+}
+
 func (b *Backend) Up() bool {
 	b.Lock()
-	up := b.up
+	up := b.isUp()
 	b.Unlock()
 	return up
 }
 
+// Return the forced state if there is one, otherwise the health check state.
+// A drained backend is never up.
+// Backend must be locked.
+func (b *Backend) isUp() bool {
+	if b.drain {
+		return false
+	}
+
+	if b.forced && !b.forcedUntil.IsZero() && time.Now().After(b.forcedUntil) {
+		log.Printf("Forced state expired for backend %s", b.Name)
+		b.forced = false
+		b.forcedUntil = time.Time{}
+	}
+
+	if b.forced {
+		return b.forcedUp
+	}
+	return b.up && !b.recycling() && !b.ejected()
+}
+
+// Take a connection slot if the backend is limited by maxConns. Returns false
+// if all slots are in use.
+func (b *Backend) acquireSlot() bool {
+	if b.maxConns == 0 {
+		return true
+	}
+
+	for {
+		n := atomic.LoadInt64(&b.slots)
+		if n >= b.maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.slots, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release a slot taken by acquireSlot. Returns true if a slot was freed.
+func (b *Backend) releaseSlot() bool {
+	if b.maxConns == 0 {
+		return false
+	}
+	atomic.AddInt64(&b.slots, -1)
+	return true
+}
+
+// Return true while the backend is recycling.
+// Backend must be locked.
+func (b *Backend) recycling() bool {
+	return !b.recycleUntil.IsZero() && time.Now().Before(b.recycleUntil)
+}
+
+// Return true while the backend is ejected for its error rate.
+// Backend must be locked.
+func (b *Backend) ejected() bool {
+	return !b.ejectedUntil.IsZero() && time.Now().Before(b.ejectedUntil)
+}
+
+// Eject the backend for d, and start counting its errors over again.
+func (b *Backend) eject(d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.ejectedUntil = time.Now().Add(d)
+	b.lastChange = time.Now()
+	atomic.AddInt64(&b.Ejections, 1)
+	b.responseRate.Reset()
+}
+
+// Count a new connection to the backend, and start recycling the backend if
+// it has served maxConnsServed since it was last recycled.
+func (b *Backend) countConn() {
+	conns := atomic.AddInt64(&b.Conns, 1)
+	if b.maxConnsServed <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if conns-b.recycleBase >= b.maxConnsServed && !b.recycling() {
+		log.Printf("Recycling backend %s after %d connections", b.Name, conns-b.recycleBase)
+		cooldown := b.recycleCooldown
+		if cooldown == 0 {
+			cooldown = client.DefaultRecycleCooldown * time.Millisecond
+		}
+		b.recycleBase = conns
+		b.recycleUntil = time.Now().Add(cooldown)
+	}
+}
+
+// Force the backend Up or Down, ignoring health checks for the duration d. If
+// d is 0, the state is kept until cleared.
+func (b *Backend) Force(up bool, d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.forced = true
+	b.forcedUp = up
+	b.forcedUntil = time.Time{}
+	if d > 0 {
+		b.forcedUntil = time.Now().Add(d)
+	}
+	b.lastChange = time.Now()
+}
+
+// Clear a forced state, and return to using the health check results.
+func (b *Backend) ClearForce() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.forced {
+		b.forced = false
+		b.forcedUntil = time.Time{}
+		b.lastChange = time.Now()
+	}
+}
+
 // Return the struct for marshaling into a json config
 func (b *Backend) Config() client.BackendConfig {
 	b.Lock()
@@ -136,6 +530,28 @@ func (b *Backend) Config() client.BackendConfig {
 		Addr:      b.Addr,
 		CheckAddr: b.CheckAddr,
 		Weight:    b.Weight,
+
+		CheckSend:       b.checkSend,
+		CheckExpect:     b.checkExpect,
+		ResolveInterval: int(b.resolveInterval / time.Millisecond),
+		DSCP:            b.dscp,
+		DialNetwork:     b.dialNetwork,
+		CheckDelay:      int(b.checkDelay / time.Millisecond),
+		MaxDials:        b.maxDials,
+		MaxConns:        int(b.maxConns),
+		MaxConnsServed:  int(b.maxConnsServed),
+		RecycleCooldown: int(b.recycleCooldown / time.Millisecond),
+
+		ConnectProxy:     b.connectProxy,
+		ConnectProxyAuth: b.connectProxyAuth,
+
+		TLS:                   b.tlsConfig != nil,
+		TLSServerName:         b.tlsServerName,
+		TLSInsecureSkipVerify: b.tlsInsecureSkipVerify,
+
+		Tags:  b.tags,
+		Drain: b.drain,
+		Group: b.group,
 	}
 
 	return cfg
@@ -146,8 +562,320 @@ func (b *Backend) String() string {
 	return string(marshal(b.Config()))
 }
 
+// Dial the backend using the provided dialer, marking the connection if
+// configured. If the backend has a dial limit, wait for a free slot first. The
+// wait counts against the dialer's Timeout.
+func (b *Backend) dial(d *net.Dialer, network string) (net.Conn, error) {
+	if b.dscp != 0 || b.dialSem != nil {
+		dialer := *d
+		d = &dialer
+	}
+
+	if b.dscp != 0 {
+		d.Control = dscpControl(b.dscp)
+	}
+
+	if b.dialSem != nil {
+		var timeout <-chan time.Time
+		if d.Timeout > 0 {
+			d.Deadline = time.Now().Add(d.Timeout)
+			timer := time.NewTimer(d.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		atomic.AddInt64(&b.dialQueued, 1)
+		select {
+		case b.dialSem <- struct{}{}:
+			atomic.AddInt64(&b.dialQueued, -1)
+		case <-timeout:
+			atomic.AddInt64(&b.dialQueued, -1)
+			return nil, fmt.Errorf("timeout waiting to dial backend %s", b.Name)
+		}
+		defer func() { <-b.dialSem }()
+	}
+
+	var conn net.Conn
+	var err error
+	if b.connectProxy != "" {
+		conn, err = b.dialConnectProxy(d, network, b.dialAddr())
+	} else {
+		conn, err = d.Dial(b.familyNetwork(network), b.dialAddr())
+	}
+
+	if err == nil && b.tlsConfig != nil {
+		conn, err = b.tlsHandshake(conn, d.Timeout)
+	}
+
+	b.countDial(err)
+	return conn, err
+}
+
+// Count a dial towards the dial failure rate, and warn when the rate reaches
+// dialFailureAlert.
+func (b *Backend) countDial(err error) {
+	b.Lock()
+	alert, window := b.dialFailureAlert, b.dialWindow()
+	b.Unlock()
+
+	rate, dials, ok := b.dialRate.Add(time.Now(), window, err != nil, alert, dialAlertMinDials)
+	if ok {
+		atomic.AddInt64(&b.DialFailureAlerts, 1)
+		log.Warnf("WARN: %.0f%% of %d dials to backend %s failed in the last %s, over the alert rate of %.0f%%",
+			rate*100, dials, b.Name, window, alert*100)
+	}
+}
+
+// Update the dial failure alert rate and window.
+func (b *Backend) setDialFailureAlert(alert float64, window time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.dialFailureAlert, b.dialFailureWindow = alert, window
+}
+
+// The backend must be locked.
+func (b *Backend) dialWindow() time.Duration {
+	if b.dialFailureWindow <= 0 {
+		return client.DefaultDialFailureWindow * time.Millisecond
+	}
+	return b.dialFailureWindow
+}
+
+// The window of a failureRate is divided into buckets, so the oldest events
+// expire as the window slides rather than all at once.
+const failureRateBuckets = 10
+
+// No dial failure alert is raised until there are this many dials in the
+// window, so a single failure isn't a 100% failure rate.
+const dialAlertMinDials = 5
+
+// Counts events, like dials or responses, and how many of them failed over a
+// sliding window.
+type failureRate struct {
+	sync.Mutex
+	window   time.Duration
+	start    time.Time
+	current  int
+	events   [failureRateBuckets]int
+	failures [failureRateBuckets]int
+	alerted  bool
+}
+
+// Move the current bucket up to now, clearing those which have expired. A
+// change of window starts over. The failureRate must be locked.
+func (r *failureRate) advance(now time.Time, window time.Duration) {
+	if window != r.window || r.start.IsZero() {
+		r.window, r.start, r.current = window, now, 0
+		r.events = [failureRateBuckets]int{}
+		r.failures = [failureRateBuckets]int{}
+		r.alerted = false
+		return
+	}
+
+	size := window / failureRateBuckets
+	steps := int(now.Sub(r.start) / size)
+	if steps <= 0 {
+		return
+	}
+	r.start = r.start.Add(time.Duration(steps) * size)
+
+	if steps > failureRateBuckets {
+		steps = failureRateBuckets
+	}
+	for i := 0; i < steps; i++ {
+		r.current = (r.current + 1) % failureRateBuckets
+		r.events[r.current] = 0
+		r.failures[r.current] = 0
+	}
+}
+
+// The failure rate and number of events in the window. The failureRate must
+// be locked.
+func (r *failureRate) rate() (float64, int) {
+	events, failures := 0, 0
+	for i := range r.events {
+		events += r.events[i]
+		failures += r.failures[i]
+	}
+	if events == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(events), events
+}
+
+// Count an event at now. When the failure rate first reaches alert, with at
+// least min events in the window, the rate and number of events are returned
+// with true. Another alert isn't raised until the rate has dropped below alert
+// again.
+func (r *failureRate) Add(now time.Time, window time.Duration, failed bool, alert float64, min int) (float64, int, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.advance(now, window)
+	r.events[r.current]++
+	if failed {
+		r.failures[r.current]++
+	}
+
+	rate, events := r.rate()
+	if alert <= 0 || rate < alert {
+		r.alerted = false
+		return rate, events, false
+	}
+	if r.alerted || events < min {
+		return rate, events, false
+	}
+
+	r.alerted = true
+	return rate, events, true
+}
+
+// Clear a raised alert, so the next event at the alert rate raises it again,
+// for an alert which couldn't be acted on.
+func (r *failureRate) Rearm() {
+	r.Lock()
+	defer r.Unlock()
+	r.alerted = false
+}
+
+// Return the failure rate over the window ending at now.
+func (r *failureRate) Rate(now time.Time, window time.Duration) float64 {
+	r.Lock()
+	defer r.Unlock()
+
+	r.advance(now, window)
+	rate, _ := r.rate()
+	return rate
+}
+
+// Clear the counts, so the next window starts over.
+func (r *failureRate) Reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.start = time.Time{}
+}
+
+// Return the network for a direct dial to the backend, which is dialNetwork
+// when it pins the family of a tcp network.
+func (b *Backend) familyNetwork(network string) string {
+	if b.dialNetwork == "" || b.dialNetwork == "tcp" || !strings.HasPrefix(network, "tcp") {
+		return network
+	}
+	return b.dialNetwork
+}
+
+// Start a TLS client session over conn. The handshake is bound by timeout.
+func (b *Backend) tlsHandshake(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tlsConn := tls.Client(conn, b.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with backend %s: %s", b.Name, err)
+	}
+
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		b.Lock()
+		b.certExpiry = certs[0].NotAfter
+		b.Unlock()
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Return a warning if the backend's certificate expires within the
+// certWarning window. The backend must be locked.
+func (b *Backend) certWarning() string {
+	if b.certExpiry.IsZero() || time.Until(b.certExpiry) > certWarning {
+		return ""
+	}
+	return fmt.Sprintf("TLS certificate expires at %s", b.certExpiry.Format(time.RFC3339))
+}
+
+// Dial addr through the backend's HTTP CONNECT proxy. The CONNECT exchange is
+// bound by the dialer's Timeout, and any response other than 2xx is returned
+// as an error.
+func (b *Backend) dialConnectProxy(d *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := d.Dial(network, b.connectProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if b.connectProxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", b.connectProxyAuth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT to %s via %s failed: %s", addr, b.connectProxy, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// the backend may have already sent data after the CONNECT response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// A net.Conn which first reads any data left in a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func (b *Backend) Start() {
+	b.Lock()
+	b.checkStart = time.Now().Add(b.checkDelay)
+	b.Unlock()
+
 	go b.startCheck.Do(b.healthCheck)
+
+	if b.resolveInterval > 0 && strings.HasPrefix(b.Network, "tcp") {
+		host, _, err := net.SplitHostPort(b.Addr)
+		if err == nil && !isIPHost(host) {
+			go b.resolveLoop()
+		}
+	}
 }
 
 func (b *Backend) Stop() {
@@ -160,41 +888,185 @@ func (b *Backend) check() {
 	}
 
 	up := true
-	if c, e := net.DialTimeout("tcp", b.CheckAddr, b.dialTimeout); e == nil {
-		c.(*net.TCPConn).SetLinger(0)
-		c.Close()
-	} else {
-		log.Debug("Check error:", e)
+	start := time.Now()
+	checkErr := b.checkConn()
+	latency := time.Since(start)
+	if checkErr != nil {
+		log.Debug("Check error:", checkErr)
 		up = false
 	}
 
 	b.Lock()
 	defer b.Unlock()
+
+	// an expiring certificate is only a warning, and doesn't fail the check
+	if warning := b.certWarning(); warning != "" && !b.certWarned {
+		log.Warnf("WARN: backend %s: %s", b.Name, warning)
+		b.certWarned = true
+	} else if warning == "" {
+		b.certWarned = false
+	}
+
 	if up {
 		log.Debugf("Check OK for %s/%s", b.Name, b.CheckAddr)
+		b.checkLatency = latency
+		b.healthFactor = healthFactor(latency, b.checkFast, b.checkSlow)
 		b.fallCount = 0
 		b.riseCount++
 		b.checkOK++
 		if b.riseCount >= b.rise {
 			if !b.up {
 				log.Debugf("Marking backend %s Up", b.Name)
+				b.lastChange = time.Now()
 			}
 			b.up = true
 		}
+	} else if time.Now().Before(b.checkStart) {
+		log.Debugf("Ignoring failed check for %s/%s during check delay", b.Name, b.CheckAddr)
+		b.lastError = checkErr.Error()
 	} else {
 		log.Debugf("Check failed for %s/%s", b.Name, b.CheckAddr)
 		b.riseCount = 0
 		b.fallCount++
 		b.checkFail++
+		b.lastError = checkErr.Error()
 		if b.fallCount >= b.fall {
 			if b.up {
 				log.Debugf("Marking backend %s Down", b.Name)
+				b.lastChange = time.Now()
 			}
 			b.up = false
 		}
 	}
 }
 
+// Return the factor a backend's weight is scaled by for a health check which
+// took latency. This falls from 1 at fast to 0 at slow, and is always 1 when
+// slow isn't set.
+func healthFactor(latency, fast, slow time.Duration) float64 {
+	switch {
+	case slow <= 0 || latency <= fast:
+		return 1
+	case latency >= slow:
+		return 0
+	}
+	return 1 - float64(latency-fast)/float64(slow-fast)
+}
+
+// Set the health check times from the service. The health factor is reset if
+// scaling is turned off.
+func (b *Backend) setCheckTimes(fast, slow time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.checkFast, b.checkSlow = fast, slow
+	if slow <= 0 {
+		b.healthFactor = 1
+	}
+}
+
+// Return the backend's current health factor.
+func (b *Backend) health() float64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.healthFactor
+}
+
+// Number of round robin turns a healthy backend gets for each unit of weight
+// when its weight is scaled by the health factor. This leaves room to scale
+// down a backend with a weight of 1.
+const healthWeightScale = 10
+
+// The weight used for round robin balancing. When scaled is set, because a
+// backend being balanced is slow, the weight is scaled by the health factor,
+// but never below 1.
+func (b *Backend) balanceWeight(scaled bool) int {
+	b.Lock()
+	defer b.Unlock()
+
+	if !scaled || b.checkSlow <= 0 {
+		return b.Weight
+	}
+
+	weight := int(math.Round(float64(b.Weight*healthWeightScale) * b.healthFactor))
+	if weight < 1 {
+		weight = 1
+	}
+	return weight
+}
+
+// Maximum response read during a health check
+const maxCheckRead = 4096
+
+// Connect to the CheckAddr, and if configured, send checkSend and verify the
+// response contains checkExpect.
+func (b *Backend) checkConn() error {
+	d := &net.Dialer{Timeout: b.dialTimeout, Resolver: backendResolver}
+
+	// check through the CONNECT proxy when the backend is only reachable
+	// that way
+	var raw net.Conn
+	var err error
+	if b.connectProxy != "" {
+		raw, err = b.dialConnectProxy(d, "tcp", b.CheckAddr)
+	} else {
+		raw, err = d.Dial(b.familyNetwork("tcp"), b.CheckAddr)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		raw.Close()
+	}()
+	c := raw
+
+	timeout := b.dialTimeout
+	if timeout == 0 {
+		timeout = client.DefaultTimeout * time.Millisecond
+	}
+
+	// checking the TLS address also checks the certificate
+	if b.tlsConfig != nil && b.CheckAddr == b.Addr {
+		c, err = b.tlsHandshake(c, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.checkSend == "" && b.checkExpect == "" {
+		return nil
+	}
+
+	c.SetDeadline(time.Now().Add(timeout))
+
+	if b.checkSend != "" {
+		if _, err := io.WriteString(c, b.checkSend); err != nil {
+			return err
+		}
+	}
+
+	if b.checkExpect == "" {
+		return nil
+	}
+
+	resp := make([]byte, 0, maxCheckRead)
+	buff := make([]byte, maxCheckRead)
+	for len(resp) < maxCheckRead {
+		n, err := c.Read(buff[:maxCheckRead-len(resp)])
+		resp = append(resp, buff[:n]...)
+		if strings.Contains(string(resp), b.checkExpect) {
+			return nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	return fmt.Errorf("check response from %s didn't contain %q", b.CheckAddr, b.checkExpect)
+}
+
 // Periodically check the status of this backend
 func (b *Backend) healthCheck() {
 	t := time.NewTicker(b.checkInterval)
@@ -205,17 +1077,175 @@ func (b *Backend) healthCheck() {
 			t.Stop()
 			return
 		case <-t.C:
+			if !b.acquireCheck() {
+				log.Debug("Stopping backend", b.Name)
+				t.Stop()
+				return
+			}
 			b.check()
+			b.releaseCheck()
+		}
+	}
+}
+
+// Limits the number of health checks in progress across all backends, so
+// checks falling on the same interval boundary don't all dial at once. This is
+// nil when there's no limit.
+var checkSlots chan struct{}
+
+// Wait for a health check slot, returning false if the backend is stopped
+// first.
+func (b *Backend) acquireCheck() bool {
+	if b.checkSlots == nil {
+		return true
+	}
+
+	select {
+	case b.checkSlots <- struct{}{}:
+		return true
+	case <-b.stopCheck:
+		return false
+	}
+}
+
+func (b *Backend) releaseCheck() {
+	if b.checkSlots != nil {
+		<-b.checkSlots
+	}
+}
+
+// Lookup the backend's hostname, and replace the set of endpoints we balance
+// over. If the lookup fails, we keep the last good set of addresses.
+func (b *Backend) resolve() {
+	host, port, err := net.SplitHostPort(b.Addr)
+	if err != nil {
+		log.Errorf("ERROR: %s", err.Error())
+		return
+	}
+
+	addrs, err := backendResolver.LookupHost(context.Background(), host)
+	if err != nil || len(addrs) == 0 {
+		log.Warnf("WARN: could not resolve backend %s: %v", b.Name, err)
+		return
+	}
+
+	network := b.familyNetwork("tcp")
+	if addrs = filterFamily(addrs, network); len(addrs) == 0 {
+		log.Warnf("WARN: backend %s has no addresses for %s", b.Name, network)
+		return
+	}
+
+	// keep these sorted so we can easily compare them
+	sort.Strings(addrs)
+	endpoints := make([]string, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i] = net.JoinHostPort(addr, port)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if strings.Join(endpoints, ",") != strings.Join(b.endpoints, ",") {
+		log.Printf("Backend %s resolved to %s", b.Name, strings.Join(endpoints, ", "))
+	}
+	b.endpoints = endpoints
+}
+
+// Return the addresses in the family of a tcp4 or tcp6 network, or all of
+// them for tcp.
+func filterFamily(addrs []string, network string) []string {
+	if network != "tcp4" && network != "tcp6" {
+		return addrs
+	}
+
+	var filtered []string
+	for _, addr := range addrs {
+		host, _ := splitZone(addr)
+		ip := net.ParseIP(host)
+		if ip == nil || (ip.To4() != nil) == (network == "tcp4") {
+			filtered = append(filtered, addr)
 		}
 	}
+	return filtered
 }
 
-// use to identify embedded TCPConns
-type closeReader interface {
+// Periodically resolve the backend's hostname
+func (b *Backend) resolveLoop() {
+	b.resolve()
+
+	t := time.NewTicker(b.resolveInterval)
+	for {
+		select {
+		case <-b.stopCheck:
+			t.Stop()
+			return
+		case <-t.C:
+			b.resolve()
+		}
+	}
+}
+
+// Return the address to dial for the next connection, cycling through the
+// resolved endpoints if we have them.
+func (b *Backend) dialAddr() string {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.endpoints) == 0 {
+		return b.Addr
+	}
+
+	b.lastEndpoint = (b.lastEndpoint + 1) % len(b.endpoints)
+	return b.endpoints[b.lastEndpoint]
+}
+
+// A connection which can close its read side independently, like a TCPConn.
+type halfCloser interface {
 	CloseRead() error
 }
 
-func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
+// A connection which can close its write side independently, like a TCPConn.
+type writeCloser interface {
+	CloseWrite() error
+}
+
+// Split the zone from an IPv6 link-local host, like "fe80::1%eth0".
+func splitZone(host string) (string, string) {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// Return true if host is an IP address, including a zoned IPv6 address.
+func isIPHost(host string) bool {
+	ip, _ := splitZone(host)
+	return net.ParseIP(ip) != nil
+}
+
+// Close the read side of the connection if it can be half-closed, otherwise
+// close the entire connection.
+func closeRead(c net.Conn) error {
+	if hc, ok := c.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return c.Close()
+}
+
+// Close the write side of the connection if it can be half-closed, otherwise
+// close the entire connection.
+func closeWrite(c net.Conn) error {
+	if wc, ok := c.(writeCloser); ok {
+		return wc.CloseWrite()
+	}
+	return c.Close()
+}
+
+// Proxy data between the client and backend connections, returning true if
+// the backend closed first. Both are closed as soon as either side closes,
+// unless halfOpen is set, when a close is passed on as a half-close and data
+// continues to flow in the other direction until it's closed too, or until an
+// error.
+func (b *Backend) proxy(srvConn, cliConn net.Conn, halfOpen bool) bool {
 	log.Debugf("Initiating proxy: %s/%s-%s/%s",
 		cliConn.RemoteAddr(),
 		cliConn.LocalAddr(),
@@ -227,7 +1257,7 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	// but all updates will be done atomically.
 
 	bConn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
+		Conn:      srvConn,
 		rwTimeout: b.rwTimeout,
 		read:      &b.Rcvd,
 		written:   &b.Sent,
@@ -235,101 +1265,290 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	// TODO: No way to force shutdown. Do we need it, or should we always just
 	// let a connection run out?
 
-	atomic.AddInt64(&b.Conns, 1)
+	b.countConn()
 	atomic.AddInt64(&b.Active, 1)
 	defer atomic.AddInt64(&b.Active, -1)
 
+	if halfOpen {
+		return proxyHalfOpen(bConn, cliConn, &b.Errors, &b.Resets)
+	}
+
 	// channels to wait on close event
 	backendClosed := make(chan bool, 1)
 	clientClosed := make(chan bool, 1)
 
-	go broker(bConn, cliConn, clientClosed, &b.Sent, &b.Errors)
-	go broker(cliConn, bConn, backendClosed, &b.Rcvd, &b.Errors)
+	go broker(bConn, cliConn, clientClosed, &b.Errors, &b.Resets)
+	go broker(cliConn, bConn, backendClosed, &b.Errors, &b.Resets)
 
 	// wait for one half of the proxy to exit, then trigger a shutdown of the
 	// other half by calling CloseRead(). This will break the read loop in the
 	// broker and fully close the connection.
 	var waitFor chan bool
+	backendFirst := false
 	select {
 	case <-clientClosed:
 		log.Debugf("Client %s/%s closed connection", cliConn.RemoteAddr(), cliConn.LocalAddr())
 		// the client closed first, so any more packets here are invalid, and
 		// we can SetLinger(0) to recycle the port faster.
-		bConn.TCPConn.SetLinger(0)
+		bConn.SetLinger(0)
 		bConn.CloseRead()
 		waitFor = backendClosed
 	case <-backendClosed:
+		backendFirst = true
 		log.Debugf("Server %s/%s closed connection", srvConn.RemoteAddr(), srvConn.LocalAddr())
-		cliConn.(closeReader).CloseRead()
+		// a TLS terminated client can't be half closed
+		closeRead(cliConn)
 		waitFor = clientClosed
 	}
 	// wait for the other connection to close
 	<-waitFor
+	return backendFirst
 }
 
 // This does the actual data transfer.
 // The broker only closes the Read side.
-func broker(dst, src net.Conn, srcClosed chan bool, written, errors *int64) {
-	_, err := io.Copy(dst, src)
+func broker(dst, src net.Conn, srcClosed chan bool, errors, resets *int64) {
+	// always signal that we're done, even if we panic
+	defer func() { srcClosed <- true }()
+	defer recoverConn("broker", src, errors)
+
+	_, err := copyConn(dst, src)
 	if err != nil {
-		atomic.AddInt64(errors, 1)
-		log.Printf("Copy error: %s", err)
+		countCopyError(err, errors, resets)
 	}
 	if err := src.Close(); err != nil {
 		atomic.AddInt64(errors, 1)
 		log.Printf("Close error: %s", err)
 	}
-	srcClosed <- true
+}
+
+// Copy in both directions until each is closed. An EOF from one side is
+// passed on by closing the write side of the other. If either direction
+// fails, both connections are closed to stop the other copy. Returns true if
+// the backend finished first.
+func proxyHalfOpen(srvConn, cliConn net.Conn, errors, resets *int64) bool {
+	clientDone := make(chan error, 1)
+	backendDone := make(chan error, 1)
+	backendFirst := false
+
+	go halfBroker(srvConn, cliConn, clientDone, errors, resets)
+	go halfBroker(cliConn, srvConn, backendDone, errors, resets)
+
+	for clientDone != nil || backendDone != nil {
+		var err error
+		select {
+		case err = <-clientDone:
+			log.Debugf("Client %s/%s closed write", cliConn.RemoteAddr(), cliConn.LocalAddr())
+			clientDone = nil
+		case err = <-backendDone:
+			log.Debugf("Server %s/%s closed write", srvConn.RemoteAddr(), srvConn.LocalAddr())
+			backendFirst = clientDone != nil
+			backendDone = nil
+		}
+
+		if err != nil {
+			srvConn.Close()
+			cliConn.Close()
+		}
+	}
+
+	srvConn.Close()
+	cliConn.Close()
+	return backendFirst
+}
+
+// Copy from src to dst, then half-close dst once src returns EOF. Any error
+// from the copy or the half-close is sent on done.
+func halfBroker(dst, src net.Conn, done chan error, errors, resets *int64) {
+	err := io.ErrUnexpectedEOF
+	// always signal that we're done, even if we panic
+	defer func() { done <- err }()
+	defer recoverConn("broker", src, errors)
+
+	if _, err = copyConn(dst, src); err != nil {
+		countCopyError(err, errors, resets)
+		return
+	}
+
+	if err = closeWrite(dst); err != nil {
+		atomic.AddInt64(errors, 1)
+		log.Printf("Close error: %s", err)
+	}
+}
+
+// Count an error copying between connections. A connection reset is counted
+// separately from other errors too, since it's an abrupt close rather than a
+// failure of the proxy.
+func countCopyError(err error, errors, resets *int64) {
+	atomic.AddInt64(errors, 1)
+	if isConnReset(err) {
+		atomic.AddInt64(resets, 1)
+		log.Printf("Connection reset: %s", err)
+		return
+	}
+	log.Printf("Copy error: %s", err)
+}
+
+// Return true if err is from a connection reset by the other end.
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// Recover from a panic in a goroutine handling a connection, so that a
+// single bad connection can't take down the whole process. The connection is
+// closed, and the panic is counted as an error.
+// This must be called directly via defer.
+func recoverConn(desc string, conn net.Conn, errors *int64) {
+	if !recoverPanics {
+		return
+	}
+
+	if r := recover(); r != nil {
+		atomic.AddInt64(errors, 1)
+		log.Errorf("ERROR: panic in %s %s/%s: %v\n%s", desc, conn.RemoteAddr(), conn.LocalAddr(), r, stack())
+		conn.Close()
+	}
 }
 
 // A net.Conn that sets a deadline for every read or write operation.
 // This will allow the server to close connections that are broken at the
 // network level.
 type shuttleConn struct {
-	*net.TCPConn
+	net.Conn
 	rwTimeout time.Duration
 
 	// count bytes read and written through this connection
 	written *int64
 	read    *int64
 
+	// count reads and writes that fail with a connection reset, if set
+	resets *int64
+
 	// decrement when closed
 	connected *int64
+	closed    int32
 }
 
 func (c *shuttleConn) Read(b []byte) (int, error) {
 	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetReadDeadline(time.Now().Add(c.rwTimeout))
+		err := c.Conn.SetReadDeadline(time.Now().Add(c.rwTimeout))
 		if err != nil {
 			return 0, err
 		}
 	}
-	n, err := c.TCPConn.Read(b)
+	n, err := c.Conn.Read(b)
 	atomic.AddInt64(c.read, int64(n))
+	c.countReset(err)
 	return n, err
 }
 
 func (c *shuttleConn) Write(b []byte) (int, error) {
 	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetWriteDeadline(time.Now().Add(c.rwTimeout))
+		err := c.Conn.SetWriteDeadline(time.Now().Add(c.rwTimeout))
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	n, err := c.TCPConn.Write(b)
+	n, err := c.Conn.Write(b)
 	atomic.AddInt64(c.written, int64(n))
+	c.countReset(err)
 	return n, err
 }
 
+func (c *shuttleConn) countReset(err error) {
+	if c.resets != nil && err != nil && isConnReset(err) {
+		atomic.AddInt64(c.resets, 1)
+	}
+}
+
+// Close the connection. The connected count is only decremented on the
+// first Close, since the http.Transport and the brokers may both close it.
 func (c *shuttleConn) Close() error {
-	if c.connected != nil {
+	if c.connected != nil && atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
 		atomic.AddInt64(c.connected, -1)
 	}
-	return c.TCPConn.Close()
+	return c.Conn.Close()
+}
+
+// Close the read side of the connection. If the underlying connection can't
+// be half-closed, the entire connection is closed.
+func (c *shuttleConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+// Close the write side of the connection. If the underlying connection can't
+// be half-closed, the entire connection is closed.
+func (c *shuttleConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// The deadlines for rwTimeout are set on every read and write, so a
+// connection with a timeout can't be spliced.
+func (c *shuttleConn) tcpConn() *net.TCPConn {
+	if c.rwTimeout > 0 {
+		return nil
+	}
+	return spliceConn(c.Conn)
+}
+
+func (c *shuttleConn) countRead(n int64) {
+	atomic.AddInt64(c.read, n)
+	if s, ok := c.Conn.(splicer); ok {
+		s.countRead(n)
+	}
+}
+
+func (c *shuttleConn) countWritten(n int64) {
+	atomic.AddInt64(c.written, n)
+	if s, ok := c.Conn.(splicer); ok {
+		s.countWritten(n)
+	}
 }
 
-// Empty function to override the ReadFrom in *net.TCPConn
-// io.Copy will attempt to use ReadFrom when it can, but there's no bennefit
-// for a TCPConn->TCPConn, and it prevents us from collecting Read/Write stats.
-func (c *shuttleConn) ReadFrom() {}
+// Set TCP_NODELAY on the connection, if it's a TCPConn or a wrapper of one.
+// TLS connections are left unchanged.
+func setNoDelay(c net.Conn, noDelay bool) error {
+	switch conn := c.(type) {
+	case *net.TCPConn:
+		return conn.SetNoDelay(noDelay)
+	case *shuttleConn:
+		return setNoDelay(conn.Conn, noDelay)
+	case *bufferedConn:
+		return setNoDelay(conn.Conn, noDelay)
+	case *countingConn:
+		return setNoDelay(conn.Conn, noDelay)
+	}
+	return nil
+}
+
+// Set the socket buffer sizes on the underlying TCPConn. A size of 0 leaves
+// that buffer at the OS default.
+func setBufferSizes(c net.Conn, send, recv int) error {
+	switch conn := c.(type) {
+	case *net.TCPConn:
+		if send > 0 {
+			if err := conn.SetWriteBuffer(send); err != nil {
+				return err
+			}
+		}
+		if recv > 0 {
+			return conn.SetReadBuffer(recv)
+		}
+	case *shuttleConn:
+		return setBufferSizes(conn.Conn, send, recv)
+	case *bufferedConn:
+		return setBufferSizes(conn.Conn, send, recv)
+	case *countingConn:
+		return setBufferSizes(conn.Conn, send, recv)
+	}
+	return nil
+}
+
+// Set SO_LINGER on the underlying connection if it's a TCPConn.
+func (c *shuttleConn) SetLinger(sec int) error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.SetLinger(sec)
+	}
+	return nil
+}
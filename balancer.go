@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"sort"
+	"strings"
 	"sync/atomic"
+
+	"github.com/litl/shuttle/log"
 )
 
 // Balancing functions return a slice of all known available backends, in
@@ -12,17 +17,28 @@ import (
 // RR is always weighted.
 // we don't reduce the weight, we just distribute exactly "Weight" calls in
 // a row
-func (s *Service) roundRobin() []*Backend {
+func (s *Service) roundRobin() (balanced []*Backend) {
+	// log the decision once the service is unlocked
+	var decision *balanceLog
+	defer func() { decision.print(balanced) }()
+
 	s.Lock()
 	defer s.Unlock()
 
-	count := len(s.Backends)
+	backends, failover := s.balanceGroups()
+	if s.LogBalance {
+		decision = newBalanceLog(s.Name, "RR", backends)
+	}
+
+	count := len(backends)
 	switch count {
 	case 0:
+		decision.reason("no backends")
 		return nil
 	case 1:
 		// fast track for the single backend case
-		return s.Backends[0:1]
+		decision.reason("only backend")
+		return append(backends[0:1:1], failover...)
 	}
 
 	// we may be out of range if we lost a backend since last connections
@@ -34,13 +50,14 @@ func (s *Service) roundRobin() []*Backend {
 	// if our backend was over-weight, but we can't find another, use this
 	var reuse *Backend
 
-	var balanced []*Backend
+	scaled := healthScaled(backends)
+
 	// Find the next Up backend to call
 	for i := 0; i < count; i++ {
-		backend := s.Backends[s.lastBackend]
+		backend := backends[s.lastBackend]
 
 		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
+			if s.lastCount >= backend.balanceWeight(scaled) {
 				// used too many times, but save it just in case
 				reuse = backend
 				s.lastBackend = (s.lastBackend + 1) % count
@@ -58,11 +75,14 @@ func (s *Service) roundRobin() []*Backend {
 	}
 
 	if len(balanced) == 0 {
-		if reuse != nil {
-			balanced = append(balanced, reuse)
-		} else {
+		if reuse == nil {
+			decision.reason("no backend up")
 			return nil
 		}
+		balanced = append(balanced, reuse)
+		decision.reason("every up backend has had its turns, reusing the last")
+	} else {
+		decision.reason("index %d, turn %d of %d", s.lastBackend, s.lastCount, balanced[0].balanceWeight(scaled))
 	}
 
 	// Now add the rest of the available backends in order, in case the first
@@ -70,46 +90,70 @@ func (s *Service) roundRobin() []*Backend {
 	lastBackend := s.lastBackend
 	for i := 0; i < count-1; i++ {
 		lastBackend = (lastBackend + 1) % count
-		backend := s.Backends[lastBackend]
+		backend := backends[lastBackend]
 		if backend.Up() {
 			balanced = append(balanced, backend)
 		}
 	}
 
-	return balanced
+	// and then those of the groups to fail over to
+	return append(balanced, failover...)
 }
 
 // LC returns the backend with the least number of active connections
-func (s *Service) leastConn() []*Backend {
+func (s *Service) leastConn() (balanced []*Backend) {
+	// log the decision once the service is unlocked
+	var decision *balanceLog
+	defer func() { decision.print(balanced) }()
+
 	s.Lock()
 	defer s.Unlock()
 
-	count := len(s.Backends)
+	backends, failover := s.balanceGroups()
+	if s.LogBalance {
+		decision = newBalanceLog(s.Name, "LC", backends)
+	}
+
+	count := len(backends)
 	switch count {
 	case 0:
+		decision.reason("no backends")
 		return nil
 	case 1:
 		// fast track for the single backend case
-		return s.Backends[0:1]
+		decision.reason("only backend")
+		return append(backends[0:1:1], failover...)
 	}
 
-	// return the backends in the order of least connections
-	var balanced []*Backend
-
 	// Accumulate all backends that are currently Up
-	for _, b := range s.Backends {
+	for _, b := range backends {
 		if b.Up() {
 			balanced = append(balanced, b)
 		}
 	}
 
 	if len(balanced) == 0 {
+		decision.reason("no backend up")
 		return nil
 	}
 
-	sort.Sort(ByActive(balanced))
+	// return the backends in the order of least connections, counting those
+	// of slow backends as more by their health factor
+	if healthScaled(balanced) {
+		sort.Stable(newByLoad(balanced))
+	} else {
+		sort.Sort(ByActive(balanced))
+	}
+
+	if decision != nil {
+		active := make([]string, len(balanced))
+		for i, b := range balanced {
+			active[i] = fmt.Sprintf("%s=%d", b.Name, atomic.LoadInt64(&b.Active))
+		}
+		decision.reason("fewest active connections, %s", strings.Join(active, " "))
+	}
 
-	return balanced
+	return append(balanced, failover...)
 }
 
 // Simple, but still weighted, RR for UDP where we don't don't have active
@@ -118,13 +162,14 @@ func (s *Service) udpRoundRobin() *Backend {
 	s.Lock()
 	defer s.Unlock()
 
-	count := len(s.Backends)
+	backends, _ := s.balanceGroups()
+	count := len(backends)
 	switch count {
 	case 0:
 		return nil
 	case 1:
 		// fast track for the single backend case
-		return s.Backends[0]
+		return backends[0]
 	}
 
 	// we may be out of range if we lost a backend since last connections
@@ -136,12 +181,14 @@ func (s *Service) udpRoundRobin() *Backend {
 	// if our backend was over-weight, but we can't find another, use this
 	var backend, reuse *Backend
 
+	scaled := healthScaled(backends)
+
 	// Find the next Up backend to call
 	for i := 0; i < count; i++ {
-		backend = s.Backends[s.lastBackend]
+		backend = backends[s.lastBackend]
 
 		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
+			if s.lastCount >= backend.balanceWeight(scaled) {
 				// used too many times, but save it just in case
 				reuse = backend
 				s.lastBackend = (s.lastBackend + 1) % count
@@ -167,6 +214,175 @@ func (s *Service) udpRoundRobin() *Backend {
 	return nil
 }
 
+// A group of backends, balanced separately from the other groups.
+type backendGroup struct {
+	name     string
+	backends []*Backend
+}
+
+// Split the backends into their groups, in the GroupOrder followed by the
+// unlisted groups sorted by name. Service must be locked.
+func (s *Service) backendGroups() []backendGroup {
+	grouped := false
+	for _, b := range s.Backends {
+		if b.group != "" {
+			grouped = true
+			break
+		}
+	}
+	if !grouped {
+		return []backendGroup{{backends: s.Backends}}
+	}
+
+	members := make(map[string][]*Backend)
+	var unlisted []string
+	for _, b := range s.Backends {
+		if _, ok := members[b.group]; !ok {
+			unlisted = append(unlisted, b.group)
+		}
+		members[b.group] = append(members[b.group], b)
+	}
+	sort.Strings(unlisted)
+
+	var groups []backendGroup
+	listed := make(map[string]bool)
+	for _, name := range s.GroupOrder {
+		listed[name] = true
+		if backends, ok := members[name]; ok {
+			groups = append(groups, backendGroup{name: name, backends: backends})
+		}
+	}
+	for _, name := range unlisted {
+		if !listed[name] {
+			groups = append(groups, backendGroup{name: name, backends: members[name]})
+		}
+	}
+	return groups
+}
+
+// Return the index of the first group with an Up backend, or -1 if none are
+// Up.
+func activeGroup(groups []backendGroup) int {
+	for i, g := range groups {
+		for _, b := range g.backends {
+			if b.Up() {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Return the backends to balance across, which are those of the first group
+// with an Up backend, along with the Up backends of the groups after it, to
+// fail over to if connecting fails. Without groups, all the backends are
+// balanced. Service must be locked.
+func (s *Service) balanceGroups() (backends, failover []*Backend) {
+	groups := s.backendGroups()
+	if len(groups) == 1 {
+		return groups[0].backends, nil
+	}
+
+	active := activeGroup(groups)
+	if active < 0 {
+		return nil, nil
+	}
+
+	for _, g := range groups[active+1:] {
+		for _, b := range g.backends {
+			if b.Up() {
+				failover = append(failover, b)
+			}
+		}
+	}
+	return groups[active].backends, failover
+}
+
+// A balancing decision, for services with LogBalance set. The details are
+// recorded while the service is locked, and printed once it's unlocked. The
+// methods do nothing on a nil balanceLog, so a balancer can call them without
+// checking whether logging is enabled.
+type balanceLog struct {
+	service string
+	balance string
+	group   string
+	why     string
+}
+
+func newBalanceLog(service, balance string, backends []*Backend) *balanceLog {
+	l := &balanceLog{service: service, balance: balance}
+	if len(backends) > 0 {
+		l.group = backends[0].group
+	}
+	return l
+}
+
+// Record why the first backend was chosen.
+func (l *balanceLog) reason(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.why = fmt.Sprintf(format, args...)
+}
+
+func (l *balanceLog) print(balanced []*Backend) {
+	if l == nil {
+		return
+	}
+
+	chosen := "no backend"
+	if len(balanced) > 0 {
+		chosen = balanced[0].Name
+	}
+
+	group := ""
+	if l.group != "" {
+		group = fmt.Sprintf(" in group %s", l.group)
+	}
+
+	log.Printf("Balancing %s %s: chose %s%s, %s", l.service, l.balance, chosen, group, l.why)
+}
+
+// Report whether any of the backends is slow enough to have its share of
+// connections scaled down. Weights are only scaled then, so that the turns
+// of healthy backends are left as configured.
+func healthScaled(backends []*Backend) bool {
+	for _, b := range backends {
+		if b.health() < 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts backends by their load, the active connections including a new one
+// divided by the health factor, so a slow backend is only chosen over a
+// healthy backend with proportionally more connections.
+type byLoad struct {
+	backends []*Backend
+	loads    []float64
+}
+
+func newByLoad(backends []*Backend) byLoad {
+	loads := make([]float64, len(backends))
+	for i, b := range backends {
+		active := float64(atomic.LoadInt64(&b.Active) + 1)
+		if factor := b.health(); factor > 0 {
+			loads[i] = active / factor
+		} else {
+			loads[i] = math.Inf(1)
+		}
+	}
+	return byLoad{backends: backends, loads: loads}
+}
+
+func (s byLoad) Len() int           { return len(s.backends) }
+func (s byLoad) Less(i, j int) bool { return s.loads[i] < s.loads[j] }
+func (s byLoad) Swap(i, j int) {
+	s.backends[i], s.backends[j] = s.backends[j], s.backends[i]
+	s.loads[i], s.loads[j] = s.loads[j], s.loads[i]
+}
+
 type ByActive []*Backend
 
 func (s ByActive) Len() int      { return len(s) }
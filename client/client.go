@@ -7,20 +7,88 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+// ErrNotFound is returned when the requested service or backend doesn't exist
+// on the shuttle server.
+var ErrNotFound = errors.New("not found")
+
 // Client is an http client for communicating with the shuttle server api
 type Client struct {
 	httpClient *http.Client
 	addr       string
+
+	retries       int
+	retryInterval time.Duration
+}
+
+// ClientOptions configures a Client created with NewClientWithOptions.
+type ClientOptions struct {
+	// Timeout for each request. The default is 2s.
+	Timeout time.Duration
+
+	// Retries is the number of times an idempotent request (GET, PUT or
+	// DELETE) is retried after a connection error or a 5xx response. Other
+	// requests, and 4xx responses, are never retried.
+	Retries int
+
+	// RetryInterval is the delay before the first retry, which doubles after
+	// each attempt. The default is 100ms.
+	RetryInterval time.Duration
 }
 
 // An http client for communicating with the shuttle server.
 func NewClient(addr string) *Client {
+	return NewClientWithOptions(addr, ClientOptions{})
+}
+
+// An http client for communicating with the shuttle server, configured by
+// opts.
+func NewClientWithOptions(addr string, opts ClientOptions) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 100 * time.Millisecond
+	}
+
 	return &Client{
-		httpClient: &http.Client{Timeout: 2 * time.Second},
-		addr:       addr,
+		httpClient:    &http.Client{Timeout: opts.Timeout},
+		addr:          addr,
+		retries:       opts.Retries,
+		retryInterval: opts.RetryInterval,
+	}
+}
+
+// Send the request, retrying idempotent requests which fail with a
+// connection error or 5xx status. The last response or error is returned.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	retries := 0
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		retries = c.retries
+	}
+
+	interval := c.retryInterval
+	for i := 0; ; i++ {
+		resp, err := c.httpClient.Do(req)
+		if i >= retries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
 	}
 }
 
@@ -32,7 +100,7 @@ func (c *Client) GetConfig() (*Config, error) {
 		return nil, err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +120,49 @@ func (c *Client) GetConfig() (*Config, error) {
 	return config, nil
 }
 
+// GetService retrieves the configuration of a single service from a running
+// shuttle server, returning ErrNotFound if it doesn't exist.
+func (c *Client) GetService(service string) (*ServiceConfig, error) {
+	svcCfg := &ServiceConfig{}
+	if err := c.getJSON(fmt.Sprintf("http://%s/%s/_config", c.addr, service), svcCfg); err != nil {
+		return nil, err
+	}
+	return svcCfg, nil
+}
+
+// GetBackend retrieves the configuration of a single backend from a running
+// shuttle server, returning ErrNotFound if it or its service doesn't exist.
+func (c *Client) GetBackend(service, backend string) (*BackendConfig, error) {
+	backendCfg := &BackendConfig{}
+	if err := c.getJSON(fmt.Sprintf("http://%s/%s/%s/_config", c.addr, service, backend), backendCfg); err != nil {
+		return nil, err
+	}
+	return backendCfg, nil
+}
+
+// GET the url and decode the json response into v.
+func (c *Client) getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("failed to get %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
 // UpdateConfig updates the running config on a shuttle server. This will
 // update globals settings and add services, but currently doesn't remove any
 // running service or backends.
@@ -62,19 +173,73 @@ func (c *Client) UpdateConfig(config *Config) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/_config", c.addr), "application/json",
-		bytes.NewBuffer(js))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/_config", c.addr), bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		if errs := readConfigErrors(resp); errs != nil {
+			return errs
+		}
 		return fmt.Errorf("failed to update shuttle config: %s", resp.Status)
 	}
 	return nil
 }
 
+// Return the ConfigErrors from a rejected config, or nil if the response
+// doesn't contain any.
+func readConfigErrors(resp *http.Response) error {
+	if resp.StatusCode != http.StatusBadRequest {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil
+	}
+
+	errResp := ConfigErrorResponse{}
+	if err := json.Unmarshal(body, &errResp); err != nil || len(errResp.Errors) == 0 {
+		return nil
+	}
+	return errResp.Errors
+}
+
+// PatchGlobalConfig updates only the global defaults on a running shuttle
+// server. Zero values in partial are ignored, and services are left unchanged.
+func (c *Client) PatchGlobalConfig(partial *Config) error {
+
+	js, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("http://%s/_config", c.addr), bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to patch shuttle config: %s", resp.Status)
+	}
+	return nil
+}
+
 // UpdateService adds or updates a service on a running shuttle server.
 func (c *Client) UpdateService(service *ServiceConfig) error {
 
@@ -83,14 +248,22 @@ func (c *Client) UpdateService(service *ServiceConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s", c.addr, service.Name), "application/json",
-		bytes.NewBuffer(js))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s", c.addr, service.Name), bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		if errs := readConfigErrors(resp); errs != nil {
+			return errs
+		}
 		return fmt.Errorf("failed to update shuttle service '%s': %s", service.Name, resp.Status)
 	}
 	return nil
@@ -103,7 +276,7 @@ func (c *Client) RemoveService(service string) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -115,6 +288,27 @@ func (c *Client) RemoveService(service string) error {
 	return nil
 }
 
+// RemoveServiceDrain removes a service from a running shuttle server, waiting
+// up to drain for its active connections to finish after its listeners close.
+func (c *Client) RemoveServiceDrain(service string, drain time.Duration) error {
+	url := fmt.Sprintf("http://%s/%s?drain=%d", c.addr, service, drain/time.Millisecond)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to remove shuttle service '%s': %s", service, resp.Status)
+	}
+	return nil
+}
+
 // UpdateBackend adds or updates a single backend on a running shuttle server.
 func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 
@@ -123,8 +317,13 @@ func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend.Name), "application/json",
-		bytes.NewBuffer(js))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend.Name), bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -143,7 +342,7 @@ func (c *Client) RemoveBackend(service, backend string) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -154,3 +353,148 @@ func (c *Client) RemoveBackend(service, backend string) error {
 	}
 	return nil
 }
+
+// ForceBackend marks a backend up or down on a running shuttle server,
+// overriding its health checks for the duration d. If d is 0, the state is
+// held until cleared with ClearForcedBackend.
+func (c *Client) ForceBackend(service, backend string, up bool, d time.Duration) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+
+	url := fmt.Sprintf("http://%s/%s/%s/%s", c.addr, service, backend, state)
+	if d > 0 {
+		url += fmt.Sprintf("?duration=%d", d/time.Millisecond)
+	}
+
+	resp, err := c.httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to force shuttle backend '%s/%s' %s: %s", service, backend, state, resp.Status)
+	}
+	return nil
+}
+
+// SetBackendWeight updates only the weight of an existing backend on a running
+// shuttle server, without replacing the backend.
+func (c *Client) SetBackendWeight(service, backend string, weight int) error {
+	url := fmt.Sprintf("http://%s/%s/%s/weight?weight=%d", c.addr, service, backend, weight)
+	resp, err := c.httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set shuttle backend '%s/%s' weight: %s", service, backend, resp.Status)
+	}
+	return nil
+}
+
+// DrainBackend stops new connections to a backend on a running shuttle
+// server, or returns it to service when drain is false.
+func (c *Client) DrainBackend(service, backend string, drain bool) error {
+	url := fmt.Sprintf("http://%s/%s/%s/drain?enabled=%t", c.addr, service, backend, drain)
+	resp, err := c.httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to drain shuttle backend '%s/%s': %s", service, backend, resp.Status)
+	}
+	return nil
+}
+
+// RestartService re-binds the listeners of a service on a running shuttle
+// server, waiting up to drain for its active connections first.
+func (c *Client) RestartService(service string, drain time.Duration) error {
+	url := fmt.Sprintf("http://%s/%s/_restart?drain=%d", c.addr, service, drain/time.Millisecond)
+	resp, err := c.httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to restart shuttle service '%s': %s", service, resp.Status)
+	}
+	return nil
+}
+
+// SetMaintenance turns global maintenance mode on or off on a running shuttle
+// server. If tcp is set, new TCP connections are closed while it's enabled.
+func (c *Client) SetMaintenance(enabled, tcp bool) error {
+	url := fmt.Sprintf("http://%s/_maintenance?enabled=%t&tcp=%t", c.addr, enabled, tcp)
+	resp, err := c.httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set shuttle maintenance mode: %s", resp.Status)
+	}
+	return nil
+}
+
+// ClearForcedBackend returns a backend to health check control on a running
+// shuttle server.
+func (c *Client) ClearForcedBackend(service, backend string) error {
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s/clear", c.addr, service, backend), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to clear shuttle backend '%s/%s': %s", service, backend, resp.Status)
+	}
+	return nil
+}
+
+// ForceTaggedBackends marks every backend with all of the tags up or down on a
+// running shuttle server, across all services, as with ForceBackend.
+func (c *Client) ForceTaggedBackends(tags []string, up bool, d time.Duration) error {
+	state := "down"
+	if up {
+		state = "up"
+	}
+
+	params := url.Values{"tag": tags}
+	if d > 0 {
+		params.Set("duration", fmt.Sprintf("%d", d/time.Millisecond))
+	}
+
+	resp, err := c.httpClient.PostForm(fmt.Sprintf("http://%s/_backends/%s", c.addr, state), params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to force shuttle backends tagged %v %s: %s", tags, state, resp.Status)
+	}
+	return nil
+}
+
+// ClearForcedTaggedBackends returns every backend with all of the tags to
+// health check control on a running shuttle server.
+func (c *Client) ClearForcedTaggedBackends(tags []string) error {
+	resp, err := c.httpClient.PostForm(fmt.Sprintf("http://%s/_backends/clear", c.addr), url.Values{"tag": tags})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to clear shuttle backends tagged %v: %s", tags, resp.Status)
+	}
+	return nil
+}
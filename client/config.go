@@ -2,15 +2,32 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 const (
+	// ConfigVersion is the current version of the config format. Configs
+	// without a version were written before versioning was added, and are
+	// treated as version 0.
+	ConfigVersion = 1
+
 	// Balancing schemes
 	RoundRobin = "RR"
 	LeastConn  = "LC"
 
+	// Default time in milliseconds a recycled backend receives no new
+	// connections
+	DefaultRecycleCooldown = 30000
+
+	// Default delay in milliseconds before the first retry of a failed error
+	// page fetch
+	DefaultErrorPageRetryInterval = 1000
+
 	// Default timeout in milliseconds for clients and server connections
 	DefaultTimeout = 2000
 
@@ -23,14 +40,45 @@ const (
 	// All RoundRobin backends are weighted, with a default of 1
 	DefaultWeight = 1
 
-	// RoundRobin is the default balancing scheme
-	DefaultBalance = RoundRobin
+	// Default maximum length of an HTTP request URI
+	DefaultMaxURILength = 8192
+
+	// Default window in milliseconds over which the accept rate is measured
+	DefaultAcceptRateWindow = 1000
+
+	// Default time in milliseconds to wait for a client's first bytes when
+	// sniffing for HTTP
+	DefaultSniffTimeout = 1000
+
+	// Default window in milliseconds over which a backend's dial failure
+	// rate is measured
+	DefaultDialFailureWindow = 10000
+
+	// Default window in milliseconds over which a backend's HTTP error rate
+	// is measured, and time for which a backend is ejected
+	DefaultEjectWindow = 10000
+	DefaultEjectTime   = 30000
+
+	// Default name of the cookie pinning HTTP clients to a backend
+	DefaultStickyCookieName = "SHUTTLEID"
+
+	// Maximum number of backends a port range can expand into
+	MaxPortRange = 64
+
+	// Bounds for the socket buffer sizes, when they're set
+	MinSocketBufferBytes = 4 << 10
+	MaxSocketBufferBytes = 64 << 20
 
 	// Default for Fall and Rise is 2
 	DefaultFall = 2
 	DefaultRise = 2
 )
 
+// DefaultBalance is the balancing scheme for services which don't set one,
+// when the global config doesn't set one either. This is RoundRobin unless
+// changed, e.g. by shuttle's -default-balance flag.
+var DefaultBalance = RoundRobin
+
 var (
 	// Status400s is a set of response codes to set an Error page for all 4xx responses.
 	Status400s = []int{400, 401, 402, 403, 404, 405, 406, 407, 408, 409, 410, 411, 412, 413, 414, 415, 416, 417, 418}
@@ -41,6 +89,9 @@ var (
 // Config is the global configuration for all Services.
 // Defaults set here can be overridden by individual services.
 type Config struct {
+	// Version is the version of the config format. See ConfigVersion.
+	Version int `json:"version,omitempty"`
+
 	// Balance method
 	// Valid values are "RR" for RoundRobin, the default, and "LC" for
 	// LeastConnected.
@@ -74,15 +125,52 @@ type Config struct {
 	// have an "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// MaxURILength is the maximum length of an HTTP request URI. Longer
+	// requests are rejected with a 414. The default is DefaultMaxURILength.
+	MaxURILength int `json:"max_uri_length,omitempty"`
+
+	// MaintenanceBody is returned by services in global maintenance mode
+	// which don't have a maintenance response of their own.
+	MaintenanceBody string `json:"maintenance_body,omitempty"`
+
+	// MaintenanceContentType is the Content-Type of the MaintenanceBody.
+	MaintenanceContentType string `json:"maintenance_content_type,omitempty"`
+
+	// TrustedProxies are networks of proxies trusted to report the real
+	// client address, for services which don't set their own. The address in
+	// X-Forwarded-For, or a PROXY protocol header, is only used when the
+	// connection comes directly from one of these.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// SendBufferBytes and RecvBufferBytes set the socket buffer sizes for
+	// services which don't set their own.
+	SendBufferBytes int `json:"send_buffer_bytes,omitempty"`
+	RecvBufferBytes int `json:"recv_buffer_bytes,omitempty"`
+
 	// Services is a slice of ServiceConfig for each service. A service
 	// corresponds to one listening connection, and a number of backends to
 	// proxy.
 	Services []ServiceConfig `json:"services"`
 }
 
+// Redact returns a copy of the config with all secrets replaced by Redacted.
+func (c Config) Redact() Config {
+	if c.Services != nil {
+		services := make([]ServiceConfig, len(c.Services))
+		for i, s := range c.Services {
+			services[i] = s.Redact()
+		}
+		c.Services = services
+	}
+	return c
+}
+
 // Marshal returns an entire config as a json []byte.
 func (c *Config) Marshal() []byte {
 	sort.Sort(serviceSlice(c.Services))
+	for _, svc := range c.Services {
+		sort.Sort(backendSlice(svc.Backends))
+	}
 	js, _ := json.Marshal(c)
 	return js
 }
@@ -92,26 +180,215 @@ func (c *Config) String() string {
 	return string(c.Marshal())
 }
 
+// Migrations from each older config version to the next. The function at
+// index i upgrades a version i config to version i+1.
+var configMigrations = []func(*Config){
+	// version 0 configs are unversioned, with no other changes in format
+	func(c *Config) {},
+}
+
+// Migrate upgrades a config from an older version to ConfigVersion. A config
+// from a newer version is an error, since any fields this version doesn't
+// know about would be silently dropped.
+func (c *Config) Migrate() error {
+	if c.Version < 0 || c.Version > ConfigVersion {
+		return fmt.Errorf("unsupported config version %d, the latest supported version is %d",
+			c.Version, ConfigVersion)
+	}
+
+	for c.Version < ConfigVersion {
+		configMigrations[c.Version](c)
+		c.Version++
+	}
+	return nil
+}
+
+// ConfigErrors maps service names to the reason the service's configuration
+// is invalid.
+type ConfigErrors map[string]string
+
+func (e ConfigErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// The json body returned by the server when a config is rejected.
+type ConfigErrorResponse struct {
+	Errors ConfigErrors `json:"errors"`
+}
+
+// Validate checks every service in the config, returning ConfigErrors with an
+// entry for each invalid service, or nil if the config is valid. Services
+// without a name are identified by their index.
+func (c Config) Validate() error {
+	errs := ConfigErrors{}
+	seen := make(map[string]bool)
+
+	if c.Version < 0 || c.Version > ConfigVersion {
+		errs["version"] = fmt.Sprintf("unsupported config version %d", c.Version)
+	}
+
+	if c.Balance != "" {
+		if err := ValidateBalance(c.Balance); err != nil {
+			errs["balance"] = err.Error()
+		}
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs["trusted_proxies"] = err.Error()
+			break
+		}
+	}
+
+	if err := validateBufferBytes("send_buffer_bytes", c.SendBufferBytes); err != nil {
+		errs["send_buffer_bytes"] = err.Error()
+	}
+	if err := validateBufferBytes("recv_buffer_bytes", c.RecvBufferBytes); err != nil {
+		errs["recv_buffer_bytes"] = err.Error()
+	}
+
+	for i, svc := range c.Services {
+		name := svc.Name
+		if name == "" {
+			errs[fmt.Sprintf("services[%d]", i)] = "missing service name"
+			continue
+		}
+
+		if seen[name] {
+			errs[name] = "duplicate service name"
+			continue
+		}
+		seen[name] = true
+
+		if err := svc.Validate(); err != nil {
+			errs[name] = err.Error()
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // BackendConfig defines the parameters unique for individual backends.
 type BackendConfig struct {
 	// Name must be unique for this service.
 	// Used for reference and for the HTTP API.
 	Name string `json:"name"`
 
-	// Addr must in the form ip:port
+	// Addr must in the form ip:port. The port may be a range, like
+	// "127.0.0.1:9001-9004", which is expanded into a backend for each port,
+	// named with the port appended to Name. A CheckAddr with the same range,
+	// or a range of the same size, is expanded along with it. A range can
+	// include up to MaxPortRange ports.
 	Addr string `json:"address"`
 
 	// Network must be "tcp" or "udp".
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
+	// DialNetwork pins the address family used to connect to a TCP backend
+	// and its CheckAddr, for dual-stack backends which perform better over
+	// one family. It may be "tcp4", "tcp6" or "tcp", which allows either.
+	// A hostname is only resolved to addresses of the pinned family, and an
+	// IP address must match it. Default is "tcp"
+	DialNetwork string `json:"dial_network,omitempty"`
+
 	// CheckAddr must be in the form ip:port.
 	// A TCP connect is performed against this address to determine server
 	// availability. If this is empty, no checks will be performed.
 	CheckAddr string `json:"check_address"`
 
+	// CheckSend is sent to the CheckAddr during a health check, and the
+	// check only passes if the response contains CheckExpect. If CheckExpect
+	// is empty, the response isn't read. The response is read until
+	// CheckExpect is found, up to 4KB or the service's DialTimeout.
+	CheckSend   string `json:"check_send,omitempty"`
+	CheckExpect string `json:"check_expect,omitempty"`
+
 	// Weight is always used for RoundRobin balancing. Default is 1
 	Weight int `json:"weight"`
+
+	// CheckDelay is the time in milliseconds after the backend is added
+	// during which failed health checks are ignored, giving the backend time
+	// to start.
+	CheckDelay int `json:"check_delay,omitempty"`
+
+	// ResolveInterval is the time in milliseconds between DNS lookups when
+	// Addr contains a hostname. Connections are balanced across all resolved
+	// addresses. If this is 0, the hostname is resolved on every connection.
+	ResolveInterval int `json:"resolve_interval,omitempty"`
+
+	// DSCP is the Differentiated Services Code Point, 0-63, used to mark
+	// connections to this backend. If this is 0, connections aren't marked.
+	DSCP int `json:"dscp,omitempty"`
+
+	// MaxDials limits the number of connection attempts in progress to this
+	// backend. Further attempts wait for up to the service's DialTimeout.
+	// If this is 0, dials are not limited.
+	MaxDials int `json:"max_dials,omitempty"`
+
+	// MaxConns limits the number of concurrent TCP connections proxied to
+	// this backend. New connections go to another backend, or wait in the
+	// service's queue. If this is 0, connections are not limited.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// MaxConnsServed is the number of connections after which the backend is
+	// recycled. New connections aren't sent to a recycling backend for
+	// RecycleCooldown, while existing connections drain. If this is 0, the
+	// backend is never recycled.
+	MaxConnsServed int `json:"max_conns_served,omitempty"`
+
+	// RecycleCooldown is the time in milliseconds a backend is recycled for.
+	// Default is DefaultRecycleCooldown.
+	RecycleCooldown int `json:"recycle_cooldown,omitempty"`
+
+	// ConnectProxy is the address of an HTTP proxy, in the form ip:port, used
+	// to tunnel connections to the backend with a CONNECT request.
+	ConnectProxy string `json:"connect_proxy,omitempty"`
+
+	// ConnectProxyAuth is sent as the Proxy-Authorization header in the
+	// CONNECT request. It's replaced by Redacted in configs returned by the
+	// admin API.
+	ConnectProxyAuth string `json:"connect_proxy_auth,omitempty"`
+
+	// TLS enables TLS for connections to the backend. The backend's
+	// certificate is verified against TLSServerName, or the host in Addr if
+	// that isn't set.
+	TLS bool `json:"tls,omitempty"`
+
+	// TLSServerName is sent via SNI, and used to verify the backend's
+	// certificate.
+	TLSServerName string `json:"tls_server_name,omitempty"`
+
+	// TLSInsecureSkipVerify disables verification of the backend's
+	// certificate.
+	TLSInsecureSkipVerify bool `json:"tls_insecure_skip_verify,omitempty"`
+
+	// Tags label the backend for queries and bulk operations through the
+	// admin API, e.g. "az=us-east-1a" or "version=2".
+	Tags []string `json:"tags,omitempty"`
+
+	// Drain stops new connections to the backend, while existing connections
+	// finish. It's kept in the state config, so a drained backend stays
+	// drained when shuttle restarts.
+	Drain bool `json:"drain,omitempty"`
+
+	// Group places the backend in a group, such as a data center. Only the
+	// first group with an Up backend, in the service's GroupOrder, receives
+	// connections, which are balanced across that group's backends.
+	Group string `json:"group,omitempty"`
 }
 
 // return a copy of the BackendConfig with default values set
@@ -125,10 +402,219 @@ func (b BackendConfig) SetDefaults() BackendConfig {
 	return b
 }
 
+// Validate checks for settings that would prevent the backend from running.
+func (b BackendConfig) Validate() error {
+	if _, err := b.Expand(); err != nil {
+		return err
+	}
+	if err := validateZone(b.Addr); err != nil {
+		return fmt.Errorf("invalid address %s for backend %s: %s", b.Addr, b.Name, err)
+	}
+	if err := validateZone(b.CheckAddr); err != nil {
+		return fmt.Errorf("invalid check address %s for backend %s: %s", b.CheckAddr, b.Name, err)
+	}
+	if b.DSCP < 0 || b.DSCP > 63 {
+		return fmt.Errorf("invalid DSCP value %d for backend %s", b.DSCP, b.Name)
+	}
+	if b.MaxDials < 0 {
+		return fmt.Errorf("invalid max_dials %d for backend %s", b.MaxDials, b.Name)
+	}
+	if b.MaxConns < 0 {
+		return fmt.Errorf("invalid max_conns %d for backend %s", b.MaxConns, b.Name)
+	}
+	if b.MaxConnsServed < 0 {
+		return fmt.Errorf("invalid max_conns_served %d for backend %s", b.MaxConnsServed, b.Name)
+	}
+	switch b.DialNetwork {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("invalid dial_network %s for backend %s", b.DialNetwork, b.Name)
+	}
+	if b.DialNetwork != "" {
+		if b.Network != "" && !strings.HasPrefix(b.Network, "tcp") {
+			return fmt.Errorf("dial_network requires a tcp network for backend %s", b.Name)
+		}
+		if b.Network != "" && b.Network != "tcp" && b.DialNetwork != "tcp" && b.Network != b.DialNetwork {
+			return fmt.Errorf("dial_network %s conflicts with network %s for backend %s", b.DialNetwork, b.Network, b.Name)
+		}
+		if err := validateFamily(b.Addr, b.DialNetwork); err != nil {
+			return fmt.Errorf("invalid address %s for backend %s: %s", b.Addr, b.Name, err)
+		}
+		if err := validateFamily(b.CheckAddr, b.DialNetwork); err != nil {
+			return fmt.Errorf("invalid check address %s for backend %s: %s", b.CheckAddr, b.Name, err)
+		}
+	}
+	if b.TLS {
+		switch b.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("tls requires a tcp network for backend %s", b.Name)
+		}
+	} else if b.TLSServerName != "" || b.TLSInsecureSkipVerify {
+		return fmt.Errorf("tls options set without tls for backend %s", b.Name)
+	}
+	for _, tag := range b.Tags {
+		if tag == "" {
+			return fmt.Errorf("empty tag for backend %s", b.Name)
+		}
+	}
+	return nil
+}
+
+// Split an address with a port range, like "127.0.0.1:9001-9004". If addr
+// doesn't have a range, ok is false.
+func splitPortRange(addr string) (host string, first, last int, ok bool, err error) {
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil || !strings.Contains(port, "-") {
+		return "", 0, 0, false, nil
+	}
+
+	parts := strings.SplitN(port, "-", 2)
+	first, err1 := strconv.Atoi(parts[0])
+	last, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return "", 0, 0, true, fmt.Errorf("invalid port range %s", port)
+	}
+	if last-first+1 > MaxPortRange {
+		return "", 0, 0, true, fmt.Errorf("port range %s is larger than %d ports", port, MaxPortRange)
+	}
+	return host, first, last, true, nil
+}
+
+// Expand returns a BackendConfig for each port in the range of Addr, or just
+// this BackendConfig if Addr doesn't have a range.
+func (b BackendConfig) Expand() ([]BackendConfig, error) {
+	host, first, last, ok, err := splitPortRange(b.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s for backend %s: %s", b.Addr, b.Name, err)
+	}
+	if !ok {
+		if _, _, _, ok, _ := splitPortRange(b.CheckAddr); ok {
+			return nil, fmt.Errorf("check address %s for backend %s has a port range without one in the address", b.CheckAddr, b.Name)
+		}
+		return []BackendConfig{b}, nil
+	}
+
+	checkHost, checkFirst, checkLast, checkRange, err := splitPortRange(b.CheckAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check address %s for backend %s: %s", b.CheckAddr, b.Name, err)
+	}
+	if checkRange && checkLast-checkFirst != last-first {
+		return nil, fmt.Errorf("check address %s for backend %s doesn't match the size of the address range", b.CheckAddr, b.Name)
+	}
+
+	backends := make([]BackendConfig, 0, last-first+1)
+	for i := 0; i <= last-first; i++ {
+		port := strconv.Itoa(first + i)
+
+		backend := b
+		backend.Addr = net.JoinHostPort(host, port)
+		if b.Name == "" {
+			backend.Name = backend.Addr
+		} else {
+			backend.Name = b.Name + "_" + port
+		}
+		if checkRange {
+			backend.CheckAddr = net.JoinHostPort(checkHost, strconv.Itoa(checkFirst+i))
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// ExpandBackends expands any backends with a port range, see
+// BackendConfig.Expand.
+func ExpandBackends(backends []BackendConfig) ([]BackendConfig, error) {
+	var expanded []BackendConfig
+	for _, b := range backends {
+		bs, err := b.Expand()
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, bs...)
+	}
+	return expanded, nil
+}
+
+// A zone is only valid on an IPv6 address, e.g. "[fe80::1%eth0]:80". Any
+// other problem with the address is left to be reported when it's dialed.
+func validateZone(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+
+	i := strings.LastIndex(host, "%")
+	if i < 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(host[:i])
+	if ip == nil || ip.To4() != nil {
+		return fmt.Errorf("zone on a non-IPv6 address")
+	}
+	if i == len(host)-1 {
+		return fmt.Errorf("empty zone")
+	}
+	return nil
+}
+
+// Check that an address with an IP host can be dialed on network, when the
+// network is tcp4 or tcp6. Hostnames are only resolved to the network's
+// family, so they always match.
+func validateFamily(addr, network string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	switch {
+	case network == "tcp4" && ip.To4() == nil:
+		return fmt.Errorf("IPv6 address with dial_network tcp4")
+	case network == "tcp6" && ip.To4() != nil:
+		return fmt.Errorf("IPv4 address with dial_network tcp6")
+	}
+	return nil
+}
+
 func (b BackendConfig) Equal(other BackendConfig) bool {
 	b = b.SetDefaults()
 	other = other.SetDefaults()
-	return b == other
+
+	// nil and empty tags are equal
+	if len(b.Tags) == 0 && len(other.Tags) == 0 {
+		b.Tags, other.Tags = nil, nil
+	}
+	return reflect.DeepEqual(b, other)
+}
+
+// Redacted replaces secrets in configs returned by the admin API. A backend
+// updated with Redacted in place of a secret keeps its current value.
+const Redacted = "REDACTED"
+
+// Redact returns a copy of the backend config with its secrets replaced by
+// Redacted.
+func (b BackendConfig) Redact() BackendConfig {
+	if b.ConnectProxyAuth != "" {
+		b.ConnectProxyAuth = Redacted
+	}
+	return b
+}
+
+// Keep the current value of any secrets which were sent back Redacted.
+func (b BackendConfig) Unredact(current BackendConfig) BackendConfig {
+	if b.ConnectProxyAuth == Redacted {
+		b.ConnectProxyAuth = current.ConnectProxyAuth
+	}
+	return b
 }
 
 func (b *BackendConfig) Marshal() []byte {
@@ -153,6 +639,27 @@ func (p serviceSlice) Len() int           { return len(p) }
 func (p serviceSlice) Less(i, j int) bool { return p[i].Name < p[j].Name }
 func (p serviceSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// ErrorPageConfig defines an error page scoped to a subset of requests.
+type ErrorPageConfig struct {
+	// Location is the URL of the error page content.
+	Location string `json:"location"`
+
+	// Fallbacks are URLs tried in order when the page can't be fetched from
+	// Location.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// StatusCodes are the response codes for which this page is returned.
+	StatusCodes []int `json:"status_codes"`
+
+	// Methods limits this page to requests with these methods. If empty,
+	// all methods match.
+	Methods []string `json:"methods,omitempty"`
+
+	// PathPrefix limits this page to requests with paths beginning with this
+	// prefix.
+	PathPrefix string `json:"path_prefix,omitempty"`
+}
+
 // Subset of service fields needed for configuration.
 type ServiceConfig struct {
 	// Name is the unique name of the service. This is used only for reference
@@ -160,13 +667,24 @@ type ServiceConfig struct {
 	Name string `json:"name"`
 
 	// Addr is the listening address for this service. Must be in the form
-	// "ip:addr"
+	// "ip:addr". Multiple addresses can be separated by commas, in which case
+	// the service listens on all of them, proxying to the same backends.
 	Addr string `json:"address"`
 
 	// Network must be "tcp" or "udp".
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
+	// TLSAddr is an optional secondary listening address for a tcp service,
+	// in the form "ip:port". Connections are TLS terminated using TLSCert and
+	// TLSKey, and proxied to the same backends.
+	TLSAddr string `json:"tls_address,omitempty"`
+
+	// TLSCert and TLSKey are paths to the PEM encoded certificate and key
+	// for the TLSAddr listener.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+
 	// Balance method
 	// Valid values are "RR" for RoundRobin, the default, and "LC" for
 	// LeastConnected.
@@ -182,6 +700,14 @@ type ServiceConfig struct {
 	// marked up.
 	Rise int `json:"rise"`
 
+	// CheckFast and CheckSlow are health check times in milliseconds. When
+	// CheckSlow is set, a backend whose checks take longer than CheckFast
+	// has its round robin weight scaled down, or its connections counted as
+	// more for least conn, until at CheckSlow it's balanced with the lowest
+	// weight, without being marked down.
+	CheckFast int `json:"check_fast,omitempty"`
+	CheckSlow int `json:"check_slow,omitempty"`
+
 	// ClientTimeout is the maximum inactivity time, in milliseconds, for a
 	// connection to the client before it is closed.
 	ClientTimeout int `json:"client_timeout"`
@@ -194,11 +720,62 @@ type ServiceConfig struct {
 	// backend service, including name resolution.
 	DialTimeout int `json:"connect_timeout"`
 
+	// ResponseHeaderTimeout is the maximum time, in milliseconds, to wait for
+	// the response headers from a backend for an HTTP request. A 504 is
+	// returned to the client when this is exceeded.
+	ResponseHeaderTimeout int `json:"response_header_timeout,omitempty"`
+
+	// ResponseTimeout is the maximum time, in milliseconds, for an entire
+	// HTTP response from a backend, including the body. If the headers
+	// haven't been received a 504 is returned, otherwise the response is
+	// cut short.
+	ResponseTimeout int `json:"response_timeout,omitempty"`
+
 	// HTTPSRedirect when set to true, redirects non-https request to https. The
 	// request may either have Scheme set to 'https',  or have an
 	// "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// HTTPSRedirectCode is the status code for HTTPS redirects. The default is
+	// 301. Use 307 or 308 to have clients keep the method and body, e.g. for
+	// a POST.
+	HTTPSRedirectCode int `json:"https_redirect_code,omitempty"`
+
+	// RejectHTTP when set to true, responds to non-https requests with a 403
+	// Forbidden, rather than proxying or redirecting them, for clients which
+	// wouldn't follow a redirect. It takes precedence over HTTPSRedirect.
+	RejectHTTP bool `json:"reject_http,omitempty"`
+
+	// MaxURILength overrides the global maximum length of an HTTP request URI
+	// for this service.
+	MaxURILength int `json:"max_uri_length,omitempty"`
+
+	// MaxRequestBodyBytes is the largest HTTP request body accepted. A
+	// request with a larger Content-Length is rejected with a 413 before it's
+	// sent to a backend, and a chunked request is cut off with a 413 once it
+	// exceeds the limit. If this is 0, the body size is not limited.
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes,omitempty"`
+
+	// StickyCookie pins HTTP clients to a backend with a cookie identifying
+	// the backend, which is set on the first response. Requests carrying the
+	// cookie go to that backend while it's up, and are balanced as usual if
+	// it's down or has been removed. The cookie is named StickyCookieName,
+	// with a default of DefaultStickyCookieName, and expires after
+	// StickyCookieTTL seconds, or at the end of the browser session if the
+	// TTL is 0.
+	StickyCookie     bool   `json:"sticky_cookie,omitempty"`
+	StickyCookieName string `json:"sticky_cookie_name,omitempty"`
+	StickyCookieTTL  int    `json:"sticky_cookie_ttl,omitempty"`
+
+	// MirrorAddr is the address, in the form ip:port, of an HTTP backend
+	// which receives a copy of a sample of the service's HTTP requests, such
+	// as a new version under test. MirrorSample is the fraction of requests
+	// copied, from 0 to 1. The mirror's responses are discarded, and its
+	// failures don't affect the client's response. Requests with bodies
+	// over 64KB, or of unknown length, aren't copied.
+	MirrorAddr   string  `json:"mirror_address,omitempty"`
+	MirrorSample float64 `json:"mirror_sample,omitempty"`
+
 	// Virtualhosts is a set of virtual hostnames for which this service should
 	// handle HTTP requests.
 	VirtualHosts []string `json:"virtual_hosts,omitempty"`
@@ -206,15 +783,200 @@ type ServiceConfig struct {
 	// ErrorPages are responses to be returned for HTTP error codes. Each page
 	// is defined by a URL mapped and is mapped to a list of error codes that
 	// should return the content at the URL. Error pages are retrieved ahead of
-	// time if possible, and cached.
+	// time if possible, and cached. For a page with fallback URLs, use an
+	// ErrorPageRule without a method or path prefix.
 	ErrorPages map[string][]int `json:"error_pages,omitempty"`
 
+	// ErrorPageRules are error pages which only apply to requests matching a
+	// method and/or path prefix. When multiple pages match a response, the
+	// most specific page is used, falling back to ErrorPages.
+	ErrorPageRules []ErrorPageConfig `json:"error_page_rules,omitempty"`
+
+	// ErrorPageRetries is the number of times a failed error page fetch is
+	// retried after the page is configured, in case the server hosting the
+	// page isn't yet available. A page that still couldn't be fetched is
+	// fetched again when it's first needed.
+	ErrorPageRetries int `json:"error_page_retries,omitempty"`
+
+	// ErrorPageRetryInterval is the delay in milliseconds before the first
+	// retry of an error page fetch. The delay doubles after each attempt.
+	ErrorPageRetryInterval int `json:"error_page_retry_interval,omitempty"`
+
 	// Backends is a list of all servers handling connections for this service.
 	Backends []BackendConfig `json:"backends,omitempty"`
 
 	// Maintenance mode is a flag to return 503 status codes to clients
 	// without visiting backends.
 	MaintenanceMode bool `json:"maintenance_mode"`
+
+	// MaintenanceBody is returned to clients in maintenance mode when there
+	// is no error page for a 503 response.
+	MaintenanceBody string `json:"maintenance_body,omitempty"`
+
+	// MaintenanceContentType is the Content-Type of the MaintenanceBody.
+	MaintenanceContentType string `json:"maintenance_content_type,omitempty"`
+
+	// MaintenanceFile is the path to a local file returned to clients in
+	// maintenance mode. The file is read when the service is configured, and
+	// takes precedence over MaintenanceBody.
+	MaintenanceFile string `json:"maintenance_file,omitempty"`
+
+	// Warmup is the number of probe connections opened to a backend when it's
+	// added, to prime the network path before it receives traffic.
+	Warmup int `json:"warmup,omitempty"`
+
+	// NoDelay sets TCP_NODELAY on client and backend connections, which is the
+	// default when this is unset. Setting it to false enables Nagle's
+	// algorithm, which coalesces small writes for better throughput on bulk
+	// transfers, at the cost of added latency for small messages.
+	NoDelay *bool `json:"no_delay,omitempty"`
+
+	// SendBufferBytes and RecvBufferBytes set the SO_SNDBUF and SO_RCVBUF
+	// sizes of TCP client and backend connections, from MinSocketBufferBytes
+	// to MaxSocketBufferBytes. If these are 0, the global sizes are used, or
+	// the OS defaults. On Linux, setting a size turns off the kernel's
+	// autotuning of that buffer, and the size is capped by net.core.wmem_max
+	// or net.core.rmem_max.
+	SendBufferBytes int `json:"send_buffer_bytes,omitempty"`
+	RecvBufferBytes int `json:"recv_buffer_bytes,omitempty"`
+
+	// ConnLogSample is the fraction of TCP connections, from 0 to 1, which are
+	// logged when closed, with the backend, bytes transferred and duration.
+	// If this is 0, no connections are logged.
+	ConnLogSample float64 `json:"conn_log_sample,omitempty"`
+
+	// LogBalance logs every backend selection, with the backend chosen, the
+	// state of the balancing algorithm and the reason for the choice. This is
+	// verbose, and meant for debugging uneven balancing.
+	LogBalance bool `json:"log_balance,omitempty"`
+
+	// AllowHalfOpen keeps a TCP connection open in one direction after the
+	// other side closes its write half. The close is passed on as a
+	// half-close, and the connection is closed once both directions are
+	// done. When this is false, the connection is fully closed as soon as
+	// either side closes.
+	AllowHalfOpen bool `json:"allow_half_open,omitempty"`
+
+	// HealthCheckCIDRs are networks of external load balancer health
+	// checkers. TCP connections from these addresses are answered by shuttle
+	// and closed, without selecting a backend. HealthCheckResponse is
+	// written to the connection before it's closed, if set.
+	HealthCheckCIDRs    []string `json:"health_check_cidrs,omitempty"`
+	HealthCheckResponse string   `json:"health_check_response,omitempty"`
+
+	// MaxConnsPerClient limits the concurrent TCP connections, or HTTP
+	// requests, from a single client IP. Excess connections are closed, and
+	// excess requests get a 429 response. If this is 0, clients are not
+	// limited.
+	MaxConnsPerClient int `json:"max_conns_per_client,omitempty"`
+
+	// RebalanceConns, with the LC balancing scheme, closes TCP connections
+	// older than MaxConnAge milliseconds when their backend has more active
+	// connections than the least connected one, so that long lived clients
+	// reconnect and are balanced again, e.g. onto a newly added backend. The
+	// backend side is closed for writing first, letting it finish what it's
+	// sending, and the closes are spread out to avoid a reconnection storm.
+	RebalanceConns bool `json:"rebalance_conns,omitempty"`
+	MaxConnAge     int  `json:"max_conn_age,omitempty"`
+
+	// TrustedProxies are networks of proxies which report the real client
+	// address. A TCP connection from one of these which starts with a PROXY
+	// protocol v1 header, or an HTTP request with an X-Forwarded-For header,
+	// is counted against that client instead of the proxy. The header is
+	// passed on to the backend unchanged. If this isn't set, the global
+	// TrustedProxies are used.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// GroupOrder lists the backend groups in failover order. Groups which
+	// aren't listed, including backends without a group, follow those listed
+	// in order of their names.
+	GroupOrder []string `json:"group_order,omitempty"`
+
+	// StatsInterval is the interval in milliseconds between sending the
+	// service's stats to statsd. If this is 0, the global -statsd-interval
+	// is used.
+	StatsInterval int `json:"stats_interval,omitempty"`
+
+	// SniffHTTP peeks at the first bytes of each TCP connection. Connections
+	// which begin with an HTTP request are routed by virtual host, like those
+	// on the HTTP listener, and the rest are proxied to the backends. The
+	// client has SniffTimeout milliseconds to send its first bytes, with a
+	// default of DefaultSniffTimeout, after which the connection is treated
+	// as TCP.
+	SniffHTTP    bool `json:"sniff_http,omitempty"`
+	SniffTimeout int  `json:"sniff_timeout,omitempty"`
+
+	// RetryEmpty moves a TCP connection on to the next backend when the
+	// backend closes it without sending any data, as long as nothing from
+	// the client has been forwarded yet. Each backend is tried at most once.
+	RetryEmpty bool `json:"retry_empty,omitempty"`
+
+	// RetryReset moves an HTTP request on to the next backend when the
+	// backend resets the connection before sending a response. Only requests
+	// without a body are retried, since a body can't be sent again once it's
+	// been read.
+	RetryReset bool `json:"retry_reset,omitempty"`
+
+	// HandshakeTimeout is the time in milliseconds a new TCP client has to
+	// send its first bytes, or complete the TLS handshake on the TLS
+	// listener, before the connection is closed without dialing a backend.
+	// This is separate from ClientTimeout, which applies once data is
+	// flowing. It shouldn't be set for protocols where the server speaks
+	// first.
+	HandshakeTimeout int `json:"handshake_timeout,omitempty"`
+
+	// RemoveWhenEmpty removes the service once its last backend is removed,
+	// rather than leaving it running with no backends.
+	RemoveWhenEmpty bool `json:"remove_when_empty,omitempty"`
+
+	// AcceptRateAlert is a rate of new TCP connections per second. When more
+	// connections than this are accepted in an AcceptRateWindow, a warning is
+	// logged and the service's accept_rate_alerts stat is incremented. The
+	// window is in milliseconds, with a default of DefaultAcceptRateWindow.
+	// If AcceptRateAlert is 0, the accept rate isn't checked.
+	AcceptRateAlert  int `json:"accept_rate_alert,omitempty"`
+	AcceptRateWindow int `json:"accept_rate_window,omitempty"`
+
+	// DialFailureAlert is a fraction of dials, from 0 to 1. When a backend's
+	// connection failures over the last DialFailureWindow reach this rate, a
+	// warning is logged and the backend's dial_failure_alerts stat is
+	// incremented, whether or not health checks have marked it down yet. The
+	// window is in milliseconds, with a default of DefaultDialFailureWindow.
+	// The failure rate is reported in the backend stats either way. If
+	// DialFailureAlert is 0, no warnings are logged.
+	DialFailureAlert  float64 `json:"dial_failure_alert,omitempty"`
+	DialFailureWindow int     `json:"dial_failure_window,omitempty"`
+
+	// EjectErrorRate is a fraction of HTTP responses, from 0 to 1. When the
+	// 5xx responses proxied from a backend over the last EjectWindow reach
+	// this rate, the backend is ejected, receiving no new requests or
+	// connections for EjectTime, even though its health checks pass. The
+	// last Up backend is never ejected. Both times are in milliseconds, with
+	// defaults of DefaultEjectWindow and DefaultEjectTime. If EjectErrorRate
+	// is 0, backends aren't ejected.
+	EjectErrorRate float64 `json:"eject_error_rate,omitempty"`
+	EjectWindow    int     `json:"eject_window,omitempty"`
+	EjectTime      int     `json:"eject_time,omitempty"`
+
+	// QueueSize is the number of TCP connections which can wait for a free
+	// backend when all backends are at MaxConns. Connections wait for up to
+	// QueueTimeout milliseconds, and are refused when the queue is full or
+	// the timeout expires. If either is 0, connections are refused
+	// immediately.
+	QueueSize    int `json:"queue_size,omitempty"`
+	QueueTimeout int `json:"queue_timeout,omitempty"`
+
+	// UDPSessionTimeout enables replies for UDP services. Each client address
+	// is mapped to a backend, and packets returned from the backend are
+	// sent back to the client. The session is removed after being idle for
+	// UDPSessionTimeout milliseconds. When 0, UDP packets are only forwarded
+	// to the backends.
+	UDPSessionTimeout int `json:"udp_session_timeout,omitempty"`
+
+	// FlushInterval is the interval in milliseconds between flushes of a
+	// streaming HTTP response to the client. A value of -1 flushes after
+	// every write, and 0 disables periodic flushing.
+	FlushInterval int `json:"flush_interval,omitempty"`
 }
 
 // Return a copy  of ServiceConfig with any unset fields to their default
@@ -238,6 +1000,209 @@ func (s ServiceConfig) SetDefaults() ServiceConfig {
 	return s
 }
 
+// Addrs returns each of the listening addresses in Addr.
+func (s ServiceConfig) Addrs() []string {
+	return SplitAddrs(s.Addr)
+}
+
+// SplitAddrs splits a comma separated list of addresses, ignoring any empty
+// entries.
+func SplitAddrs(addr string) []string {
+	addrs := []string{}
+	for _, a := range strings.Split(addr, ",") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Check a socket buffer size, which is either 0 for the default, or within
+// MinSocketBufferBytes and MaxSocketBufferBytes.
+func validateBufferBytes(name string, n int) error {
+	if n != 0 && (n < MinSocketBufferBytes || n > MaxSocketBufferBytes) {
+		return fmt.Errorf("invalid %s %d, must be from %d to %d", name, n, MinSocketBufferBytes, MaxSocketBufferBytes)
+	}
+	return nil
+}
+
+// Check that a cookie name is an HTTP token, which is printable ASCII other
+// than spaces and separators.
+func validCookieName(name string) bool {
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateBalance returns an error if balance isn't a known balancing scheme.
+func ValidateBalance(balance string) error {
+	switch balance {
+	case RoundRobin, LeastConn:
+		return nil
+	}
+	return fmt.Errorf("invalid balancing algorithm '%s'", balance)
+}
+
+// Redact returns a copy of the service config with its backends' secrets
+// replaced by Redacted.
+func (s ServiceConfig) Redact() ServiceConfig {
+	if s.Backends != nil {
+		backends := make([]BackendConfig, len(s.Backends))
+		for i, b := range s.Backends {
+			backends[i] = b.Redact()
+		}
+		s.Backends = backends
+	}
+	return s
+}
+
+// Validate checks for settings that would prevent the service from running.
+func (s ServiceConfig) Validate() error {
+	if s.Balance != "" {
+		if err := ValidateBalance(s.Balance); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range s.Addrs() {
+		if seen[addr] && !strings.HasSuffix(addr, ":0") {
+			return fmt.Errorf("duplicate address %s", addr)
+		}
+		seen[addr] = true
+	}
+
+	if s.TLSAddr != "" {
+		if s.TLSCert == "" || s.TLSKey == "" {
+			return fmt.Errorf("tls_address requires tls_cert and tls_key")
+		}
+		if s.Network != "" && !strings.HasPrefix(s.Network, "tcp") {
+			return fmt.Errorf("tls_address requires a tcp network")
+		}
+	}
+
+	if s.MaxURILength < 0 {
+		return fmt.Errorf("invalid max_uri_length %d", s.MaxURILength)
+	}
+
+	if s.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("invalid max_request_body_bytes %d", s.MaxRequestBodyBytes)
+	}
+
+	if s.StickyCookieName != "" && !validCookieName(s.StickyCookieName) {
+		return fmt.Errorf("invalid sticky_cookie_name %q", s.StickyCookieName)
+	}
+	if s.StickyCookieTTL < 0 {
+		return fmt.Errorf("invalid sticky_cookie_ttl %d", s.StickyCookieTTL)
+	}
+
+	if s.MirrorAddr != "" {
+		if _, _, err := net.SplitHostPort(s.MirrorAddr); err != nil {
+			return fmt.Errorf("invalid mirror_address %s: %s", s.MirrorAddr, err)
+		}
+	}
+	if s.MirrorSample < 0 || s.MirrorSample > 1 {
+		return fmt.Errorf("invalid mirror_sample %v, must be from 0 to 1", s.MirrorSample)
+	}
+
+	switch s.HTTPSRedirectCode {
+	case 0, 301, 302, 303, 307, 308:
+	default:
+		return fmt.Errorf("invalid https_redirect_code %d", s.HTTPSRedirectCode)
+	}
+
+	if s.ConnLogSample < 0 || s.ConnLogSample > 1 {
+		return fmt.Errorf("invalid conn_log_sample %v, must be from 0 to 1", s.ConnLogSample)
+	}
+
+	if s.QueueSize < 0 || s.QueueTimeout < 0 {
+		return fmt.Errorf("invalid queue_size or queue_timeout")
+	}
+
+	if s.AcceptRateAlert < 0 || s.AcceptRateWindow < 0 {
+		return fmt.Errorf("invalid accept_rate_alert or accept_rate_window")
+	}
+
+	if s.DialFailureAlert < 0 || s.DialFailureAlert > 1 {
+		return fmt.Errorf("invalid dial_failure_alert %v, must be from 0 to 1", s.DialFailureAlert)
+	}
+	if s.DialFailureWindow < 0 {
+		return fmt.Errorf("invalid dial_failure_window %d", s.DialFailureWindow)
+	}
+
+	if s.EjectErrorRate < 0 || s.EjectErrorRate > 1 {
+		return fmt.Errorf("invalid eject_error_rate %v, must be from 0 to 1", s.EjectErrorRate)
+	}
+	if s.EjectWindow < 0 || s.EjectTime < 0 {
+		return fmt.Errorf("invalid eject_window or eject_time")
+	}
+
+	if s.SniffTimeout < 0 {
+		return fmt.Errorf("invalid sniff_timeout %d", s.SniffTimeout)
+	}
+
+	if s.HandshakeTimeout < 0 {
+		return fmt.Errorf("invalid handshake_timeout %d", s.HandshakeTimeout)
+	}
+
+	if s.CheckFast < 0 || s.CheckSlow < 0 || s.CheckSlow > 0 && s.CheckFast >= s.CheckSlow {
+		return fmt.Errorf("invalid check_fast %d or check_slow %d", s.CheckFast, s.CheckSlow)
+	}
+
+	if s.StatsInterval < 0 {
+		return fmt.Errorf("invalid stats_interval %d", s.StatsInterval)
+	}
+
+	for _, cidr := range s.HealthCheckCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid health_check_cidrs: %s", err)
+		}
+	}
+
+	if err := validateBufferBytes("send_buffer_bytes", s.SendBufferBytes); err != nil {
+		return err
+	}
+	if err := validateBufferBytes("recv_buffer_bytes", s.RecvBufferBytes); err != nil {
+		return err
+	}
+
+	if s.MaxConnsPerClient < 0 {
+		return fmt.Errorf("invalid max_conns_per_client %d", s.MaxConnsPerClient)
+	}
+
+	if s.MaxConnAge < 0 {
+		return fmt.Errorf("invalid max_conn_age %d", s.MaxConnAge)
+	}
+	if s.RebalanceConns && s.MaxConnAge == 0 {
+		return fmt.Errorf("rebalance_conns requires max_conn_age")
+	}
+
+	for _, cidr := range s.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid trusted_proxies: %s", err)
+		}
+	}
+
+	groups := make(map[string]bool)
+	for _, group := range s.GroupOrder {
+		if groups[group] {
+			return fmt.Errorf("duplicate group %q in group_order", group)
+		}
+		groups[group] = true
+	}
+
+	for _, b := range s.Backends {
+		if err := b.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Compare a service's settings, ignoring individual backends.
 func (s ServiceConfig) Equal(other ServiceConfig) bool {
 	// just remove the backends and compare the rest
@@ -324,6 +1289,114 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 	if cfg.DialTimeout != 0 {
 		new.DialTimeout = cfg.DialTimeout
 	}
+	if cfg.FlushInterval != 0 {
+		new.FlushInterval = cfg.FlushInterval
+	}
+	if cfg.ResponseHeaderTimeout != 0 {
+		new.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	}
+	if cfg.ResponseTimeout != 0 {
+		new.ResponseTimeout = cfg.ResponseTimeout
+	}
+	if cfg.MaintenanceBody != "" {
+		new.MaintenanceBody = cfg.MaintenanceBody
+	}
+	if cfg.MaintenanceContentType != "" {
+		new.MaintenanceContentType = cfg.MaintenanceContentType
+	}
+	if cfg.MaintenanceFile != "" {
+		new.MaintenanceFile = cfg.MaintenanceFile
+	}
+	if cfg.TLSAddr != "" {
+		new.TLSAddr = cfg.TLSAddr
+	}
+	if cfg.TLSCert != "" {
+		new.TLSCert = cfg.TLSCert
+	}
+	if cfg.TLSKey != "" {
+		new.TLSKey = cfg.TLSKey
+	}
+	if cfg.Warmup != 0 {
+		new.Warmup = cfg.Warmup
+	}
+	if cfg.MaxURILength != 0 {
+		new.MaxURILength = cfg.MaxURILength
+	}
+	if cfg.MaxRequestBodyBytes != 0 {
+		new.MaxRequestBodyBytes = cfg.MaxRequestBodyBytes
+	}
+	if cfg.HTTPSRedirectCode != 0 {
+		new.HTTPSRedirectCode = cfg.HTTPSRedirectCode
+	}
+	if cfg.StickyCookieName != "" {
+		new.StickyCookieName = cfg.StickyCookieName
+	}
+	if cfg.StickyCookieTTL != 0 {
+		new.StickyCookieTTL = cfg.StickyCookieTTL
+	}
+	if cfg.NoDelay != nil {
+		new.NoDelay = cfg.NoDelay
+	}
+	if cfg.SendBufferBytes != 0 {
+		new.SendBufferBytes = cfg.SendBufferBytes
+	}
+	if cfg.RecvBufferBytes != 0 {
+		new.RecvBufferBytes = cfg.RecvBufferBytes
+	}
+	if cfg.ConnLogSample != 0 {
+		new.ConnLogSample = cfg.ConnLogSample
+	}
+	if cfg.AcceptRateAlert != 0 {
+		new.AcceptRateAlert = cfg.AcceptRateAlert
+	}
+	if cfg.AcceptRateWindow != 0 {
+		new.AcceptRateWindow = cfg.AcceptRateWindow
+	}
+	if cfg.DialFailureAlert != 0 {
+		new.DialFailureAlert = cfg.DialFailureAlert
+	}
+	if cfg.DialFailureWindow != 0 {
+		new.DialFailureWindow = cfg.DialFailureWindow
+	}
+	if cfg.EjectErrorRate != 0 {
+		new.EjectErrorRate = cfg.EjectErrorRate
+	}
+	if cfg.EjectWindow != 0 {
+		new.EjectWindow = cfg.EjectWindow
+	}
+	if cfg.EjectTime != 0 {
+		new.EjectTime = cfg.EjectTime
+	}
+	if cfg.SniffTimeout != 0 {
+		new.SniffTimeout = cfg.SniffTimeout
+	}
+	if cfg.HandshakeTimeout != 0 {
+		new.HandshakeTimeout = cfg.HandshakeTimeout
+	}
+	if cfg.CheckFast != 0 {
+		new.CheckFast = cfg.CheckFast
+	}
+	if cfg.CheckSlow != 0 {
+		new.CheckSlow = cfg.CheckSlow
+	}
+	if cfg.StatsInterval != 0 {
+		new.StatsInterval = cfg.StatsInterval
+	}
+	if cfg.QueueSize != 0 {
+		new.QueueSize = cfg.QueueSize
+	}
+	if cfg.QueueTimeout != 0 {
+		new.QueueTimeout = cfg.QueueTimeout
+	}
+	if cfg.UDPSessionTimeout != 0 {
+		new.UDPSessionTimeout = cfg.UDPSessionTimeout
+	}
+	if cfg.ErrorPageRetries != 0 {
+		new.ErrorPageRetries = cfg.ErrorPageRetries
+	}
+	if cfg.ErrorPageRetryInterval != 0 {
+		new.ErrorPageRetryInterval = cfg.ErrorPageRetryInterval
+	}
 
 	if cfg.VirtualHosts != nil {
 		new.VirtualHosts = cfg.VirtualHosts
@@ -333,12 +1406,48 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 		new.ErrorPages = cfg.ErrorPages
 	}
 
+	if cfg.ErrorPageRules != nil {
+		new.ErrorPageRules = cfg.ErrorPageRules
+	}
+
+	if cfg.HealthCheckCIDRs != nil {
+		new.HealthCheckCIDRs = cfg.HealthCheckCIDRs
+	}
+	if cfg.HealthCheckResponse != "" {
+		new.HealthCheckResponse = cfg.HealthCheckResponse
+	}
+	if cfg.MaxConnsPerClient != 0 {
+		new.MaxConnsPerClient = cfg.MaxConnsPerClient
+	}
+	if cfg.MaxConnAge != 0 {
+		new.MaxConnAge = cfg.MaxConnAge
+	}
+	if cfg.TrustedProxies != nil {
+		new.TrustedProxies = cfg.TrustedProxies
+	}
+	if cfg.GroupOrder != nil {
+		new.GroupOrder = cfg.GroupOrder
+	}
+
 	if cfg.Backends != nil {
 		new.Backends = cfg.Backends
 	}
 
 	new.HTTPSRedirect = cfg.HTTPSRedirect
+	new.RejectHTTP = cfg.RejectHTTP
+	new.RebalanceConns = cfg.RebalanceConns
 	new.MaintenanceMode = cfg.MaintenanceMode
+	new.AllowHalfOpen = cfg.AllowHalfOpen
+	new.RemoveWhenEmpty = cfg.RemoveWhenEmpty
+	new.SniffHTTP = cfg.SniffHTTP
+	new.RetryEmpty = cfg.RetryEmpty
+	new.RetryReset = cfg.RetryReset
+	new.LogBalance = cfg.LogBalance
+	new.StickyCookie = cfg.StickyCookie
+
+	// mirroring is always replaced, so it can be turned off
+	new.MirrorAddr = cfg.MirrorAddr
+	new.MirrorSample = cfg.MirrorSample
 
 	return new
 }
@@ -1,67 +1,236 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"sync"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
-func loadConfig() {
-	for _, cfgPath := range []string{stateConfig, defaultConfig} {
-		if cfgPath == "" {
+// Load the state and default configs. Errors are logged and the remaining
+// configs are loaded, unless strictConfig is set, in which case the first
+// error is returned. A config with an invalid service isn't applied at all.
+// A missing config is never an error.
+func loadConfig() error {
+	var stores []ConfigStore
+	if store := stateStore(); store != nil {
+		stores = append(stores, store)
+	}
+	if defaultConfig != "" {
+		stores = append(stores, &fileStore{path: defaultConfig})
+	}
+
+	for _, store := range stores {
+		cfg, err := store.Load()
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warnln("Error reading config:", err)
 			continue
 		}
-
-		cfgData, err := ioutil.ReadFile(cfgPath)
 		if err != nil {
-			log.Warnln("Error reading config:", err)
+			if strictConfig {
+				return fmt.Errorf("config error in %s: %s", store, err)
+			}
+			log.Warnln("Config error:", err)
 			continue
 		}
 
-		var cfg client.Config
-		err = json.Unmarshal(cfgData, &cfg)
+		if err := applyConfig(store, cfg); err != nil {
+			if strictConfig {
+				return err
+			}
+			log.Errorf("ERROR: %s", err)
+		}
+	}
+	return nil
+}
+
+// Migrate and apply a config loaded from the store. When strictConfig is set,
+// the config is validated before it's applied.
+func applyConfig(store ConfigStore, cfg client.Config) error {
+	// don't partially load a config from a newer version of shuttle
+	if err := cfg.Migrate(); err != nil {
+		return fmt.Errorf("not loading config %s: %s", store, err)
+	}
+	log.Debug("Loaded config from:", store)
+
+	if strictConfig {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("config error in %s: %s", store, err)
+		}
+	}
+
+	if err := Registry.UpdateConfig(cfg); err != nil {
+		return fmt.Errorf("unable to load config %s: %s", store, err)
+	}
+	return nil
+}
+
+// Load and validate the config file for -config-check, without applying it.
+// Along with the checks made by Config.Validate, each listen address must be
+// a valid ip:port which isn't used by another service, and a service can't
+// list the same virtual host twice. Services may share a virtual host, since
+// its requests are balanced across them. Problems with the services are
+// returned as client.ConfigErrors.
+func checkConfig(path string) error {
+	_, err := loadCheckedConfig(&fileStore{path: path})
+	return err
+}
+
+// Load and migrate the config from the store, and make the checks described
+// for checkConfig, returning the config if there are no errors.
+func loadCheckedConfig(store ConfigStore) (client.Config, error) {
+	cfg, err := store.Load()
+	if err != nil {
+		return cfg, fmt.Errorf("config error in %s: %s", store, err)
+	}
+	if err := cfg.Migrate(); err != nil {
+		return cfg, fmt.Errorf("config error in %s: %s", store, err)
+	}
+
+	errs := client.ConfigErrors{}
+	if err := cfg.Validate(); err != nil {
+		cfgErrs, ok := err.(client.ConfigErrors)
+		if !ok {
+			return cfg, err
+		}
+		errs = cfgErrs
+	}
+
+	listeners := make(map[string]string)
+	for _, svc := range cfg.Services {
+		// missing and duplicate names are already reported
+		if svc.Name == "" || errs[svc.Name] != "" {
+			continue
+		}
+
+		if err := checkServiceListeners(svc, listeners); err != nil {
+			errs[svc.Name] = err.Error()
+			continue
+		}
+
+		vhosts := make(map[string]bool)
+		for _, vhost := range svc.VirtualHosts {
+			if vhosts[vhost] {
+				errs[svc.Name] = fmt.Sprintf("duplicate virtual host %s", vhost)
+				break
+			}
+			vhosts[vhost] = true
+		}
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// Check the format of the service's listen addresses, and that none are
+// already in listeners, which maps each address to the service using it.
+func checkServiceListeners(svc client.ServiceConfig, listeners map[string]string) error {
+	addrs := svc.Addrs()
+	if svc.TLSAddr != "" {
+		addrs = append(addrs, svc.TLSAddr)
+	}
+
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
 		if err != nil {
-			log.Warnln("Config error:", err)
+			return fmt.Errorf("invalid address %s: %s", addr, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			return fmt.Errorf("invalid port in address %s", addr)
+		}
+
+		// port 0 binds a random port, so it can't conflict
+		if port == "0" {
 			continue
 		}
-		log.Debug("Loaded config from:", cfgPath)
+		if other, ok := listeners[addr]; ok {
+			return fmt.Errorf("address %s is also used by %s", addr, other)
+		}
+		listeners[addr] = svc.Name
+	}
+	return nil
+}
 
-		if err := Registry.UpdateConfig(cfg); err != nil {
-			log.Printf("Unable to load config: error: %s", err)
+// Reload the -config file, as on a SIGHUP. The whole file is checked as it
+// is for -config-check before anything is applied, so if there's an error the
+// running config is left intact. The file is applied as the desired state, so
+// services and backends which aren't in it are removed.
+func reloadConfig() error {
+	if defaultConfig == "" {
+		return fmt.Errorf("no -config file to reload")
+	}
+
+	store := &fileStore{path: defaultConfig}
+	cfg, err := loadCheckedConfig(store)
+	if err != nil {
+		return err
+	}
+
+	err = Registry.ReplaceConfig(cfg)
+	go writeStateConfig()
+	if err != nil {
+		return fmt.Errorf("unable to load config %s: %s", store, err)
+	}
+	return nil
+}
+
+// Apply each change to the config in the store, for stores which can be
+// watched.
+func watchConfig(store ConfigStore) {
+	configs := store.Watch()
+	if configs == nil {
+		return
+	}
+
+	log.Printf("Watching %s for config changes", store)
+	for cfg := range configs {
+		if err := applyWatchedConfig(store, cfg); err != nil {
+			log.Errorf("ERROR: %s", err)
 		}
 	}
 }
 
-// protects the state config file
+// Apply a changed config from a watched store as the desired state, removing
+// the services and backends it doesn't list. The state isn't written, since
+// it would only be written back to the store the change came from.
+func applyWatchedConfig(store ConfigStore, cfg client.Config) error {
+	if err := cfg.Migrate(); err != nil {
+		return fmt.Errorf("not loading config %s: %s", store, err)
+	}
+	log.Debug("Config changed in:", store)
+
+	if err := Registry.ReplaceConfig(cfg); err != nil {
+		return fmt.Errorf("unable to load config %s: %s", store, err)
+	}
+	return nil
+}
+
+// protects the state config
 var configMutex sync.Mutex
 
 func writeStateConfig() {
 	configMutex.Lock()
 	defer configMutex.Unlock()
 
-	if stateConfig == "" {
+	store := stateStore()
+	if store == nil {
 		log.Debug("No state file. Not saving changes")
 		return
 	}
 
-	cfg := marshal(Registry.Config())
-	if len(cfg) == 0 {
+	if noStateWrite {
+		log.Debug("State file is read-only. Not saving changes")
 		return
 	}
 
-	lastCfg, _ := ioutil.ReadFile(stateConfig)
-	if bytes.Equal(cfg, lastCfg) {
-		log.Println("No change in config")
-		return
-	}
-
-	// We should probably write a temp file and mv for atomic update.
-	err := ioutil.WriteFile(stateConfig, cfg, 0644)
-	if err != nil {
+	if err := store.Save(Registry.Config()); err != nil {
 		log.Println("Error saving config state:", err)
 	}
 }
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "syscall"
+
+const dscpSupported = false
+
+// DSCP marking isn't implemented on this platform, so connections are dialed
+// without a Control function.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
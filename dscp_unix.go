@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+const dscpSupported = true
+
+// Return a net.Dialer Control function which sets the DSCP bits in the
+// socket's IP_TOS, or IPV6_TCLASS for IPv6.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	// DSCP is the upper 6 bits of the TOS byte
+	tos := dscp << 2
+
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			switch network {
+			case "tcp6", "udp6":
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			default:
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
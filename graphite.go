@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Format the service and backend stats as Graphite plaintext lines, of
+// "path value timestamp". Counters are the totals since the stats were last
+// reset, leaving Graphite to compute the rates.
+func graphiteMetrics(prefix string, stats []ServiceStat, now time.Time) []string {
+	prefix = strings.Trim(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+	ts := now.Unix()
+
+	lines := []string{}
+	add := func(path string, value interface{}) {
+		lines = append(lines, fmt.Sprintf("%s%s %v %d", prefix, path, value, ts))
+	}
+
+	for _, svc := range stats {
+		// a failed service has no stats to report
+		if svc.Error != "" {
+			continue
+		}
+
+		name := graphiteName(svc.Name) + "."
+		add(name+"sent", svc.Sent)
+		add(name+"received", svc.Rcvd)
+		add(name+"errors", svc.Errors)
+		add(name+"connections", svc.Conns)
+		add(name+"active", svc.Active)
+		add(name+"http_connections", svc.HTTPConns)
+		add(name+"http_errors", svc.HTTPErrors)
+		add(name+"http_active", svc.HTTPActive)
+		add(name+"queued", svc.Queued)
+		add(name+"refused", svc.Refused)
+		add(name+"backends", svc.BackendCount)
+		add(name+"backends_up", svc.UpCount)
+
+		for _, b := range svc.Backends {
+			up := 0
+			if b.Up {
+				up = 1
+			}
+
+			bName := name + "backends." + graphiteName(b.Name) + "."
+			add(bName+"up", up)
+			add(bName+"sent", b.Sent)
+			add(bName+"received", b.Rcvd)
+			add(bName+"errors", b.Errors)
+			add(bName+"connections", b.Conns)
+			add(bName+"active", b.Active)
+			add(bName+"http_active", b.HTTPActive)
+			add(bName+"empty_responses", b.EmptyResponses)
+		}
+	}
+	return lines
+}
+
+// Make a name safe to use as a single node of a Graphite metric path. Dots
+// separate the nodes, and whitespace separates the fields of a line, so
+// anything other than letters, digits, '-' and '_' is replaced with '_'.
+func graphiteName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
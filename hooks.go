@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// ConnInfo describes a proxied TCP connection to the ConnHooks. The fields
+// are filled in as the connection progresses.
+type ConnInfo struct {
+	Service string
+	Client  string
+	Start   time.Time
+
+	// The backend currently being dialed, or the connected backend
+	Backend     string
+	BackendAddr string
+
+	// Time taken to dial the backend
+	DialDuration time.Duration
+
+	// Set once a backend is connected
+	Connected bool
+
+	// Bytes received from and sent to the client
+	Rcvd int64
+	Sent int64
+
+	// Total duration of the connection, set when it's closed
+	Duration time.Duration
+
+	// The last error on the connection, if any
+	Err error
+}
+
+// ConnHooks are called at each stage of a proxied TCP connection, for
+// instrumentation. Hooks are called synchronously from the connection's
+// goroutine, and shouldn't block.
+type ConnHooks interface {
+	// Accepted is called when a new client connection is accepted.
+	Accepted(info *ConnInfo)
+
+	// BackendSelected is called before each attempt to dial a backend.
+	BackendSelected(info *ConnInfo)
+
+	// Dialed is called after each attempt to dial a backend, with Err set if
+	// the dial failed.
+	Dialed(info *ConnInfo)
+
+	// Closed is called once the client and backend connections are closed,
+	// or when no backend could be connected.
+	Closed(info *ConnInfo)
+}
+
+// NoopHooks implements ConnHooks and does nothing. It can be embedded to
+// implement only some of the hooks.
+type NoopHooks struct{}
+
+func (NoopHooks) Accepted(*ConnInfo)        {}
+func (NoopHooks) BackendSelected(*ConnInfo) {}
+func (NoopHooks) Dialed(*ConnInfo)          {}
+func (NoopHooks) Closed(*ConnInfo)          {}
+
+// MultiHooks calls each of the hooks in order.
+type MultiHooks []ConnHooks
+
+func (m MultiHooks) Accepted(info *ConnInfo) {
+	for _, h := range m {
+		h.Accepted(info)
+	}
+}
+
+func (m MultiHooks) BackendSelected(info *ConnInfo) {
+	for _, h := range m {
+		h.BackendSelected(info)
+	}
+}
+
+func (m MultiHooks) Dialed(info *ConnInfo) {
+	for _, h := range m {
+		h.Dialed(info)
+	}
+}
+
+func (m MultiHooks) Closed(info *ConnInfo) {
+	for _, h := range m {
+		h.Closed(info)
+	}
+}
+
+var (
+	connHooksMu sync.RWMutex
+	connHooks   ConnHooks = NoopHooks{}
+)
+
+// SetConnHooks sets the hooks called for all TCP connections. Connections
+// already in progress keep the hooks they started with.
+func SetConnHooks(h ConnHooks) {
+	if h == nil {
+		h = NoopHooks{}
+	}
+
+	connHooksMu.Lock()
+	defer connHooksMu.Unlock()
+	connHooks = h
+}
+
+// AddConnHooks adds to the hooks called for all TCP connections.
+func AddConnHooks(h ConnHooks) {
+	connHooksMu.Lock()
+	defer connHooksMu.Unlock()
+
+	if _, ok := connHooks.(NoopHooks); ok {
+		connHooks = h
+		return
+	}
+	connHooks = MultiHooks{connHooks, h}
+}
+
+func getConnHooks() ConnHooks {
+	connHooksMu.RLock()
+	defer connHooksMu.RUnlock()
+	return connHooks
+}
+
+// Logs each connection when it's closed. This is added to the hooks of
+// connections sampled by the service's ConnLogSample.
+type connLogger struct {
+	NoopHooks
+}
+
+func (connLogger) Closed(info *ConnInfo) {
+	errStr := fmt.Sprintf("%v", info.Err)
+	fmtStr := "conn service=%s client=%s backend=%s rcvd=%d sent=%d duration=%s err=%s"
+	log.Printf(fmtStr, info.Service, info.Client, info.Backend, info.Rcvd, info.Sent, info.Duration, errStr)
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
@@ -46,15 +49,6 @@ func NewHostRouter(httpServer *http.Server) *HostRouter {
 }
 
 func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	reqId := req.Header.Get("X-Request-Id")
-	if reqId == "" {
-		reqId = genId()
-	} else {
-		reqId = genId() + "." + reqId
-	}
-	req.Header.Set("X-Request-Id", reqId)
-	w.Header().Add("X-Request-Id", reqId)
-
 	var err error
 	host := req.Host
 
@@ -67,6 +61,21 @@ func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	svc := Registry.GetVHostService(host)
 
+	// reject long URIs before anything is done with the request
+	if len(req.RequestURI) > Registry.MaxURILength(svc) {
+		http.Error(w, "Request URI Too Long", http.StatusRequestURITooLong)
+		return
+	}
+
+	reqId := req.Header.Get("X-Request-Id")
+	if reqId == "" {
+		reqId = genId()
+	} else {
+		reqId = genId() + "." + reqId
+	}
+	req.Header.Set("X-Request-Id", reqId)
+	w.Header().Add("X-Request-Id", reqId)
+
 	if svc != nil && svc.httpProxy != nil {
 		// The vhost has a service registered, give it to the proxy
 		svc.ServeHTTP(w, req)
@@ -87,28 +96,43 @@ func (r *HostRouter) noHostHandler(w http.ResponseWriter, req *http.Request) {
 // Takes a channel to notify when the listener is started
 // to safely synchronize tests.
 func (r *HostRouter) Start(ready chan bool) {
+	if err := r.Listen(); err != nil {
+		log.Errorf("%s", err)
+		return
+	}
+
+	if ready != nil {
+		close(ready)
+	}
+
+	r.Serve()
+}
+
+// Bind the router's listener, without serving any requests yet.
+func (r *HostRouter) Listen() error {
 	//FIXME: poor locking strategy
 	r.Lock()
+	defer r.Unlock()
+
 	var err error
-	r.listener, err = newTimeoutListener("tcp", r.server.Addr, 300*time.Second)
+	r.listener, err = newTimeoutListener("tcp", r.server.Addr, 300*time.Second, false)
 	if err != nil {
-		log.Errorf("%s", err)
-		r.Unlock()
-		return
+		return err
 	}
 
+	log.Printf("%s server listening at %s", strings.ToUpper(r.Scheme), r.server.Addr)
+	return nil
+}
+
+// Serve requests on the bound listener until it's closed.
+func (r *HostRouter) Serve() {
+	r.Lock()
 	listener := r.listener
 	if r.Scheme == "https" {
 		listener = tls.NewListener(listener, r.server.TLSConfig)
 	}
-
 	r.Unlock()
 
-	log.Printf("%s server listening at %s", strings.ToUpper(r.Scheme), r.server.Addr)
-	if ready != nil {
-		close(ready)
-	}
-
 	// This will log a closed connection error every time we Stop
 	// but that's mostly a testing issue.
 	log.Errorf("%s", r.server.Serve(listener))
@@ -131,7 +155,13 @@ func startHTTPServer(wg *sync.WaitGroup) {
 
 	httpRouter = NewHostRouter(httpServer)
 
-	httpRouter.Start(nil)
+	err := httpRouter.Listen()
+	startup.Done("http", err)
+	if err != nil {
+		return
+	}
+
+	httpRouter.Serve()
 }
 
 // find certs in and is the named directory, and match them up by their base
@@ -168,7 +198,17 @@ func loadCerts(certDir string) (*tls.Config, error) {
 		NextProtos: []string{"http/1.1"},
 	}
 
-	for key, pair := range pairs {
+	// load the pairs in a consistent order, so the default certificate
+	// doesn't change between runs
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	store := newCertStore()
+	for _, key := range keys {
+		pair := pairs[key]
 		if pair[0] == "" {
 			log.Errorf("missing cert for key: %s", pair[1])
 			continue
@@ -183,6 +223,11 @@ func loadCerts(certDir string) (*tls.Config, error) {
 			log.Error(err)
 			continue
 		}
+
+		if err := store.add(&cert); err != nil {
+			log.Error(err)
+			continue
+		}
 		tlsCfg.Certificates = append(tlsCfg.Certificates, cert)
 		log.Debugf("loaded X509KeyPair for %s", key)
 	}
@@ -191,17 +236,79 @@ func loadCerts(certDir string) (*tls.Config, error) {
 		return nil, fmt.Errorf("no tls certificates loaded")
 	}
 
-	tlsCfg.BuildNameToCertificate()
+	tlsCfg.GetCertificate = store.GetCertificate
 
 	return tlsCfg, nil
 }
 
+// Certificates indexed by the DNS names they're valid for. A name may have
+// multiple certificates, e.g. RSA and ECDSA, and the first one the client
+// supports is used.
+type certStore struct {
+	names map[string][]*tls.Certificate
+	all   []*tls.Certificate
+}
+
+func newCertStore() *certStore {
+	return &certStore{
+		names: make(map[string][]*tls.Certificate),
+	}
+}
+
+// Index the certificate under each of its names.
+func (s *certStore) add(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		s.names[name] = append(s.names[name], cert)
+	}
+	s.all = append(s.all, cert)
+	return nil
+}
+
+// GetCertificate returns the best certificate for the client's server name,
+// falling back to a wildcard certificate, then to any certificate we have.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+
+	certs := s.names[name]
+	if len(certs) == 0 {
+		if i := strings.Index(name, "."); i > 0 {
+			certs = s.names["*"+name[i:]]
+		}
+	}
+	if len(certs) == 0 {
+		certs = s.all
+	}
+
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	// let the handshake fail with the client if it really can't use this
+	return certs[0], nil
+}
+
 func startHTTPSServer(wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	tlsCfg, err := loadCerts(certDir)
 	if err != nil {
-		log.Error(err)
+		startup.Done("https", err)
 		return
 	}
 
@@ -217,7 +324,13 @@ func startHTTPSServer(wg *sync.WaitGroup) {
 	httpRouter = NewHostRouter(httpsServer)
 	httpRouter.Scheme = "https"
 
-	httpRouter.Start(nil)
+	err = httpRouter.Listen()
+	startup.Done("https", err)
+	if err != nil {
+		return
+	}
+
+	httpRouter.Serve()
 }
 
 type ErrorPage struct {
@@ -225,15 +338,59 @@ type ErrorPage struct {
 	// Everything else should be static once the ErrorPage is created.
 	sync.Mutex
 
+	// The URL of the page, and others tried in order if it can't be fetched
 	Location    string
+	Fallbacks   []string
 	StatusCodes []int
 
+	// optionally limit the requests this page is used for
+	Methods    []string
+	PathPrefix string
+
 	// body contains the cached error page
 	body []byte
 	// important headers
 	header http.Header
 }
 
+// Check if the request is within the scope of this ErrorPage. A nil request
+// only matches pages with no scope.
+func (e *ErrorPage) Matches(req *http.Request) bool {
+	if req == nil {
+		return len(e.Methods) == 0 && e.PathPrefix == ""
+	}
+
+	if !strings.HasPrefix(req.URL.Path, e.PathPrefix) {
+		return false
+	}
+
+	if len(e.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range e.Methods {
+		if strings.EqualFold(m, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// How specific this page's scope is. A longer path prefix is more specific
+// than a method match.
+func (e *ErrorPage) specificity() int {
+	s := 2 * len(e.PathPrefix)
+	if len(e.Methods) > 0 {
+		s++
+	}
+	return s
+}
+
+// The URLs the page can be fetched from, in order of preference.
+func (e *ErrorPage) URLs() []string {
+	return append([]string{e.Location}, e.Fallbacks...)
+}
+
 func (e *ErrorPage) Body() []byte {
 	e.Lock()
 	defer e.Unlock()
@@ -274,15 +431,23 @@ type ErrorResponse struct {
 	sync.Mutex
 
 	// map them by status for responses
-	pages map[int]*ErrorPage
+	pages map[int][]*ErrorPage
 
 	// keep this handy to refresh the pages
 	client *http.Client
+
+	// retry failed fetches when pages are added
+	retries       int
+	retryInterval time.Duration
+
+	// closed when the pages are replaced, to stop any pending retries
+	replaced chan struct{}
 }
 
-func NewErrorResponse(pages map[string][]int) *ErrorResponse {
+func NewErrorResponse(pages map[string][]int, rules []client.ErrorPageConfig) *ErrorResponse {
 	errors := &ErrorResponse{
-		pages: make(map[int]*ErrorPage),
+		pages:    make(map[int][]*ErrorPage),
+		replaced: make(chan struct{}),
 	}
 
 	// aggressively timeout connections
@@ -296,20 +461,29 @@ func NewErrorResponse(pages map[string][]int) *ErrorResponse {
 		Timeout: 5 * time.Second,
 	}
 
-	if pages != nil {
-		errors.Update(pages)
+	if pages != nil || rules != nil {
+		errors.Update(pages, rules)
 	}
 	return errors
 }
 
-// Get the ErrorPage, returning nil if the page was incomplete.
+// Get the most specific ErrorPage for the request, returning nil if the page
+// was incomplete.
 // We permanently cache error pages and headers once we've seen them.
-func (e *ErrorResponse) Get(code int) *ErrorPage {
+func (e *ErrorResponse) Get(code int, req *http.Request) *ErrorPage {
 	e.Lock()
-	page, ok := e.pages[code]
+	var page *ErrorPage
+	for _, p := range e.pages[code] {
+		if !p.Matches(req) {
+			continue
+		}
+		if page == nil || p.specificity() > page.specificity() {
+			page = p
+		}
+	}
 	e.Unlock()
 
-	if !ok {
+	if page == nil {
 		// this is a code we don't handle
 		return nil
 	}
@@ -324,12 +498,57 @@ func (e *ErrorResponse) Get(code int) *ErrorPage {
 	return page
 }
 
-func (e *ErrorResponse) fetch(page *ErrorPage) {
-	log.Debugf("Fetching error page from %s", page.Location)
-	resp, err := e.client.Get(page.Location)
+// Set the number of retries for pages which fail to be fetched when they're
+// added, and the delay before the first retry. The delay doubles after each
+// attempt. This only applies to pages added after the call.
+func (e *ErrorResponse) SetRetries(retries int, interval time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+
+	if interval <= 0 {
+		interval = client.DefaultErrorPageRetryInterval * time.Millisecond
+	}
+	e.retries = retries
+	e.retryInterval = interval
+}
+
+// Fetch a newly added page, retrying with backoff until it succeeds, the
+// retries are exhausted, or the page is replaced.
+func (e *ErrorResponse) fetchRetry(page *ErrorPage, retries int, interval time.Duration, replaced chan struct{}) {
+	for i := 0; ; i++ {
+		if e.fetch(page) || i >= retries {
+			return
+		}
+
+		log.Debugf("Retrying error page %s in %s", page.Location, interval)
+		select {
+		case <-time.After(interval):
+		case <-replaced:
+			return
+		}
+		interval *= 2
+	}
+}
+
+// Fetch and cache the page from the first of its URLs that returns it,
+// returning false if they all failed.
+func (e *ErrorResponse) fetch(page *ErrorPage) bool {
+	for _, loc := range page.URLs() {
+		if e.fetchURL(page, loc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch and cache the page from a single URL, returning false if the fetch
+// failed.
+func (e *ErrorResponse) fetchURL(page *ErrorPage, loc string) bool {
+	log.Debugf("Fetching error page from %s", loc)
+	resp, err := e.client.Get(loc)
 	if err != nil {
-		log.Warnf("Could not fetch %s: %s", page.Location, err.Error())
-		return
+		log.Warnf("Could not fetch %s: %s", loc, err.Error())
+		return false
 	}
 	defer resp.Body.Close()
 
@@ -342,8 +561,8 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Warnf("Server returned %d when fetching %s", resp.StatusCode, page.Location)
-		return
+		log.Warnf("Server returned %d when fetching %s", resp.StatusCode, loc)
+		return false
 	}
 
 	header := make(map[string][]string)
@@ -356,41 +575,60 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Warnf("Error reading response from %s: %s", page.Location, err.Error())
-		return
+		log.Warnf("Error reading response from %s: %s", loc, err.Error())
+		return false
 	}
 
 	if len(body) > 0 {
 		page.SetHeader(header)
 		page.SetBody(body)
-		return
+		return true
 	}
-	log.Warnf("Empty response from %s", page.Location)
+	log.Warnf("Empty response from %s", loc)
+	return false
 }
 
 // This replaces all existing ErrorPages
-func (e *ErrorResponse) Update(pages map[string][]int) {
+func (e *ErrorResponse) Update(pages map[string][]int, rules []client.ErrorPageConfig) {
 	e.Lock()
 	defer e.Unlock()
 
-	e.pages = make(map[int]*ErrorPage)
+	e.pages = make(map[int][]*ErrorPage)
+
+	// stop retrying any pages we're replacing
+	close(e.replaced)
+	e.replaced = make(chan struct{})
 
 	for loc, codes := range pages {
-		page := &ErrorPage{
+		e.add(&ErrorPage{
 			StatusCodes: codes,
 			Location:    loc,
-		}
+		})
+	}
 
-		for _, code := range codes {
-			e.pages[code] = page
-		}
-		go e.fetch(page)
+	for _, rule := range rules {
+		e.add(&ErrorPage{
+			StatusCodes: rule.StatusCodes,
+			Location:    rule.Location,
+			Fallbacks:   rule.Fallbacks,
+			Methods:     rule.Methods,
+			PathPrefix:  rule.PathPrefix,
+		})
+	}
+}
+
+// register a page under each of its status codes, and start fetching it.
+// ErrorResponse must be locked.
+func (e *ErrorResponse) add(page *ErrorPage) {
+	for _, code := range page.StatusCodes {
+		e.pages[code] = append(e.pages[code], page)
 	}
+	go e.fetchRetry(page, e.retries, e.retryInterval, e.replaced)
 }
 
 func (e *ErrorResponse) CheckResponse(pr *ProxyRequest) bool {
 
-	errPage := e.Get(pr.Response.StatusCode)
+	errPage := e.Get(pr.Response.StatusCode, pr.Request)
 	if errPage != nil {
 		// load the cached headers
 		header := pr.ResponseWriter.Header()
@@ -412,7 +650,8 @@ func logRequest(req *http.Request, statusCode int, backend string, proxyError er
 	url := req.Host + req.RequestURI
 	agent := req.UserAgent()
 
-	clientIP := req.Header.Get("X-Forwarded-For")
+	// X-Real-IP is set by the service from a trusted X-Forwarded-For
+	clientIP := req.Header.Get("X-Real-IP")
 	if clientIP == "" {
 		clientIP = req.RemoteAddr
 	}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/litl/shuttle/log"
+)
+
+// A log file which is rotated when it grows past maxSize bytes, keeping up to
+// maxBackups old files named path.1, path.2, and so on, with path.1 the
+// newest. A maxSize of 0 never rotates, leaving it to an external tool like
+// logrotate, which can signal shuttle to reopen the file.
+type logFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// Open the log file at path for appending, creating it if needed.
+func openLogFile(path string, maxSize int64, maxBackups int) (*logFile, error) {
+	l := &logFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// logFile must be locked.
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write p to the file, rotating it first if p would take it past maxSize.
+// A single write is never split across files.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// keep logging to the current file, rather than losing the line
+			fmt.Fprintf(os.Stderr, "ERROR: rotating log file %s: %s\n", l.path, err)
+		}
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Shift the backups along, dropping the oldest, move the current file to
+// path.1, and open a new file. logFile must be locked.
+func (l *logFile) rotate() error {
+	if l.maxBackups <= 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+
+	for i := l.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(l.backup(i), l.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(l.path, l.backup(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+// The path of the nth backup
+func (l *logFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// Close and reopen the file at path, after it's been moved by another tool.
+func (l *logFile) Reopen() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.open()
+}
+
+func (l *logFile) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+// Reopen the log file each time shuttle receives a SIGUSR1, for logrotate.
+func reopenOnUSR1(l *logFile) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	for range usr1 {
+		if err := l.Reopen(); err != nil {
+			// the old file is still open, so this can still be logged
+			log.Errorf("ERROR: reopening log file %s: %s", l.path, err)
+			continue
+		}
+		log.Printf("Reopened log file %s", l.path)
+	}
+}
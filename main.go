@@ -2,8 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
@@ -16,6 +23,12 @@ var (
 	// The default config is loaded if this file does not exist.
 	stateConfig string
 
+	// DNS server for resolving backend hostnames
+	resolverAddr string
+
+	// Load the state config, but never write it
+	noStateWrite bool
+
 	// Listen addressed for the http servers.
 	httpAddr  string
 	httpsAddr string
@@ -35,6 +48,68 @@ var (
 
 	// SSL Certificate directory
 	certDir string
+
+	// Number of times to retry binding a service listener
+	bindRetries int
+
+	// Maximum delay between retries of temporary Accept errors
+	acceptBackoffMax time.Duration
+
+	// Default time to wait for active connections when restarting a service
+	restartDrain time.Duration
+
+	// Balancing scheme for services which don't set one
+	defaultBalance string
+
+	// Warn when a backend's TLS certificate expires within this window
+	certWarning time.Duration
+
+	// Recover from panics in connection handlers
+	recoverPanics bool
+
+	// Copy TCP connections without timeouts with splice where available
+	spliceConns bool
+
+	// Register the pprof handlers on the admin server
+	enablePprof bool
+
+	// Comma separated networks allowed to use the admin server
+	adminAllow string
+
+	// Where the state config is kept, and the server and key for a remote
+	// store
+	configStoreType string
+	configStoreAddr string
+	configStoreKey  string
+
+	// Exit if the config can't be loaded completely
+	strictConfig bool
+
+	// Validate this config file and exit, without starting shuttle
+	configCheck string
+
+	// Proxy a connection and request through a local service, and exit
+	selfTestMode bool
+
+	// Maximum number of registered services, or 0 for no limit
+	maxServices int
+
+	// Maximum number of health checks in progress at once, or 0 for no limit
+	maxHealthChecks int
+
+	// Send backend stats to a statsd server
+	statsdAddr     string
+	statsdPrefix   string
+	statsdInterval time.Duration
+
+	// Prefix for metric paths in the Graphite stats format
+	graphitePrefix string
+
+	// Log to this file instead of stderr, rotating it at logMaxSize
+	// megabytes and keeping logMaxBackups old files
+	logFilePath   string
+	logMaxSize    int
+	logMaxBackups int
 )
 
 func init() {
@@ -43,9 +118,35 @@ func init() {
 	flag.StringVar(&adminListenAddr, "admin", "127.0.0.1:9090", "admin http server address")
 	flag.StringVar(&defaultConfig, "config", "", "default config file")
 	flag.StringVar(&stateConfig, "state", "", "updated config which reflects the internal state")
+	flag.StringVar(&configStoreType, "config-store", "file", "where the state config is kept: file, consul or etcd")
+	flag.StringVar(&configStoreAddr, "config-store-addr", "http://127.0.0.1:8500", "consul or etcd server url for the config store")
+	flag.StringVar(&configStoreKey, "config-store-key", "shuttle/config", "key holding the state config in consul or etcd")
+	flag.BoolVar(&noStateWrite, "no-state-write", false, "load the state config, but don't write changes to it")
 	flag.StringVar(&certDir, "certs", "./", "directory containing SSL Certficates and Keys")
 	flag.BoolVar(&debug, "debug", false, "verbose logging")
+	flag.StringVar(&logFilePath, "log-file", "", "log to this file instead of stderr, reopening it on SIGUSR1")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "rotate the log file when it reaches this many megabytes, 0 to never rotate")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 5, "number of rotated log files to keep")
 	flag.BoolVar(&version, "v", false, "display version")
+	flag.BoolVar(&enablePprof, "pprof", false, "enable pprof handlers on the admin server")
+	flag.StringVar(&adminAllow, "admin-allow", "", "comma separated networks allowed to use the admin server, like '10.0.0.0/8,127.0.0.1/32'")
+	flag.BoolVar(&strictConfig, "strict-config", false, "exit on any error loading the initial config")
+	flag.StringVar(&configCheck, "config-check", "", "validate this config file and exit, without starting shuttle")
+	flag.BoolVar(&selfTestMode, "selftest", false, "proxy a connection and a request through a local test service, and exit")
+	flag.BoolVar(&recoverPanics, "recover", true, "recover from panics in connection handlers")
+	flag.BoolVar(&spliceConns, "splice", true, "splice tcp connections without timeouts, where supported")
+	flag.IntVar(&maxServices, "max-services", 0, "maximum number of services, 0 for no limit")
+	flag.IntVar(&maxHealthChecks, "max-health-checks", 0, "maximum number of backend health checks in progress at once, 0 for no limit")
+	flag.IntVar(&bindRetries, "bind-retries", 0, "number of times to retry a failed service listener bind")
+	flag.DurationVar(&acceptBackoffMax, "accept-backoff", time.Second, "max delay after temporary accept errors")
+	flag.StringVar(&defaultBalance, "default-balance", client.RoundRobin, "balancing scheme for services which don't set one, RR or LC")
+	flag.DurationVar(&certWarning, "cert-warning", 30*24*time.Hour, "warn when a backend's TLS certificate expires within this window")
+	flag.DurationVar(&restartDrain, "restart-drain", time.Second, "time to wait for active connections when restarting a service")
+	flag.StringVar(&resolverAddr, "resolver", "", "DNS server address for backend hostnames, instead of the system resolver")
+	flag.StringVar(&statsdAddr, "statsd", "", "statsd server address for backend stats")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "shuttle", "prefix for statsd metric names")
+	flag.DurationVar(&statsdInterval, "statsd-interval", 10*time.Second, "interval between sending stats to statsd")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", "shuttle", "prefix for metric paths in graphite formatted stats")
 
 	flag.BoolVar(&httpsRedirect, "https-redirect", false, "redirect all http vhost requests to https")
 	flag.BoolVar(&httpsRedirect, "sslOnly", false, "require https (deprecated)")
@@ -63,13 +164,86 @@ func main() {
 		return
 	}
 
+	if logFilePath != "" {
+		if logMaxSize < 0 || logMaxBackups < 0 {
+			log.Fatal("log-max-size and log-max-backups can't be negative")
+		}
+		lf, err := openLogFile(logFilePath, int64(logMaxSize)<<20, logMaxBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.DefaultLogger.SetOutput(lf)
+		go reopenOnUSR1(lf)
+	}
+
+	if configCheck != "" {
+		os.Exit(runConfigCheck(configCheck))
+	}
+
+	if selfTestMode {
+		os.Exit(runSelfTest())
+	}
+
 	log.Printf("Starting shuttle %s", buildVersion)
-	loadConfig()
+
+	if err := client.ValidateBalance(defaultBalance); err != nil {
+		log.Fatal(err)
+	}
+	client.DefaultBalance = defaultBalance
+
+	store, err := newRemoteStore(configStoreType, configStoreAddr, configStoreKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	remoteStore = store
+
+	adminNets, err = parseAdminAllow(adminAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if maxHealthChecks > 0 {
+		checkSlots = make(chan struct{}, maxHealthChecks)
+	}
+
+	if resolverAddr != "" {
+		log.Printf("Resolving backends with %s", resolverAddr)
+		backendResolver = newResolver(resolverAddr)
+	}
+
+	// shuttle isn't healthy until the config is loaded, and all the
+	// listeners are bound. The admin server is started first, so the health
+	// status can be queried during startup.
+	startup.Begin("config")
+	if httpAddr != "" {
+		startup.Begin("http")
+	}
+	if httpsAddr != "" {
+		startup.Begin("https")
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go startAdminHTTPServer(&wg)
 
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	startup.Done("config", nil)
+
+	go reloadOnHangup()
+
+	if remoteStore != nil {
+		go watchConfig(remoteStore)
+	}
+
+	if statsdAddr != "" {
+		if statsdInterval <= 0 {
+			log.Fatal("statsd-interval must be greater than 0")
+		}
+		go startStatsd()
+	}
+
 	if httpAddr != "" {
 		wg.Add(1)
 		go startHTTPServer(&wg)
@@ -81,3 +255,114 @@ func main() {
 	}
 	wg.Wait()
 }
+
+// Validate the config file for -config-check, printing each error, and return
+// the exit status.
+func runConfigCheck(path string) int {
+	if err := client.ValidateBalance(defaultBalance); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client.DefaultBalance = defaultBalance
+
+	err := checkConfig(path)
+	if err == nil {
+		fmt.Printf("%s: config ok\n", path)
+		return 0
+	}
+
+	cfgErrs, ok := err.(client.ConfigErrors)
+	if !ok {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	names := make([]string, 0, len(cfgErrs))
+	for name := range cfgErrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "%s: invalid config\n", path)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", name, cfgErrs[name])
+	}
+	return 1
+}
+
+// Reload the -config file each time shuttle receives a SIGHUP. A reload which
+// fails is logged, and the running config is unchanged.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		log.Printf("Reloading config on SIGHUP")
+		if err := reloadConfig(); err != nil {
+			log.Errorf("ERROR: config not reloaded: %s", err)
+			continue
+		}
+		log.Printf("Reloaded config from %s", defaultConfig)
+	}
+}
+
+// Tracks the steps of startup, so that the health status can report whether
+// shuttle is ready to receive traffic.
+type startupState struct {
+	sync.Mutex
+	pending map[string]bool
+	errors  map[string]string
+}
+
+var startup = &startupState{}
+
+// Mark a startup step as in progress.
+func (s *startupState) Begin(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending == nil {
+		s.pending = make(map[string]bool)
+	}
+	s.pending[name] = true
+}
+
+// Mark a startup step as complete. If err is not nil the step failed, and
+// shuttle will not report healthy.
+func (s *startupState) Done(name string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.pending, name)
+	if err == nil {
+		return
+	}
+
+	log.Errorf("ERROR: %s failed to start: %s", name, err)
+	if s.errors == nil {
+		s.errors = make(map[string]string)
+	}
+	s.errors[name] = err.Error()
+}
+
+// Add the startup state to the health status.
+func (s *startupState) Check(health *HealthStatus) {
+	s.Lock()
+	defer s.Unlock()
+
+	for name := range s.pending {
+		health.Starting = append(health.Starting, name)
+	}
+	sort.Strings(health.Starting)
+
+	if len(s.errors) > 0 {
+		health.StartupErrors = make(map[string]string)
+		for name, err := range s.errors {
+			health.StartupErrors[name] = err
+		}
+	}
+
+	if len(health.Starting) > 0 || len(health.StartupErrors) > 0 {
+		health.Healthy = false
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// Largest request body copied to the mirror. Requests with a larger body, or
+// a chunked body of unknown length, aren't mirrored, so the real request is
+// never held up buffering a large upload.
+const mirrorMaxBody = 64 << 10
+
+// Maximum mirror requests in flight for a service. Sampled requests are
+// skipped while the mirror is this far behind, rather than piling up.
+const mirrorMaxPending = 64
+
+// Send a copy of the request to the service's MirrorAddr, if it's sampled.
+// The copy is sent in the background and its response is discarded, so the
+// mirror can't change the client's response, or delay it beyond reading a
+// small request body.
+func (s *Service) mirrorRequest(r *http.Request) {
+	s.Lock()
+	addr, sample := s.MirrorAddr, s.MirrorSample
+	timeout := s.ServerTimeout
+	s.Unlock()
+
+	if addr == "" || sample <= 0 || rand.Float64() >= sample {
+		return
+	}
+
+	if r.ContentLength < 0 || r.ContentLength > mirrorMaxBody {
+		atomic.AddInt64(&s.MirrorSkipped, 1)
+		return
+	}
+
+	select {
+	case s.mirrorSlots <- struct{}{}:
+	default:
+		atomic.AddInt64(&s.MirrorSkipped, 1)
+		return
+	}
+
+	body := make([]byte, r.ContentLength)
+	if n, err := io.ReadFull(r.Body, body); err != nil {
+		// put back what was read, and leave the error for the real request
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body[:n]), r.Body))
+		atomic.AddInt64(&s.MirrorSkipped, 1)
+		<-s.mirrorSlots
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	req, err := http.NewRequest(r.Method, "http://"+addr+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		atomic.AddInt64(&s.MirrorErrors, 1)
+		<-s.mirrorSlots
+		return
+	}
+	req.Host = r.Host
+
+	// copy the headers now, since the proxy may modify the originals
+	copyHeader(req.Header, r.Header)
+	removeHopHeaders(req.Header)
+
+	if timeout <= 0 {
+		timeout = client.DefaultTimeout * time.Millisecond
+	}
+
+	atomic.AddInt64(&s.MirrorRequests, 1)
+	go func() {
+		defer func() { <-s.mirrorSlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		resp, err := s.mirrorTransport.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			atomic.AddInt64(&s.MirrorErrors, 1)
+			log.Debugf("Mirror request for %s to %s failed: %s", s.Name, addr, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			atomic.AddInt64(&s.MirrorErrors, 1)
+		}
+	}()
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"strconv"
 	"testing"
 
 	"github.com/litl/shuttle/client"
@@ -204,3 +208,81 @@ func BenchmarkHTTPProxyKeepalive(b *testing.B) {
 	}
 
 }
+
+// Send a stream of data through the TCP proxy, to compare copying with and
+// without splice.
+func benchmarkTCPThroughput(b *testing.B, splice bool) {
+	setupBench(b)
+	defer tearDownBench(b)
+
+	defer func(orig bool) { spliceConns = orig }(spliceConns)
+	spliceConns = splice
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	// discard everything, then respond with the count once the client closes
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(ioutil.Discard, conn)
+				fmt.Fprintf(conn, "%d", n)
+			}()
+		}
+	}()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "ThroughputTest",
+		Addr:          "127.0.0.1:9000",
+		AllowHalfOpen: true,
+		Backends: []client.BackendConfig{
+			{Name: "discard", Addr: l.Addr().String()},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		b.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9000")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 64<<10)
+	b.SetBytes(int64(len(buff)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buff); err != nil {
+			b.Fatal("Error during Write:", err)
+		}
+	}
+
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		b.Fatal("Error during Read:", err)
+	}
+	b.StopTimer()
+
+	if string(resp) != strconv.Itoa(b.N*len(buff)) {
+		b.Fatalf("Error in Response: %s", resp)
+	}
+}
+
+func BenchmarkTCPThroughput(b *testing.B) {
+	benchmarkTCPThroughput(b, false)
+}
+
+func BenchmarkTCPThroughputSplice(b *testing.B) {
+	benchmarkTCPThroughput(b, true)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
@@ -16,6 +18,7 @@ var (
 	ErrNoBackend        = fmt.Errorf("backend does not exist")
 	ErrDuplicateService = fmt.Errorf("service already exists")
 	ErrDuplicateBackend = fmt.Errorf("backend already exists")
+	ErrMaxServices      = fmt.Errorf("maximum number of services reached")
 )
 
 type multiError struct {
@@ -42,6 +45,22 @@ func (e multiError) String() string {
 	return e.Error()
 }
 
+// Return true if err is target, or a multiError containing target.
+func hasError(err, target error) bool {
+	switch e := err.(type) {
+	case *multiError:
+		return hasError(*e, target)
+	case multiError:
+		for _, err := range e.errors {
+			if err == target {
+				return true
+			}
+		}
+		return false
+	}
+	return err == target
+}
+
 type VirtualHost struct {
 	sync.Mutex
 	Name string
@@ -131,25 +150,70 @@ func (v *VirtualHost) Service() *Service {
 
 //TODO: notify or prevent vhost name conflicts between services.
 // ServiceRegistry is a global container for all configured services.
+// The registry lock only guards the maps of services and vhosts. Changes to a
+// service are serialized by the service's own updateLock, so that slow
+// operations, like binding a listener, don't block other services.
 type ServiceRegistry struct {
-	sync.Mutex
+	sync.RWMutex
 	svcs map[string]*Service
 	// Multiple services may respond from a single vhost
 	vhosts map[string]*VirtualHost
 
 	// Global config to apply to new services.
 	cfg client.Config
+
+	// The parsed global TrustedProxies
+	trustedNets []*net.IPNet
+
+	// Services which failed to start, and the reason why.
+	failed map[string]failedService
+
+	// Services which are being started, and aren't registered yet.
+	adding map[string]bool
+
+	// Global maintenance mode, set through the admin server.
+	maintenance MaintenanceStatus
+
+	// Backends indexed by tag, with the service each belongs to.
+	tags map[string]map[*Backend]*Service
 }
 
-// Update the global config state, including services and backends.
-// This does not remove any Services, but will add or update any provided in
-// the config.
-func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
+// The global maintenance state. While Enabled, every HTTP service serves its
+// maintenance response, and if TCP is set, TCP connections are closed as soon
+// as they're accepted.
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+	TCP     bool `json:"tcp"`
+}
 
-	// Set globals
-	// TODO: we might need to unset something
-	// TODO: this should remove services and backends to match the submitted config
+// A service that could not be started, retained so that we can report the
+// error.
+type failedService struct {
+	cfg client.ServiceConfig
+	err error
+}
+
+// The health status returned by the admin server.
+type HealthStatus struct {
+	Healthy        bool              `json:"healthy"`
+	FailedServices map[string]string `json:"failed_services,omitempty"`
+
+	// Startup steps which haven't completed, or have failed
+	Starting      []string          `json:"starting,omitempty"`
+	StartupErrors map[string]string `json:"startup_errors,omitempty"`
 
+	// Set while in global maintenance mode, which is reported as unhealthy
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// Update the global default settings, ignoring any services in the config.
+// Only non-zero values are applied, so a partial config leaves the other
+// defaults unchanged.
+func (s *ServiceRegistry) UpdateGlobals(cfg client.Config) {
+	s.Lock()
+	defer s.Unlock()
+
+	// TODO: we might need to unset something
 	if cfg.Balance != "" {
 		s.cfg.Balance = cfg.Balance
 	}
@@ -171,12 +235,132 @@ func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
 	if cfg.DialTimeout != 0 {
 		s.cfg.DialTimeout = cfg.DialTimeout
 	}
+	if cfg.MaxURILength > 0 {
+		s.cfg.MaxURILength = cfg.MaxURILength
+	}
+	if cfg.MaintenanceBody != "" {
+		s.cfg.MaintenanceBody = cfg.MaintenanceBody
+	}
+	if cfg.MaintenanceContentType != "" {
+		s.cfg.MaintenanceContentType = cfg.MaintenanceContentType
+	}
+	if cfg.TrustedProxies != nil {
+		s.cfg.TrustedProxies = cfg.TrustedProxies
+		s.trustedNets = parseCIDRs(cfg.TrustedProxies)
+	}
+	if cfg.SendBufferBytes != 0 {
+		s.cfg.SendBufferBytes = cfg.SendBufferBytes
+	}
+	if cfg.RecvBufferBytes != 0 {
+		s.cfg.RecvBufferBytes = cfg.RecvBufferBytes
+	}
 
 	// apply the https rediect flag
 	if httpsRedirect {
 		s.cfg.HTTPSRedirect = true
 	}
+}
+
+// Update the global config state, including services and backends.
+// This does not remove any Services, but will add or update any provided in
+// the config. The services are all validated first, and if any are invalid
+// none of the config is applied.
+func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
+	if err := s.validateConfig(cfg); err != nil {
+		return err
+	}
+
+	err := s.updateConfig(cfg)
+	go writeStateConfig()
+	return err
+}
+
+// Apply the globals and services from a config which has been validated.
+func (s *ServiceRegistry) updateConfig(cfg client.Config) error {
+	s.UpdateGlobals(cfg)
+
+	errors := &multiError{}
 
+	for _, svc := range cfg.Services {
+		// Add a new service, or update an existing one.
+		if Registry.GetService(svc.Name) == nil {
+			if err := Registry.AddService(svc); err != nil {
+				log.Errorln("Unable to add service %s: %s", svc.Name, err.Error())
+				errors.Add(err)
+				continue
+			}
+		} else if err := Registry.UpdateService(svc); err != nil {
+			log.Errorln("Unable to update service %s: %s", svc.Name, err.Error())
+			errors.Add(err)
+			continue
+		}
+	}
+
+	if errors.Len() == 0 {
+		return nil
+	}
+	return errors
+}
+
+// Make the running services and backends match the config. Services are added
+// or updated as with UpdateConfig, and those which aren't in the config are
+// removed, along with any backends no longer listed for a service. Like
+// UpdateConfig, nothing is applied if any service is invalid. The state config
+// isn't written, which is left to the caller.
+func (s *ServiceRegistry) ReplaceConfig(cfg client.Config) error {
+	// a service listed without backends should have none, rather than keep
+	// the ones it has
+	listed := make(map[string]bool)
+	services := make([]client.ServiceConfig, len(cfg.Services))
+	for i, svc := range cfg.Services {
+		if svc.Backends == nil {
+			svc.Backends = []client.BackendConfig{}
+		}
+		services[i] = svc
+		listed[svc.Name] = true
+	}
+	cfg.Services = services
+
+	if err := s.validateConfig(cfg); err != nil {
+		return err
+	}
+
+	errors := &multiError{}
+	if err := s.updateConfig(cfg); err != nil {
+		errors.Add(err)
+	}
+
+	s.RLock()
+	var removed []string
+	for name := range s.svcs {
+		if !listed[name] {
+			removed = append(removed, name)
+		}
+	}
+	for name := range s.failed {
+		if !listed[name] {
+			removed = append(removed, name)
+		}
+	}
+	s.RUnlock()
+
+	for _, name := range removed {
+		log.Printf("Removing service %s, which is no longer in the config", name)
+		if err := s.RemoveService(name); err != nil {
+			errors.Add(err)
+		}
+	}
+
+	if errors.Len() == 0 {
+		return nil
+	}
+	return errors
+}
+
+// Check each service in the config as it would be applied, with updates to
+// existing services merged into their current config, returning all the
+// errors found.
+func (s *ServiceRegistry) validateConfig(cfg client.Config) error {
 	invalidPorts := []string{
 		// FIXME: lookup bound addresses some other way.  We may have multiple
 		//        http listeners, as well as all listening Services.
@@ -185,31 +369,45 @@ func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
 	}
 
 	errors := &multiError{}
+	added := 0
 
 	for _, svc := range cfg.Services {
+		conflict := false
 		for _, port := range invalidPorts {
-			if strings.HasSuffix(svc.Addr, port) {
+			if hasPort(svc.Addrs(), port) {
 				// TODO: report conflicts between service listeners
 				errors.Add(fmt.Errorf("Port conflict: %s port %s already bound by shuttle", svc.Name, port))
-				continue
+				conflict = true
 			}
 		}
+		if conflict {
+			continue
+		}
 
-		// Add a new service, or update an existing one.
-		if Registry.GetService(svc.Name) == nil {
-			if err := Registry.AddService(svc); err != nil {
-				log.Errorln("Unable to add service %s: %s", svc.Name, err.Error())
-				errors.Add(err)
-				continue
-			}
-		} else if err := Registry.UpdateService(svc); err != nil {
-			log.Errorln("Unable to update service %s: %s", svc.Name, err.Error())
+		if current := s.GetService(svc.Name); current != nil {
+			svc = current.Config().Merge(svc)
+		} else {
+			added++
+		}
+
+		if err := svc.Validate(); err != nil {
 			errors.Add(err)
 			continue
 		}
+		if _, err := client.ExpandBackends(svc.Backends); err != nil {
+			errors.Add(err)
+		}
+		if err := checkMaintenanceFile(svc.MaintenanceFile); err != nil {
+			errors.Add(err)
+		}
 	}
 
-	go writeStateConfig()
+	s.RLock()
+	running := len(s.svcs) + len(s.adding)
+	s.RUnlock()
+	if maxServices > 0 && added > 0 && running+added > maxServices {
+		errors.Add(ErrMaxServices)
+	}
 
 	if errors.Len() == 0 {
 		return nil
@@ -219,15 +417,15 @@ func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
 
 // Return a service by name.
 func (s *ServiceRegistry) GetService(name string) *Service {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 	return s.svcs[name]
 }
 
 // Return a service that handles a particular vhost by name.
 func (s *ServiceRegistry) GetVHostService(name string) *Service {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	if vhost := s.vhosts[name]; vhost != nil {
 		return vhost.Service()
@@ -235,34 +433,144 @@ func (s *ServiceRegistry) GetVHostService(name string) *Service {
 	return nil
 }
 
-func (s *ServiceRegistry) VHostsLen() int {
+// The maximum HTTP request URI length for a service, using the global limit
+// unless the service has its own.
+func (s *ServiceRegistry) MaxURILength(svc *Service) int {
+	if svc != nil {
+		svc.Lock()
+		limit := svc.MaxURILength
+		svc.Unlock()
+		if limit > 0 {
+			return limit
+		}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	if s.cfg.MaxURILength > 0 {
+		return s.cfg.MaxURILength
+	}
+	return client.DefaultMaxURILength
+}
+
+// The networks of proxies trusted to report the client address for a
+// service, using the global TrustedProxies unless the service has its own.
+func (s *ServiceRegistry) TrustedNets(svc *Service) []*net.IPNet {
+	if svc != nil {
+		svc.Lock()
+		nets := svc.trustedNets
+		svc.Unlock()
+		if len(nets) > 0 {
+			return nets
+		}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.trustedNets
+}
+
+// Enable or disable global maintenance mode.
+func (s *ServiceRegistry) SetMaintenance(m MaintenanceStatus) {
 	s.Lock()
 	defer s.Unlock()
+
+	if m.Enabled {
+		log.Printf("Enabling global maintenance mode, tcp=%t", m.TCP)
+	} else {
+		log.Printf("Disabling global maintenance mode")
+		m.TCP = false
+	}
+	s.maintenance = m
+}
+
+func (s *ServiceRegistry) Maintenance() MaintenanceStatus {
+	s.RLock()
+	defer s.RUnlock()
+	return s.maintenance
+}
+
+// Return the global maintenance response, for services without their own.
+func (s *ServiceRegistry) maintenancePage() (body, contentType string) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cfg.MaintenanceBody, s.cfg.MaintenanceContentType
+}
+
+func (s *ServiceRegistry) VHostsLen() int {
+	s.RLock()
+	defer s.RUnlock()
 	return len(s.vhosts)
 }
 
 // Add a new service to the Registry.
 // Do not replace an existing service.
 func (s *ServiceRegistry) AddService(svcCfg client.ServiceConfig) error {
-	s.Lock()
-	defer s.Unlock()
+	if err := svcCfg.Validate(); err != nil {
+		return err
+	}
 
+	// reserve the name while the service starts, without holding the lock
+	s.Lock()
 	log.Debug("Adding service:", svcCfg.Name)
-	if _, ok := s.svcs[svcCfg.Name]; ok {
+	if _, ok := s.svcs[svcCfg.Name]; ok || s.adding[svcCfg.Name] {
+		s.Unlock()
 		log.Debug("Service already exists:", svcCfg.Name)
 		return ErrDuplicateService
 	}
+	if maxServices > 0 && len(s.svcs)+len(s.adding) >= maxServices {
+		s.Unlock()
+		log.Warnf("WARN: not adding service %s, limit of %d services reached", svcCfg.Name, maxServices)
+		return ErrMaxServices
+	}
+	if s.adding == nil {
+		s.adding = make(map[string]bool)
+	}
+	s.adding[svcCfg.Name] = true
 
 	s.setServiceDefaults(&svcCfg)
+	s.Unlock()
+
 	svcCfg = svcCfg.SetDefaults()
 
 	service := NewService(svcCfg)
-	err := service.start()
-	if err != nil {
-		return err
+
+	service.Lock()
+	cfgErr := service.loadMaintenanceFile(svcCfg.MaintenanceFile)
+	service.Unlock()
+
+	var startErr error
+	if cfgErr == nil {
+		startErr = service.start()
+		if startErr != nil {
+			log.Errorf("ERROR: service %s failed to start: %s", svcCfg.Name, startErr)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	delete(s.adding, svcCfg.Name)
+
+	if cfgErr != nil || startErr != nil {
+		// shutdown the backend health checks
+		service.stop()
 	}
 
+	if cfgErr != nil {
+		return cfgErr
+	}
+
+	if startErr != nil {
+		if s.failed == nil {
+			s.failed = make(map[string]failedService)
+		}
+		s.failed[svcCfg.Name] = failedService{cfg: svcCfg, err: startErr}
+		return startErr
+	}
+
+	delete(s.failed, service.Name)
 	s.svcs[service.Name] = service
+	s.indexBackends(service)
 
 	svcCfg.VirtualHosts = filterEmpty(svcCfg.VirtualHosts)
 	for _, name := range svcCfg.VirtualHosts {
@@ -278,23 +586,31 @@ func (s *ServiceRegistry) AddService(svcCfg client.ServiceConfig) error {
 }
 
 // Replace the service's configuration, or update its list of backends.
-// Replacing a configuration will shutdown the existing service, and start a
-// new one, which will cause the listening socket to be temporarily
-// unavailable.
+// The running service is updated in place. Only a change of address or network
+// will replace the listener, and existing connections are not interrupted.
 func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
-	s.Lock()
-	defer s.Unlock()
-
 	log.Debug("Updating Service:", newCfg.Name)
-	service, ok := s.svcs[newCfg.Name]
-	if !ok {
+	service := s.lockService(newCfg.Name)
+	if service == nil {
 		log.Debug("Service not found:", newCfg.Name)
 		return ErrNoService
 	}
+	defer service.updateLock.Unlock()
 
 	currentCfg := service.Config()
 	newCfg = currentCfg.Merge(newCfg)
 
+	if err := newCfg.Validate(); err != nil {
+		return err
+	}
+
+	// compare backends with port ranges by the backends they expand into
+	backends, err := client.ExpandBackends(newCfg.Backends)
+	if err != nil {
+		return err
+	}
+	newCfg.Backends = backends
+
 	if err := service.UpdateConfig(newCfg); err != nil {
 		return err
 	}
@@ -309,6 +625,9 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 	for _, backendCfg := range currentCfg.Backends {
 		currentBackends[backendCfg.Name] = backendCfg
 	}
+	for i, newBackend := range newCfg.Backends {
+		newCfg.Backends[i] = newBackend.Unredact(currentBackends[newBackend.Name])
+	}
 
 	// Keep existing backends when they have equivalent config.
 	// Update changed backends, and add new ones.
@@ -335,25 +654,58 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 		service.remove(name)
 	}
 
+	s.Lock()
+	s.indexBackends(service)
+	s.Unlock()
+
 	if currentCfg.Equal(newCfg) {
 		log.Debugf("Service Unchanged %s", service.Name)
 		return nil
 	}
 
 	// replace error pages if there's any change
-	if !reflect.DeepEqual(service.errPagesCfg, newCfg.ErrorPages) {
+	if !reflect.DeepEqual(service.errPagesCfg, newCfg.ErrorPages) ||
+		!reflect.DeepEqual(service.errPageRulesCfg, newCfg.ErrorPageRules) {
 		log.Debugf("Updating ErrorPages")
 		service.errPagesCfg = newCfg.ErrorPages
-		service.errorPages.Update(newCfg.ErrorPages)
+		service.errPageRulesCfg = newCfg.ErrorPageRules
+		service.errorPages.Update(newCfg.ErrorPages, newCfg.ErrorPageRules)
 	}
 
+	s.Lock()
 	s.updateVHosts(service, filterEmpty(newCfg.VirtualHosts))
+	s.Unlock()
 
 	return nil
 }
 
+// Return the named service with its updateLock held, or nil if the service
+// doesn't exist. The registry lock is only held for the lookup, and the
+// service is checked again once it's locked in case it was removed.
+func (s *ServiceRegistry) lockService(name string) *Service {
+	s.RLock()
+	service := s.svcs[name]
+	s.RUnlock()
+
+	if service == nil {
+		return nil
+	}
+
+	service.updateLock.Lock()
+
+	s.RLock()
+	current := s.svcs[name]
+	s.RUnlock()
+
+	if current != service {
+		service.updateLock.Unlock()
+		return nil
+	}
+	return service
+}
+
 // update the VirtualHost entries for this service
-// only to be called from UpdateService.
+// only to be called from UpdateService, with the registry locked.
 func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 	// We could just clear the vhosts and the new list since we're doing
 	// this all while the registry is locked, but because we want sane log
@@ -418,136 +770,545 @@ func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 }
 
 func (s *ServiceRegistry) RemoveService(name string) error {
+	return s.RemoveServiceDrain(name, 0)
+}
+
+// Remove a service, giving its active connections up to drain to finish after
+// its listeners are closed.
+func (s *ServiceRegistry) RemoveServiceDrain(name string, drain time.Duration) error {
+	svc, err := s.unregisterService(name)
+	if svc == nil {
+		return err
+	}
+
+	// Wait for any update in progress before shutting down. The registry
+	// isn't locked, so other services are unaffected while this one stops.
+	svc.updateLock.Lock()
+	defer svc.updateLock.Unlock()
+	svc.Stop(drain)
+	return nil
+}
+
+// Remove a service and its vhosts from the registry, returning the service so
+// it can be stopped.
+func (s *ServiceRegistry) unregisterService(name string) (*Service, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	// a failed service is only registered to report its error
+	if _, ok := s.failed[name]; ok {
+		log.Debugf("Removing failed Service %s", name)
+		delete(s.failed, name)
+		return nil, nil
+	}
+
 	svc, ok := s.svcs[name]
-	if ok {
-		log.Debugf("Removing Service %s", svc.Name)
-		delete(s.svcs, name)
-		svc.stop()
-
-		for host, vhost := range s.vhosts {
-			vhost.Remove(svc)
-
-			removeVhost := true
-			for _, service := range s.svcs {
-				for _, h := range service.VirtualHosts {
-					if host == h {
-						// FIXME: is this still correct? NOT TESTED!
-						// vhost exists in another service, so leave it
-						removeVhost = false
-						break
-					}
-				}
-			}
-			if removeVhost {
-				log.Debugf("Removing VirtualHost %s", host)
-				delete(s.vhosts, host)
+	if !ok {
+		return nil, ErrNoService
+	}
 
+	log.Debugf("Removing Service %s", svc.Name)
+	delete(s.svcs, name)
+	s.unindexBackends(svc)
+
+	for host, vhost := range s.vhosts {
+		vhost.Remove(svc)
+
+		removeVhost := true
+		for _, service := range s.svcs {
+			for _, h := range service.VirtualHosts {
+				if host == h {
+					// FIXME: is this still correct? NOT TESTED!
+					// vhost exists in another service, so leave it
+					removeVhost = false
+					break
+				}
 			}
 		}
+		if removeVhost {
+			log.Debugf("Removing VirtualHost %s", host)
+			delete(s.vhosts, host)
 
-		return nil
+		}
 	}
-	return ErrNoService
+
+	return svc, nil
 }
 
 func (s *ServiceRegistry) ServiceStats(serviceName string) (ServiceStat, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	service, ok := s.svcs[serviceName]
-	if !ok {
+	service := s.GetService(serviceName)
+	if service == nil {
 		return ServiceStat{}, ErrNoService
 	}
 	return service.Stats(), nil
 }
 
 func (s *ServiceRegistry) ServiceConfig(serviceName string) (client.ServiceConfig, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	service, ok := s.svcs[serviceName]
-	if !ok {
+	service := s.GetService(serviceName)
+	if service == nil {
 		return client.ServiceConfig{}, ErrNoService
 	}
 	return service.Config(), nil
 }
 
 func (s *ServiceRegistry) BackendStats(serviceName, backendName string) (BackendStat, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	service, ok := s.svcs[serviceName]
-	if !ok {
+	service := s.GetService(serviceName)
+	if service == nil {
 		return BackendStat{}, ErrNoService
 	}
 
-	for _, backend := range service.Backends {
-		if backendName == backend.Name {
-			return backend.Stats(), nil
+	backend := service.get(backendName)
+	if backend == nil {
+		return BackendStat{}, ErrNoBackend
+	}
+	return backend.Stats(), nil
+}
+
+func (s *ServiceRegistry) BackendConfig(serviceName, backendName string) (client.BackendConfig, error) {
+	service := s.GetService(serviceName)
+	if service == nil {
+		return client.BackendConfig{}, ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return client.BackendConfig{}, ErrNoBackend
+	}
+	return backend.Config(), nil
+}
+
+// Restart the named service's listeners, see Service.Restart.
+func (s *ServiceRegistry) RestartService(name string, drain time.Duration) error {
+	service := s.lockService(name)
+	if service == nil {
+		return ErrNoService
+	}
+	defer service.updateLock.Unlock()
+
+	return service.Restart(drain)
+}
+
+// Zero the cumulative counters of all services, or only the named service or
+// backend if they're set.
+func (s *ServiceRegistry) ResetStats(svcName, backendName string) error {
+	if svcName == "" {
+		s.RLock()
+		defer s.RUnlock()
+
+		log.Println("Resetting stats")
+		for _, service := range s.svcs {
+			service.ResetStats()
 		}
+		return nil
+	}
+
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	if backendName == "" {
+		log.Printf("Resetting stats for %s", svcName)
+		service.ResetStats()
+		return nil
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
 	}
-	return BackendStat{}, ErrNoBackend
+
+	log.Printf("Resetting stats for %s/%s", svcName, backendName)
+	backend.ResetStats()
+	return nil
+}
+
+// Force a Backend Up or Down for the duration d, or until cleared if d is 0.
+func (s *ServiceRegistry) ForceBackend(svcName, backendName string, up bool, d time.Duration) error {
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	log.Printf("Forcing backend %s/%s up=%t", svcName, backendName, up)
+	backend.Force(up, d)
+	return nil
+}
+
+// Update only the weight of an existing Backend.
+func (s *ServiceRegistry) SetBackendWeight(svcName, backendName string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("invalid weight %d", weight)
+	}
+
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	log.Printf("Setting backend %s/%s weight=%d", svcName, backendName, weight)
+	if !service.SetBackendWeight(backendName, weight) {
+		return ErrNoBackend
+	}
+	return nil
+}
+
+// Drain an existing Backend, or return it to service.
+func (s *ServiceRegistry) SetBackendDrain(svcName, backendName string, drain bool) error {
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	log.Printf("Setting backend %s/%s drain=%t", svcName, backendName, drain)
+	if !service.SetBackendDrain(backendName, drain) {
+		return ErrNoBackend
+	}
+	return nil
+}
+
+// Clear a forced state on a Backend, returning it to health check control.
+func (s *ServiceRegistry) ClearForcedBackend(svcName, backendName string) error {
+	service := s.GetService(svcName)
+	if service == nil {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	log.Printf("Clearing forced state for backend %s/%s", svcName, backendName)
+	backend.ClearForce()
+	return nil
 }
 
 // Add or update a Backend on an existing Service.
 func (s *ServiceRegistry) AddBackend(svcName string, backendCfg client.BackendConfig) error {
-	s.Lock()
-	defer s.Unlock()
+	if err := backendCfg.Validate(); err != nil {
+		return err
+	}
 
-	service, ok := s.svcs[svcName]
-	if !ok {
+	service := s.lockService(svcName)
+	if service == nil {
 		return ErrNoService
 	}
+	defer service.updateLock.Unlock()
 
-	log.Debugf("Adding Backend %s/%s", service.Name, backendCfg.Name)
-	service.add(NewBackend(backendCfg))
+	backends, err := backendCfg.Expand()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range backends {
+		if current := service.get(b.Name); current != nil {
+			b = b.Unredact(current.Config())
+		}
+		log.Debugf("Adding Backend %s/%s", service.Name, b.Name)
+		service.add(NewBackend(b))
+	}
+
+	s.Lock()
+	s.indexBackends(service)
+	s.Unlock()
 	return nil
 }
 
-// Remove a Backend from an existing Service.
+// Remove a Backend from an existing Service. A service with RemoveWhenEmpty
+// is removed along with its last backend.
 func (s *ServiceRegistry) RemoveBackend(svcName, backendName string) error {
-	s.Lock()
-	defer s.Unlock()
-
 	log.Debugf("Removing Backend %s/%s", svcName, backendName)
-	service, ok := s.svcs[svcName]
-	if !ok {
+	service := s.lockService(svcName)
+	if service == nil {
 		return ErrNoService
 	}
+	defer service.updateLock.Unlock()
 
 	if !service.remove(backendName) {
 		return ErrNoBackend
 	}
+
+	s.Lock()
+	s.indexBackends(service)
+	s.Unlock()
+
+	service.Lock()
+	empty := service.RemoveWhenEmpty && len(service.Backends) == 0
+	service.Unlock()
+
+	// stop the service while it's still locked, so no backend can be added
+	// in the meantime
+	if empty {
+		log.Printf("Removing empty service %s", svcName)
+		if _, err := s.unregisterService(svcName); err != nil {
+			return err
+		}
+		service.stop()
+	}
 	return nil
 }
 
+// Index the service's backends by tag, replacing any previous entries for the
+// service. ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) indexBackends(service *Service) {
+	s.unindexBackends(service)
+
+	service.Lock()
+	backends := make([]*Backend, len(service.Backends))
+	copy(backends, service.Backends)
+	service.Unlock()
+
+	for _, b := range backends {
+		for _, tag := range b.tags {
+			if s.tags == nil {
+				s.tags = make(map[string]map[*Backend]*Service)
+			}
+			if s.tags[tag] == nil {
+				s.tags[tag] = make(map[*Backend]*Service)
+			}
+			s.tags[tag][b] = service
+		}
+	}
+}
+
+// Remove the service's backends from the tag index.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) unindexBackends(service *Service) {
+	for tag, backends := range s.tags {
+		for b, svc := range backends {
+			if svc == service {
+				delete(backends, b)
+			}
+		}
+		if len(backends) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+// A backend's stats along with the name of its service, as returned by tag
+// queries.
+type TaggedBackendStat struct {
+	Service string `json:"service"`
+	BackendStat
+}
+
+// Return the backends which have all of the tags, with their services.
+func (s *ServiceRegistry) taggedBackends(tags []string) map[*Backend]*Service {
+	s.RLock()
+	defer s.RUnlock()
+
+	found := make(map[*Backend]*Service)
+	if len(tags) == 0 {
+		return found
+	}
+
+	// start from the smallest set, and keep the backends with every tag
+	first := tags[0]
+	for _, tag := range tags[1:] {
+		if len(s.tags[tag]) < len(s.tags[first]) {
+			first = tag
+		}
+	}
+
+	for b, svc := range s.tags[first] {
+		all := true
+		for _, tag := range tags {
+			if _, ok := s.tags[tag][b]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			found[b] = svc
+		}
+	}
+	return found
+}
+
+// Return the stats of the backends which have all of the tags, sorted by
+// service and backend name.
+func (s *ServiceRegistry) TaggedBackends(tags []string) []TaggedBackendStat {
+	stats := []TaggedBackendStat{}
+	for b, svc := range s.taggedBackends(tags) {
+		stats = append(stats, TaggedBackendStat{Service: svc.Name, BackendStat: b.Stats()})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Service != stats[j].Service {
+			return stats[i].Service < stats[j].Service
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Force all backends which have all of the tags up or down, like
+// ForceBackend. Returns the stats of the backends changed.
+func (s *ServiceRegistry) ForceTaggedBackends(tags []string, up bool, d time.Duration) []TaggedBackendStat {
+	for b, svc := range s.taggedBackends(tags) {
+		log.Printf("Forcing backend %s/%s up=%t", svc.Name, b.Name, up)
+		b.Force(up, d)
+	}
+	return s.TaggedBackends(tags)
+}
+
+// Clear the forced state of all backends which have all of the tags. Returns
+// the stats of the backends changed.
+func (s *ServiceRegistry) ClearForcedTaggedBackends(tags []string) []TaggedBackendStat {
+	for b, svc := range s.taggedBackends(tags) {
+		log.Printf("Clearing forced state for backend %s/%s", svc.Name, b.Name)
+		b.ClearForce()
+	}
+	return s.TaggedBackends(tags)
+}
+
 func (s *ServiceRegistry) Stats() []ServiceStat {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	stats := []ServiceStat{}
 	for _, service := range s.svcs {
 		stats = append(stats, service.Stats())
 	}
 
+	for name, failed := range s.failed {
+		stats = append(stats, ServiceStat{
+			Name:  name,
+			Addr:  failed.cfg.Addr,
+			Error: failed.err.Error(),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
 	return stats
 }
 
-func (s *ServiceRegistry) Config() client.Config {
-	s.Lock()
-	defer s.Unlock()
+// Health reports whether all configured services are running.
+func (s *ServiceRegistry) Health() HealthStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	health := HealthStatus{
+		Healthy:     len(s.failed) == 0 && !s.maintenance.Enabled,
+		Maintenance: s.maintenance.Enabled,
+	}
 
-	// make sure the old ServiceConfigs are purged when we copy the slice
-	s.cfg.Services = nil
+	if len(s.failed) > 0 {
+		health.FailedServices = make(map[string]string)
+		for name, failed := range s.failed {
+			health.FailedServices[name] = failed.err.Error()
+		}
+	}
+
+	return health
+}
+
+func (s *ServiceRegistry) Config() client.Config {
+	s.RLock()
+	defer s.RUnlock()
 
+	// make sure the old ServiceConfigs are purged when we copy the struct
 	cfg := s.cfg
+	cfg.Version = client.ConfigVersion
+	cfg.Services = nil
 	for _, service := range s.svcs {
 		cfg.Services = append(cfg.Services, service.Config())
 	}
 
+	// keep the failed services so they aren't lost from the saved state
+	for _, failed := range s.failed {
+		cfg.Services = append(cfg.Services, failed.cfg)
+	}
+
+	sort.Slice(cfg.Services, func(i, j int) bool {
+		return cfg.Services[i].Name < cfg.Services[j].Name
+	})
+
+	return cfg
+}
+
+// Return the config with the global settings and built in defaults applied to
+// every service and backend, showing the values actually in effect rather
+// than those left unset.
+func (s *ServiceRegistry) EffectiveConfig() client.Config {
+	cfg := s.Config()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for i := range cfg.Services {
+		svc := cfg.Services[i]
+		s.setServiceDefaults(&svc)
+		svc = svc.SetDefaults()
+
+		if svc.MaxURILength == 0 {
+			svc.MaxURILength = s.cfg.MaxURILength
+		}
+		if svc.MaxURILength == 0 {
+			svc.MaxURILength = client.DefaultMaxURILength
+		}
+		if len(svc.TrustedProxies) == 0 {
+			svc.TrustedProxies = s.cfg.TrustedProxies
+		}
+		if svc.StickyCookie && svc.StickyCookieName == "" {
+			svc.StickyCookieName = client.DefaultStickyCookieName
+		}
+		if svc.SniffHTTP && svc.SniffTimeout == 0 {
+			svc.SniffTimeout = client.DefaultSniffTimeout
+		}
+		if svc.AcceptRateAlert > 0 && svc.AcceptRateWindow == 0 {
+			svc.AcceptRateWindow = client.DefaultAcceptRateWindow
+		}
+		if svc.DialFailureWindow == 0 {
+			svc.DialFailureWindow = client.DefaultDialFailureWindow
+		}
+		if svc.EjectErrorRate > 0 && svc.EjectWindow == 0 {
+			svc.EjectWindow = client.DefaultEjectWindow
+		}
+		if svc.EjectErrorRate > 0 && svc.EjectTime == 0 {
+			svc.EjectTime = client.DefaultEjectTime
+		}
+
+		// copy the backends, which may be shared with a failed service
+		backends := make([]client.BackendConfig, len(svc.Backends))
+		for j, b := range svc.Backends {
+			b = b.SetDefaults()
+			if b.MaxConnsServed > 0 && b.RecycleCooldown == 0 {
+				b.RecycleCooldown = client.DefaultRecycleCooldown
+			}
+			backends[j] = b
+		}
+		svc.Backends = backends
+
+		cfg.Services[i] = svc
+	}
+
+	// the globals fall back to the same defaults as services
+	if cfg.Balance == "" {
+		cfg.Balance = client.DefaultBalance
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = client.DefaultCheckInterval
+	}
+	if cfg.Rise == 0 {
+		cfg.Rise = client.DefaultRise
+	}
+	if cfg.Fall == 0 {
+		cfg.Fall = client.DefaultFall
+	}
+	if cfg.MaxURILength == 0 {
+		cfg.MaxURILength = client.DefaultMaxURILength
+	}
+
 	return cfg
 }
 
@@ -579,7 +1340,23 @@ func (s *ServiceRegistry) setServiceDefaults(svc *client.ServiceConfig) {
 	if svc.DialTimeout == 0 && s.cfg.DialTimeout != 0 {
 		svc.DialTimeout = s.cfg.DialTimeout
 	}
+	if svc.SendBufferBytes == 0 && s.cfg.SendBufferBytes != 0 {
+		svc.SendBufferBytes = s.cfg.SendBufferBytes
+	}
+	if svc.RecvBufferBytes == 0 && s.cfg.RecvBufferBytes != 0 {
+		svc.RecvBufferBytes = s.cfg.RecvBufferBytes
+	}
 	if s.cfg.HTTPSRedirect {
 		svc.HTTPSRedirect = true
 	}
 }
+
+// Check if any of the addresses use the port.
+func hasPort(addrs []string, port string) bool {
+	for _, addr := range addrs {
+		if strings.HasSuffix(addr, port) {
+			return true
+		}
+	}
+	return false
+}
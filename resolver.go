@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The resolver used for backend hostnames, by backend dials, health checks,
+// and periodic resolution. This is the system resolver unless the -resolver
+// flag is set.
+var backendResolver = net.DefaultResolver
+
+// Create a resolver which sends all queries to the DNS server at addr. A port
+// of 53 is used if addr doesn't include one.
+func newResolver(addr string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Resolve a UDP address using the backendResolver.
+func resolveUDPAddr(network, addr string) (*net.UDPAddr, error) {
+	if backendResolver == net.DefaultResolver {
+		return net.ResolveUDPAddr(network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	portNum, err := backendResolver.LookupPort(ctx, network, port)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := backendResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		isV4 := ip.IP.To4() != nil
+		if network == "udp4" && !isV4 || network == "udp6" && isV4 {
+			continue
+		}
+		return &net.UDPAddr{IP: ip.IP, Port: portNum, Zone: ip.Zone}, nil
+	}
+	return nil, fmt.Errorf("no suitable address found for %s", addr)
+}
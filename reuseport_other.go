@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// SO_REUSEPORT isn't used on this platform, so a listener has to be closed
+// before its address can be bound again.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func setReusePort(conn syscall.Conn) error {
+	return errors.New("SO_REUSEPORT is not supported")
+}
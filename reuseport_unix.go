@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+const reusePortSupported = true
+
+// A net.ListenConfig Control function which sets SO_REUSEPORT, so the socket
+// can be bound to the address of a listener marked by setReusePort.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return setReusePortRaw(c)
+}
+
+// Set SO_REUSEPORT on a bound listener, allowing a new listener to bind the
+// same address before this one is closed.
+func setReusePort(conn syscall.Conn) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setReusePortRaw(c)
+}
+
+func setReusePortRaw(c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
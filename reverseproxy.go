@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/litl/shuttle/log"
@@ -51,8 +52,21 @@ type ReverseProxy struct {
 	// to flush to the client while copying the
 	// response body.
 	// If zero, no periodic flushing is done.
+	// If negative, the response is flushed after every write.
 	FlushInterval time.Duration
 
+	// ResponseHeaderTimeout limits the time waiting for the response headers
+	// from the backend, and ResponseTimeout limits the time for the entire
+	// response including the body. The backend request is canceled when
+	// either is exceeded, and a 504 is returned if the headers weren't yet
+	// received. If zero, there is no limit.
+	ResponseHeaderTimeout time.Duration
+	ResponseTimeout       time.Duration
+
+	// RetryReset tries the next backend when one resets the connection before
+	// responding, for requests without a body.
+	RetryReset bool
+
 	// These are called in order on before any request is made to the backend server.
 	// Each Callback must return true to continue processing.
 	OnRequest []ProxyCallback
@@ -69,12 +83,104 @@ type ReverseProxy struct {
 // This will still need to have a Director and Transport assigned.
 func NewReverseProxy(t *http.Transport) *ReverseProxy {
 	p := &ReverseProxy{
-		Transport:     t,
-		FlushInterval: 1109 * time.Millisecond,
+		Transport: t,
 	}
 	return p
 }
 
+// SetFlushInterval safely updates the FlushInterval on a running proxy.
+func (p *ReverseProxy) SetFlushInterval(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.FlushInterval = d
+}
+
+// SetResponseTimeouts safely updates the ResponseHeaderTimeout and
+// ResponseTimeout on a running proxy.
+func (p *ReverseProxy) SetResponseTimeouts(header, total time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.ResponseHeaderTimeout = header
+	p.ResponseTimeout = total
+}
+
+// SetRetryReset safely updates RetryReset on a running proxy.
+func (p *ReverseProxy) SetRetryReset(retry bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.RetryReset = retry
+}
+
+// The error returned when a backend request exceeds a response timeout
+var errResponseTimeout = fmt.Errorf("timeout awaiting response from backend")
+
+// The error returned when a request body exceeds the service's
+// MaxRequestBodyBytes
+var errRequestTooLarge = fmt.Errorf("request body too large")
+
+// A request body limited to a maximum size, which records whether the limit
+// was exceeded, since the error may not be returned intact by the Transport.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded int32
+}
+
+// Limit the request body to n bytes. Exceeding the limit also closes the
+// client connection after the response, as with http.MaxBytesReader.
+func newLimitedBody(w http.ResponseWriter, body io.ReadCloser, n int64) *limitedBody {
+	return &limitedBody{ReadCloser: http.MaxBytesReader(w, body, n)}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		atomic.StoreInt32(&b.exceeded, 1)
+	}
+	return n, err
+}
+
+// Return true if the request's body exceeded its limit.
+func bodyTooLarge(req *http.Request) bool {
+	b, ok := req.Body.(*limitedBody)
+	return ok && atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// Cancel a backend request when any of its timers expire
+type requestDeadline struct {
+	cancel   chan struct{}
+	once     sync.Once
+	timedOut int32
+	timers   []*time.Timer
+}
+
+// Start a timer to cancel the request after d. A zero duration is ignored.
+func (r *requestDeadline) after(d time.Duration) *time.Timer {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.AfterFunc(d, func() {
+		r.once.Do(func() {
+			atomic.StoreInt32(&r.timedOut, 1)
+			close(r.cancel)
+		})
+	})
+	r.timers = append(r.timers, t)
+	return t
+}
+
+// Check if the request was canceled by a timer
+func (r *requestDeadline) expired() bool {
+	return atomic.LoadInt32(&r.timedOut) == 1
+}
+
+// stop all timers
+func (r *requestDeadline) stop() {
+	for _, t := range r.timers {
+		t.Stop()
+	}
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -95,19 +201,51 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-// Hop-by-hop headers. These are removed when sent to the backend.
-// http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
+// Hop-by-hop headers. These are removed when sent to the backend, and from
+// the response sent back to the client.
+// http://tools.ietf.org/html/rfc7230#section-6.1
 var hopHeaders = []string{
 	"Connection",
+	"Proxy-Connection", // non-standard, but still sent by some clients
 	"Keep-Alive",
 	"Proxy-Authenticate",
 	"Proxy-Authorization",
 	"Te", // canonicalized version of "TE"
-	"Trailers",
+	"Trailer",
 	"Transfer-Encoding",
 	"Upgrade",
 }
 
+// Remove the hop-by-hop headers from h, including any additional headers
+// listed in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// Check if h contains any hop-by-hop headers which need to be removed.
+func hasHopHeaders(h http.Header) bool {
+	if len(h["Connection"]) > 0 {
+		return true
+	}
+	for _, name := range hopHeaders {
+		if _, ok := h[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // This probably shouldn't be called ServeHTTP anymore
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addrs []string) {
 
@@ -124,8 +262,32 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 		}
 	}
 
+	p.Lock()
+	headerTimeout := p.ResponseHeaderTimeout
+	totalTimeout := p.ResponseTimeout
+	p.Unlock()
+
+	deadline := &requestDeadline{cancel: make(chan struct{})}
+	defer deadline.stop()
+	deadline.after(totalTimeout)
+	headerTimer := deadline.after(headerTimeout)
+	pr.cancel = deadline.cancel
+
 	pr.StartTime = time.Now()
 	res, err := p.doRequest(pr)
+	if headerTimer != nil {
+		headerTimer.Stop()
+	}
+
+	status := http.StatusBadGateway
+	switch {
+	case err != nil && bodyTooLarge(req):
+		err = errRequestTooLarge
+		status = http.StatusRequestEntityTooLarge
+	case err != nil && deadline.expired():
+		err = errResponseTimeout
+		status = http.StatusGatewayTimeout
+	}
 
 	pr.Response = res
 	pr.ProxyError = err
@@ -139,17 +301,15 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 		// be written to the client.
 		res = &http.Response{
 			Header:     make(map[string][]string),
-			StatusCode: http.StatusBadGateway,
-			Status:     http.StatusText(http.StatusBadGateway),
+			StatusCode: status,
+			Status:     http.StatusText(status),
 			// this ensures Body isn't nil
 			Body: ioutil.NopCloser(bytes.NewReader(nil)),
 		}
 		pr.Response = res
 	}
 
-	for _, h := range hopHeaders {
-		res.Header.Del(h)
-	}
+	removeHopHeaders(res.Header)
 
 	copyHeader(rw.Header(), res.Header)
 
@@ -183,23 +343,17 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 	outreq.ProtoMajor = 1
 	outreq.ProtoMinor = 1
 	outreq.Close = false
+	outreq.Cancel = pr.cancel
 
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.  This
-	// is modifying the same underlying map from req (shallow
+	// would modify the same underlying map from req (shallow
 	// copied above) so we only copy it if necessary.
-	copiedHeaders := false
-	for _, h := range hopHeaders {
-		if outreq.Header.Get(h) != "" {
-			if !copiedHeaders {
-				outreq.Header = make(http.Header)
-				copyHeader(outreq.Header, pr.Request.Header)
-				copiedHeaders = true
-			}
-
-			outreq.Header.Del(h)
-		}
+	if hasHopHeaders(outreq.Header) {
+		outreq.Header = make(http.Header)
+		copyHeader(outreq.Header, pr.Request.Header)
+		removeHopHeaders(outreq.Header)
 	}
 
 	if clientIP, _, err := net.SplitHostPort(pr.Request.RemoteAddr); err == nil {
@@ -212,6 +366,12 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	// A request body has been at least partly read once the request is sent,
+	// so only requests without one can be retried after a reset.
+	p.Lock()
+	retryReset := p.RetryReset && pr.Request.ContentLength == 0
+	p.Unlock()
+
 	var err error
 	var resp *http.Response
 
@@ -229,11 +389,16 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 			continue
 		}
 
+		if retryReset && isConnReset(err) {
+			log.Warnf("WARN: backend %s reset the connection, retrying: %s", addr, err)
+			continue
+		}
+
 		// not a DialError, so make this terminal.
 		return nil, err
 	}
 
-	// In this case, our last backend returned a DialError
+	// In this case, our last backend returned a DialError or reset
 	if err != nil {
 		return nil, err
 	}
@@ -243,16 +408,24 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 }
 
 func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) (int64, error) {
-	if p.FlushInterval != 0 {
+	p.Lock()
+	flushInterval := p.FlushInterval
+	p.Unlock()
+
+	if flushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
-			mlw := &maxLatencyWriter{
-				dst:     wf,
-				latency: p.FlushInterval,
-				done:    make(chan bool),
+			if flushInterval < 0 {
+				dst = immediateFlushWriter{wf}
+			} else {
+				mlw := &maxLatencyWriter{
+					dst:     wf,
+					latency: flushInterval,
+					done:    make(chan bool),
+				}
+				go mlw.flushLoop()
+				defer mlw.stop()
+				dst = mlw
 			}
-			go mlw.flushLoop()
-			defer mlw.stop()
-			dst = mlw
 		}
 	}
 
@@ -264,6 +437,18 @@ type writeFlusher interface {
 	http.Flusher
 }
 
+// immediateFlushWriter flushes after every write, for streaming responses
+// that can't tolerate any buffering delay.
+type immediateFlushWriter struct {
+	dst writeFlusher
+}
+
+func (w immediateFlushWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.dst.Flush()
+	return n, err
+}
+
 type maxLatencyWriter struct {
 	dst     writeFlusher
 	latency time.Duration
@@ -319,4 +504,7 @@ type ProxyRequest struct {
 	// Duration of the backend request
 	StartTime  time.Time
 	FinishTime time.Time
+
+	// closed to cancel the backend request
+	cancel chan struct{}
 }
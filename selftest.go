@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+// The service and virtual host used by -selftest. No other config is loaded,
+// so these can't collide with a real service.
+const (
+	selfTestService = "_selftest"
+	selfTestVHost   = "selftest.shuttle.invalid"
+)
+
+// Time allowed for each request made by the self test
+var selfTestTimeout = 5 * time.Second
+
+// Run the -selftest, printing each step, and return the exit status.
+func runSelfTest() int {
+	// the self test's service is never saved to the state config
+	noStateWrite = true
+
+	if err := selfTest(os.Stdout); err != nil {
+		fmt.Printf("FAIL: %s\n", err)
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
+
+// Start a service and an HTTP router in process, with a local backend, and
+// check that a TCP connection through the service's listener, and an HTTP
+// request through the router to the service's virtual host, both reach the
+// backend. Each step is reported to w, and the first failure is returned.
+func selfTest(w io.Writer) error {
+	token := genId()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("starting backend: %s", err)
+	}
+	defer backend.Close()
+
+	go http.Serve(backend, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, token)
+	}))
+	fmt.Fprintf(w, "backend listening on %s\n", backend.Addr())
+
+	svcCfg := client.ServiceConfig{
+		Name:         selfTestService,
+		Addr:         "127.0.0.1:0",
+		VirtualHosts: []string{selfTestVHost},
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: backend.Addr().String()},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		return fmt.Errorf("adding service: %s", err)
+	}
+	defer Registry.RemoveService(selfTestService)
+
+	svc := Registry.GetService(selfTestService)
+	fmt.Fprintf(w, "service listening on %s\n", svc.Addr)
+
+	if err := selfTestRequest(svc.Addr, "", token); err != nil {
+		return fmt.Errorf("tcp proxy: %s", err)
+	}
+	fmt.Fprintln(w, "tcp connection proxied to the backend")
+
+	router := NewHostRouter(&http.Server{Addr: "127.0.0.1:0"})
+	if err := router.Listen(); err != nil {
+		return fmt.Errorf("starting http router: %s", err)
+	}
+	defer router.Stop()
+	go router.Serve()
+	fmt.Fprintf(w, "http router listening on %s\n", router.listener.Addr())
+
+	if err := selfTestRequest(router.listener.Addr().String(), selfTestVHost, token); err != nil {
+		return fmt.Errorf("http proxy: %s", err)
+	}
+	fmt.Fprintln(w, "http request routed to the backend")
+	return nil
+}
+
+// Make a GET request to addr, with the Host header set to host if it isn't
+// empty, and check that the response body is the expected token.
+func selfTestRequest(addr, host, token string) error {
+	req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		req.Host = host
+	}
+
+	client := &http.Client{
+		Timeout:   selfTestTimeout,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	if string(body) != token {
+		return fmt.Errorf("unexpected response body %q", body)
+	}
+	return nil
+}
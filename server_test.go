@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -158,6 +160,96 @@ func (s *udpTestServer) Stop() {
 	s.wg.Wait()
 }
 
+// Minimal DNS server answering A queries for a fixed set of names, which
+// counts the queries received.
+type testDNSServer struct {
+	conn    *net.UDPConn
+	addr    string
+	hosts   map[string]net.IP
+	queries int64
+}
+
+func NewTestDNSServer(hosts map[string]string, c Tester) *testDNSServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	s := &testDNSServer{
+		conn:  conn,
+		addr:  conn.LocalAddr().String(),
+		hosts: make(map[string]net.IP),
+	}
+	for name, ip := range hosts {
+		s.hosts[name] = net.ParseIP(ip).To4()
+	}
+
+	go s.serve()
+	return s
+}
+
+func (s *testDNSServer) serve() {
+	buff := make([]byte, 512)
+	for {
+		n, client, err := s.conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buff[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, client)
+		}
+	}
+}
+
+// Answer a single question query. Unknown names and non-A queries get an
+// empty answer.
+func (s *testDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	atomic.AddInt64(&s.queries, 1)
+
+	// read the question name
+	labels := []string{}
+	pos := 12
+	for pos < len(query) && query[pos] != 0 {
+		l := int(query[pos])
+		if pos+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[pos+1:pos+1+l]))
+		pos += 1 + l
+	}
+	if pos+5 > len(query) {
+		return nil
+	}
+	qtype := int(query[pos+1])<<8 | int(query[pos+2])
+	question := query[12 : pos+5]
+
+	ip := s.hosts[strings.Join(labels, ".")]
+
+	resp := []byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}
+	resp = append(resp, question...)
+	if ip != nil && qtype == 1 {
+		resp[7] = 1
+		resp = append(resp,
+			0xc0, 12, // name pointer to the question
+			0, 1, 0, 1, // A, IN
+			0, 0, 0, 60, // ttl
+			0, 4)
+		resp = append(resp, ip...)
+	}
+	return resp
+}
+
+func (s *testDNSServer) Queries() int64 {
+	return atomic.LoadInt64(&s.queries)
+}
+
+func (s *testDNSServer) Stop() {
+	s.conn.Close()
+}
+
 // Backend server for testing HTTP proxies
 type testHTTPServer struct {
 	*httptest.Server
@@ -184,6 +276,20 @@ func (s *testHTTPServer) errorHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, s.addr)
 }
 
+// write the request headers as json, and send a hop-by-hop header in the
+// response.
+func (s *testHTTPServer) headersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "X-Backend-Hop")
+	w.Header().Set("X-Backend-Hop", s.addr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Header)
+}
+
+// write the request body back in the response
+func (s *testHTTPServer) echoHandler(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+}
+
 type fataler interface {
 	Fatal(...interface{})
 }
@@ -204,6 +310,8 @@ func NewHTTPTestServer(addr string, c fataler) (*testHTTPServer, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/addr", s.addrHandler)
 	mux.HandleFunc("/error", s.errorHandler)
+	mux.HandleFunc("/headers", s.headersHandler)
+	mux.HandleFunc("/echo", s.echoHandler)
 
 	s.Config.Handler = mux
 	s.Start()
@@ -278,3 +386,177 @@ func checkHTTP(url, host, expected string, status int, c Tester) {
 	}
 	c.Assert(string(body), Equals, expected)
 }
+
+// Backend HTTP server which supports keep-alive and chunked responses, and
+// tracks connection reuse. Latency and errors can be injected to simulate a
+// slow or failing backend.
+type testKeepAliveServer struct {
+	*httptest.Server
+	addr string
+
+	sync.Mutex
+	latency   time.Duration
+	failEvery int
+	requests  int
+	conns     int
+}
+
+// Start an HTTP server which responds with it's addr, and counts the
+// connections and requests it receives.
+func NewKeepAliveTestServer() *testKeepAliveServer {
+	s := &testKeepAliveServer{
+		Server: httptest.NewUnstartedServer(nil),
+	}
+	s.addr = s.Listener.Addr().String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/addr", s.addrHandler)
+	mux.HandleFunc("/chunked", s.chunkedHandler)
+
+	s.Config.Handler = mux
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.Lock()
+			s.conns++
+			s.Unlock()
+		}
+	}
+	s.Start()
+
+	return s
+}
+
+// Delay every response by d.
+func (s *testKeepAliveServer) SetLatency(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.latency = d
+}
+
+// Respond with a 500 to every nth request. 0 disables errors.
+func (s *testKeepAliveServer) SetFailEvery(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.failEvery = n
+}
+
+// The number of connections accepted by the server.
+func (s *testKeepAliveServer) Conns() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.conns
+}
+
+// The number of requests handled by the server.
+func (s *testKeepAliveServer) Requests() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests
+}
+
+// count the request, and apply any latency. Returns false if the request
+// should fail.
+func (s *testKeepAliveServer) start() bool {
+	s.Lock()
+	s.requests++
+	fail := s.failEvery > 0 && s.requests%s.failEvery == 0
+	latency := s.latency
+	s.Unlock()
+
+	time.Sleep(latency)
+	return !fail
+}
+
+func (s *testKeepAliveServer) addrHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.start() {
+		http.Error(w, s.addr, http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, s.addr)
+}
+
+// write the server addr in a number of separately flushed chunks, given by
+// the "n" parameter.
+func (s *testKeepAliveServer) chunkedHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.start() {
+		http.Error(w, s.addr, http.StatusInternalServerError)
+		return
+	}
+
+	n, _ := strconv.Atoi(r.FormValue("n"))
+	if n == 0 {
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		io.WriteString(w, s.addr)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// A consul KV store holding a single value, supporting blocking queries.
+type testConsulServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	value   []byte
+	index   uint64
+	changed chan struct{}
+}
+
+func NewTestConsulServer() *testConsulServer {
+	s := &testConsulServer{
+		index:   1,
+		changed: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.kvHandler))
+	return s
+}
+
+// Set the value, as if changed outside of shuttle.
+func (s *testConsulServer) Set(value []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.value = value
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *testConsulServer) Value() []byte {
+	s.Lock()
+	defer s.Unlock()
+	return s.value
+}
+
+func (s *testConsulServer) kvHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.Set(body)
+		w.Write([]byte("true"))
+		return
+	}
+
+	index, _ := strconv.ParseUint(r.FormValue("index"), 10, 64)
+
+	s.Lock()
+	changed := s.changed
+	if index == s.index {
+		s.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+		s.Lock()
+	}
+	value, index := s.value, s.index
+	s.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if value == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(value)
+}
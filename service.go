@@ -1,9 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,12 +29,14 @@ var (
 		svcs:   make(map[string]*Service),
 		vhosts: make(map[string]*VirtualHost),
 	}
-
-	ErrInvalidServiceUpdate = fmt.Errorf("configuration requires a new service")
 )
 
 type Service struct {
 	sync.Mutex
+
+	// serializes configuration changes from the registry
+	updateLock sync.Mutex
+
 	Name            string
 	Addr            string
 	HTTPSRedirect   bool
@@ -43,6 +57,159 @@ type Service struct {
 	HTTPActive      int64
 	Network         string
 	MaintenanceMode bool
+	FlushInterval   time.Duration
+
+	// Limits on the time for HTTP responses from the backends
+	ResponseHeaderTimeout time.Duration
+	ResponseTimeout       time.Duration
+
+	// Retries for error pages which couldn't be fetched when configured
+	ErrorPageRetries       int
+	ErrorPageRetryInterval time.Duration
+
+	// Inline response for maintenance mode, if there's no error page
+	MaintenanceBody        string
+	MaintenanceContentType string
+
+	// Maintenance response read from a file, cached when configured
+	MaintenanceFile     string
+	maintenanceFileBody []byte
+	maintenanceFileType string
+
+	// Number of connections to open to a new backend
+	Warmup int
+
+	// Status code for HTTPS redirects, 301 if this is 0
+	HTTPSRedirectCode int
+
+	// Respond to plaintext HTTP requests with a 403 instead of redirecting
+	RejectHTTP bool
+
+	// Maximum HTTP request URI length, using the global limit if this is 0
+	MaxURILength int
+
+	// Maximum HTTP request body size, or 0 for no limit
+	MaxRequestBodyBytes int64
+
+	// Pin HTTP clients to a backend with a cookie, named
+	// DefaultStickyCookieName if the name is empty, and expiring after the
+	// TTL, or with the session if the TTL is 0.
+	StickyCookie     bool
+	StickyCookieName string
+	StickyCookieTTL  time.Duration
+
+	// Copy a sample of HTTP requests to the MirrorAddr, discarding the
+	// responses
+	MirrorAddr      string
+	MirrorSample    float64
+	MirrorRequests  int64
+	MirrorErrors    int64
+	MirrorSkipped   int64
+	mirrorTransport *http.Transport
+	mirrorSlots     chan struct{}
+
+	// Set TCP_NODELAY on client and backend connections
+	NoDelay bool
+
+	// Socket buffer sizes for client and backend connections, or 0 for the
+	// OS defaults
+	SendBufferBytes int
+	RecvBufferBytes int
+
+	// Fraction of TCP connections to log
+	ConnLogSample float64
+
+	// Pass a half-close through to the other side, rather than closing the
+	// connection
+	AllowHalfOpen bool
+
+	// Interval between sending stats to statsd, or 0 for the global interval
+	StatsInterval time.Duration
+
+	// Route connections which start with an HTTP request through the vhosts,
+	// and proxy the rest to the backends
+	SniffHTTP    bool
+	SniffTimeout time.Duration
+
+	// Retry the next backend when one closes a connection without sending
+	// any data, before any client data is forwarded.
+	RetryEmpty bool
+
+	// Retry the next backend when one resets an HTTP request without a body
+	// before responding.
+	RetryReset bool
+
+	// Log each backend selection
+	LogBalance bool
+
+	// Close TCP connections which don't send any data, or complete the TLS
+	// handshake, within HandshakeTimeout
+	HandshakeTimeout  time.Duration
+	HandshakeTimeouts int64
+
+	// Health check times which scale down the weight of slow backends
+	CheckFast time.Duration
+	CheckSlow time.Duration
+
+	// Remove the service when its last backend is removed
+	RemoveWhenEmpty bool
+
+	// Connections from external health checkers, which are answered without
+	// a backend
+	HealthCheckCIDRs    []string
+	HealthCheckResponse string
+	HealthChecks        int64
+	healthCheckNets     []*net.IPNet
+
+	// Limit the concurrent connections from each client IP, counted in
+	// clientConns, and the proxies trusted to report the client's IP.
+	MaxConnsPerClient int
+	PerClientRefused  int64
+	TrustedProxies    []string
+	trustedNets       []*net.IPNet
+	clientLock        sync.Mutex
+	clientConns       map[string]int
+
+	// Close connections older than MaxConnAge on a backend with more than
+	// its share, counting them in Rebalanced, no more often than
+	// rebalanceSpacing since lastRebalance
+	RebalanceConns bool
+	MaxConnAge     time.Duration
+	Rebalanced     int64
+	lastRebalance  time.Time
+
+	// Backend groups in failover order, before any groups not listed
+	GroupOrder []string
+
+	// Warn when more than AcceptRateAlert connections per second are
+	// accepted over the AcceptRateWindow
+	AcceptRateAlert  int
+	AcceptRateWindow time.Duration
+	AcceptRateAlerts int64
+	acceptRate       acceptRate
+
+	// Warn when a backend's dial failures over the DialFailureWindow reach
+	// the DialFailureAlert fraction of its dials
+	DialFailureAlert  float64
+	DialFailureWindow time.Duration
+
+	// Eject backends whose HTTP 5xx rate over the EjectWindow reaches
+	// EjectErrorRate, for EjectTime
+	EjectErrorRate float64
+	EjectWindow    time.Duration
+	EjectTime      time.Duration
+
+	// Connections waiting for a backend under MaxConns
+	QueueSize    int
+	QueueTimeout time.Duration
+	queued       int64
+	Refused      int64
+
+	// closed and replaced whenever a backend connection slot is freed
+	slotFreed chan struct{}
+
+	// Idle timeout for UDP sessions, which are disabled when 0
+	UDPSessionTimeout time.Duration
 
 	// Next returns the backends in priority order.
 	next func() []*Backend
@@ -51,9 +218,21 @@ type Service struct {
 	lastBackend int
 	lastCount   int
 
-	// Each Service owns it's own netowrk listener
-	tcpListener net.Listener
-	udpListener *net.UDPConn
+	// Each Service owns it's own netowrk listeners, one for each address
+	tcpListeners []net.Listener
+	udpListeners []*net.UDPConn
+	udpSessions  []*udpSessionTable
+
+	// set while Restart binds new listeners alongside the old ones
+	reusePort bool
+
+	// Optional secondary listener terminating TLS
+	TLSAddr        string
+	TLSCert        string
+	TLSKey         string
+	tlsListener    net.Listener
+	tlsBase        *timeoutListener
+	tlsCertificate *tls.Certificate
 
 	// reverse proxy for vhost routing
 	httpProxy *ReverseProxy
@@ -64,6 +243,9 @@ type Service struct {
 	// the original map of errors as loaded in by a config
 	errPagesCfg map[string][]int
 
+	// the original scoped error pages as loaded in by a config
+	errPageRulesCfg []client.ErrorPageConfig
+
 	// net.Dialer so we don't need to allocate one every time
 	dialer *net.Dialer
 }
@@ -74,6 +256,8 @@ type ServiceStat struct {
 	Addr          string        `json:"address"`
 	VirtualHosts  []string      `json:"virtual_hosts"`
 	Backends      []BackendStat `json:"backends"`
+	BackendCount  int           `json:"backend_count"`
+	UpCount       int           `json:"up_count"`
 	Balance       string        `json:"balance"`
 	CheckInterval int           `json:"check_interval"`
 	Fall          int           `json:"fall"`
@@ -89,6 +273,53 @@ type ServiceStat struct {
 	HTTPActive    int64         `json:"http_active"`
 	HTTPConns     int64         `json:"http_connections"`
 	HTTPErrors    int64         `json:"http_errors"`
+	UDPSessions   int           `json:"udp_sessions,omitempty"`
+	QueueSize     int           `json:"queue_size,omitempty"`
+	Queued        int64         `json:"queued"`
+	Refused       int64         `json:"refused"`
+	HealthChecks  int64         `json:"health_checks,omitempty"`
+
+	// Connections closed for not sending data within the HandshakeTimeout
+	HandshakeTimeouts int64 `json:"handshake_timeouts,omitempty"`
+
+	// Connections or requests refused by MaxConnsPerClient, and the number
+	// of clients currently connected while it's set
+	PerClientRefused int64 `json:"per_client_refused,omitempty"`
+	Clients          int   `json:"clients,omitempty"`
+
+	// Connections closed by RebalanceConns for exceeding MaxConnAge
+	Rebalanced int64 `json:"rebalanced,omitempty"`
+
+	// Connections per second accepted over the last complete accept rate
+	// window, and the number of windows which exceeded AcceptRateAlert
+	AcceptRate       float64 `json:"accept_rate,omitempty"`
+	AcceptRateAlerts int64   `json:"accept_rate_alerts,omitempty"`
+
+	// Requests copied to the mirror, those which failed or returned a 5xx
+	// status, and sampled requests which weren't copied because of their
+	// body or the number already pending
+	MirrorRequests int64 `json:"mirror_requests,omitempty"`
+	MirrorErrors   int64 `json:"mirror_errors,omitempty"`
+	MirrorSkipped  int64 `json:"mirror_skipped,omitempty"`
+
+	// Interval in milliseconds between sending stats to statsd, if not the
+	// global interval
+	StatsInterval int `json:"stats_interval,omitempty"`
+
+	// The backend groups in failover order, when any backend has a group
+	Groups []GroupStat `json:"groups,omitempty"`
+
+	// Error is set when the service could not be started
+	Error string `json:"error,omitempty"`
+}
+
+// Stats about a group of backends. Active is set on the group currently
+// receiving connections.
+type GroupStat struct {
+	Name         string `json:"name"`
+	BackendCount int    `json:"backend_count"`
+	UpCount      int    `json:"up_count"`
+	Active       bool   `json:"active"`
 }
 
 // Create a Service from a config struct
@@ -105,16 +336,82 @@ func NewService(cfg client.ServiceConfig) *Service {
 		ClientTimeout:   time.Duration(cfg.ClientTimeout) * time.Millisecond,
 		ServerTimeout:   time.Duration(cfg.ServerTimeout) * time.Millisecond,
 		DialTimeout:     time.Duration(cfg.DialTimeout) * time.Millisecond,
-		errorPages:      NewErrorResponse(cfg.ErrorPages),
+		errorPages:      NewErrorResponse(nil, nil),
 		errPagesCfg:     cfg.ErrorPages,
+		errPageRulesCfg: cfg.ErrorPageRules,
 		Network:         cfg.Network,
 		MaintenanceMode: cfg.MaintenanceMode,
+		FlushInterval:   time.Duration(cfg.FlushInterval) * time.Millisecond,
+
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout) * time.Millisecond,
+		ResponseTimeout:       time.Duration(cfg.ResponseTimeout) * time.Millisecond,
+
+		MaintenanceBody:        cfg.MaintenanceBody,
+		MaintenanceContentType: cfg.MaintenanceContentType,
+		TLSAddr:                cfg.TLSAddr,
+		TLSCert:                cfg.TLSCert,
+		TLSKey:                 cfg.TLSKey,
+		Warmup:                 cfg.Warmup,
+		HTTPSRedirectCode:      cfg.HTTPSRedirectCode,
+		RejectHTTP:             cfg.RejectHTTP,
+		MaxURILength:           cfg.MaxURILength,
+		MaxRequestBodyBytes:    cfg.MaxRequestBodyBytes,
+		StickyCookie:           cfg.StickyCookie,
+		StickyCookieName:       cfg.StickyCookieName,
+		StickyCookieTTL:        time.Duration(cfg.StickyCookieTTL) * time.Second,
+		MirrorAddr:             cfg.MirrorAddr,
+		MirrorSample:           cfg.MirrorSample,
+		NoDelay:                cfg.NoDelay == nil || *cfg.NoDelay,
+		SendBufferBytes:        cfg.SendBufferBytes,
+		RecvBufferBytes:        cfg.RecvBufferBytes,
+		UDPSessionTimeout:      time.Duration(cfg.UDPSessionTimeout) * time.Millisecond,
+		ConnLogSample:          cfg.ConnLogSample,
+		AllowHalfOpen:          cfg.AllowHalfOpen,
+		RemoveWhenEmpty:        cfg.RemoveWhenEmpty,
+		SniffHTTP:              cfg.SniffHTTP,
+		SniffTimeout:           time.Duration(cfg.SniffTimeout) * time.Millisecond,
+		RetryEmpty:             cfg.RetryEmpty,
+		RetryReset:             cfg.RetryReset,
+		LogBalance:             cfg.LogBalance,
+		HandshakeTimeout:       time.Duration(cfg.HandshakeTimeout) * time.Millisecond,
+		CheckFast:              time.Duration(cfg.CheckFast) * time.Millisecond,
+		CheckSlow:              time.Duration(cfg.CheckSlow) * time.Millisecond,
+		StatsInterval:          time.Duration(cfg.StatsInterval) * time.Millisecond,
+		HealthCheckCIDRs:       cfg.HealthCheckCIDRs,
+		HealthCheckResponse:    cfg.HealthCheckResponse,
+		healthCheckNets:        parseCIDRs(cfg.HealthCheckCIDRs),
+		MaxConnsPerClient:      cfg.MaxConnsPerClient,
+		RebalanceConns:         cfg.RebalanceConns,
+		MaxConnAge:             time.Duration(cfg.MaxConnAge) * time.Millisecond,
+		TrustedProxies:         cfg.TrustedProxies,
+		trustedNets:            parseCIDRs(cfg.TrustedProxies),
+		GroupOrder:             cfg.GroupOrder,
+		clientConns:            make(map[string]int),
+		AcceptRateAlert:        cfg.AcceptRateAlert,
+		AcceptRateWindow:       time.Duration(cfg.AcceptRateWindow) * time.Millisecond,
+		DialFailureAlert:       cfg.DialFailureAlert,
+		DialFailureWindow:      time.Duration(cfg.DialFailureWindow) * time.Millisecond,
+		EjectErrorRate:         cfg.EjectErrorRate,
+		EjectWindow:            time.Duration(cfg.EjectWindow) * time.Millisecond,
+		EjectTime:              time.Duration(cfg.EjectTime) * time.Millisecond,
+		QueueSize:              cfg.QueueSize,
+		QueueTimeout:           time.Duration(cfg.QueueTimeout) * time.Millisecond,
+		slotFreed:              make(chan struct{}),
+		ErrorPageRetries:       cfg.ErrorPageRetries,
+		ErrorPageRetryInterval: time.Duration(cfg.ErrorPageRetryInterval) * time.Millisecond,
+	}
+
+	// set the retries before the first fetch of the error pages
+	s.errorPages.SetRetries(s.ErrorPageRetries, s.ErrorPageRetryInterval)
+	if cfg.ErrorPages != nil || cfg.ErrorPageRules != nil {
+		s.errorPages.Update(cfg.ErrorPages, cfg.ErrorPageRules)
 	}
 
 	// TODO: insert this into the backends too
 	s.dialer = &net.Dialer{
 		Timeout:   s.DialTimeout,
 		KeepAlive: 30 * time.Second,
+		Resolver:  backendResolver,
 	}
 
 	// create our reverse proxy, using our load-balancing Dial method
@@ -123,12 +420,20 @@ func NewService(cfg client.ServiceConfig) *Service {
 		MaxIdleConnsPerHost: 10,
 	}
 	s.httpProxy = NewReverseProxy(proxyTransport)
-	s.httpProxy.FlushInterval = time.Second
+	s.httpProxy.SetFlushInterval(s.FlushInterval)
+	s.httpProxy.SetResponseTimeouts(s.ResponseHeaderTimeout, s.ResponseTimeout)
+	s.httpProxy.SetRetryReset(s.RetryReset)
 	s.httpProxy.Director = func(req *http.Request) {
 		req.URL.Scheme = "http"
 	}
 
-	s.httpProxy.OnResponse = []ProxyCallback{logProxyRequest, s.errStats, s.errorPages.CheckResponse}
+	s.mirrorTransport = &http.Transport{
+		Dial:                s.dialer.Dial,
+		MaxIdleConnsPerHost: 10,
+	}
+	s.mirrorSlots = make(chan struct{}, mirrorMaxPending)
+
+	s.httpProxy.OnResponse = []ProxyCallback{logProxyRequest, s.errStats, s.countResponse, s.setStickyCookie, s.errorPages.CheckResponse}
 
 	if s.CheckInterval == 0 {
 		s.CheckInterval = client.DefaultCheckInterval
@@ -145,35 +450,59 @@ func NewService(cfg client.ServiceConfig) *Service {
 	}
 
 	for _, b := range cfg.Backends {
-		s.add(NewBackend(b))
-	}
-
-	switch cfg.Balance {
-	case client.RoundRobin:
-		s.next = s.roundRobin
-	case client.LeastConn:
-		s.next = s.leastConn
-	default:
-		if cfg.Balance != "" {
-			log.Warnf("invalid balancing algorithm '%s'", cfg.Balance)
+		expanded, err := b.Expand()
+		if err != nil {
+			log.Errorf("ERROR: %s", err)
+			continue
+		}
+		for _, b := range expanded {
+			s.add(NewBackend(b))
 		}
-		s.next = s.roundRobin
 	}
 
+	s.setBalance(cfg.Balance)
+
 	return s
 }
 
-// Update the running configuration.
+// Update the running configuration in place. The listener is only replaced
+// when the address or network changes, otherwise existing connections are left
+// untouched.
 func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.ClientTimeout != time.Duration(cfg.ClientTimeout)*time.Millisecond {
-		return ErrInvalidServiceUpdate
+	// always re-read the file, in case the content changed
+	if err := s.loadMaintenanceFile(cfg.MaintenanceFile); err != nil {
+		return err
+	}
+
+	// New connections get the updated timeout, existing connections keep the
+	// timeout they were accepted with.
+	clientTimeout := time.Duration(cfg.ClientTimeout) * time.Millisecond
+	if s.ClientTimeout != clientTimeout {
+		s.ClientTimeout = clientTimeout
+		for _, l := range s.tcpListeners {
+			if l, ok := l.(*timeoutListener); ok {
+				l.SetTimeout(clientTimeout)
+			}
+		}
+		if s.tlsBase != nil {
+			s.tlsBase.SetTimeout(clientTimeout)
+		}
+	}
+
+	if cfg.Network != "" && cfg.Network != s.Network ||
+		cfg.Addr != "" && !sameAddrs(s.Addr, cfg.Addr) {
+		if err := s.listen(cfg.Network, cfg.Addr); err != nil {
+			return err
+		}
 	}
 
-	if s.Addr != "" && s.Addr != cfg.Addr {
-		return ErrInvalidServiceUpdate
+	if !sameAddr(s.TLSAddr, cfg.TLSAddr) || s.TLSCert != cfg.TLSCert || s.TLSKey != cfg.TLSKey {
+		if err := s.listenTLS(cfg.TLSAddr, cfg.TLSCert, cfg.TLSKey); err != nil {
+			return err
+		}
 	}
 
 	s.CheckInterval = cfg.CheckInterval
@@ -182,26 +511,111 @@ func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	s.ServerTimeout = time.Duration(cfg.ServerTimeout) * time.Millisecond
 	s.DialTimeout = time.Duration(cfg.DialTimeout) * time.Millisecond
 	s.HTTPSRedirect = cfg.HTTPSRedirect
+	s.HTTPSRedirectCode = cfg.HTTPSRedirectCode
+	s.RejectHTTP = cfg.RejectHTTP
+	s.MaxURILength = cfg.MaxURILength
+	s.MaxRequestBodyBytes = cfg.MaxRequestBodyBytes
+	s.StickyCookie = cfg.StickyCookie
+	s.StickyCookieName = cfg.StickyCookieName
+	s.StickyCookieTTL = time.Duration(cfg.StickyCookieTTL) * time.Second
+	if s.MirrorAddr != cfg.MirrorAddr && s.mirrorTransport != nil {
+		// don't keep idle connections to the old mirror
+		s.mirrorTransport.CloseIdleConnections()
+	}
+	s.MirrorAddr = cfg.MirrorAddr
+	s.MirrorSample = cfg.MirrorSample
 	s.MaintenanceMode = cfg.MaintenanceMode
+	s.MaintenanceBody = cfg.MaintenanceBody
+	s.MaintenanceContentType = cfg.MaintenanceContentType
+	s.Warmup = cfg.Warmup
+	s.NoDelay = cfg.NoDelay == nil || *cfg.NoDelay
+	s.SendBufferBytes = cfg.SendBufferBytes
+	s.RecvBufferBytes = cfg.RecvBufferBytes
+
+	s.ConnLogSample = cfg.ConnLogSample
+	s.AllowHalfOpen = cfg.AllowHalfOpen
+	s.RemoveWhenEmpty = cfg.RemoveWhenEmpty
+	s.SniffHTTP = cfg.SniffHTTP
+	s.SniffTimeout = time.Duration(cfg.SniffTimeout) * time.Millisecond
+	s.RetryEmpty = cfg.RetryEmpty
+	s.RetryReset = cfg.RetryReset
+	s.httpProxy.SetRetryReset(s.RetryReset)
+	s.LogBalance = cfg.LogBalance
+	s.HandshakeTimeout = time.Duration(cfg.HandshakeTimeout) * time.Millisecond
+
+	s.CheckFast = time.Duration(cfg.CheckFast) * time.Millisecond
+	s.CheckSlow = time.Duration(cfg.CheckSlow) * time.Millisecond
+	for _, b := range s.Backends {
+		b.setCheckTimes(s.CheckFast, s.CheckSlow)
+	}
+	s.StatsInterval = time.Duration(cfg.StatsInterval) * time.Millisecond
+	s.HealthCheckCIDRs = cfg.HealthCheckCIDRs
+	s.HealthCheckResponse = cfg.HealthCheckResponse
+	s.healthCheckNets = parseCIDRs(cfg.HealthCheckCIDRs)
+	s.MaxConnsPerClient = cfg.MaxConnsPerClient
+	s.RebalanceConns = cfg.RebalanceConns
+	s.MaxConnAge = time.Duration(cfg.MaxConnAge) * time.Millisecond
+	s.TrustedProxies = cfg.TrustedProxies
+	s.trustedNets = parseCIDRs(cfg.TrustedProxies)
+	s.GroupOrder = cfg.GroupOrder
+	s.AcceptRateAlert = cfg.AcceptRateAlert
+	s.AcceptRateWindow = time.Duration(cfg.AcceptRateWindow) * time.Millisecond
+	s.DialFailureAlert = cfg.DialFailureAlert
+	s.DialFailureWindow = time.Duration(cfg.DialFailureWindow) * time.Millisecond
+	for _, b := range s.Backends {
+		b.setDialFailureAlert(s.DialFailureAlert, s.DialFailureWindow)
+	}
+	s.EjectErrorRate = cfg.EjectErrorRate
+	s.EjectWindow = time.Duration(cfg.EjectWindow) * time.Millisecond
+	s.EjectTime = time.Duration(cfg.EjectTime) * time.Millisecond
+	s.QueueSize = cfg.QueueSize
+	s.QueueTimeout = time.Duration(cfg.QueueTimeout) * time.Millisecond
+
+	s.UDPSessionTimeout = time.Duration(cfg.UDPSessionTimeout) * time.Millisecond
+	for _, sessions := range s.udpSessions {
+		sessions.SetTimeout(s.UDPSessionTimeout)
+	}
+
+	s.ErrorPageRetries = cfg.ErrorPageRetries
+	s.ErrorPageRetryInterval = time.Duration(cfg.ErrorPageRetryInterval) * time.Millisecond
+	s.errorPages.SetRetries(s.ErrorPageRetries, s.ErrorPageRetryInterval)
+
+	s.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout) * time.Millisecond
+	s.ResponseTimeout = time.Duration(cfg.ResponseTimeout) * time.Millisecond
+	s.httpProxy.SetResponseTimeouts(s.ResponseHeaderTimeout, s.ResponseTimeout)
+
+	flushInterval := time.Duration(cfg.FlushInterval) * time.Millisecond
+	if s.FlushInterval != flushInterval {
+		s.FlushInterval = flushInterval
+		s.httpProxy.SetFlushInterval(flushInterval)
+	}
 
 	if s.Balance != cfg.Balance {
 		s.Balance = cfg.Balance
-		switch s.Balance {
-		case client.RoundRobin:
-			s.next = s.roundRobin
-		case client.LeastConn:
-			s.next = s.leastConn
-		default:
-			if cfg.Balance != "" {
-				log.Warnf("invalid balancing algorithm '%s'", cfg.Balance)
-			}
-			s.next = s.roundRobin
-		}
+		s.setBalance(cfg.Balance)
 	}
 
 	return nil
 }
 
+// Set the balancing function, using client.DefaultBalance if balance is
+// empty.
+func (s *Service) setBalance(balance string) {
+	if balance == "" {
+		balance = client.DefaultBalance
+	}
+
+	switch balance {
+	case client.RoundRobin:
+		s.next = s.roundRobin
+	case client.LeastConn:
+		s.next = s.leastConn
+	default:
+		log.Warnf("invalid balancing algorithm '%s'", balance)
+		s.next = s.roundRobin
+	}
+}
+
 func (s *Service) Stats() ServiceStat {
 	s.Lock()
 	defer s.Unlock()
@@ -217,25 +631,93 @@ func (s *Service) Stats() ServiceStat {
 		ClientTimeout: int(s.ClientTimeout / time.Millisecond),
 		ServerTimeout: int(s.ServerTimeout / time.Millisecond),
 		DialTimeout:   int(s.DialTimeout / time.Millisecond),
-		HTTPConns:     s.HTTPConns,
-		HTTPErrors:    s.HTTPErrors,
+		HTTPConns:     atomic.LoadInt64(&s.HTTPConns),
+		HTTPErrors:    atomic.LoadInt64(&s.HTTPErrors),
 		HTTPActive:    atomic.LoadInt64(&s.HTTPActive),
 		Rcvd:          atomic.LoadInt64(&s.Rcvd),
 		Sent:          atomic.LoadInt64(&s.Sent),
+		QueueSize:     s.QueueSize,
+		Queued:        atomic.LoadInt64(&s.queued),
+		Refused:       atomic.LoadInt64(&s.Refused),
+		HealthChecks:  atomic.LoadInt64(&s.HealthChecks),
+
+		HandshakeTimeouts: atomic.LoadInt64(&s.HandshakeTimeouts),
+		PerClientRefused:  atomic.LoadInt64(&s.PerClientRefused),
+		Clients:           s.clientCount(),
+
+		Rebalanced: atomic.LoadInt64(&s.Rebalanced),
+
+		AcceptRate:       s.acceptRate.Rate(time.Now(), s.acceptRateWindow()),
+		AcceptRateAlerts: atomic.LoadInt64(&s.AcceptRateAlerts),
+		StatsInterval:    int(s.StatsInterval / time.Millisecond),
+
+		MirrorRequests: atomic.LoadInt64(&s.MirrorRequests),
+		MirrorErrors:   atomic.LoadInt64(&s.MirrorErrors),
+		MirrorSkipped:  atomic.LoadInt64(&s.MirrorSkipped),
+	}
+
+	for _, sessions := range s.udpSessions {
+		stats.UDPSessions += sessions.Len()
 	}
 
 	for _, b := range s.Backends {
-		stats.Backends = append(stats.Backends, b.Stats())
-		stats.Sent += b.Sent
-		stats.Rcvd += b.Rcvd
-		stats.Errors += b.Errors
-		stats.Conns += b.Conns
-		stats.Active += b.Active
+		bStats := b.Stats()
+		stats.Backends = append(stats.Backends, bStats)
+		stats.BackendCount++
+		if bStats.Up {
+			stats.UpCount++
+		}
+		stats.Sent += bStats.Sent
+		stats.Rcvd += bStats.Rcvd
+		stats.Errors += bStats.Errors
+		stats.Conns += bStats.Conns
+		stats.Active += bStats.Active
+	}
+
+	groups := s.backendGroups()
+	if len(groups) > 1 || len(groups) == 1 && groups[0].name != "" {
+		active := activeGroup(groups)
+		for i, g := range groups {
+			gStats := GroupStat{
+				Name:         g.name,
+				BackendCount: len(g.backends),
+				Active:       i == active,
+			}
+			for _, b := range g.backends {
+				if b.Up() {
+					gStats.UpCount++
+				}
+			}
+			stats.Groups = append(stats.Groups, gStats)
+		}
 	}
 
+	// report the backends in a stable order, regardless of the order used
+	// for balancing
+	sort.Slice(stats.Backends, func(i, j int) bool {
+		return stats.Backends[i].Name < stats.Backends[j].Name
+	})
+
 	return stats
 }
 
+// Zero the cumulative counters for the service and all its backends. Live
+// counts, like the active connections, are unchanged.
+func (s *Service) ResetStats() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, counter := range []*int64{&s.Sent, &s.Rcvd, &s.Errors, &s.HTTPConns,
+		&s.HTTPErrors, &s.Refused, &s.AcceptRateAlerts, &s.HealthChecks, &s.HandshakeTimeouts,
+		&s.PerClientRefused, &s.MirrorRequests, &s.MirrorErrors, &s.MirrorSkipped, &s.Rebalanced} {
+		atomic.StoreInt64(counter, 0)
+	}
+
+	for _, b := range s.Backends {
+		b.ResetStats()
+	}
+}
+
 func (s *Service) Config() client.ServiceConfig {
 	s.Lock()
 	defer s.Unlock()
@@ -257,16 +739,128 @@ func (s *Service) config() client.ServiceConfig {
 		ServerTimeout:   int(s.ServerTimeout / time.Millisecond),
 		DialTimeout:     int(s.DialTimeout / time.Millisecond),
 		ErrorPages:      s.errPagesCfg,
+		ErrorPageRules:  s.errPageRulesCfg,
 		Network:         s.Network,
 		MaintenanceMode: s.MaintenanceMode,
+		FlushInterval:   int(s.FlushInterval / time.Millisecond),
+
+		ResponseHeaderTimeout: int(s.ResponseHeaderTimeout / time.Millisecond),
+		ResponseTimeout:       int(s.ResponseTimeout / time.Millisecond),
+
+		MaintenanceBody:        s.MaintenanceBody,
+		MaintenanceContentType: s.MaintenanceContentType,
+		MaintenanceFile:        s.MaintenanceFile,
+		Warmup:                 s.Warmup,
+		HTTPSRedirectCode:      s.HTTPSRedirectCode,
+		RejectHTTP:             s.RejectHTTP,
+		MaxURILength:           s.MaxURILength,
+		MaxRequestBodyBytes:    s.MaxRequestBodyBytes,
+		StickyCookie:           s.StickyCookie,
+		StickyCookieName:       s.StickyCookieName,
+		StickyCookieTTL:        int(s.StickyCookieTTL / time.Second),
+		MirrorAddr:             s.MirrorAddr,
+		MirrorSample:           s.MirrorSample,
+		UDPSessionTimeout:      int(s.UDPSessionTimeout / time.Millisecond),
+		ConnLogSample:          s.ConnLogSample,
+		AllowHalfOpen:          s.AllowHalfOpen,
+		RemoveWhenEmpty:        s.RemoveWhenEmpty,
+		SniffHTTP:              s.SniffHTTP,
+		SniffTimeout:           int(s.SniffTimeout / time.Millisecond),
+		RetryEmpty:             s.RetryEmpty,
+		RetryReset:             s.RetryReset,
+		LogBalance:             s.LogBalance,
+		HandshakeTimeout:       int(s.HandshakeTimeout / time.Millisecond),
+		CheckFast:              int(s.CheckFast / time.Millisecond),
+		CheckSlow:              int(s.CheckSlow / time.Millisecond),
+		StatsInterval:          int(s.StatsInterval / time.Millisecond),
+		HealthCheckCIDRs:       s.HealthCheckCIDRs,
+		HealthCheckResponse:    s.HealthCheckResponse,
+		MaxConnsPerClient:      s.MaxConnsPerClient,
+		RebalanceConns:         s.RebalanceConns,
+		MaxConnAge:             int(s.MaxConnAge / time.Millisecond),
+		TrustedProxies:         s.TrustedProxies,
+		GroupOrder:             s.GroupOrder,
+		AcceptRateAlert:        s.AcceptRateAlert,
+		AcceptRateWindow:       int(s.AcceptRateWindow / time.Millisecond),
+		DialFailureAlert:       s.DialFailureAlert,
+		DialFailureWindow:      int(s.DialFailureWindow / time.Millisecond),
+		EjectErrorRate:         s.EjectErrorRate,
+		EjectWindow:            int(s.EjectWindow / time.Millisecond),
+		EjectTime:              int(s.EjectTime / time.Millisecond),
+		QueueSize:              s.QueueSize,
+		QueueTimeout:           int(s.QueueTimeout / time.Millisecond),
+		ErrorPageRetries:       s.ErrorPageRetries,
+		ErrorPageRetryInterval: int(s.ErrorPageRetryInterval / time.Millisecond),
+		TLSAddr:                s.TLSAddr,
+		TLSCert:                s.TLSCert,
+		TLSKey:                 s.TLSKey,
+		SendBufferBytes:        s.SendBufferBytes,
+		RecvBufferBytes:        s.RecvBufferBytes,
 	}
 	for _, b := range s.Backends {
 		config.Backends = append(config.Backends, b.Config())
 	}
+	sort.Slice(config.Backends, func(i, j int) bool {
+		return config.Backends[i].Name < config.Backends[j].Name
+	})
+
+	if !s.NoDelay {
+		noDelay := false
+		config.NoDelay = &noDelay
+	}
 
 	return config
 }
 
+// Check if the requested listen address is satisfied by the bound address.
+// A requested port of 0 matches whatever port was assigned to the listener,
+// and the unspecified hosts "", "0.0.0.0" and "::" all match each other, since
+// a listener on ":0" reports its address as "[::]:port".
+func sameAddr(bound, requested string) bool {
+	if bound == requested {
+		return true
+	}
+
+	bHost, bPort, err := net.SplitHostPort(bound)
+	if err != nil {
+		return false
+	}
+	rHost, rPort, err := net.SplitHostPort(requested)
+	if err != nil {
+		return false
+	}
+
+	if rPort != "0" && rPort != bPort {
+		return false
+	}
+	return bHost == rHost || unspecifiedHost(bHost) && unspecifiedHost(rHost)
+}
+
+// Report whether a listen host binds all addresses.
+func unspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// Compare lists of addresses with sameAddr.
+func sameAddrs(bound, requested string) bool {
+	b := client.SplitAddrs(bound)
+	r := client.SplitAddrs(requested)
+	if len(b) != len(r) {
+		return false
+	}
+
+	for i := range b {
+		if !sameAddr(b[i], r[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Service) String() string {
 	return string(marshal(s.Config()))
 }
@@ -283,6 +877,43 @@ func (s *Service) get(name string) *Backend {
 	return nil
 }
 
+// Change the weight of a backend in place, without replacing the Backend.
+// The balancer uses the new weight on its next selection.
+func (s *Service) SetBackendWeight(name string, weight int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Name == name {
+			b.Lock()
+			b.Weight = weight
+			b.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// Drain a backend in place, or return it to service, without replacing the
+// Backend.
+func (s *Service) SetBackendDrain(name string, drain bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Name == name {
+			b.Lock()
+			if b.drain != drain {
+				b.lastChange = time.Now()
+			}
+			b.drain = drain
+			b.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
 // Add or replace a Backend in this service
 func (s *Service) add(backend *Backend) {
 	s.Lock()
@@ -293,9 +924,11 @@ func (s *Service) add(backend *Backend) {
 	backend.rwTimeout = s.ServerTimeout
 	backend.dialTimeout = s.DialTimeout
 	backend.checkInterval = time.Duration(s.CheckInterval) * time.Millisecond
+	backend.checkFast, backend.checkSlow = s.CheckFast, s.CheckSlow
+	backend.dialFailureAlert, backend.dialFailureWindow = s.DialFailureAlert, s.DialFailureWindow
 
 	// We may add some allowed protocol bridging in the future, but for now just fail
-	if s.Network[:3] != backend.Network[:3] {
+	if strings.HasPrefix(s.Network, "tcp") != strings.HasPrefix(backend.Network, "tcp") {
 		log.Errorf("ERROR: backend %s cannot use network '%s'", backend.Name, backend.Network)
 	}
 
@@ -305,6 +938,7 @@ func (s *Service) add(backend *Backend) {
 			b.Stop()
 			s.Backends[i] = backend
 			backend.Start()
+			s.warmup(backend)
 			return
 		}
 	}
@@ -312,6 +946,30 @@ func (s *Service) add(backend *Backend) {
 	s.Backends = append(s.Backends, backend)
 
 	backend.Start()
+	s.warmup(backend)
+}
+
+// Open and close probe connections to a backend in the background, so the
+// first client doesn't pay the full cost of a cold connection.
+// Service must be locked.
+func (s *Service) warmup(backend *Backend) {
+	if s.Warmup <= 0 || !strings.HasPrefix(backend.Network, "tcp") {
+		return
+	}
+
+	dialer := s.dialer
+	count := s.Warmup
+	go func() {
+		for i := 0; i < count; i++ {
+			conn, err := backend.dial(dialer, backend.Network)
+			if err != nil {
+				log.Warnf("WARN: warmup connection to backend %s failed: %s", backend.Name, err)
+				return
+			}
+			conn.Close()
+		}
+		log.Debugf("Warmed up %d connections to backend %s", count, backend.Name)
+	}()
 }
 
 // Remove a Backend by name
@@ -342,117 +1000,533 @@ func (s *Service) start() (err error) {
 		s.Backends = make([]*Backend, 0)
 	}
 
-	switch s.Network {
+	if err := s.listen(s.Network, s.Addr); err != nil {
+		return err
+	}
+
+	if s.TLSAddr != "" {
+		return s.listenTLS(s.TLSAddr, s.TLSCert, s.TLSKey)
+	}
+	return nil
+}
+
+// Bind a listener on the network for each of the comma separated addresses,
+// and start serving them. Listeners already bound to one of the addresses
+// are kept. Any other existing listeners are closed only after all the new
+// ones are bound, so a failed bind leaves the service running as it was.
+// The service must be locked.
+func (s *Service) listen(network, addr string) error {
+	addrs := client.SplitAddrs(addr)
+	if len(addrs) == 0 {
+		return fmt.Errorf("Error: no listening address for %s", s.Name)
+	}
+
+	var err error
+	switch network {
 	case "tcp", "tcp4", "tcp6":
-		log.Printf("Starting TCP listener for %s on %s", s.Name, s.Addr)
+		err = s.listenTCP(network, addrs)
+	case "udp", "udp4", "udp6":
+		err = s.listenUDP(network, addrs)
+	default:
+		return fmt.Errorf("Error: unknown network '%s'", network)
+	}
+	if err != nil {
+		return err
+	}
 
-		s.tcpListener, err = newTimeoutListener(s.Network, s.Addr, s.ClientTimeout)
-		if err != nil {
-			return err
+	s.Network = network
+	return nil
+}
+
+// Find the index of a bound address matching the requested address, which
+// hasn't already been used.
+func findBound(bound []string, used []bool, addr string) int {
+	for i, b := range bound {
+		if !used[i] && sameAddr(b, addr) {
+			return i
 		}
+	}
+	return -1
+}
 
-		go s.runTCP()
-	case "udp", "udp4", "udp6":
-		log.Printf("Starting UDP listener for %s on %s", s.Name, s.Addr)
+// The service must be locked.
+func (s *Service) listenTCP(network string, addrs []string) error {
+	var existing []net.Listener
+	if s.Network == network {
+		existing = s.tcpListeners
+	}
 
-		laddr, err := net.ResolveUDPAddr(s.Network, s.Addr)
-		if err != nil {
-			return err
+	bound := make([]string, len(existing))
+	for i, l := range existing {
+		bound[i] = l.Addr().String()
+	}
+	kept := make([]bool, len(existing))
+
+	listeners := make([]net.Listener, len(addrs))
+	started := []net.Listener{}
+	for i, addr := range addrs {
+		if j := findBound(bound, kept, addr); j >= 0 {
+			kept[j] = true
+			listeners[i] = existing[j]
+			continue
 		}
-		s.udpListener, err = net.ListenUDP(s.Network, laddr)
+
+		log.Printf("Starting TCP listener for %s on %s", s.Name, addr)
+
+		var l net.Listener
+		err := bindRetry(func() (err error) {
+			l, err = newTimeoutListener(network, addr, s.ClientTimeout, s.reusePort)
+			return err
+		})
 		if err != nil {
+			for _, l := range started {
+				l.Close()
+			}
 			return err
 		}
 
-		go s.runUDP()
-	default:
-		return fmt.Errorf("Error: unknown network '%s'", s.Network)
+		listeners[i] = l
+		started = append(started, l)
 	}
 
-	return nil
-}
-
-// Start the Service's Accept loop
-func (s *Service) runTCP() {
-	for {
-		conn, err := s.tcpListener.Accept()
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnln("WARN:", err)
-				continue
-			}
-			// we must be getting shut down
-			return
+	// close the listeners which weren't kept
+	for i, l := range s.tcpListeners {
+		if i < len(kept) && kept[i] {
+			continue
+		}
+		if err := l.Close(); err != nil {
+			log.Println(err)
 		}
+	}
+	s.tcpListeners = nil
 
-		go s.connectTCP(conn)
+	// and any listeners from a previous network
+	s.closeListeners()
+	s.tcpListeners = listeners
+
+	for _, l := range started {
+		go s.runTCP(l)
+	}
+
+	// report the actual addresses in case we were assigned a port
+	for i, l := range listeners {
+		addrs[i] = l.Addr().String()
 	}
+	s.Addr = strings.Join(addrs, ",")
+	return nil
 }
 
-func (s *Service) runUDP() {
-	buff := make([]byte, 65536)
-	conn := s.udpListener
+// The service must be locked.
+func (s *Service) listenUDP(network string, addrs []string) error {
+	var existing []*net.UDPConn
+	if s.Network == network {
+		existing = s.udpListeners
+	}
 
-	// for UDP, we can proxy the data right here.
-	for {
-		n, _, err := conn.ReadFromUDP(buff)
-		if err != nil {
-			// we can't cleanly signal the Read to stop, so we have to
-			// string-match this error.
-			if err.Error() == "use of closed network connection" {
-				// normal shutdown
-				return
-			} else if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnf("WARN: %s", err.Error())
-			} else {
-				// unexpected error, log it before exiting
-				log.Errorf("ERROR: %s", err.Error())
-				atomic.AddInt64(&s.Errors, 1)
-				return
-			}
+	bound := make([]string, len(existing))
+	for i, conn := range existing {
+		bound[i] = conn.LocalAddr().String()
+	}
+	kept := make([]bool, len(existing))
+
+	conns := make([]*net.UDPConn, len(addrs))
+	sessions := make([]*udpSessionTable, len(addrs))
+	started := []*net.UDPConn{}
+	closeStarted := func() {
+		for _, conn := range started {
+			conn.Close()
 		}
+	}
 
-		if n == 0 {
+	for i, addr := range addrs {
+		if j := findBound(bound, kept, addr); j >= 0 {
+			kept[j] = true
+			conns[i] = existing[j]
+			sessions[i] = s.udpSessions[j]
 			continue
 		}
 
-		atomic.AddInt64(&s.Rcvd, int64(n))
+		log.Printf("Starting UDP listener for %s on %s", s.Name, addr)
 
-		backend := s.udpRoundRobin()
-		if backend == nil {
-			// this could produce a lot of message
-			// TODO: log some %, or max rate of messages
-			continue
+		laddr, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			closeStarted()
+			return err
 		}
 
-		n, err = conn.WriteTo(buff[:n], backend.udpAddr)
+		var conn *net.UDPConn
+		err = bindRetry(func() (err error) {
+			conn, err = listenUDP(network, laddr, s.reusePort)
+			return err
+		})
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnf("WARN: %s", err.Error())
-				continue
-			}
+			closeStarted()
+			return err
+		}
 
-			log.Errorf("ERROR: %s", err.Error())
-			atomic.AddInt64(&s.Errors, 1)
-		} else {
-			atomic.AddInt64(&s.Sent, int64(n))
+		conns[i] = conn
+		started = append(started, conn)
+	}
+
+	// close the listeners which weren't kept
+	for i, conn := range s.udpListeners {
+		if i < len(kept) && kept[i] {
+			continue
+		}
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+		s.udpSessions[i].Close()
+	}
+	s.udpListeners = nil
+	s.udpSessions = nil
+
+	// and any listeners from a previous network
+	s.closeListeners()
+
+	// replies must be sent from the listener the client sent to, so each
+	// listener has its own sessions
+	for i, conn := range conns {
+		if sessions[i] == nil {
+			sessions[i] = newUDPSessionTable(conn, s.UDPSessionTimeout)
+			go s.runUDP(conn, sessions[i])
 		}
 	}
+	s.udpListeners = conns
+	s.udpSessions = sessions
+
+	for i, conn := range conns {
+		addrs[i] = conn.LocalAddr().String()
+	}
+	s.Addr = strings.Join(addrs, ",")
+	return nil
 }
 
-// Return the addresses of the current backends in the order they would be balanced
-func (s *Service) NextAddrs() []string {
-	backends := s.next()
+// Bind the secondary TLS listener, which terminates TLS and proxies to the
+// same backends. If the listener is already bound to the address, only the
+// certificate is reloaded. An empty address removes the TLS listener.
+// The service must be locked.
+func (s *Service) listenTLS(addr, certFile, keyFile string) error {
+	if addr == "" {
+		s.closeTLSListener()
+		s.TLSAddr, s.TLSCert, s.TLSKey = "", "", ""
+		return nil
+	}
 
-	addrs := make([]string, len(backends))
-	for i, b := range backends {
-		addrs[i] = b.Addr
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate for %s: %s", s.Name, err)
 	}
-	return addrs
+
+	if s.tlsListener != nil && sameAddr(s.TLSAddr, addr) {
+		log.Printf("Reloading TLS certificate for %s", s.Name)
+		s.tlsCertificate = &cert
+		s.TLSCert, s.TLSKey = certFile, keyFile
+		return nil
+	}
+
+	log.Printf("Starting TLS listener for %s on %s", s.Name, addr)
+
+	var l net.Listener
+	err = bindRetry(func() (err error) {
+		l, err = newTimeoutListener(s.Network, addr, s.ClientTimeout, s.reusePort)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.closeTLSListener()
+	s.tlsCertificate = &cert
+	s.tlsBase = l.(*timeoutListener)
+	s.tlsListener = tls.NewListener(l, &tls.Config{GetCertificate: s.getCertificate})
+	s.TLSAddr = l.Addr().String()
+	s.TLSCert, s.TLSKey = certFile, keyFile
+
+	go s.runTCP(s.tlsListener)
+	return nil
 }
 
-// Available returns the number of backends marked as Up
-func (s *Service) Available() int {
+// Return the current certificate for the TLS listener.
+func (s *Service) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.tlsCertificate, nil
+}
+
+// The service must be locked.
+func (s *Service) closeTLSListener() {
+	if s.tlsListener == nil {
+		return
+	}
+
+	if err := s.tlsListener.Close(); err != nil {
+		log.Println(err)
+	}
+	s.tlsListener = nil
+	s.tlsBase = nil
+}
+
+// Close any open listeners, except the TLS listener.
+// The service must be locked.
+func (s *Service) closeListeners() {
+	// the service may have been bad, and the listener failed
+	for _, l := range s.tcpListeners {
+		if err := l.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	s.tcpListeners = nil
+
+	for _, conn := range s.udpListeners {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	s.udpListeners = nil
+
+	for _, sessions := range s.udpSessions {
+		sessions.Close()
+	}
+	s.udpSessions = nil
+}
+
+// Start the Service's Accept loop
+func (s *Service) runTCP(l net.Listener) {
+	backoff := &acceptBackoff{}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				backoff.wait(s.Name, err)
+				continue
+			}
+			// we must be getting shut down
+			return
+		}
+		backoff.reset()
+		s.countAccept()
+
+		go s.connectTCP(conn)
+	}
+}
+
+// Count an accepted connection towards the accept rate, and warn once per
+// window if it exceeds AcceptRateAlert.
+func (s *Service) countAccept() {
+	s.Lock()
+	limit, window := s.AcceptRateAlert, s.acceptRateWindow()
+	s.Unlock()
+
+	if limit <= 0 {
+		return
+	}
+
+	if rate, ok := s.acceptRate.Add(time.Now(), window, limit); ok {
+		atomic.AddInt64(&s.AcceptRateAlerts, 1)
+		log.Warnf("WARN: %s accepted %.0f connections/s, over the alert rate of %d/s",
+			s.Name, rate, limit)
+	}
+}
+
+// The service must be locked.
+func (s *Service) acceptRateWindow() time.Duration {
+	if s.AcceptRateWindow <= 0 {
+		return client.DefaultAcceptRateWindow * time.Millisecond
+	}
+	return s.AcceptRateWindow
+}
+
+// Counts accepted connections over a window, shared by all of a service's
+// listeners.
+type acceptRate struct {
+	sync.Mutex
+	start   time.Time
+	count   int
+	alerted bool
+
+	// the rate over the last complete window
+	last float64
+}
+
+// Count a connection accepted at now. If this is the first connection over
+// the limit in the current window, the rate so far is returned with true.
+func (r *acceptRate) Add(now time.Time, window time.Duration, limit int) (float64, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if elapsed := now.Sub(r.start); elapsed >= window {
+		if !r.start.IsZero() {
+			r.last = float64(r.count) / elapsed.Seconds()
+		}
+		r.start = now
+		r.count = 0
+		r.alerted = false
+	}
+
+	r.count++
+	if r.alerted || float64(r.count) <= float64(limit)*window.Seconds() {
+		return 0, false
+	}
+
+	r.alerted = true
+	return float64(r.count) / window.Seconds(), true
+}
+
+// Return the rate over the last complete window, which is 0 if there have
+// been no connections since.
+func (r *acceptRate) Rate(now time.Time, window time.Duration) float64 {
+	r.Lock()
+	defer r.Unlock()
+
+	elapsed := now.Sub(r.start)
+	switch {
+	case r.start.IsZero() || elapsed >= 2*window:
+		return 0
+	case elapsed >= window:
+		return float64(r.count) / elapsed.Seconds()
+	}
+	return r.last
+}
+
+// Backoff for repeated temporary Accept errors, like running out of file
+// descriptors, so we don't spin on the listener. This follows the same pattern
+// as net/http's Server.
+type acceptBackoff struct {
+	delay      time.Duration
+	lastLog    time.Time
+	suppressed int
+}
+
+// Log the error at most once per second, and sleep for the next delay.
+func (b *acceptBackoff) wait(name string, err error) {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay *= 2
+	}
+	if b.delay > acceptBackoffMax {
+		b.delay = acceptBackoffMax
+	}
+
+	if time.Since(b.lastLog) >= time.Second {
+		log.Warnf("WARN: accept error for %s: %s; retrying in %s (%d errors suppressed)",
+			name, err, b.delay, b.suppressed)
+		b.lastLog = time.Now()
+		b.suppressed = 0
+	} else {
+		b.suppressed++
+	}
+
+	time.Sleep(b.delay)
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
+
+func (s *Service) runUDP(conn *net.UDPConn, sessions *udpSessionTable) {
+	buff := make([]byte, 65536)
+
+	// for UDP, we can proxy the data right here.
+	for {
+		n, cliAddr, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			// we can't cleanly signal the Read to stop, so we have to
+			// string-match this error.
+			if err.Error() == "use of closed network connection" {
+				// normal shutdown
+				return
+			} else if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.Warnf("WARN: %s", err.Error())
+			} else {
+				// unexpected error, log it before exiting
+				log.Errorf("ERROR: %s", err.Error())
+				atomic.AddInt64(&s.Errors, 1)
+				return
+			}
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		atomic.AddInt64(&s.Rcvd, int64(n))
+
+		if sessions.Timeout() > 0 {
+			s.sendUDPSession(sessions, cliAddr, buff[:n])
+			continue
+		}
+
+		backend := s.udpRoundRobin()
+		if backend == nil {
+			// this could produce a lot of message
+			// TODO: log some %, or max rate of messages
+			continue
+		}
+
+		n, err = conn.WriteTo(buff[:n], backend.udpAddr)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.Warnf("WARN: %s", err.Error())
+				continue
+			}
+
+			log.Errorf("ERROR: %s", err.Error())
+			atomic.AddInt64(&s.Errors, 1)
+		} else {
+			atomic.AddInt64(&s.Sent, int64(n))
+		}
+	}
+}
+
+// Forward a packet through the client's session, so that replies from the
+// backend are returned to the client.
+func (s *Service) sendUDPSession(sessions *udpSessionTable, cliAddr *net.UDPAddr, packet []byte) {
+	sess, err := sessions.Get(cliAddr, s.udpRoundRobin)
+	if err != nil {
+		log.Errorf("ERROR: %s", err.Error())
+		atomic.AddInt64(&s.Errors, 1)
+		return
+	}
+	if sess == nil {
+		// no backend available
+		return
+	}
+
+	n, err := sess.conn.Write(packet)
+	if err != nil {
+		log.Warnf("WARN: %s", err.Error())
+		atomic.AddInt64(&sess.backend.Errors, 1)
+		return
+	}
+	atomic.AddInt64(&s.Sent, int64(n))
+	atomic.AddInt64(&sess.backend.Sent, int64(n))
+}
+
+// Return the current backends in the order they would be balanced. The
+// balancing function may be swapped by a config update, so always read it
+// under the lock.
+func (s *Service) nextBackends() []*Backend {
+	s.Lock()
+	next := s.next
+	s.Unlock()
+	return next()
+}
+
+// Return the addresses of the current backends in the order they would be balanced
+func (s *Service) NextAddrs() []string {
+	backends := s.nextBackends()
+
+	addrs := make([]string, len(backends))
+	for i, b := range backends {
+		addrs[i] = b.Addr
+	}
+	return addrs
+}
+
+// Available returns the number of backends marked as Up
+func (s *Service) Available() int {
 	s.Lock()
 	defer s.Unlock()
 
@@ -485,161 +1559,1410 @@ func (s *Service) Dial(nw, addr string) (net.Conn, error) {
 			break
 		}
 	}
+	sendBuf, recvBuf := s.SendBufferBytes, s.RecvBufferBytes
 	s.Unlock()
 
 	if backend == nil {
 		return nil, DialError{fmt.Errorf("no backend matching %s", addr)}
 	}
 
-	srvConn, err := s.dialer.Dial(nw, backend.Addr)
+	srvConn, err := backend.dial(s.dialer, nw)
 	if err != nil {
 		log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, backend.Name, err)
 		atomic.AddInt64(&backend.Errors, 1)
 		return nil, DialError{err}
 	}
+	setBufferSizes(srvConn, sendBuf, recvBuf)
 
 	conn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
+		Conn:      srvConn,
 		rwTimeout: s.ServerTimeout,
 		written:   &backend.Sent,
 		read:      &backend.Rcvd,
+		resets:    &backend.Resets,
 		connected: &backend.HTTPActive,
 	}
 
-	atomic.AddInt64(&backend.Conns, 1)
+	backend.countConn()
 
 	// NOTE: this relies on conn.Close being called, which *should* happen in
-	// all cases, but may be at fault in the active count becomes skewed in
-	// some error case.
+	// all cases. Only the first Close decrements the count.
 	atomic.AddInt64(&backend.HTTPActive, 1)
 	return conn, nil
 }
 
 func (s *Service) connectTCP(cliConn net.Conn) {
-	backends := s.next()
+	defer recoverConn("connection", cliConn, &s.Errors)
 
-	// Try the first backend given, but if that fails, cycle through them all
-	// to make a best effort to connect the client.
-	for _, b := range backends {
-		srvConn, err := s.dialer.Dial(b.Network, b.Addr)
-		if err != nil {
-			log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
-			atomic.AddInt64(&b.Errors, 1)
-			continue
-		}
-
-		b.Proxy(srvConn, cliConn)
+	if Registry.Maintenance().TCP {
+		cliConn.Close()
 		return
 	}
 
-	log.Errorf("ERROR: no backend for %s", s.Name)
-	cliConn.Close()
-}
-
-// Stop the Service's Accept loop by closing the Listener,
-// and stop all backends for this service.
-func (s *Service) stop() {
 	s.Lock()
-	defer s.Unlock()
+	sample := s.ConnLogSample
+	noDelay := s.NoDelay
+	sendBuf, recvBuf := s.SendBufferBytes, s.RecvBufferBytes
+	halfOpen := s.AllowHalfOpen
+	healthCheckNets := s.healthCheckNets
+	healthCheckResponse := s.HealthCheckResponse
+	sniff := s.SniffHTTP
+	sniffTimeout := s.sniffTimeout()
+	retryEmpty := s.RetryEmpty
+	handshakeTimeout := s.HandshakeTimeout
+	maxPerClient := s.MaxConnsPerClient
+	s.Unlock()
 
-	log.Printf("Stopping Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
-	for _, backend := range s.Backends {
-		backend.Stop()
+	if len(healthCheckNets) > 0 && fromNets(cliConn, healthCheckNets) {
+		s.answerHealthCheck(cliConn, healthCheckResponse)
+		return
 	}
 
-	switch s.Network {
-	case "tcp", "tcp4", "tcp6":
-		// the service may have been bad, and the listener failed
-		if s.tcpListener == nil {
+	if handshakeTimeout > 0 {
+		conn, err := awaitHandshake(cliConn, handshakeTimeout)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				atomic.AddInt64(&s.HandshakeTimeouts, 1)
+				log.Warnf("WARN: client %s sent no data to %s within %s", cliConn.RemoteAddr(), s.Name, handshakeTimeout)
+			} else {
+				log.Debugf("Client %s closed before sending data to %s: %s", cliConn.RemoteAddr(), s.Name, err)
+			}
+			cliConn.Close()
 			return
 		}
+		cliConn = conn
+	}
 
-		err := s.tcpListener.Close()
+	if sniff {
+		conn, isHTTP, err := sniffConn(cliConn, sniffTimeout)
 		if err != nil {
-			log.Println(err)
+			log.Debugf("Client %s closed before sending a request to %s", cliConn.RemoteAddr(), s.Name)
+			cliConn.Close()
+			return
 		}
-
-	case "udp", "udp4", "udp6":
-		if s.udpListener == nil {
+		if isHTTP {
+			serveSniffedHTTP(conn)
 			return
 		}
-		err := s.udpListener.Close()
-		if err != nil {
-			log.Println(err)
+		cliConn = conn
+	}
+
+	if maxPerClient > 0 {
+		conn, ip := tcpClientIP(cliConn, Registry.TrustedNets(s), sniffTimeout)
+		cliConn = conn
+		if !s.acquireClient(ip, maxPerClient) {
+			atomic.AddInt64(&s.PerClientRefused, 1)
+			log.Warnf("WARN: client %s has reached max_conns_per_client for %s", ip, s.Name)
+			cliConn.Close()
+			return
 		}
+		defer s.releaseClient(ip)
 	}
 
-}
+	// TCP_NODELAY is already set by default
+	if !noDelay {
+		setNoDelay(cliConn, false)
+	}
+	setBufferSizes(cliConn, sendBuf, recvBuf)
 
-// Provide a ServeHTTP method for out ReverseProxy
-func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	atomic.AddInt64(&s.HTTPConns, 1)
-	atomic.AddInt64(&s.HTTPActive, 1)
-	defer atomic.AddInt64(&s.HTTPActive, -1)
+	hooks := getConnHooks()
+	if sample > 0 && rand.Float64() < sample {
+		hooks = MultiHooks{hooks, connLogger{}}
+	}
 
-	if s.HTTPSRedirect {
-		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") != "https" {
-			//TODO: verify RequestURI
-			redirLoc := "https://" + r.Host + r.RequestURI
-			http.Redirect(w, r, redirLoc, http.StatusMovedPermanently)
-			return
+	counted := &countingConn{Conn: cliConn}
+	cliConn = counted
+
+	info := &ConnInfo{
+		Service: s.Name,
+		Client:  counted.RemoteAddr().String(),
+		Start:   time.Now(),
+	}
+	hooks.Accepted(info)
+
+	defer func() {
+		info.Rcvd = atomic.LoadInt64(&counted.read)
+		info.Sent = atomic.LoadInt64(&counted.written)
+		info.Duration = time.Since(info.Start)
+		if info.Err == nil {
+			info.Err = counted.err
 		}
+		hooks.Closed(info)
+	}()
+
+	// Try the first backend given, but if that fails, cycle through them all
+	// to make a best effort to connect the client. If they're all at
+	// MaxConns, wait in the queue for a free slot.
+	b, srvConn, full := s.dialNext(hooks, info)
+	if b == nil && full {
+		cliConn, b, srvConn = s.queueConn(cliConn, hooks, info)
 	}
 
-	if s.MaintenanceMode {
-		// TODO: Should we increment HTTPErrors here as well?
-		logRequest(r, http.StatusServiceUnavailable, "", nil, 0)
-		errPage := s.errorPages.Get(http.StatusServiceUnavailable)
-		if errPage != nil {
-			headers := w.Header()
-			for key, val := range errPage.Header() {
-				headers[key] = val
-			}
-		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		if errPage != nil {
-			w.Write(errPage.Body())
+	if b == nil {
+		log.Errorf("ERROR: no backend for %s", s.Name)
+		if info.Err == nil {
+			info.Err = fmt.Errorf("no backend")
 		}
+		cliConn.Close()
 		return
 	}
 
-	s.httpProxy.ServeHTTP(w, r, s.NextAddrs())
-}
+	info.Connected = true
 
-func (s *Service) errStats(pr *ProxyRequest) bool {
-	if pr.ProxyError != nil {
-		atomic.AddInt64(&s.HTTPErrors, 1)
+	if !noDelay {
+		setNoDelay(srvConn, false)
+	}
+	setBufferSizes(srvConn, sendBuf, recvBuf)
+
+	if retryEmpty {
+		cliConn, b, srvConn = s.retryEmpty(cliConn, b, srvConn, hooks, info)
+		if b == nil {
+			cliConn.Close()
+			return
+		}
+	}
+
+	defer s.releaseSlot(b)
+	defer s.rebalanceConn(b, srvConn)()
+	if b.proxy(srvConn, cliConn, halfOpen) &&
+		atomic.LoadInt64(&counted.read) == 0 && atomic.LoadInt64(&counted.written) == 0 {
+		atomic.AddInt64(&b.EmptyResponses, 1)
+		log.Debugf("Backend %s/%s closed without sending any data", s.Name, b.Name)
 	}
-	return true
 }
 
-// A net.Listener that provides a read/write timeout
-type timeoutListener struct {
-	*net.TCPListener
-	rwTimeout time.Duration
+// Minimum time between rebalancing closes on a service, and the time a
+// backend is given to close a rebalanced connection before it's closed
+// outright.
+const (
+	rebalanceSpacing = 100 * time.Millisecond
+	rebalanceGrace   = 10 * time.Second
+)
 
-	// these aren't reported yet, but our new counting connections need to
-	// update something
-	read    int64
-	written int64
+// Watch the age of a proxied connection when RebalanceConns is set. Once it's
+// older than MaxConnAge, and its backend has more connections than it needs,
+// the backend connection is closed for writing, as though the client had
+// finished, so the backend closes it and the client reconnects. Returns a
+// func to stop watching when the connection is closed.
+func (s *Service) rebalanceConn(b *Backend, srvConn net.Conn) func() {
+	s.Lock()
+	enabled, maxAge := s.RebalanceConns, s.MaxConnAge
+	s.Unlock()
+
+	if !enabled || maxAge <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(jitter(maxAge))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			wait, now := s.rebalanceWait(b)
+			if now {
+				break
+			}
+			if wait <= 0 {
+				return
+			}
+			timer.Reset(wait)
+		}
+
+		log.Debugf("Rebalancing connection %s to %s/%s", srvConn.LocalAddr(), s.Name, b.Name)
+		atomic.AddInt64(&s.Rebalanced, 1)
+		closeWrite(srvConn)
+
+		timer.Reset(rebalanceGrace)
+		select {
+		case <-done:
+		case <-timer.C:
+			srvConn.Close()
+		}
+	}()
+
+	return func() { close(done) }
 }
 
-func newTimeoutListener(netw, addr string, timeout time.Duration) (net.Listener, error) {
-	lAddr, err := net.ResolveTCPAddr(netw, addr)
-	if err != nil {
-		return nil, err
+// Decide whether to close an old connection to backend b now. If not, returns
+// the time to wait before asking again, or 0 if rebalancing has been turned
+// off.
+func (s *Service) rebalanceWait(b *Backend) (time.Duration, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.RebalanceConns || s.MaxConnAge <= 0 {
+		return 0, false
 	}
 
-	l, err := net.ListenTCP(netw, lAddr)
-	if err != nil {
-		return nil, err
+	balance := s.Balance
+	if balance == "" {
+		balance = client.DefaultBalance
+	}
+	if balance != client.LeastConn {
+		return jitter(s.MaxConnAge), false
 	}
 
-	tl := &timeoutListener{
-		TCPListener: l,
-		rwTimeout:   timeout,
+	// moving the connection only helps if another backend has at least 2
+	// fewer, otherwise it would just move back
+	active := atomic.LoadInt64(&b.Active)
+	least := active
+	for _, other := range s.Backends {
+		if other != b && other.Up() {
+			if n := atomic.LoadInt64(&other.Active); n < least {
+				least = n
+			}
+		}
 	}
-	return tl, nil
+	if active-least < 2 {
+		return jitter(s.MaxConnAge), false
+	}
+
+	if since := time.Since(s.lastRebalance); since < rebalanceSpacing {
+		return jitter(rebalanceSpacing - since), false
+	}
+	s.lastRebalance = time.Now()
+	return 0, true
+}
+
+// Add up to 10% to d, so timers started together don't all fire at once.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+// Wait for the first data on either side of a new connection, and while the
+// backend hasn't sent anything and the client's data hasn't been forwarded,
+// move on to the next backend if it closes the connection. Returns the client
+// connection, which replays anything sent while waiting, and the backend to
+// proxy to, or a nil backend if there's none left or the client disconnected.
+func (s *Service) retryEmpty(cliConn net.Conn, b *Backend, srvConn net.Conn, hooks ConnHooks, info *ConnInfo) (net.Conn, *Backend, net.Conn) {
+	s.Lock()
+	tries := len(s.Backends)
+	noDelay := s.NoDelay
+	sendBuf, recvBuf := s.SendBufferBytes, s.RecvBufferBytes
+	s.Unlock()
+
+	for i := 1; ; i++ {
+		var err error
+		cliConn, err = awaitFirstData(cliConn, srvConn, b)
+		if err == nil {
+			return cliConn, b, srvConn
+		}
+
+		srvConn.Close()
+		s.releaseSlot(b)
+		if err != errEmptyResponse {
+			log.Debugf("Client %s disconnected while waiting for %s: %s", cliConn.RemoteAddr(), s.Name, err)
+			return cliConn, nil, nil
+		}
+
+		atomic.AddInt64(&b.EmptyResponses, 1)
+		log.Warnf("WARN: backend %s/%s closed without sending any data", s.Name, b.Name)
+		if i >= tries {
+			return cliConn, nil, nil
+		}
+
+		b, srvConn, _ = s.dialNext(hooks, info)
+		if b == nil {
+			return cliConn, nil, nil
+		}
+		if !noDelay {
+			setNoDelay(srvConn, false)
+		}
+		setBufferSizes(srvConn, sendBuf, recvBuf)
+	}
+}
+
+// Returned by awaitFirstData when the backend closes without sending data.
+var errEmptyResponse = fmt.Errorf("backend closed without sending data")
+
+// Wait until the backend sends its first data, or the client sends its first
+// data or disconnects. Anything received from the backend is written through
+// to the client. Returns errEmptyResponse if the backend closed first without
+// sending anything.
+func awaitFirstData(cliConn, srvConn net.Conn, b *Backend) (net.Conn, error) {
+	type readResult struct {
+		n   int
+		err error
+	}
+
+	// read the underlying connection directly, so that the read timeout
+	// doesn't override the deadline used to stop the read, and the data isn't
+	// counted twice.
+	raw := srvConn
+	if sc, ok := srvConn.(*shuttleConn); ok {
+		raw = sc.Conn
+	}
+
+	w := watchConn(cliConn)
+	buf := make([]byte, 4096)
+	read := make(chan readResult, 1)
+	go func() {
+		n, err := raw.Read(buf)
+		read <- readResult{n, err}
+	}()
+
+	var res readResult
+	clientGone := false
+	select {
+	case res = <-read:
+		read = nil
+	case <-w.data:
+	case <-w.gone:
+		clientGone = true
+	}
+
+	// stop the pending read from the backend, if it's still waiting
+	if read != nil {
+		raw.SetReadDeadline(time.Now())
+		res = <-read
+		raw.SetReadDeadline(time.Time{})
+	}
+	cliConn = w.stop()
+
+	if res.n > 0 {
+		atomic.AddInt64(&b.Rcvd, int64(res.n))
+		_, err := cliConn.Write(buf[:res.n])
+		return cliConn, err
+	}
+
+	if ne, ok := res.err.(net.Error); ok && ne.Timeout() {
+		if clientGone && w.buf.Len() == 0 {
+			return cliConn, io.EOF
+		}
+		return cliConn, nil
+	}
+	if res.err != nil {
+		return cliConn, errEmptyResponse
+	}
+	return cliConn, nil
+}
+
+// The time to wait for a client's first bytes when sniffing for HTTP.
+// Service must be locked.
+func (s *Service) sniffTimeout() time.Duration {
+	if s.SniffTimeout <= 0 {
+		return client.DefaultSniffTimeout * time.Millisecond
+	}
+	return s.SniffTimeout
+}
+
+// Write the response for an external health checker, and close the
+// connection.
+func (s *Service) answerHealthCheck(conn net.Conn, response string) {
+	atomic.AddInt64(&s.HealthChecks, 1)
+	log.Debugf("Health check from %s for %s", conn.RemoteAddr(), s.Name)
+
+	if response != "" {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		io.WriteString(conn, response)
+	}
+	conn.Close()
+}
+
+// Parse a list of CIDRs, which have already been validated.
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+// Return true if the connection's remote address is in one of the networks.
+func fromNets(conn net.Conn, nets []*net.IPNet) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return inNets(addr.IP, nets)
+}
+
+// Return true if ip is in one of the networks.
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the IP of a TCP client. A connection from a trusted proxy is checked
+// for a PROXY protocol header, which is left in place for the backend. The
+// returned connection replays anything read while checking.
+func tcpClientIP(conn net.Conn, trusted []*net.IPNet, timeout time.Duration) (net.Conn, string) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if len(trusted) == 0 || !fromNets(conn, trusted) {
+		return conn, ip
+	}
+
+	conn, proxied := peekProxyHeader(conn, timeout)
+	if proxied != "" {
+		ip = proxied
+	}
+	return conn, ip
+}
+
+// Return the IP of an HTTP client. For a request from a trusted proxy, this
+// is the last address the proxy added to X-Forwarded-For.
+func requestClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := remoteIP(r)
+	if !fromTrustedProxy(r, trusted) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	if last := strings.TrimSpace(forwarded[len(forwarded)-1]); net.ParseIP(last) != nil {
+		return last
+	}
+	return ip
+}
+
+// The IP the request was received from.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// Report whether the request was received from a trusted proxy, whose
+// forwarding headers can be believed.
+func fromTrustedProxy(r *http.Request, trusted []*net.IPNet) bool {
+	return len(trusted) > 0 && inNets(net.ParseIP(remoteIP(r)), trusted)
+}
+
+// Count a connection from the client IP, returning false if the client
+// already has limit connections.
+func (s *Service) acquireClient(ip string, limit int) bool {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	if s.clientConns[ip] >= limit {
+		return false
+	}
+	if s.clientConns == nil {
+		s.clientConns = make(map[string]int)
+	}
+	s.clientConns[ip]++
+	return true
+}
+
+// Release a connection counted by acquireClient. Clients are removed once
+// they have no connections, so the map only holds those connected.
+func (s *Service) releaseClient(ip string) {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	if s.clientConns[ip]--; s.clientConns[ip] <= 0 {
+		delete(s.clientConns, ip)
+	}
+}
+
+// The number of clients with connections counted against MaxConnsPerClient.
+func (s *Service) clientCount() int {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+	return len(s.clientConns)
+}
+
+// A client connection which counts the bytes transferred, for the ConnHooks.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+	err     error
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *countingConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *countingConn) tcpConn() *net.TCPConn {
+	return spliceConn(c.Conn)
+}
+
+func (c *countingConn) countRead(n int64) {
+	atomic.AddInt64(&c.read, n)
+	if s, ok := c.Conn.(splicer); ok {
+		s.countRead(n)
+	}
+}
+
+func (c *countingConn) countWritten(n int64) {
+	atomic.AddInt64(&c.written, n)
+	if s, ok := c.Conn.(splicer); ok {
+		s.countWritten(n)
+	}
+}
+
+// Dial the backends in balanced order, skipping any without a free
+// connection slot. Returns the connected backend, with a slot held, or nil if
+// none could be connected. full is true if any backend was skipped because
+// it was at MaxConns.
+func (s *Service) dialNext(hooks ConnHooks, info *ConnInfo) (b *Backend, srvConn net.Conn, full bool) {
+	for _, b := range s.nextBackends() {
+		if !b.acquireSlot() {
+			full = true
+			continue
+		}
+
+		info.Backend = b.Name
+		info.BackendAddr = b.Addr
+		hooks.BackendSelected(info)
+
+		start := time.Now()
+		srvConn, err := b.dial(s.dialer, b.Network)
+		info.DialDuration = time.Since(start)
+		info.Err = err
+		hooks.Dialed(info)
+
+		if err != nil {
+			s.releaseSlot(b)
+			log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
+			atomic.AddInt64(&b.Errors, 1)
+			continue
+		}
+		return b, srvConn, false
+	}
+	return nil, nil, full
+}
+
+// Release the backend's connection slot, and wake any queued connections.
+func (s *Service) releaseSlot(b *Backend) {
+	if !b.releaseSlot() {
+		return
+	}
+
+	s.Lock()
+	close(s.slotFreed)
+	s.slotFreed = make(chan struct{})
+	s.Unlock()
+}
+
+// Return a channel which is closed when the next connection slot is freed.
+func (s *Service) slotWait() chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+	return s.slotFreed
+}
+
+// Wait for a backend connection slot, up to QueueTimeout. Returns the client
+// connection, which replays any data sent while it was queued, and the
+// connected backend, or a nil backend if the connection was refused or the
+// client disconnected.
+func (s *Service) queueConn(cliConn net.Conn, hooks ConnHooks, info *ConnInfo) (net.Conn, *Backend, net.Conn) {
+	s.Lock()
+	size := int64(s.QueueSize)
+	timeout := s.QueueTimeout
+	s.Unlock()
+
+	if size <= 0 || timeout <= 0 {
+		atomic.AddInt64(&s.Refused, 1)
+		return cliConn, nil, nil
+	}
+
+	if atomic.AddInt64(&s.queued, 1) > size {
+		atomic.AddInt64(&s.queued, -1)
+		atomic.AddInt64(&s.Refused, 1)
+		log.Warnf("WARN: connection queue full for %s", s.Name)
+		return cliConn, nil, nil
+	}
+	defer atomic.AddInt64(&s.queued, -1)
+
+	w := watchConn(cliConn)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// get the channel before trying the backends, so we don't miss a
+		// slot freed in between.
+		wait := s.slotWait()
+		if b, srvConn, full := s.dialNext(hooks, info); b != nil || !full {
+			return w.stop(), b, srvConn
+		}
+
+		select {
+		case <-wait:
+		case <-w.gone:
+			log.Debugf("Client %s disconnected while queued for %s", cliConn.RemoteAddr(), s.Name)
+			return w.stop(), nil, nil
+		case <-timer.C:
+			atomic.AddInt64(&s.Refused, 1)
+			log.Warnf("WARN: connection queue timeout for %s", s.Name)
+			return w.stop(), nil, nil
+		}
+	}
+}
+
+// Maximum data buffered from a queued client
+const maxQueuedRead = 64 << 10
+
+// Read from a queued connection to detect when the client disconnects,
+// buffering anything the client sends in the meantime.
+type connWatcher struct {
+	conn     net.Conn
+	raw      net.Conn
+	buf      bytes.Buffer
+	stopping int32
+
+	// gone is closed if the client disconnects, data when the client first
+	// sends something, and done when the read loop exits.
+	gone chan struct{}
+	data chan struct{}
+	done chan struct{}
+}
+
+func watchConn(conn net.Conn) *connWatcher {
+	w := &connWatcher{
+		conn: conn,
+		raw:  conn,
+		gone: make(chan struct{}),
+		data: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	// read the underlying connection directly, so that the read timeout
+	// doesn't override the deadline used to stop the watcher.
+	if sc, ok := conn.(*shuttleConn); ok {
+		w.raw = sc.Conn
+	}
+
+	go w.readLoop()
+	return w
+}
+
+func (w *connWatcher) readLoop() {
+	defer close(w.done)
+
+	buff := make([]byte, 4096)
+	for w.buf.Len() < maxQueuedRead {
+		n, err := w.raw.Read(buff)
+		if n > 0 && w.buf.Len() == 0 {
+			close(w.data)
+		}
+		w.buf.Write(buff[:n])
+		if err != nil {
+			if atomic.LoadInt32(&w.stopping) == 0 {
+				close(w.gone)
+			}
+			return
+		}
+	}
+}
+
+// Stop watching the connection, and return a connection which first returns
+// any buffered data.
+func (w *connWatcher) stop() net.Conn {
+	atomic.StoreInt32(&w.stopping, 1)
+
+	// a wrapper with a read timeout may set its own deadline as the read
+	// starts, so keep expiring it until the read loop exits
+	for stopped := false; !stopped; {
+		w.raw.SetReadDeadline(time.Now())
+		select {
+		case <-w.done:
+			stopped = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	w.raw.SetReadDeadline(time.Time{})
+
+	if w.buf.Len() == 0 {
+		return w.conn
+	}
+	return &bufferedConn{
+		Conn: w.conn,
+		r:    bufio.NewReader(io.MultiReader(&w.buf, w.conn)),
+	}
+}
+
+// The result of a probe through a service.
+type ProbeResult struct {
+	Backend  string  `json:"backend,omitempty"`
+	Addr     string  `json:"address,omitempty"`
+	DialTime float64 `json:"dial_ms"`
+	RTT      float64 `json:"rtt_ms"`
+	Response string  `json:"response"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Probe connects to a backend chosen by the service's balancer, falling back
+// to the other backends like a client connection would. The payload, if any,
+// is sent, and the first response read within timeout is returned, along with
+// the backend used and the round-trip time.
+func (s *Service) Probe(payload []byte, timeout time.Duration) ProbeResult {
+	var res ProbeResult
+
+	if s.Network != "tcp" && s.Network != "tcp4" && s.Network != "tcp6" {
+		res.Error = fmt.Sprintf("can't probe %s service", s.Network)
+		return res
+	}
+
+	if timeout <= 0 {
+		timeout = client.DefaultTimeout * time.Millisecond
+	}
+
+	var conn net.Conn
+	for _, b := range s.nextBackends() {
+		start := time.Now()
+		c, err := b.dial(s.dialer, b.Network)
+		if err != nil {
+			log.Warnf("WARN: probing backend %s/%s: %s", s.Name, b.Name, err)
+			res.Error = err.Error()
+			continue
+		}
+
+		conn = c
+		res.Backend = b.Name
+		res.Addr = b.Addr
+		res.DialTime = msSince(start)
+		res.Error = ""
+		break
+	}
+
+	if conn == nil {
+		if res.Error == "" {
+			res.Error = fmt.Sprintf("no backend for %s", s.Name)
+		}
+		return res
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+	}
+
+	buff := make([]byte, 65536)
+	n, err := conn.Read(buff)
+	res.RTT = msSince(start)
+	res.Response = string(buff[:n])
+
+	if err != nil && err != io.EOF {
+		// a backend that doesn't respond to an empty probe is still connected
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() || len(payload) > 0 {
+			res.Error = err.Error()
+		}
+	}
+	return res
+}
+
+// The time since start in fractional milliseconds
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// Stop the Service's Accept loop by closing the Listener,
+// and stop all backends for this service.
+func (s *Service) stop() {
+	s.Stop(0)
+}
+
+// Stop the service, closing its listeners and stopping its backends. When
+// drain is set, the listeners are closed first and connections already
+// proxied are given up to drain to finish before the backends are stopped.
+// Connections still running after that are left open.
+func (s *Service) Stop(drain time.Duration) {
+	if drain > 0 {
+		s.Lock()
+		log.Printf("Draining Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
+		s.closeListeners()
+		s.closeTLSListener()
+		s.Unlock()
+
+		s.drain(drain)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	log.Printf("Stopping Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
+	for _, backend := range s.Backends {
+		backend.Stop()
+	}
+
+	s.closeListeners()
+	s.closeTLSListener()
+
+	if s.mirrorTransport != nil {
+		s.mirrorTransport.CloseIdleConnections()
+	}
+}
+
+// Close and re-bind the service's listeners on the same addresses, keeping its
+// config and backends. Where SO_REUSEPORT is supported, the new listeners are
+// bound alongside the old ones before those are closed, so if a bind fails the
+// error is returned and the old listeners are left in place. Otherwise the old
+// listeners have to be closed first, and a failed bind leaves the service
+// without them, allowing the restart to be retried. Either way, connections
+// already proxied are given up to drain to finish, and are left running after
+// that.
+func (s *Service) Restart(drain time.Duration) error {
+	if !reusePortSupported {
+		return s.restartClosed(drain)
+	}
+
+	s.Lock()
+	log.Printf("Restarting Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
+	if err := s.rebind(); err != nil {
+		s.Unlock()
+		log.Errorf("ERROR: restarting %s: %s", s.Name, err)
+		return err
+	}
+	s.Unlock()
+
+	s.drain(drain)
+	return nil
+}
+
+// Bind new listeners on the service's addresses while the old ones are still
+// open, then close the old ones. If any bind fails, the new listeners are
+// closed and the old ones restored. The service must be locked.
+func (s *Service) rebind() error {
+	network, addr := s.Network, s.Addr
+	tlsAddr, tlsCert, tlsKey := s.TLSAddr, s.TLSCert, s.TLSKey
+
+	for _, l := range s.tcpListeners {
+		if err := setReusePort(l.(*timeoutListener).TCPListener); err != nil {
+			return err
+		}
+	}
+	for _, conn := range s.udpListeners {
+		if err := setReusePort(conn); err != nil {
+			return err
+		}
+	}
+	if s.tlsBase != nil {
+		if err := setReusePort(s.tlsBase.TCPListener); err != nil {
+			return err
+		}
+	}
+
+	// set the old listeners aside, so they aren't kept or closed by listen
+	tcpListeners, udpListeners, udpSessions := s.tcpListeners, s.udpListeners, s.udpSessions
+	tlsListener, tlsBase, tlsCertificate := s.tlsListener, s.tlsBase, s.tlsCertificate
+	s.tcpListeners, s.udpListeners, s.udpSessions = nil, nil, nil
+	s.tlsListener, s.tlsBase = nil, nil
+
+	s.reusePort = true
+	err := s.listen(network, addr)
+	if err == nil && tlsAddr != "" {
+		err = s.listenTLS(tlsAddr, tlsCert, tlsKey)
+	}
+	s.reusePort = false
+
+	if err != nil {
+		s.closeListeners()
+		s.closeTLSListener()
+		s.tcpListeners, s.udpListeners, s.udpSessions = tcpListeners, udpListeners, udpSessions
+		s.tlsListener, s.tlsBase, s.tlsCertificate = tlsListener, tlsBase, tlsCertificate
+		s.Network, s.Addr = network, addr
+		s.TLSAddr, s.TLSCert, s.TLSKey = tlsAddr, tlsCert, tlsKey
+		return err
+	}
+
+	for _, l := range tcpListeners {
+		if err := l.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	for i, conn := range udpListeners {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+		udpSessions[i].Close()
+	}
+	if tlsListener != nil {
+		if err := tlsListener.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// Restart without SO_REUSEPORT, by closing the listeners, waiting for up to
+// drain for active connections, and binding the addresses again.
+func (s *Service) restartClosed(drain time.Duration) error {
+	s.Lock()
+	network, addr := s.Network, s.Addr
+	tlsAddr, tlsCert, tlsKey := s.TLSAddr, s.TLSCert, s.TLSKey
+
+	log.Printf("Restarting Listener for %s on %s:%s", s.Name, network, addr)
+	s.closeListeners()
+	s.closeTLSListener()
+	s.Unlock()
+
+	s.drain(drain)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.listen(network, addr); err != nil {
+		log.Errorf("ERROR: restarting %s: %s", s.Name, err)
+		return err
+	}
+
+	if tlsAddr != "" {
+		if err := s.listenTLS(tlsAddr, tlsCert, tlsKey); err != nil {
+			log.Errorf("ERROR: restarting %s: %s", s.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait up to timeout for the active connections to all backends to finish.
+func (s *Service) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		active := int64(0)
+		s.Lock()
+		for _, b := range s.Backends {
+			active += atomic.LoadInt64(&b.Active)
+		}
+		s.Unlock()
+
+		if active == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Provide a ServeHTTP method for out ReverseProxy
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.HTTPConns, 1)
+	atomic.AddInt64(&s.HTTPActive, 1)
+	defer atomic.AddInt64(&s.HTTPActive, -1)
+
+	s.Lock()
+	redirect, redirectCode := s.HTTPSRedirect, s.HTTPSRedirectCode
+	reject := s.RejectHTTP
+	s.Unlock()
+
+	// X-Real-IP is always replaced, so a client can't set its own
+	trusted := Registry.TrustedNets(s)
+	ip := requestClientIP(r, trusted)
+	r.Header.Set("X-Real-IP", ip)
+
+	forwardedHTTPS := r.Header.Get("X-Forwarded-Proto") == "https"
+	plaintext := r.TLS == nil && !forwardedHTTPS
+
+	// only a trusted proxy can get past reject_http by reporting TLS
+	if reject && r.TLS == nil && !(forwardedHTTPS && fromTrustedProxy(r, trusted)) {
+		atomic.AddInt64(&s.HTTPErrors, 1)
+		logRequest(r, http.StatusForbidden, "", nil, 0)
+		http.Error(w, "HTTPS required", http.StatusForbidden)
+		return
+	}
+
+	if redirect && plaintext {
+		if redirectCode == 0 {
+			redirectCode = http.StatusMovedPermanently
+		}
+
+		// keep the original host, path and query
+		redirLoc := "https://" + r.Host + r.URL.RequestURI()
+		http.Redirect(w, r, redirLoc, redirectCode)
+		return
+	}
+
+	if s.MaintenanceMode || Registry.Maintenance().Enabled {
+		// TODO: Should we increment HTTPErrors here as well?
+		logRequest(r, http.StatusServiceUnavailable, "", nil, 0)
+		s.serveMaintenance(w, r)
+		return
+	}
+
+	s.Lock()
+	maxPerClient := s.MaxConnsPerClient
+	maxBody := s.MaxRequestBodyBytes
+	s.Unlock()
+
+	if maxBody > 0 {
+		if r.ContentLength > maxBody {
+			atomic.AddInt64(&s.HTTPErrors, 1)
+			logRequest(r, http.StatusRequestEntityTooLarge, "", nil, 0)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = newLimitedBody(w, r.Body, maxBody)
+	}
+
+	if maxPerClient > 0 {
+		if !s.acquireClient(ip, maxPerClient) {
+			atomic.AddInt64(&s.PerClientRefused, 1)
+			logRequest(r, http.StatusTooManyRequests, "", nil, 0)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		defer s.releaseClient(ip)
+	}
+
+	s.mirrorRequest(r)
+
+	addrs := s.NextAddrs()
+	if b := s.stickyBackend(r); b != nil {
+		addrs = pinAddr(addrs, b.Addr)
+	}
+
+	s.httpProxy.ServeHTTP(w, r, addrs)
+}
+
+// The name of the service's sticky cookie. The service must be locked.
+func (s *Service) stickyCookieName() string {
+	if s.StickyCookieName == "" {
+		return client.DefaultStickyCookieName
+	}
+	return s.StickyCookieName
+}
+
+// The value of the sticky cookie for a backend. This is a hash of the
+// backend's name, so it doesn't expose the name, and stays the same across
+// restarts and between shuttle instances.
+func stickyID(backend string) string {
+	h := fnv.New64a()
+	io.WriteString(h, backend)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Return the backend the request's sticky cookie pins it to, or nil if the
+// service doesn't use sticky cookies, or the backend is down or was removed.
+func (s *Service) stickyBackend(r *http.Request) *Backend {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.StickyCookie {
+		return nil
+	}
+
+	cookie, err := r.Cookie(s.stickyCookieName())
+	if err != nil {
+		return nil
+	}
+
+	for _, b := range s.Backends {
+		if stickyID(b.Name) == cookie.Value {
+			if !b.Up() {
+				return nil
+			}
+			return b
+		}
+	}
+	return nil
+}
+
+// Move addr to the front of the balanced addrs, adding it if it's missing.
+func pinAddr(addrs []string, addr string) []string {
+	pinned := []string{addr}
+	for _, a := range addrs {
+		if a != addr {
+			pinned = append(pinned, a)
+		}
+	}
+	return pinned
+}
+
+// Set the sticky cookie when a response came from a backend other than the
+// one the request was pinned to, so later requests go to the same backend.
+func (s *Service) setStickyCookie(pr *ProxyRequest) bool {
+	if pr.ProxyError != nil {
+		return true
+	}
+
+	addr := pr.ResponseWriter.Header().Get("X-Backend")
+
+	s.Lock()
+	if !s.StickyCookie {
+		s.Unlock()
+		return true
+	}
+	name, ttl := s.stickyCookieName(), s.StickyCookieTTL
+	id := ""
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			id = stickyID(b.Name)
+			break
+		}
+	}
+	s.Unlock()
+
+	if id == "" {
+		return true
+	}
+	if cookie, err := pr.Request.Cookie(name); err == nil && cookie.Value == id {
+		return true
+	}
+
+	http.SetCookie(pr.ResponseWriter, &http.Cookie{
+		Name:     name,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+	})
+	return true
+}
+
+// Write the maintenance response. An error page for 503 takes precedence over
+// the inline MaintenanceBody.
+func (s *Service) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	headers := w.Header()
+
+	errPage := s.errorPages.Get(http.StatusServiceUnavailable, r)
+	if errPage != nil && errPage.Body() != nil {
+		for key, val := range errPage.Header() {
+			headers[key] = val
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(errPage.Body())
+		return
+	}
+
+	s.Lock()
+	body := []byte(s.MaintenanceBody)
+	contentType := s.MaintenanceContentType
+	if s.maintenanceFileBody != nil {
+		body = s.maintenanceFileBody
+		contentType = s.maintenanceFileType
+	}
+	s.Unlock()
+
+	// fall back to the global maintenance response
+	if len(body) == 0 {
+		globalBody, globalType := Registry.maintenancePage()
+		body, contentType = []byte(globalBody), globalType
+	}
+
+	if len(body) > 0 && contentType != "" {
+		headers.Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(body)
+}
+
+// Read and cache the maintenance file. The Content-Type is taken from the file
+// extension, or detected from the content if the extension is unknown. The
+// cached content is only replaced if the file is read successfully.
+// Service must be locked.
+func (s *Service) loadMaintenanceFile(path string) error {
+	if path == "" {
+		s.MaintenanceFile = ""
+		s.maintenanceFileBody = nil
+		s.maintenanceFileType = ""
+		return nil
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read maintenance_file: %s", err)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+
+	s.MaintenanceFile = path
+	s.maintenanceFileBody = body
+	s.maintenanceFileType = contentType
+	return nil
+}
+
+// Check that the maintenance file can be read, so that a config naming one
+// that can't is rejected before any of it is applied.
+func checkMaintenanceFile(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if _, err := ioutil.ReadFile(path); err != nil {
+		return fmt.Errorf("cannot read maintenance_file: %s", err)
+	}
+	return nil
+}
+
+func (s *Service) errStats(pr *ProxyRequest) bool {
+	if pr.ProxyError != nil {
+		atomic.AddInt64(&s.HTTPErrors, 1)
+	}
+	return true
+}
+
+// The number of responses a backend must have in the EjectWindow before it
+// can be ejected, so a single error isn't a 100% error rate.
+const ejectMinResponses = 10
+
+// Count a proxied HTTP response towards its backend's error rate, and eject
+// the backend when the rate of 5xx responses reaches EjectErrorRate, unless
+// it's the last backend up.
+func (s *Service) countResponse(pr *ProxyRequest) bool {
+	if pr.ProxyError != nil || pr.Response == nil {
+		return true
+	}
+
+	addr := pr.ResponseWriter.Header().Get("X-Backend")
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.EjectErrorRate <= 0 {
+		return true
+	}
+
+	var backend *Backend
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			backend = b
+			break
+		}
+	}
+	if backend == nil {
+		return true
+	}
+
+	window := s.EjectWindow
+	if window <= 0 {
+		window = client.DefaultEjectWindow * time.Millisecond
+	}
+
+	failed := pr.Response.StatusCode >= 500
+	rate, responses, eject := backend.responseRate.Add(time.Now(), window, failed, s.EjectErrorRate, ejectMinResponses)
+	if !eject {
+		return true
+	}
+
+	up := 0
+	for _, b := range s.Backends {
+		if b != backend && b.Up() {
+			up++
+		}
+	}
+	if up == 0 {
+		// try again on the next response, once another backend may be up
+		log.Warnf("WARN: not ejecting %s/%s with %.0f%% errors, no other backend is up", s.Name, backend.Name, rate*100)
+		backend.responseRate.Rearm()
+		return true
+	}
+
+	ejectTime := s.EjectTime
+	if ejectTime <= 0 {
+		ejectTime = client.DefaultEjectTime * time.Millisecond
+	}
+	log.Warnf("WARN: ejecting %s/%s for %s, %.0f%% of %d responses were errors", s.Name, backend.Name, ejectTime, rate*100, responses)
+	backend.eject(ejectTime)
+	return true
+}
+
+// Call bind, retrying with an exponential backoff up to bindRetries times.
+// This helps when an address is temporarily in use during a restart.
+func bindRetry(bind func() error) error {
+	backoff := 250 * time.Millisecond
+	err := bind()
+	for i := 0; err != nil && i < bindRetries; i++ {
+		log.Warnf("WARN: %s, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 4*time.Second {
+			backoff *= 2
+		}
+		err = bind()
+	}
+	return err
+}
+
+// A net.Listener that provides a read/write timeout
+type timeoutListener struct {
+	*net.TCPListener
+
+	// accessed atomically, so the timeout can be changed while running
+	rwTimeout int64
+
+	// these aren't reported yet, but our new counting connections need to
+	// update something
+	read    int64
+	written int64
+}
+
+func newTimeoutListener(netw, addr string, timeout time.Duration, reusePort bool) (net.Listener, error) {
+	lAddr, err := net.ResolveTCPAddr(netw, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var l *net.TCPListener
+	if reusePort {
+		lc := net.ListenConfig{Control: reusePortControl}
+		var ln net.Listener
+		ln, err = lc.Listen(context.Background(), netw, lAddr.String())
+		if ln != nil {
+			l = ln.(*net.TCPListener)
+		}
+	} else {
+		l, err = net.ListenTCP(netw, lAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tl := &timeoutListener{
+		TCPListener: l,
+		rwTimeout:   int64(timeout),
+	}
+	return tl, nil
+}
+
+// Listen on a UDP address, setting SO_REUSEPORT when reusePort is set.
+func listenUDP(network string, laddr *net.UDPAddr, reusePort bool) (*net.UDPConn, error) {
+	if !reusePort {
+		return net.ListenUDP(network, laddr)
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Set the read/write timeout for newly accepted connections.
+func (l *timeoutListener) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&l.rwTimeout, int64(timeout))
 }
 
 func (l *timeoutListener) Accept() (net.Conn, error) {
@@ -652,8 +2975,8 @@ func (l *timeoutListener) Accept() (net.Conn, error) {
 	conn.SetKeepAlivePeriod(3 * time.Minute)
 
 	sc := &shuttleConn{
-		TCPConn:   conn,
-		rwTimeout: l.rwTimeout,
+		Conn:      conn,
+		rwTimeout: time.Duration(atomic.LoadInt64(&l.rwTimeout)),
 		read:      &l.read,
 		written:   &l.written,
 	}
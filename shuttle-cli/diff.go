@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	shuttle "github.com/litl/shuttle/client"
+)
+
+// Exit statuses for diff, following diff(1).
+const (
+	diffSame    = 0
+	diffChanged = 1
+	diffTrouble = 2
+)
+
+// Compare a local config file to the running config, and print the
+// differences. Exit with a status of 0 if there are no differences, 1 if
+// there are, and 2 if there was an error.
+func diff(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: shuttle-cli diff file")
+		os.Exit(diffTrouble)
+	}
+
+	changes, err := diffFile(args[0], client.GetConfig)
+	if err != nil {
+		log.Print(err)
+	}
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	os.Exit(diffStatus(changes, err))
+}
+
+// Return the diff(1) style exit status for the result of a diff.
+func diffStatus(changes []string, err error) int {
+	switch {
+	case err != nil:
+		return diffTrouble
+	case len(changes) > 0:
+		return diffChanged
+	default:
+		return diffSame
+	}
+}
+
+// Load the config file at path, and return the changes needed to get to it
+// from the config returned by getRunning.
+func diffFile(path string, getRunning func() (*shuttle.Config, error)) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := shuttle.Config{}
+	if err := json.Unmarshal(data, &desired); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	if err := desired.Migrate(); err != nil {
+		return nil, fmt.Errorf("error in %s: %s", path, err)
+	}
+
+	running, err := getRunning()
+	if err != nil {
+		return nil, err
+	}
+
+	// secrets are redacted in the running config, so they can't be compared,
+	// and shouldn't be printed
+	return diffConfig(desired.Redact(), *running), nil
+}
+
+// Return the changes needed to get from the running config to the desired
+// config. Lines start with "+" for additions, "-" for removals, and "~" for
+// changed fields.
+func diffConfig(desired, running shuttle.Config) []string {
+	changes := []string{}
+
+	globals, runningGlobals := desired, running
+	globals.Services, runningGlobals.Services = nil, nil
+	for _, field := range diffFields(globals, runningGlobals) {
+		changes = append(changes, fmt.Sprintf("~ config: %s", field))
+	}
+
+	runningSvcs := make(map[string]shuttle.ServiceConfig)
+	for _, svc := range running.Services {
+		runningSvcs[svc.Name] = svc
+	}
+
+	desiredSvcs := make(map[string]bool)
+	for _, svc := range desired.Services {
+		desiredSvcs[svc.Name] = true
+
+		current, ok := runningSvcs[svc.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ service %s", svc.Name))
+			continue
+		}
+
+		if svc.DeepEqual(current) {
+			continue
+		}
+		changes = append(changes, diffService(svc, current)...)
+	}
+
+	for _, svc := range running.Services {
+		if !desiredSvcs[svc.Name] {
+			changes = append(changes, fmt.Sprintf("- service %s", svc.Name))
+		}
+	}
+
+	return changes
+}
+
+// Return the changes to a service and its backends.
+func diffService(desired, running shuttle.ServiceConfig) []string {
+	changes := []string{}
+
+	// backends with port ranges are running as a backend for each port
+	if backends, err := shuttle.ExpandBackends(desired.Backends); err == nil {
+		desired.Backends = backends
+	}
+
+	if !desired.Equal(running) {
+		a, b := desired.SetDefaults(), running.SetDefaults()
+		a.Backends, b.Backends = nil, nil
+		sort.Strings(a.VirtualHosts)
+		sort.Strings(b.VirtualHosts)
+
+		for _, field := range diffFields(a, b) {
+			changes = append(changes, fmt.Sprintf("~ service %s: %s", desired.Name, field))
+		}
+	}
+
+	runningBackends := make(map[string]shuttle.BackendConfig)
+	for _, b := range running.Backends {
+		runningBackends[b.Name] = b
+	}
+
+	desiredBackends := make(map[string]bool)
+	for _, b := range desired.Backends {
+		desiredBackends[b.Name] = true
+
+		current, ok := runningBackends[b.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ backend %s/%s", desired.Name, b.Name))
+			continue
+		}
+
+		if b.Equal(current) {
+			continue
+		}
+
+		for _, field := range diffFields(b.SetDefaults(), current.SetDefaults()) {
+			changes = append(changes, fmt.Sprintf("~ backend %s/%s: %s", desired.Name, b.Name, field))
+		}
+	}
+
+	for _, b := range running.Backends {
+		if !desiredBackends[b.Name] {
+			changes = append(changes, fmt.Sprintf("- backend %s/%s", desired.Name, b.Name))
+		}
+	}
+
+	return changes
+}
+
+// Compare each field of two structs of the same type, returning the changed
+// fields by their json name as "name running -> desired".
+func diffFields(desired, running interface{}) []string {
+	a := reflect.ValueOf(desired)
+	b := reflect.ValueOf(running)
+
+	fields := []string{}
+	for i := 0; i < a.NumField(); i++ {
+		av, bv := a.Field(i).Interface(), b.Field(i).Interface()
+		if reflect.DeepEqual(av, bv) {
+			continue
+		}
+
+		name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = a.Type().Field(i).Name
+		}
+
+		fields = append(fields, fmt.Sprintf("%s %s -> %s", name, fieldString(bv), fieldString(av)))
+	}
+	return fields
+}
+
+// Format a field value as json, for an unambiguous representation of strings
+// and empty values.
+func fieldString(v interface{}) string {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(js)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	shuttle "github.com/litl/shuttle/client"
+)
+
+func TestDiffStatus(t *testing.T) {
+	running := shuttle.Config{
+		Version: shuttle.ConfigVersion,
+		Services: []shuttle.ServiceConfig{
+			{
+				Name: "web",
+				Addr: "127.0.0.1:9000",
+				Backends: []shuttle.BackendConfig{
+					{Name: "web-1", Addr: "127.0.0.1:9001"},
+				},
+			},
+		},
+	}
+
+	withAuth := running
+	withAuth.Services = []shuttle.ServiceConfig{running.Services[0]}
+	withAuth.Services[0].Backends = []shuttle.BackendConfig{
+		{Name: "web-1", Addr: "127.0.0.1:9001", ConnectProxy: "127.0.0.1:3128", ConnectProxyAuth: "Basic c2VjcmV0"},
+	}
+
+	changed := running
+	changed.Services = []shuttle.ServiceConfig{running.Services[0]}
+	changed.Services[0].Backends = append(changed.Services[0].Backends,
+		shuttle.BackendConfig{Name: "web-2", Addr: "127.0.0.1:9002"})
+
+	dir, err := ioutil.TempDir("", "shuttle-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	marshal := func(cfg shuttle.Config) []byte {
+		js, err := json.Marshal(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return js
+	}
+
+	getRunning := func() (*shuttle.Config, error) {
+		cfg := running
+		return &cfg, nil
+	}
+
+	// the admin API returns secrets redacted
+	getRedacted := func() (*shuttle.Config, error) {
+		cfg := withAuth.Redact()
+		return &cfg, nil
+	}
+
+	getError := func() (*shuttle.Config, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		getRunning func() (*shuttle.Config, error)
+		changes    int
+		status     int
+	}{
+		{"same", writeConfig("same.json", marshal(running)), getRunning, 0, diffSame},
+		{"changed", writeConfig("changed.json", marshal(changed)), getRunning, 1, diffChanged},
+		{"proxy auth", writeConfig("auth.json", marshal(withAuth)), getRedacted, 0, diffSame},
+		{"missing file", filepath.Join(dir, "missing.json"), getRunning, 0, diffTrouble},
+		{"bad json", writeConfig("bad.json", []byte("{")), getRunning, 0, diffTrouble},
+		{"bad version", writeConfig("version.json", []byte(`{"version": 1000}`)), getRunning, 0, diffTrouble},
+		{"shuttle error", writeConfig("error.json", marshal(running)), getError, 0, diffTrouble},
+	}
+
+	for _, test := range tests {
+		changes, err := diffFile(test.path, test.getRunning)
+		if len(changes) != test.changes {
+			t.Errorf("%s: expected %d changes, got %q", test.name, test.changes, changes)
+		}
+
+		if status := diffStatus(changes, err); status != test.status {
+			t.Errorf("%s: expected status %d, got %d (%v)", test.name, test.status, status, err)
+		}
+	}
+}
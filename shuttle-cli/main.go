@@ -27,10 +27,12 @@ var (
 	serviceCfg = &shuttle.ServiceConfig{}
 	serviceFS  = flag.NewFlagSet("service", flag.ExitOnError)
 	vhosts     = stringSlice{}
+	groupOrder = stringSlice{}
 	errorPages = stringSlice{}
 
-	backendCfg = &shuttle.BackendConfig{}
-	backendFS  = flag.NewFlagSet("backend", flag.ExitOnError)
+	backendCfg  = &shuttle.BackendConfig{}
+	backendFS   = flag.NewFlagSet("backend", flag.ExitOnError)
+	backendTags = stringSlice{}
 )
 
 func init() {
@@ -42,6 +44,9 @@ func init() {
 	configFS.IntVar(&cfg.ServerTimeout, "server-timeout", 0, "innactivity timeout for server connections")
 	configFS.IntVar(&cfg.DialTimeout, "dial-timeout", 0, "timeout for dialing new connections connections")
 	configFS.BoolVar(&cfg.HTTPSRedirect, "https-redirect", false, "rediect all http requests to https")
+	configFS.IntVar(&cfg.MaxURILength, "max-uri-length", 0, "maximum length of http request URIs")
+	configFS.IntVar(&cfg.SendBufferBytes, "send-buffer-bytes", 0, "socket send buffer size for services which don't set one")
+	configFS.IntVar(&cfg.RecvBufferBytes, "recv-buffer-bytes", 0, "socket receive buffer size for services which don't set one")
 
 	serviceFS.StringVar(&serviceCfg.Addr, "address", "", "service listening address")
 	serviceFS.StringVar(&serviceCfg.Network, "network", "", "service network type")
@@ -53,18 +58,67 @@ func init() {
 	serviceFS.IntVar(&serviceCfg.ServerTimeout, "server-timeout", 0, "innactivity timeout for server connections")
 	serviceFS.IntVar(&serviceCfg.DialTimeout, "dial-timeout", 0, "timeout for dialing new connections connections")
 	serviceFS.BoolVar(&serviceCfg.HTTPSRedirect, "https-redirect", false, "rediect all http requests to https")
+	serviceFS.BoolVar(&serviceCfg.RejectHTTP, "reject-http", false, "respond to all http requests with a 403, requiring https")
+	serviceFS.IntVar(&serviceCfg.MaxURILength, "max-uri-length", 0, "maximum length of http request URIs")
+	serviceFS.BoolVar(&serviceCfg.StickyCookie, "sticky-cookie", false, "pin http clients to a backend with a cookie")
+	serviceFS.StringVar(&serviceCfg.StickyCookieName, "sticky-cookie-name", "", "name of the sticky cookie, SHUTTLEID by default")
+	serviceFS.IntVar(&serviceCfg.StickyCookieTTL, "sticky-cookie-ttl", 0, "lifetime of the sticky cookie in seconds, 0 for a session cookie")
+	serviceFS.StringVar(&serviceCfg.MirrorAddr, "mirror-address", "", "http backend to copy a sample of requests to")
+	serviceFS.Float64Var(&serviceCfg.MirrorSample, "mirror-sample", 0, "fraction of http requests to copy to the mirror, from 0 to 1")
+	serviceFS.IntVar(&serviceCfg.SendBufferBytes, "send-buffer-bytes", 0, "socket send buffer size for tcp client and backend connections")
+	serviceFS.IntVar(&serviceCfg.RecvBufferBytes, "recv-buffer-bytes", 0, "socket receive buffer size for tcp client and backend connections")
+	serviceFS.IntVar(&serviceCfg.FlushInterval, "flush-interval", 0, "interval between http response flushes in milliseconds, -1 to flush every write")
+	serviceFS.Float64Var(&serviceCfg.ConnLogSample, "conn-log-sample", 0, "fraction of tcp connections to log, from 0 to 1")
+	serviceFS.IntVar(&serviceCfg.StatsInterval, "stats-interval", 0, "interval between sending stats to statsd in milliseconds")
+	serviceFS.BoolVar(&serviceCfg.SniffHTTP, "sniff-http", false, "route tcp connections which start with an http request by virtual host")
+	serviceFS.IntVar(&serviceCfg.CheckFast, "check-fast", 0, "health check time in milliseconds below which a backend's weight isn't scaled down")
+	serviceFS.IntVar(&serviceCfg.CheckSlow, "check-slow", 0, "health check time in milliseconds at which a backend gets the lowest weight")
+	serviceFS.IntVar(&serviceCfg.HandshakeTimeout, "handshake-timeout", 0, "time for a tcp client to send its first data in milliseconds")
+	serviceFS.BoolVar(&serviceCfg.RebalanceConns, "rebalance-conns", false, "close connections older than max-conn-age on busy backends, with LC balancing")
+	serviceFS.IntVar(&serviceCfg.MaxConnAge, "max-conn-age", 0, "age in milliseconds after which a connection can be rebalanced")
+	serviceFS.IntVar(&serviceCfg.MaxConnsPerClient, "max-conns-per-client", 0, "max concurrent connections from a single client ip")
+	serviceFS.BoolVar(&serviceCfg.RetryEmpty, "retry-empty", false, "retry the next backend when one closes a tcp connection without sending data")
+	serviceFS.BoolVar(&serviceCfg.RetryReset, "retry-reset", false, "retry the next backend when one resets an http request without a body")
+	serviceFS.BoolVar(&serviceCfg.LogBalance, "log-balance", false, "log every backend selection and the reason for it")
+	serviceFS.BoolVar(&serviceCfg.RemoveWhenEmpty, "remove-when-empty", false, "remove the service when its last backend is removed")
+	serviceFS.BoolVar(&serviceCfg.AllowHalfOpen, "allow-half-open", false, "keep tcp connections open in one direction after a half-close")
+	serviceFS.IntVar(&serviceCfg.AcceptRateAlert, "accept-rate-alert", 0, "warn when more tcp connections per second are accepted")
+	serviceFS.IntVar(&serviceCfg.AcceptRateWindow, "accept-rate-window", 0, "window in milliseconds for measuring the accept rate")
+	serviceFS.Float64Var(&serviceCfg.DialFailureAlert, "dial-failure-alert", 0, "warn when this fraction of dials to a backend fail, from 0 to 1")
+	serviceFS.Float64Var(&serviceCfg.EjectErrorRate, "eject-error-rate", 0, "eject a backend when this fraction of its http responses are errors, from 0 to 1")
+	serviceFS.IntVar(&serviceCfg.EjectWindow, "eject-window", 0, "window in milliseconds for measuring a backend's http error rate")
+	serviceFS.IntVar(&serviceCfg.EjectTime, "eject-time", 0, "time in milliseconds a backend is ejected for")
+	serviceFS.IntVar(&serviceCfg.DialFailureWindow, "dial-failure-window", 0, "window in milliseconds for measuring the dial failure rate")
 	serviceFS.Var(&vhosts, "vhost", "virtual host name. may be set multiple times")
+	serviceFS.Var(&groupOrder, "group-order", "backend group in failover order. may be set multiple times")
 	serviceFS.Var(&errorPages, "error-page", "location for http error code formatted as 'http://example.com/|500,503'. may be set multiple times")
 
 	backendFS.StringVar(&backendCfg.Addr, "address", "", "service listening address")
 	backendFS.StringVar(&backendCfg.Network, "network", "", "backend network type")
+	backendFS.StringVar(&backendCfg.DialNetwork, "dial-network", "", "address family to dial the backend with, {tcp|tcp4|tcp6}")
 	backendFS.StringVar(&backendCfg.CheckAddr, "check-address", "", "health check address")
+	backendFS.StringVar(&backendCfg.CheckSend, "check-send", "", "data to send in a health check")
+	backendFS.StringVar(&backendCfg.CheckExpect, "check-expect", "", "required substring in the health check response")
 	backendFS.IntVar(&backendCfg.Weight, "weight", 0, "balance weight")
+	backendFS.IntVar(&backendCfg.ResolveInterval, "resolve-interval", 0, "interval between backend hostname lookups in milliseconds")
+	backendFS.IntVar(&backendCfg.CheckDelay, "check-delay", 0, "time in milliseconds to ignore failed checks after the backend is added")
+	backendFS.IntVar(&backendCfg.DSCP, "dscp", 0, "DSCP value to mark backend connections")
+	backendFS.IntVar(&backendCfg.MaxDials, "max-dials", 0, "max concurrent connection attempts to the backend")
+	backendFS.IntVar(&backendCfg.MaxConnsServed, "max-conns-served", 0, "recycle the backend after this many connections")
+	backendFS.StringVar(&backendCfg.ConnectProxy, "connect-proxy", "", "HTTP CONNECT proxy address for the backend")
+	backendFS.StringVar(&backendCfg.ConnectProxyAuth, "connect-proxy-auth", "", "Proxy-Authorization header for the CONNECT proxy")
+	backendFS.IntVar(&backendCfg.RecycleCooldown, "recycle-cooldown", 0, "time in milliseconds a recycled backend receives no connections")
+	backendFS.BoolVar(&backendCfg.TLS, "tls", false, "connect to the backend with TLS")
+	backendFS.StringVar(&backendCfg.TLSServerName, "tls-server-name", "", "server name to verify the backend's TLS certificate")
+	backendFS.BoolVar(&backendCfg.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "don't verify the backend's TLS certificate")
+	backendFS.BoolVar(&backendCfg.Drain, "drain", false, "add the backend drained, without new connections")
+	backendFS.StringVar(&backendCfg.Group, "group", "", "backend group, balanced separately for failover")
+	backendFS.Var(&backendTags, "tag", "backend tag, like 'az=us-east-1a'. may be set multiple times")
 }
 
 func usage() {
 	flag.PrintDefaults()
-	fmt.Println(`shuttle-cli {config|update|remove} [options]
+	fmt.Println(`shuttle-cli {config|update|remove|diff} [options]
 
 config [options]
          set or print global config
@@ -94,6 +148,13 @@ remove: remove services or backends
         remove service
         remove service/backend`)
 
+	fmt.Println(`
+diff file
+         compare a config file to the running config, and print the
+         differences. Exits with a status of 0 if there are no differences,
+         1 if there are differences, and 2 if there was an error.
+example: $ shuttle-cli diff config.json`)
+
 	os.Exit(1)
 }
 
@@ -102,6 +163,7 @@ func main() {
 	log.SetFlags(0)
 
 	flag.StringVar(&shuttleAddr, "addr", "127.0.0.1:9090", "shuttle admin address")
+	retries := flag.Int("retries", 0, "number of times to retry idempotent requests after a server error")
 	flag.Usage = usage
 
 	flag.Parse()
@@ -111,7 +173,7 @@ func main() {
 
 	}
 
-	client = shuttle.NewClient(shuttleAddr)
+	client = shuttle.NewClientWithOptions(shuttleAddr, shuttle.ClientOptions{Retries: *retries})
 
 	switch flag.Args()[0] {
 	case "version":
@@ -123,6 +185,8 @@ func main() {
 		update(flag.Args()[1:])
 	case "remove":
 		remove(flag.Args()[1:])
+	case "diff":
+		diff(flag.Args()[1:])
 	default:
 		usage()
 	}
@@ -186,6 +250,10 @@ func updateService(service string, args []string) {
 		serviceCfg.VirtualHosts = vhosts
 	}
 
+	if len(groupOrder) > 0 {
+		serviceCfg.GroupOrder = groupOrder
+	}
+
 	if len(errorPages) > 1 {
 		serviceCfg.ErrorPages = parseErrorPages(errorPages)
 	}
@@ -224,6 +292,9 @@ func updateBackend(service, backend string, args []string) {
 	backendFS.Parse(args)
 
 	backendCfg.Name = backend
+	if len(backendTags) > 0 {
+		backendCfg.Tags = backendTags
+	}
 	err := client.UpdateBackend(service, backendCfg)
 	if err != nil {
 		log.Fatal(err)
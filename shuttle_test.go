@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -87,6 +97,8 @@ func myTearDown(s *BasicSuite, t Tester) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.SendBufferBytes = 0
+	Registry.cfg.RecvBufferBytes = 0
 
 	err := Registry.RemoveService(s.service.Name)
 	if err != nil {
@@ -155,6 +167,26 @@ func (s *BasicSuite) TestSingleBackend(c *C) {
 	checkResp(s.service.Addr, s.servers[0].addr, c)
 }
 
+// Stats include the number of backends, and how many are up
+func (s *BasicSuite) TestBackendCounts(c *C) {
+	stats := s.service.Stats()
+	c.Assert(stats.BackendCount, Equals, 0)
+	c.Assert(stats.UpCount, Equals, 0)
+
+	s.AddBackend(c)
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	stats = s.service.Stats()
+	c.Assert(stats.BackendCount, Equals, 3)
+	c.Assert(stats.UpCount, Equals, 3)
+
+	s.service.Backends[1].Force(false, 0)
+	stats = s.service.Stats()
+	c.Assert(stats.BackendCount, Equals, 3)
+	c.Assert(stats.UpCount, Equals, 2)
+}
+
 func (s *BasicSuite) TestRoundRobin(c *C) {
 	s.AddBackend(c)
 	s.AddBackend(c)
@@ -234,6 +266,63 @@ func (s *BasicSuite) TestLeastConn(c *C) {
 	checkResp(s.service.Addr, s.servers[2].addr, c)
 }
 
+// Old connections are closed to rebalance them onto a new backend
+func (s *BasicSuite) TestRebalanceConns(c *C) {
+	Registry.RemoveService("testService")
+	svcCfg := client.ServiceConfig{
+		Name:           "testService",
+		Addr:           "127.0.0.1:2223",
+		Balance:        "LC",
+		RebalanceConns: true,
+		MaxConnAge:     200,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	s.service = Registry.GetService("testService")
+
+	s.AddBackend(c)
+
+	buff := make([]byte, 64)
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, "connect\n"); err != nil {
+			c.Fatal(err)
+		}
+		if n, err := conn.Read(buff); err != nil || n == 0 {
+			c.Fatal("no response from backend")
+		}
+		conns = append(conns, conn)
+	}
+
+	// with nowhere better to go, nothing is closed
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(s.service.Stats().Rebalanced, Equals, int64(0))
+
+	s.AddBackend(c)
+
+	// connections are closed until the backends are within 1 of each other
+	closed := 0
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(buff); err == io.EOF {
+			closed++
+		}
+	}
+	c.Assert(closed, Equals, 3)
+	c.Assert(s.service.Stats().Rebalanced, Equals, int64(3))
+
+	svcCfg.MaxConnAge = 0
+	c.Assert(svcCfg.Validate(), NotNil)
+}
+
 // Test health check by taking down a server from a configured backend
 func (s *BasicSuite) TestFailedCheck(c *C) {
 	s.service.CheckInterval = 500
@@ -324,240 +413,2927 @@ func (s *BasicSuite) TestUpdateBackend(c *C) {
 	c.Assert(stats.Backends[0].CheckFail, Equals, 0)
 }
 
-// Test removal of a single Backend from a service with multiple.
-func (s *BasicSuite) TestRemoveBackend(c *C) {
-	s.AddBackend(c)
-	s.AddBackend(c)
+// A service can terminate TLS on a secondary address for the same backends
+func (s *BasicSuite) TestTLSListener(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:    "TLSService",
+		Addr:    "127.0.0.1:0",
+		TLSAddr: "127.0.0.1:0",
+		TLSCert: "testdata/vhost1.pem",
+		TLSKey:  "testdata/vhost1.key",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
 
-	stats, err := Registry.ServiceStats("testService")
-	if err != nil {
+	if err := Registry.AddService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
+	defer Registry.RemoveService("TLSService")
 
-	c.Assert(len(stats.Backends), Equals, 2)
+	svc := Registry.GetService("TLSService")
+	checkResp(svc.Addr, s.servers[0].addr, c)
 
-	backend1 := stats.Backends[0].Name
+	checkTLS := func(expectedName string) {
+		conn, err := tls.Dial("tcp", svc.TLSAddr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
 
-	err = Registry.RemoveBackend("testService", backend1)
-	if err != nil {
-		c.Fatal(err)
+		checkConnResp(conn, s.servers[0].addr, c)
+		cert := conn.ConnectionState().PeerCertificates[0]
+		c.Assert(cert.DNSNames[0], Equals, expectedName)
 	}
+	checkTLS("vhost1.test")
 
-	stats, err = Registry.ServiceStats("testService")
-	if err != nil {
+	// updating the certificate keeps the same listener
+	listener := svc.tlsListener
+	svcCfg.TLSAddr = svc.TLSAddr
+	svcCfg.TLSCert = "testdata/vhost2.pem"
+	svcCfg.TLSKey = "testdata/vhost2.key"
+	if err := Registry.UpdateService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
-
-	c.Assert(len(stats.Backends), Equals, 1)
-
-	_, err = Registry.BackendStats("testService", backend1)
-	c.Assert(err, Equals, ErrNoBackend)
+	c.Assert(svc.tlsListener, Equals, listener)
+	checkTLS("vhost2.test")
+
+	// a bad certificate is a config error
+	svcCfg.TLSKey = "testdata/missing.key"
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+	checkTLS("vhost2.test")
+
+	// so is a network other than tcp, however short
+	for _, network := range []string{"udp", "ip"} {
+		svcCfg.Network = network
+		c.Assert(svcCfg.Validate(), NotNil)
+	}
 }
 
-func (s *BasicSuite) TestInvalidUpdateService(c *C) {
+// Clients which don't send data or finish the TLS handshake within the
+// HandshakeTimeout are closed without reaching a backend.
+func (s *BasicSuite) TestHandshakeTimeout(c *C) {
 	svcCfg := client.ServiceConfig{
-		Name: "Update",
-		Addr: "127.0.0.1:9324",
+		Name:             "HandshakeService",
+		Addr:             "127.0.0.1:0",
+		TLSAddr:          "127.0.0.1:0",
+		TLSCert:          "testdata/vhost1.pem",
+		TLSKey:           "testdata/vhost1.key",
+		ClientTimeout:    5000,
+		HandshakeTimeout: 100,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
 	}
 
 	if err := Registry.AddService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
+	defer Registry.RemoveService("HandshakeService")
+	svc := Registry.GetService("HandshakeService")
 
-	svc := Registry.GetService("Update")
-	if svc == nil {
-		c.Fatal(ErrNoService)
+	// a silent client is closed, on either listener
+	for _, addr := range []string{svc.Addr, svc.TLSAddr} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		c.Assert(err, Equals, io.EOF)
 	}
 
-	svcCfg.Addr = "127.0.0.1:9425"
+	stats := svc.Stats()
+	c.Assert(stats.HandshakeTimeouts, Equals, int64(2))
+	c.Assert(stats.Backends[0].Conns, Equals, int64(0))
 
-	// Make sure we can't add the same service again
-	if err := Registry.AddService(svcCfg); err == nil {
-		c.Fatal(err)
-	}
+	// clients which send data in time are proxied as usual
+	checkResp(svc.Addr, s.servers[0].addr, c)
 
-	// the update should fail, because it would require a new listener
-	if err := Registry.UpdateService(svcCfg); err == nil {
+	conn, err := tls.Dial("tcp", svc.TLSAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
 		c.Fatal(err)
 	}
+	defer conn.Close()
+	checkConnResp(conn, s.servers[0].addr, c)
 
-	// change the addres back, and try to update ClientTimeout
-	svcCfg.Addr = "127.0.0.1:9324"
-	svcCfg.ClientTimeout = 1234
+	c.Assert(svc.Stats().HandshakeTimeouts, Equals, int64(2))
+}
 
-	// the update should fail, because it would require a new listener
-	if err := Registry.UpdateService(svcCfg); err == nil {
-		c.Fatal(err)
+// Backends can be reached over TLS. Use a service's TLS listener as the
+// backend.
+func (s *BasicSuite) TestBackendTLS(c *C) {
+	tlsCfg := client.ServiceConfig{
+		Name:    "TLSBackendService",
+		Addr:    "127.0.0.1:0",
+		TLSAddr: "127.0.0.1:0",
+		TLSCert: "testdata/vhost1.pem",
+		TLSKey:  "testdata/vhost1.key",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
 	}
-
-	if err := Registry.RemoveService("Update"); err != nil {
+	if err := Registry.AddService(tlsCfg); err != nil {
 		c.Fatal(err)
 	}
-}
+	defer Registry.RemoveService("TLSBackendService")
+	tlsAddr := Registry.GetService("TLSBackendService").TLSAddr
 
-// check valid service updates
-func (s *BasicSuite) TestUpdateService(c *C) {
 	svcCfg := client.ServiceConfig{
-		Name: "Update2",
-		Addr: "127.0.0.1:9324",
+		Name: "TLSOrigination",
+		Addr: "127.0.0.1:0",
+		Backends: []client.BackendConfig{
+			{
+				Name:                  "tls_backend",
+				Addr:                  tlsAddr,
+				TLS:                   true,
+				TLSServerName:         "vhost1.test",
+				TLSInsecureSkipVerify: true,
+			},
+		},
 	}
-
 	if err := Registry.AddService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
+	defer Registry.RemoveService("TLSOrigination")
 
-	svc := Registry.GetService("Update2")
-	if svc == nil {
-		c.Fatal(ErrNoService)
-	}
-
-	svcCfg.ServerTimeout = 1234
-	svcCfg.HTTPSRedirect = true
-	svcCfg.Fall = 5
-	svcCfg.Rise = 6
-	svcCfg.Balance = "LC"
+	svc := Registry.GetService("TLSOrigination")
+	checkResp(svc.Addr, s.servers[0].addr, c)
 
-	// Now update the service for real
-	if err := Registry.UpdateService(svcCfg); err != nil {
+	// the test certificate can't be verified
+	backendCfg := svcCfg.Backends[0]
+	backendCfg.TLSInsecureSkipVerify = false
+	if err := Registry.AddBackend("TLSOrigination", backendCfg); err != nil {
 		c.Fatal(err)
 	}
 
-	svc = Registry.GetService("Update2")
-	if svc == nil {
-		c.Fatal(ErrNoService)
-	}
-	c.Assert(svc.ServerTimeout, Equals, 1234*time.Millisecond)
-	c.Assert(svc.HTTPSRedirect, Equals, true)
-	c.Assert(svc.Fall, Equals, 5)
-	c.Assert(svc.Rise, Equals, 6)
-	c.Assert(svc.Balance, Equals, "LC")
-
-	if err := Registry.RemoveService("Update2"); err != nil {
+	conn, err := net.Dial("tcp", svc.Addr)
+	if err != nil {
 		c.Fatal(err)
 	}
+	defer conn.Close()
+	io.WriteString(conn, "testing\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+
+	// tls options are validated
+	backendCfg.Network = "udp"
+	c.Assert(Registry.AddBackend("TLSOrigination", backendCfg), NotNil)
+
+	backendCfg.Network = "tcp"
+	backendCfg.TLS = false
+	c.Assert(Registry.AddBackend("TLSOrigination", backendCfg), NotNil)
 }
 
-// Add backends and run response tests in parallel
-func (s *BasicSuite) TestParallel(c *C) {
-	var wg sync.WaitGroup
+// A TLS health check against a plaintext port fails, rather than crashing
+func (s *BasicSuite) TestBackendTLSCheckPlaintext(c *C) {
+	backend := NewBackend(client.BackendConfig{
+		Name:                  "tls_backend",
+		Addr:                  s.servers[0].addr,
+		TLS:                   true,
+		TLSInsecureSkipVerify: true,
+	})
+	c.Assert(backend.checkConn(), NotNil)
+}
 
-	client := func(i int) {
-		s.AddBackend(c)
-		// do a bunch of new connections in unison
-		for i := 0; i < 100; i++ {
-			checkResp(s.service.Addr, "", c)
-		}
+// Connections should queue for a backend at MaxConns
+func (s *BasicSuite) TestBackendMaxConnsQueue(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "QueueService",
+		Addr:         "127.0.0.1:0",
+		QueueSize:    1,
+		QueueTimeout: 300,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr, MaxConns: 1},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("QueueService")
+	svc := Registry.GetService("QueueService")
 
-		conn, err := net.Dial("tcp", s.service.Addr)
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", svc.Addr)
 		if err != nil {
-			// we should still get an initial connection
 			c.Fatal(err)
 		}
-		defer conn.Close()
-
-		// now do some more continuous ping-pongs with the server
-		buff := make([]byte, 1024)
-
-		for i := 0; i < 1000; i++ {
-			n, err := io.WriteString(conn, "Testing testing\n")
-			if err != nil || n == 0 {
-				c.Fatal("couldn't write:", err)
-			}
+		return conn
+	}
 
-			n, err = conn.Read(buff)
-			if err != nil || n == 0 {
-				c.Fatal("no response:", err)
-			}
+	waitQueued := func(n int64) {
+		for i := 0; i < 100 && svc.Stats().Queued != n; i++ {
+			time.Sleep(5 * time.Millisecond)
 		}
-		wg.Done()
+		c.Assert(svc.Stats().Queued, Equals, n)
 	}
 
-	for i := 0; i < 4; i++ {
-		wg.Add(1)
-		go client(i)
+	// refused connections are closed without a response
+	checkClosed := func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1024))
+		c.Assert(err, Equals, io.EOF)
 	}
 
-	wg.Wait()
-}
+	active := dial()
+	checkConnResp(active, s.servers[0].addr, c)
 
-type UDPSuite struct {
-	servers []*udpTestServer
-	service *Service
+	// data sent while queued is delivered once the backend is free
+	queued := dial()
+	io.WriteString(queued, "queued")
+	waitQueued(1)
+
+	refused := dial()
+	checkClosed(refused)
+	refused.Close()
+
+	active.Close()
+	buff := make([]byte, 1024)
+	queued.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := queued.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+	waitQueued(0)
+
+	// the queue times out
+	timedOut := dial()
+	waitQueued(1)
+	checkClosed(timedOut)
+	timedOut.Close()
+	waitQueued(0)
+
+	// a client disconnecting is removed from the queue
+	gone := dial()
+	waitQueued(1)
+	gone.Close()
+	waitQueued(0)
+
+	queued.Close()
+	c.Assert(svc.Stats().Refused, Equals, int64(2))
 }
 
-var _ = Suite(&UDPSuite{})
+// Temporary accept errors should back off exponentially up to the max
+func (s *BasicSuite) TestAcceptBackoff(c *C) {
+	defer func(max time.Duration) { acceptBackoffMax = max }(acceptBackoffMax)
+	acceptBackoffMax = 15 * time.Millisecond
 
-func (s *UDPSuite) SetUpTest(c *C) {
-	svcCfg := client.ServiceConfig{
-		Name:    "testService",
-		Addr:    "127.0.0.1:11110",
-		Network: "udp",
+	b := &acceptBackoff{}
+	err := fmt.Errorf("too many open files")
+
+	expected := []time.Duration{5, 10, 15, 15}
+	for _, d := range expected {
+		b.wait("test", err)
+		c.Assert(b.delay, Equals, d*time.Millisecond)
 	}
+	c.Assert(b.suppressed, Equals, 3)
 
-	if err := Registry.AddService(svcCfg); err != nil {
+	b.reset()
+	b.wait("test", err)
+	c.Assert(b.delay, Equals, 5*time.Millisecond)
+}
+
+// Start a minimal HTTP CONNECT proxy, which requires the auth header if set.
+func startConnectProxy(auth string, c *C) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		c.Fatal(err)
 	}
 
-	s.service = Registry.GetService(svcCfg.Name)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+
+				if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+
+				backend, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer backend.Close()
+
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() {
+					io.Copy(backend, conn)
+					backend.Close()
+				}()
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+
+	return l
 }
 
-func (s *UDPSuite) TearDownTest(c *C) {
-	for _, s := range s.servers {
-		s.Stop()
+// Connect to a backend through a CONNECT proxy
+func (s *BasicSuite) TestConnectProxy(c *C) {
+	proxy := startConnectProxy("Basic dGVzdDp0ZXN0", c)
+	defer proxy.Close()
+
+	cfg := client.BackendConfig{
+		Name:             "proxied",
+		Addr:             s.servers[0].addr,
+		CheckAddr:        s.servers[0].addr,
+		ConnectProxy:     proxy.Addr().String(),
+		ConnectProxyAuth: "Basic dGVzdDp0ZXN0",
 	}
+	s.service.add(NewBackend(cfg))
 
-	// get rid of the servers refs too!
-	s.servers = nil
+	checkResp(s.service.Addr, s.servers[0].addr, c)
 
-	// clear global defaults in Registry
-	Registry.cfg.Balance = ""
-	Registry.cfg.CheckInterval = 0
-	Registry.cfg.Fall = 0
-	Registry.cfg.Rise = 0
-	Registry.cfg.ClientTimeout = 0
-	Registry.cfg.ServerTimeout = 0
-	Registry.cfg.DialTimeout = 0
+	// health checks go through the proxy too
+	c.Assert(s.service.get("proxied").checkConn(), IsNil)
 
-	err := Registry.RemoveService(s.service.Name)
+	// a rejected CONNECT is a dial error
+	s.service.remove("proxied")
+	cfg.ConnectProxyAuth = "wrong"
+	b := NewBackend(cfg)
+	s.service.add(b)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
 	if err != nil {
-		c.Fatalf("could not remove service '%s': %s", s.service.Name, err)
+		c.Fatal(err)
 	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	_, err = conn.Read(buff)
+	c.Assert(err, NotNil)
+	c.Assert(b.Stats().Errors, Equals, int64(1))
+	c.Assert(b.checkConn(), NotNil)
 }
 
-// Add a UDP service, make sure it works, and remove it
-func (s *UDPSuite) TestAddRemove(c *C) {
-	bckCfg := client.BackendConfig{
-		Name:    "UDPServer",
-		Addr:    "127.0.0.1:11111",
-		Network: "udp",
+// A backend should stop receiving connections after MaxConnsServed
+func (s *BasicSuite) TestBackendRecycle(c *C) {
+	s.AddBackend(c)
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:            "recycle",
+		Addr:            s.servers[1].addr,
+		MaxConnsServed:  2,
+		RecycleCooldown: 200,
+	}))
+
+	recycle := s.service.get("recycle")
+	for i := 0; i < 4; i++ {
+		checkResp(s.service.Addr, "", c)
 	}
 
-	s.service.add(NewBackend(bckCfg))
+	stats := recycle.Stats()
+	c.Assert(stats.Conns, Equals, int64(2))
+	c.Assert(stats.Recycling, Equals, true)
+	c.Assert(stats.RecycleUntil, NotNil)
 
-	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
-	conn, err := net.ListenUDP("udp", lAddr)
-	if err != nil {
-		c.Fatal(err)
+	// all new connections go to the other backend
+	for i := 0; i < 4; i++ {
+		checkResp(s.service.Addr, s.servers[0].addr, c)
 	}
 
-	n, err := conn.WriteToUDP([]byte("TEST"), rAddr)
+	time.Sleep(250 * time.Millisecond)
+	stats = recycle.Stats()
+	c.Assert(stats.Recycling, Equals, false)
+	c.Assert(stats.Up, Equals, true)
+}
+
+// A new backend is dialed Warmup times before any client connects
+func (s *BasicSuite) TestBackendWarmup(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		c.Fatal(err)
 	}
+	defer l.Close()
+
+	var accepted int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			conn.Close()
+		}
+	}()
 
-	// try to make sure packets were delivered and read
-	time.Sleep(100 * time.Millisecond)
+	s.service.Lock()
+	s.service.Warmup = 3
+	s.service.Unlock()
 
-	stats := s.service.Stats()
-	c.Assert(stats.Rcvd, Equals, int64(n))
+	s.service.add(NewBackend(client.BackendConfig{
+		Name: "warmup",
+		Addr: l.Addr().String(),
+	}))
 
-	ok := s.service.remove("UDPServer")
-	c.Assert(ok, Equals, true)
+	for i := 0; atomic.LoadInt64(&accepted) < 3; i++ {
+		if i > 100 {
+			c.Fatalf("only %d warmup connections", atomic.LoadInt64(&accepted))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.service.get("warmup").Stats().Conns, Equals, int64(0))
+}
 
-	stats = s.service.Stats()
-	c.Assert(len(stats.Backends), Equals, 0)
+// Dials beyond a backend's MaxDials should wait, and fail after the timeout
+func (s *BasicSuite) TestBackendMaxDials(c *C) {
+	b := NewBackend(client.BackendConfig{
+		Name:     "maxDials",
+		Addr:     s.servers[0].addr,
+		MaxDials: 1,
+	})
+
+	// hold the only dial slot
+	b.dialSem <- struct{}{}
+
+	_, err := b.dial(&net.Dialer{Timeout: 50 * time.Millisecond}, "tcp")
+	c.Assert(err, NotNil)
+	c.Assert(b.Stats().DialQueued, Equals, int64(0))
+
+	done := make(chan error)
+	go func() {
+		conn, err := b.dial(&net.Dialer{Timeout: time.Second}, "tcp")
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	for i := 0; b.Stats().DialQueued != 1; i++ {
+		if i > 100 {
+			c.Fatal("dial never queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(b.Stats().MaxDials, Equals, 1)
+
+	// release the slot so the queued dial can proceed
+	<-b.dialSem
+	c.Assert(<-done, IsNil)
+	c.Assert(b.Stats().DialQueued, Equals, int64(0))
+}
+
+// Backend hostnames are resolved with the configured DNS server
+func (s *BasicSuite) TestResolver(c *C) {
+	dns := NewTestDNSServer(map[string]string{"backend.shuttle.test": "127.0.0.1"}, c)
+	defer dns.Stop()
+
+	defer func(r *net.Resolver) {
+		backendResolver = r
+	}(backendResolver)
+	backendResolver = newResolver(dns.addr)
+
+	_, port, _ := net.SplitHostPort(s.servers[0].addr)
+	addr := "backend.shuttle.test:" + port
+
+	svcCfg := client.ServiceConfig{
+		Name: "ResolverTest",
+		Addr: "127.0.0.1:9022",
+		Backends: []client.BackendConfig{
+			{Name: "backend", Addr: addr, CheckAddr: addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("ResolverTest")
+
+	svc := Registry.GetService("ResolverTest")
+	checkResp(svc.Addr, s.servers[0].addr, c)
+	c.Assert(dns.Queries() > 0, Equals, true)
+
+	// health checks use the same resolver
+	backend := svc.get("backend")
+	c.Assert(backend.checkConn(), IsNil)
+
+	// the system resolver doesn't know the name
+	backendResolver = net.DefaultResolver
+	c.Assert(backend.checkConn(), NotNil)
+}
+
+// Backends with a DSCP value are still proxied, and invalid values are rejected
+func (s *BasicSuite) TestBackendDSCP(c *C) {
+	cfg := client.BackendConfig{
+		Name: "dscp",
+		Addr: s.servers[0].addr,
+		DSCP: 64,
+	}
+
+	c.Assert(Registry.AddBackend("testService", cfg), NotNil)
+	c.Assert(len(s.service.Backends), Equals, 0)
+
+	cfg.DSCP = 46
+	if err := Registry.AddBackend("testService", cfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	backendCfg := s.service.Backends[0].Config()
+	c.Assert(backendCfg.DSCP, Equals, 46)
+}
+
+// A backend's dial network pins the address family it's dialed with
+func (s *BasicSuite) TestBackendDialNetwork(c *C) {
+	cfg := client.BackendConfig{
+		Name:        "pinned",
+		Addr:        s.servers[0].addr,
+		CheckAddr:   s.servers[0].addr,
+		DialNetwork: "tcp6",
+	}
+
+	// the IPv4 address can't be dialed over tcp6
+	c.Assert(Registry.AddBackend("testService", cfg), NotNil)
+	cfg.DialNetwork = "udp"
+	c.Assert(Registry.AddBackend("testService", cfg), NotNil)
+	c.Assert(len(s.service.Backends), Equals, 0)
+
+	cfg.DialNetwork = "tcp4"
+	if err := Registry.AddBackend("testService", cfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	backend := s.service.Backends[0]
+	c.Assert(backend.Config().DialNetwork, Equals, "tcp4")
+	c.Assert(backend.familyNetwork("tcp"), Equals, "tcp4")
+	c.Assert(backend.familyNetwork("udp"), Equals, "udp")
+	c.Assert(backend.checkConn(), IsNil)
+
+	// resolved addresses are limited to the pinned family
+	addrs := []string{"127.0.0.1", "::1", "fe80::1%eth0"}
+	c.Assert(filterFamily(addrs, "tcp4"), DeepEquals, []string{"127.0.0.1"})
+	c.Assert(filterFamily(addrs, "tcp6"), DeepEquals, []string{"::1", "fe80::1%eth0"})
+	c.Assert(filterFamily(addrs, "tcp"), DeepEquals, addrs)
+}
+
+// Services with TCP_NODELAY disabled are still proxied, and the setting is
+// kept through updates
+func (s *BasicSuite) TestNoDelay(c *C) {
+	c.Assert(s.service.Config().NoDelay, IsNil)
+	c.Assert(s.service.NoDelay, Equals, true)
+
+	noDelay := false
+	svcCfg := s.service.Config()
+	svcCfg.NoDelay = &noDelay
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.NoDelay, Equals, false)
+
+	s.AddBackend(c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	// an unset value in a merged config doesn't change it
+	merged := s.service.Config().Merge(client.ServiceConfig{Name: s.service.Name})
+	c.Assert(*merged.NoDelay, Equals, false)
+
+	noDelay = true
+	svcCfg.NoDelay = &noDelay
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.NoDelay, Equals, true)
+	c.Assert(s.service.Config().NoDelay, IsNil)
+}
+
+// Socket buffer sizes are set from the service, or the global config
+func (s *BasicSuite) TestSocketBuffers(c *C) {
+	Registry.UpdateGlobals(client.Config{SendBufferBytes: 256 << 10})
+
+	svcCfg := client.ServiceConfig{
+		Name:            "buffers",
+		Addr:            "127.0.0.1:0",
+		RecvBufferBytes: 128 << 10,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService(svcCfg.Name)
+
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.SendBufferBytes, Equals, 256<<10)
+	c.Assert(svc.RecvBufferBytes, Equals, 128<<10)
+	checkResp(svc.Addr, s.servers[0].addr, c)
+
+	for _, n := range []int{-1, 1024, 128 << 20} {
+		c.Assert(client.ServiceConfig{SendBufferBytes: n}.Validate(), NotNil)
+		c.Assert(client.ServiceConfig{RecvBufferBytes: n}.Validate(), NotNil)
+		c.Assert(client.Config{SendBufferBytes: n}.Validate(), NotNil)
+	}
+}
+
+// A failed check should be recorded in the backend stats
+func (s *BasicSuite) TestBackendLastError(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	b := NewBackend(client.BackendConfig{
+		Name:      "lastError",
+		Addr:      s.servers[0].addr,
+		CheckAddr: closedAddr,
+	})
+	b.up = true
+	b.fall = 1
+	b.dialTimeout = time.Second
+
+	created := b.Stats().LastChange
+	b.check()
+
+	stats := b.Stats()
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.LastError, Not(Equals), "")
+	c.Assert(stats.LastChange.After(created), Equals, true)
+}
+
+// Health checks wait for a slot when -max-health-checks is reached
+func (s *BasicSuite) TestMaxHealthChecks(c *C) {
+	b := NewBackend(client.BackendConfig{
+		Name:      "maxChecks",
+		Addr:      s.servers[0].addr,
+		CheckAddr: s.servers[0].addr,
+	})
+	b.checkInterval = 10 * time.Millisecond
+	b.dialTimeout = time.Second
+
+	// hold the only slot
+	b.checkSlots = make(chan struct{}, 1)
+	c.Assert(b.acquireCheck(), Equals, true)
+
+	b.Start()
+	defer b.Stop()
+
+	checked := func() int {
+		b.Lock()
+		defer b.Unlock()
+		return b.checkOK
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(checked(), Equals, 0)
+
+	b.releaseCheck()
+	for i := 0; checked() == 0; i++ {
+		if i == 100 {
+			c.Fatal("health check didn't run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Slow health checks scale down a backend's round robin weight
+func (s *BasicSuite) TestHealthFactor(c *C) {
+	fast, slow := 20*time.Millisecond, 100*time.Millisecond
+	c.Assert(healthFactor(10*time.Millisecond, fast, slow), Equals, 1.0)
+	c.Assert(healthFactor(60*time.Millisecond, fast, slow), Equals, 0.5)
+	c.Assert(healthFactor(200*time.Millisecond, fast, slow), Equals, 0.0)
+	c.Assert(healthFactor(200*time.Millisecond, fast, 0), Equals, 1.0)
+
+	// a check server which responds after a delay
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 64))
+			time.Sleep(60 * time.Millisecond)
+			io.WriteString(conn, "ok")
+			conn.Close()
+		}
+	}()
+
+	newBackend := func(name, checkAddr string) *Backend {
+		b := NewBackend(client.BackendConfig{
+			Name:        name,
+			Addr:        s.servers[0].addr,
+			CheckAddr:   checkAddr,
+			CheckSend:   "ping",
+			CheckExpect: "ok",
+		})
+		b.up = true
+		b.dialTimeout = time.Second
+		b.rwTimeout = time.Second
+		b.setCheckTimes(fast, slow)
+		return b
+	}
+
+	slowBackend := newBackend("slow", l.Addr().String())
+	slowBackend.check()
+	stats := slowBackend.Stats()
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.CheckLatency >= 60, Equals, true)
+	c.Assert(stats.HealthFactor < 0.5 && stats.HealthFactor > 0, Equals, true)
+
+	// the slow backend's turns are scaled down, while the other keeps its
+	// full weight
+	healthy := newBackend("healthy", "")
+	svc := &Service{Backends: []*Backend{healthy, slowBackend}}
+	slowBackend.healthFactor = 0.1
+
+	counts := make(map[string]int)
+	for i := 0; i < 22; i++ {
+		counts[svc.roundRobin()[0].Name]++
+	}
+	c.Assert(counts["healthy"], Equals, 20)
+	c.Assert(counts["slow"], Equals, 2)
+
+	// least conn counts the slow backend's connections as more
+	healthy.Active = 5
+	c.Assert(svc.leastConn()[0], Equals, healthy)
+	healthy.Active = 10
+	c.Assert(svc.leastConn()[0], Equals, slowBackend)
+	healthy.Active = 0
+
+	// while every backend is healthy, the weights aren't scaled
+	slowBackend.healthFactor = 1
+	last := svc.roundRobin()[0]
+	for i := 0; i < 4; i++ {
+		next := svc.roundRobin()[0]
+		c.Assert(next, Not(Equals), last)
+		last = next
+	}
+
+	// scaling stops when check_slow is unset
+	slowBackend.setCheckTimes(0, 0)
+	c.Assert(slowBackend.balanceWeight(true), Equals, 1)
+	c.Assert(slowBackend.Stats().HealthFactor, Equals, 1.0)
+}
+
+// Only the first group with an Up backend is balanced, with the Up backends
+// of the following groups used if connecting fails.
+func (s *BasicSuite) TestBackendGroups(c *C) {
+	newBackend := func(name, group string) *Backend {
+		b := NewBackend(client.BackendConfig{Name: name, Addr: "127.0.0.1:1", Group: group})
+		b.up = true
+		return b
+	}
+
+	a1, a2 := newBackend("a1", "dc1"), newBackend("a2", "dc1")
+	b1 := newBackend("b1", "dc2")
+	svc := &Service{
+		Backends:   []*Backend{b1, a1, a2},
+		GroupOrder: []string{"dc1", "dc2"},
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		balanced := svc.roundRobin()
+		c.Assert(balanced, HasLen, 3)
+		c.Assert(balanced[2], Equals, b1)
+		counts[balanced[0].Name]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a1": 2, "a2": 2})
+	c.Assert(svc.leastConn()[2], Equals, b1)
+
+	c.Assert(svc.Stats().Groups, DeepEquals, []GroupStat{
+		{Name: "dc1", BackendCount: 2, UpCount: 2, Active: true},
+		{Name: "dc2", BackendCount: 1, UpCount: 1},
+	})
+
+	// fail over once the whole group is down
+	a1.up = false
+	c.Assert(svc.roundRobin()[0], Equals, a2)
+	a2.up = false
+	c.Assert(svc.roundRobin(), DeepEquals, []*Backend{b1})
+	c.Assert(svc.leastConn(), DeepEquals, []*Backend{b1})
+	c.Assert(svc.udpRoundRobin(), Equals, b1)
+	c.Assert(svc.Stats().Groups[1].Active, Equals, true)
+
+	// unlisted groups follow, and nothing is returned with every group down
+	svc.GroupOrder = nil
+	a1.up = true
+	c.Assert(svc.roundRobin(), DeepEquals, []*Backend{a1, b1})
+	a1.up, b1.up = false, false
+	c.Assert(svc.roundRobin(), IsNil)
+}
+
+// A check response without the expected content should mark the backend down
+func (s *BasicSuite) TestBackendCheckExpect(c *C) {
+	b := NewBackend(client.BackendConfig{
+		Name:        "checkExpect",
+		Addr:        s.servers[0].addr,
+		CheckAddr:   s.servers[0].addr,
+		CheckSend:   "ping",
+		CheckExpect: s.servers[0].addr,
+	})
+	b.up = false
+	b.rise = 1
+	b.fall = 1
+	b.dialTimeout = 200 * time.Millisecond
+
+	b.check()
+	c.Assert(b.Up(), Equals, true)
+
+	b.checkExpect = "garbage"
+	b.check()
+	c.Assert(b.Up(), Equals, false)
+	c.Assert(b.Stats().LastError, Matches, ".*garbage.*")
+}
+
+// Failed checks during the CheckDelay shouldn't mark the backend down
+func (s *BasicSuite) TestBackendCheckDelay(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	b := NewBackend(client.BackendConfig{
+		Name:       "checkDelay",
+		Addr:       s.servers[0].addr,
+		CheckAddr:  closedAddr,
+		CheckDelay: 100,
+	})
+	b.up = true
+	b.fall = 1
+	b.dialTimeout = time.Second
+	b.checkInterval = time.Hour
+	b.Start()
+	defer b.Stop()
+
+	b.check()
+	c.Assert(b.Up(), Equals, true)
+	c.Assert(b.Stats().CheckFail, Equals, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	b.check()
+	c.Assert(b.Up(), Equals, false)
+	c.Assert(b.Config().CheckDelay, Equals, 100)
+}
+
+// A backend hostname should be resolved into a set of endpoints
+func (s *BasicSuite) TestResolveBackend(c *C) {
+	_, port, _ := net.SplitHostPort(s.servers[0].addr)
+
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:            "resolved",
+		Addr:            "localhost:" + port,
+		ResolveInterval: 100,
+	}))
+
+	time.Sleep(200 * time.Millisecond)
+
+	found := false
+	for _, addr := range s.service.Stats().Backends[0].Endpoints {
+		if addr == s.servers[0].addr {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+	c.Assert(s.service.Config().Backends[0].ResolveInterval, Equals, 100)
+}
+
+// Test removal of a single Backend from a service with multiple.
+func (s *BasicSuite) TestRemoveBackend(c *C) {
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	stats, err := Registry.ServiceStats("testService")
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(len(stats.Backends), Equals, 2)
+
+	backend1 := stats.Backends[0].Name
+
+	err = Registry.RemoveBackend("testService", backend1)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	stats, err = Registry.ServiceStats("testService")
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(len(stats.Backends), Equals, 1)
+
+	_, err = Registry.BackendStats("testService", backend1)
+	c.Assert(err, Equals, ErrNoBackend)
+}
+
+// Updates should be applied in place, only replacing the listener when the
+// address changes.
+func (s *BasicSuite) TestUpdateServiceListener(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "Update",
+		Addr: "127.0.0.1:9324",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("Update")
+
+	svc := Registry.GetService("Update")
+	if svc == nil {
+		c.Fatal(ErrNoService)
+	}
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	checkConnResp(conn, s.servers[0].addr, c)
+
+	// Make sure we can't add the same service again
+	if err := Registry.AddService(svcCfg); err == nil {
+		c.Fatal(err)
+	}
+
+	// ClientTimeout doesn't require a new listener
+	listener := svc.tcpListeners[0]
+	svcCfg.ClientTimeout = 1234
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("Update"), Equals, svc)
+	c.Assert(svc.tcpListeners[0], Equals, listener)
+	c.Assert(svc.ClientTimeout, Equals, 1234*time.Millisecond)
+	checkConnResp(conn, s.servers[0].addr, c)
+
+	// changing the address rebinds the listener
+	svcCfg.Addr = "127.0.0.1:9425"
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Addr, Equals, "127.0.0.1:9425")
+	checkResp(svcCfg.Addr, s.servers[0].addr, c)
+
+	_, err = net.Dial("tcp", "127.0.0.1:9324")
+	c.Assert(err, NotNil)
+
+	// the existing connection is still proxied
+	checkConnResp(conn, s.servers[0].addr, c)
+
+	// an address we can't bind leaves the service on its current listener
+	svcCfg.Addr = s.service.Addr
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+	c.Assert(svc.Addr, Equals, "127.0.0.1:9425")
+	checkResp("127.0.0.1:9425", s.servers[0].addr, c)
+
+	// re-posting ":0" keeps the listener on the unspecified address and the
+	// port it was assigned
+	svcCfg.Addr = ":0"
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	bound := svc.Addr
+	listener = svc.tcpListeners[0]
+
+	svcCfg.ClientTimeout = 4321
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Addr, Equals, bound)
+	c.Assert(svc.tcpListeners[0], Equals, listener)
+
+	c.Assert(sameAddr("[::]:9425", ":0"), Equals, true)
+	c.Assert(sameAddr("0.0.0.0:9425", ":9425"), Equals, true)
+	c.Assert(sameAddr("[::]:9425", "127.0.0.1:0"), Equals, false)
+	c.Assert(sameAddr("[::]:9425", ":9426"), Equals, false)
+}
+
+// check valid service updates
+func (s *BasicSuite) TestUpdateService(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "Update2",
+		Addr: "127.0.0.1:9324",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	svc := Registry.GetService("Update2")
+	if svc == nil {
+		c.Fatal(ErrNoService)
+	}
+
+	svcCfg.ServerTimeout = 1234
+	svcCfg.HTTPSRedirect = true
+	svcCfg.Fall = 5
+	svcCfg.Rise = 6
+	svcCfg.Balance = "LC"
+
+	// Now update the service for real
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	svc = Registry.GetService("Update2")
+	if svc == nil {
+		c.Fatal(ErrNoService)
+	}
+	c.Assert(svc.ServerTimeout, Equals, 1234*time.Millisecond)
+	c.Assert(svc.HTTPSRedirect, Equals, true)
+	c.Assert(svc.Fall, Equals, 5)
+	c.Assert(svc.Rise, Equals, 6)
+	c.Assert(svc.Balance, Equals, "LC")
+
+	if err := Registry.RemoveService("Update2"); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// The expiry of a TLS backend's certificate is reported, with a warning when
+// it's close, without failing the health check.
+func (s *BasicSuite) TestBackendCertExpiry(c *C) {
+	dir := c.MkDir()
+	writeECDSACert(dir, "expiring", "expiring.test", c)
+
+	tlsCfg := client.ServiceConfig{
+		Name:    "ExpiringTLSService",
+		Addr:    "127.0.0.1:0",
+		TLSAddr: "127.0.0.1:0",
+		TLSCert: filepath.Join(dir, "expiring.pem"),
+		TLSKey:  filepath.Join(dir, "expiring.key"),
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(tlsCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("ExpiringTLSService")
+	tlsAddr := Registry.GetService("ExpiringTLSService").TLSAddr
+
+	backend := NewBackend(client.BackendConfig{
+		Name:                  "tls_backend",
+		Addr:                  tlsAddr,
+		CheckAddr:             tlsAddr,
+		TLS:                   true,
+		TLSInsecureSkipVerify: true,
+	})
+
+	// nothing is known before a handshake
+	stats := backend.Stats()
+	c.Assert(stats.CertExpiry, IsNil)
+	c.Assert(stats.CheckWarning, Equals, "")
+
+	backend.check()
+	stats = backend.Stats()
+	c.Assert(stats.CheckOK, Equals, 1)
+	c.Assert(stats.CheckFail, Equals, 0)
+	c.Assert(stats.CertExpiry, NotNil)
+	c.Assert(stats.CertExpiry.After(time.Now()), Equals, true)
+	c.Assert(stats.CertExpiry.Before(time.Now().Add(time.Hour)), Equals, true)
+	c.Assert(stats.CheckWarning, Not(Equals), "")
+
+	// outside the warning window
+	defer func(d time.Duration) {
+		certWarning = d
+	}(certWarning)
+	certWarning = time.Minute
+
+	backend.check()
+	stats = backend.Stats()
+	c.Assert(stats.CheckOK, Equals, 2)
+	c.Assert(stats.CertExpiry, NotNil)
+	c.Assert(stats.CheckWarning, Equals, "")
+}
+
+// A backend address with a port range is expanded into a backend per port
+func (s *BasicSuite) TestBackendPortRange(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "PortRange",
+		Addr: "127.0.0.1:0",
+		Backends: []client.BackendConfig{
+			{Name: "web", Addr: "127.0.0.1:9001-9004", CheckAddr: "127.0.0.1:8001-8004"},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("PortRange")
+
+	checkBackends := func() {
+		cfg, err := Registry.ServiceConfig("PortRange")
+		if err != nil {
+			c.Fatal(err)
+		}
+		c.Assert(cfg.Backends, HasLen, 4)
+		for i, b := range cfg.Backends {
+			port := strconv.Itoa(9001 + i)
+			c.Assert(b.Name, Equals, "web_"+port)
+			c.Assert(b.Addr, Equals, "127.0.0.1:"+port)
+			c.Assert(b.CheckAddr, Equals, "127.0.0.1:"+strconv.Itoa(8001+i))
+		}
+	}
+	checkBackends()
+
+	// submitting the same range again doesn't add any backends
+	svc := Registry.GetService("PortRange")
+	first := svc.get("web_9001")
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkBackends()
+	c.Assert(svc.get("web_9001"), Equals, first)
+
+	if err := Registry.AddBackend("PortRange", svcCfg.Backends[0]); err != nil {
+		c.Fatal(err)
+	}
+	checkBackends()
+
+	// unnamed backends are named by their address
+	backends, err := client.BackendConfig{Addr: "127.0.0.1:80-81", CheckAddr: "127.0.0.1:80-81"}.Expand()
+	c.Assert(err, IsNil)
+	c.Assert(backends, HasLen, 2)
+	c.Assert(backends[1].Name, Equals, "127.0.0.1:81")
+	c.Assert(backends[1].CheckAddr, Equals, "127.0.0.1:81")
+
+	// a single check address is shared
+	backends, err = client.BackendConfig{Addr: "127.0.0.1:80-81", CheckAddr: "127.0.0.1:79"}.Expand()
+	c.Assert(err, IsNil)
+	c.Assert(backends[1].CheckAddr, Equals, "127.0.0.1:79")
+
+	for _, addr := range []string{"127.0.0.1:9004-9001", "127.0.0.1:0-10", "127.0.0.1:65535-65536", "127.0.0.1:1-x", "127.0.0.1:9000-9999"} {
+		c.Assert(client.BackendConfig{Addr: addr}.Validate(), NotNil, Commentf(addr))
+	}
+	c.Assert(client.BackendConfig{Addr: "127.0.0.1:80-81", CheckAddr: "127.0.0.1:80-82"}.Validate(), NotNil)
+	c.Assert(client.BackendConfig{Addr: "127.0.0.1:80", CheckAddr: "127.0.0.1:80-82"}.Validate(), NotNil)
+}
+
+// Backends can be addressed by an IPv6 address with a zone
+func (s *BasicSuite) TestZonedIPv6Backend(c *C) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		c.Skip("no IPv6 loopback")
+	}
+	l.Close()
+
+	lo := ""
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			lo = iface.Name
+			break
+		}
+	}
+	if lo == "" {
+		c.Skip("no loopback interface")
+	}
+
+	srv, err := NewTestServer("[::1]:0", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer srv.Stop()
+
+	_, port, _ := net.SplitHostPort(srv.addr)
+	addr := net.JoinHostPort("::1%"+lo, port)
+
+	cfg := client.BackendConfig{Name: "zoned", Addr: addr, CheckAddr: addr}
+	c.Assert(cfg.Validate(), IsNil)
+
+	var decoded client.BackendConfig
+	if err := json.Unmarshal(cfg.Marshal(), &decoded); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(decoded.Addr, Equals, addr)
+	c.Assert(decoded.CheckAddr, Equals, addr)
+
+	s.service.add(NewBackend(cfg))
+	checkResp(s.service.Addr, srv.addr, c)
+
+	backend := s.service.get("zoned")
+	c.Assert(backend.checkConn(), IsNil)
+	c.Assert(backend.Stats().Addr, Equals, addr)
+
+	svcCfg, err := Registry.ServiceConfig(s.service.Name)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svcCfg.Backends[0].Addr, Equals, addr)
+	c.Assert(svcCfg.Backends[0].CheckAddr, Equals, addr)
+
+	// a zoned address is an IP, and isn't resolved
+	c.Assert(isIPHost("fe80::1%eth0"), Equals, true)
+	c.Assert(isIPHost("backend.example.com"), Equals, false)
+
+	// a zone is only valid on an IPv6 address
+	c.Assert(client.BackendConfig{Addr: "[127.0.0.1%lo]:80"}.Validate(), NotNil)
+	c.Assert(client.BackendConfig{Addr: "[fe80::1%]:80"}.Validate(), NotNil)
+	c.Assert(client.BackendConfig{CheckAddr: "[host%lo]:80"}.Validate(), NotNil)
+}
+
+// Services without a balance use the global config, then DefaultBalance
+func (s *BasicSuite) TestDefaultBalance(c *C) {
+	defer func() {
+		client.DefaultBalance = client.RoundRobin
+	}()
+	client.DefaultBalance = client.LeastConn
+
+	svcCfg := client.ServiceConfig{
+		Name: "DefaultBalance",
+		Addr: "127.0.0.1:0",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("DefaultBalance")
+
+	svc := Registry.GetService("DefaultBalance")
+	c.Assert(svc.Balance, Equals, client.LeastConn)
+
+	// an unset balance on a service created directly uses the default too
+	direct := NewService(client.ServiceConfig{Name: "direct"})
+	defer direct.stop()
+	direct.add(NewBackend(client.BackendConfig{Name: "a", Addr: "127.0.0.1:1"}))
+	direct.add(NewBackend(client.BackendConfig{Name: "b", Addr: "127.0.0.1:2"}))
+	atomic.AddInt64(&direct.Backends[0].Active, 1)
+	c.Assert(direct.next()[0].Name, Equals, "b")
+
+	// the global config takes precedence
+	Registry.UpdateGlobals(client.Config{Balance: client.RoundRobin})
+	defer func() {
+		Registry.cfg.Balance = ""
+	}()
+
+	svcCfg.Name = "GlobalBalance"
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("GlobalBalance")
+
+	svc = Registry.GetService("GlobalBalance")
+	c.Assert(svc.Balance, Equals, client.RoundRobin)
+
+	c.Assert(client.ValidateBalance("XX"), NotNil)
+	c.Assert(client.Config{Balance: "XX"}.Validate(), NotNil)
+}
+
+// A service bound to port 0 should report the port it was assigned
+func (s *BasicSuite) TestPortZero(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "PortZero",
+		Addr: "127.0.0.1:0",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("PortZero")
+
+	cfg, err := Registry.ServiceConfig("PortZero")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(cfg.Addr, Not(Equals), "127.0.0.1:0")
+
+	svc := Registry.GetService("PortZero")
+	svc.add(NewBackend(client.BackendConfig{
+		Name: "backend_0",
+		Addr: s.servers[0].addr,
+	}))
+
+	checkResp(cfg.Addr, s.servers[0].addr, c)
+
+	// re-submitting the original address shouldn't require a new listener
+	svcCfg.ServerTimeout = 1234
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// A slow service start shouldn't block changes to other services
+func (s *BasicSuite) TestRegistryServiceIsolation(c *C) {
+	defer func(retries int) { bindRetries = retries }(bindRetries)
+	bindRetries = 2
+
+	// this will retry the bind for 750ms before failing
+	slowCfg := client.ServiceConfig{
+		Name: "SlowStart",
+		Addr: s.service.Addr,
+	}
+	done := make(chan error)
+	go func() {
+		done <- Registry.AddService(slowCfg)
+	}()
+
+	// wait until the slow service is reserved
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(Registry.AddService(slowCfg), Equals, ErrDuplicateService)
+
+	start := time.Now()
+	s.AddBackend(c)
+	svcCfg := s.service.Config()
+	svcCfg.ServerTimeout = 1234
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	Registry.Stats()
+	c.Assert(time.Since(start) < 250*time.Millisecond, Equals, true)
+
+	c.Assert(<-done, NotNil)
+	Registry.RemoveService("SlowStart")
+}
+
+// A service that can't bind should be reported, and not registered
+func (s *BasicSuite) TestBindFailure(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "BindFailure",
+		Addr: s.service.Addr,
+	}
+
+	c.Assert(Registry.AddService(svcCfg), NotNil)
+	c.Assert(Registry.GetService("BindFailure"), IsNil)
+
+	health := Registry.Health()
+	c.Assert(health.Healthy, Equals, false)
+	c.Assert(health.FailedServices["BindFailure"], Not(Equals), "")
+
+	found := false
+	for _, stat := range Registry.Stats() {
+		if stat.Name == "BindFailure" {
+			found = true
+			c.Assert(stat.Error, Not(Equals), "")
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	c.Assert(Registry.RemoveService("BindFailure"), IsNil)
+	c.Assert(Registry.Health().Healthy, Equals, true)
+}
+
+// A bad initial config is only fatal with strictConfig
+func (s *BasicSuite) TestStrictConfig(c *C) {
+	dir := c.MkDir()
+	badJSON := dir + "/bad.json"
+	badBind := dir + "/bind.json"
+
+	if err := ioutil.WriteFile(badJSON, []byte(`{"services": [{"name": }]}`), 0644); err != nil {
+		c.Fatal(err)
+	}
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{{Name: "BindFailure", Addr: s.service.Addr}},
+	}
+	if err := ioutil.WriteFile(badBind, cfg.Marshal(), 0644); err != nil {
+		c.Fatal(err)
+	}
+
+	defer func(path string, strict bool) {
+		defaultConfig = path
+		strictConfig = strict
+		Registry.RemoveService("BindFailure")
+	}(defaultConfig, strictConfig)
+
+	for _, path := range []string{badJSON, badBind, dir + "/missing.json"} {
+		defaultConfig = path
+
+		strictConfig = false
+		c.Assert(loadConfig(), IsNil)
+		Registry.RemoveService("BindFailure")
+
+		strictConfig = true
+		if path == dir+"/missing.json" {
+			c.Assert(loadConfig(), IsNil)
+		} else {
+			c.Assert(loadConfig(), NotNil)
+		}
+		Registry.RemoveService("BindFailure")
+	}
+}
+
+// The self test proxies through its own service, and removes it afterwards
+func (s *BasicSuite) TestSelfTest(c *C) {
+	out := &bytes.Buffer{}
+	c.Assert(selfTest(out), IsNil)
+	c.Assert(strings.Contains(out.String(), "http request routed to the backend"), Equals, true)
+	c.Assert(Registry.GetService(selfTestService), IsNil)
+}
+
+// -config-check reports every invalid service in the file, without starting
+// any of them
+func (s *BasicSuite) TestConfigCheck(c *C) {
+	dir := c.MkDir()
+	path := dir + "/config.json"
+
+	write := func(cfg client.Config) {
+		if err := ioutil.WriteFile(path, cfg.Marshal(), 0644); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{Name: "a", Addr: "127.0.0.1:9001", VirtualHosts: []string{"a.example.com"}},
+			{Name: "b", Addr: "127.0.0.1:9002", VirtualHosts: []string{"a.example.com"}},
+			{Name: "c", Addr: "127.0.0.1:0"},
+			{Name: "d", Addr: "127.0.0.1:0"},
+		},
+	}
+	write(cfg)
+	c.Assert(checkConfig(path), IsNil)
+
+	cfg.Services = append(cfg.Services,
+		client.ServiceConfig{Name: "badBalance", Addr: "127.0.0.1:9003", Balance: "XX"},
+		client.ServiceConfig{Name: "badAddr", Addr: "127.0.0.1"},
+		client.ServiceConfig{Name: "badPort", Addr: "127.0.0.1:99999"},
+		client.ServiceConfig{Name: "dupAddr", Addr: "127.0.0.1:9004,127.0.0.1:9001"},
+		client.ServiceConfig{Name: "dupVhost", Addr: "127.0.0.1:9005", VirtualHosts: []string{"d.example.com", "d.example.com"}},
+		client.ServiceConfig{Addr: "127.0.0.1:9006"},
+	)
+	write(cfg)
+
+	err := checkConfig(path)
+	c.Assert(err, FitsTypeOf, client.ConfigErrors{})
+
+	names := []string{}
+	for name := range err.(client.ConfigErrors) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"badAddr", "badBalance", "badPort", "dupAddr", "dupVhost", "services[0]"})
+	c.Assert(Registry.GetService("a"), IsNil)
+
+	c.Assert(checkConfig(dir+"/missing.json"), NotNil)
+}
+
+// Reloading the config file applies it only when the whole file is valid
+func (s *BasicSuite) TestReloadConfig(c *C) {
+	c.Assert(reloadConfig(), NotNil)
+
+	path := c.MkDir() + "/config.json"
+	defer func(path string) {
+		defaultConfig = path
+	}(defaultConfig)
+	defaultConfig = path
+
+	// the file always lists the suite's own service, so it isn't removed
+	suiteCfg, err := Registry.ServiceConfig(s.service.Name)
+	c.Assert(err, IsNil)
+
+	write := func(cfg client.Config) {
+		cfg.Services = append(cfg.Services[:len(cfg.Services):len(cfg.Services)], suiteCfg)
+		if err := ioutil.WriteFile(path, cfg.Marshal(), 0644); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{
+			{
+				Name: "reloaded",
+				Addr: "127.0.0.1:0",
+				Backends: []client.BackendConfig{
+					{Name: "backend_0", Addr: s.servers[0].addr},
+				},
+			},
+		},
+	}
+	write(cfg)
+	c.Assert(reloadConfig(), IsNil)
+	defer Registry.RemoveService("reloaded")
+	defer Registry.RemoveService("added")
+
+	svc := Registry.GetService("reloaded")
+	c.Assert(svc, NotNil)
+	checkResp(svc.Addr, s.servers[0].addr, c)
+
+	// one invalid service stops the whole reload
+	valid := cfg
+	valid.Services = []client.ServiceConfig{
+		cfg.Services[0],
+		{Name: "added", Addr: "127.0.0.1:0"},
+	}
+	valid.Services[0].Backends = []client.BackendConfig{
+		{Name: "backend_0", Addr: s.servers[1].addr},
+	}
+	cfg.Services = append(valid.Services[:2:2],
+		client.ServiceConfig{Name: "invalid", Addr: "127.0.0.1:0", Balance: "XX"},
+	)
+	write(cfg)
+	c.Assert(reloadConfig(), NotNil)
+	c.Assert(Registry.GetService("added"), IsNil)
+	checkResp(svc.Addr, s.servers[0].addr, c)
+
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	c.Assert(reloadConfig(), NotNil)
+
+	write(valid)
+	c.Assert(reloadConfig(), IsNil)
+	c.Assert(Registry.GetService("added"), NotNil)
+	checkResp(svc.Addr, s.servers[1].addr, c)
+
+	// services and backends removed from the file are removed
+	valid.Services = valid.Services[:1]
+	valid.Services[0].Backends = nil
+	write(valid)
+	c.Assert(reloadConfig(), IsNil)
+	c.Assert(Registry.GetService("added"), IsNil)
+	c.Assert(Registry.GetService("reloaded"), NotNil)
+	c.Assert(Registry.GetService("reloaded").Config().Backends, HasLen, 0)
+}
+
+// The log file rotates past its max size, keeping a limited number of backups,
+// and can be reopened after being moved
+func (s *BasicSuite) TestLogFileRotation(c *C) {
+	path := filepath.Join(c.MkDir(), "shuttle.log")
+
+	lf, err := openLogFile(path, 10, 2)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer lf.Close()
+
+	read := func(p string) string {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := lf.Write([]byte(line)); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	c.Assert(read(path), Equals, "four\nfive\n")
+	c.Assert(read(path+".1"), Equals, "three\n")
+	c.Assert(read(path+".2"), Equals, "one\ntwo\n")
+	_, err = os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// a write larger than the max size still goes in a single file
+	lf.Write([]byte("0123456789ab\n"))
+	c.Assert(read(path), Equals, "0123456789ab\n")
+	c.Assert(read(path+".1"), Equals, "four\nfive\n")
+	c.Assert(read(path+".2"), Equals, "three\n")
+
+	// reopened after an external rotation
+	if err := os.Rename(path, path+".moved"); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(lf.Reopen(), IsNil)
+	lf.Write([]byte("six\n"))
+	c.Assert(read(path), Equals, "six\n")
+	c.Assert(read(path+".moved"), Equals, "0123456789ab\n")
+}
+
+// A service can listen on multiple addresses, with the same backends
+func (s *BasicSuite) TestMultipleAddrs(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "MultiAddr",
+		Addr: "127.0.0.1:0, 127.0.0.1:0",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("MultiAddr")
+
+	svc := Registry.GetService("MultiAddr")
+	addrs := svc.Config().Addrs()
+	c.Assert(addrs, HasLen, 2)
+	c.Assert(addrs[0], Not(Equals), addrs[1])
+
+	for _, addr := range addrs {
+		checkResp(addr, s.servers[0].addr, c)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	stats := svc.Stats()
+	c.Assert(stats.Conns, Equals, int64(2))
+	c.Assert(stats.Addr, Equals, strings.Join(addrs, ","))
+
+	// an unchanged list of addresses keeps the listeners
+	svcCfg.Addr = strings.Join(addrs, ",")
+	svcCfg.ClientTimeout = 1234
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Config().Addr, Equals, svcCfg.Addr)
+
+	// removing an address closes its listener
+	svcCfg.Addr = addrs[1]
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Config().Addrs(), DeepEquals, addrs[1:])
+	checkResp(addrs[1], s.servers[0].addr, c)
+
+	_, err := net.Dial("tcp", addrs[0])
+	c.Assert(err, NotNil)
+
+	// the same address can't be listed twice
+	svcCfg.Addr = addrs[1] + "," + addrs[1]
+	c.Assert(svcCfg.Validate(), NotNil)
+}
+
+// Set the state config flags. They're read by writeStateConfig with
+// configMutex held, which may still be running from an earlier change.
+func setStateConfig(path string, noWrite bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	stateConfig = path
+	noStateWrite = noWrite
+}
+
+// Unversioned configs are migrated, newer configs aren't loaded, and the
+// state config is written with the current version.
+func (s *BasicSuite) TestConfigVersion(c *C) {
+	dir := c.MkDir()
+	path := dir + "/config.json"
+
+	defer func(def, state string, strict bool) {
+		defaultConfig = def
+		setStateConfig(state, noStateWrite)
+		strictConfig = strict
+		Registry.RemoveService("VersionTest")
+	}(defaultConfig, stateConfig, strictConfig)
+	defaultConfig = path
+	setStateConfig("", noStateWrite)
+	strictConfig = false
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{{Name: "VersionTest", Addr: "127.0.0.1:9020"}},
+	}
+
+	// a future version is skipped entirely
+	cfg.Version = client.ConfigVersion + 1
+	if err := ioutil.WriteFile(path, cfg.Marshal(), 0644); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("VersionTest"), IsNil)
+
+	strictConfig = true
+	c.Assert(loadConfig(), NotNil)
+	c.Assert(Registry.GetService("VersionTest"), IsNil)
+	c.Assert(cfg.Validate(), NotNil)
+
+	// an unversioned config is loaded
+	cfg.Version = 0
+	if err := ioutil.WriteFile(path, cfg.Marshal(), 0644); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("VersionTest"), NotNil)
+
+	// the state is saved with the current version
+	setStateConfig(dir+"/state.json", noStateWrite)
+	writeStateConfig()
+
+	data, err := ioutil.ReadFile(dir + "/state.json")
+	if err != nil {
+		c.Fatal(err)
+	}
+	saved := client.Config{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(saved.Version, Equals, client.ConfigVersion)
+}
+
+// The state config is still loaded, but not written with -no-state-write
+func (s *BasicSuite) TestNoStateWrite(c *C) {
+	path := c.MkDir() + "/state.json"
+
+	defer func(state string, noWrite bool) {
+		setStateConfig(state, noWrite)
+		Registry.RemoveService("StateTest")
+	}(stateConfig, noStateWrite)
+	setStateConfig(path, true)
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{{Name: "StateTest", Addr: "127.0.0.1:9021"}},
+	}
+	if err := ioutil.WriteFile(path, cfg.Marshal(), 0644); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("StateTest"), NotNil)
+
+	Registry.RemoveService("StateTest")
+	writeStateConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(data), Equals, string(cfg.Marshal()))
+
+	setStateConfig(path, false)
+	writeStateConfig()
+
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(data), Not(Equals), string(cfg.Marshal()))
+}
+
+// The state config can be kept in consul, where it's watched for changes.
+func (s *BasicSuite) TestConsulConfigStore(c *C) {
+	srv := NewTestConsulServer()
+	defer srv.Close()
+
+	defer func(store ConfigStore, def string) {
+		configMutex.Lock()
+		remoteStore = store
+		configMutex.Unlock()
+		defaultConfig = def
+		Registry.RemoveService("StoreTest")
+	}(remoteStore, defaultConfig)
+	store := newConsulStore(srv.URL, "shuttle/config")
+	configMutex.Lock()
+	remoteStore = store
+	configMutex.Unlock()
+	defaultConfig = ""
+
+	// a missing key isn't an error
+	c.Assert(loadConfig(), IsNil)
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{{Name: "StoreTest", Addr: "127.0.0.1:9022"}},
+	}
+	srv.Set(cfg.Marshal())
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("StoreTest"), NotNil)
+
+	// the state is saved to the store
+	writeStateConfig()
+	saved := client.Config{}
+	if err := json.Unmarshal(srv.Value(), &saved); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(saved.Services, HasLen, len(Registry.Config().Services))
+
+	// shuttle's own write isn't seen as a change, but outside changes are
+	configs := store.Watch()
+	cfg.Services[0].Backends = []client.BackendConfig{
+		{Name: "backend_0", Addr: s.servers[0].addr},
+	}
+	srv.Set(cfg.Marshal())
+
+	var changed client.Config
+	select {
+	case changed = <-configs:
+		c.Assert(changed.Services, HasLen, 1)
+		c.Assert(changed.Services[0].Backends, HasLen, 1)
+	case <-time.After(5 * time.Second):
+		c.Fatal("config change wasn't seen")
+	}
+
+	// a change is applied as the desired state, and isn't written back
+	suiteCfg, err := Registry.ServiceConfig(s.service.Name)
+	c.Assert(err, IsNil)
+	changed.Services = append(changed.Services, suiteCfg)
+	c.Assert(applyWatchedConfig(store, changed), IsNil)
+	c.Assert(Registry.GetService("StoreTest").Config().Backends, HasLen, 1)
+
+	changed.Services[0] = client.ServiceConfig{Name: "StoreTest2", Addr: "127.0.0.1:9023"}
+	defer Registry.RemoveService("StoreTest2")
+	c.Assert(applyWatchedConfig(store, changed), IsNil)
+	c.Assert(Registry.GetService("StoreTest"), IsNil)
+	c.Assert(Registry.GetService("StoreTest2"), NotNil)
+	c.Assert(string(srv.Value()), Equals, string(cfg.Marshal()))
+}
+
+// Proxying to a backend connection that isn't a *net.TCPConn shouldn't panic
+func (s *BasicSuite) TestNonTCPBackendConn(c *C) {
+	backend := NewBackend(client.BackendConfig{
+		Name: "pipe",
+		Addr: "pipe",
+	})
+
+	// a real client connection, and a net.Pipe for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	cliConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		c.Fatal(err)
+	}
+	proxyConn, err := l.Accept()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	srvConn, backendConn := net.Pipe()
+
+	done := make(chan bool)
+	go func() {
+		backend.proxy(srvConn, proxyConn, false)
+		close(done)
+	}()
+
+	// echo back one message from the "backend"
+	go func() {
+		buff := make([]byte, 1024)
+		n, err := backendConn.Read(buff)
+		if err != nil {
+			return
+		}
+		backendConn.Write(buff[:n])
+	}()
+
+	checkConnResp(cliConn, "testing\n", c)
+	cliConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("proxy didn't exit")
+	}
+}
+
+// Active connection counts return to zero after a burst of connections,
+// including failed dials and clients which close early
+func (s *BasicSuite) TestActiveConnsBurst(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	if err := Registry.AddBackend("testService", client.BackendConfig{Name: "closed", Addr: closedAddr}); err != nil {
+		c.Fatal(err)
+	}
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", s.service.Addr)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			// some clients leave without waiting for a response
+			io.WriteString(conn, "testing\n")
+			if i%3 == 0 {
+				return
+			}
+			conn.Read(make([]byte, 1024))
+		}(i)
+	}
+	wg.Wait()
+
+	active := func() (total int64) {
+		for _, b := range s.service.Stats().Backends {
+			c.Assert(b.Active >= 0, Equals, true)
+			total += b.Active
+		}
+		return total
+	}
+
+	for i := 0; i < 50 && active() != 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(active(), Equals, int64(0))
+}
+
+// Closing a counted connection more than once only decrements the count once
+func (s *BasicSuite) TestShuttleConnDoubleClose(c *C) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	connected := int64(1)
+	conn := &shuttleConn{Conn: a, read: new(int64), written: new(int64), connected: &connected}
+	conn.Close()
+	conn.Close()
+	c.Assert(connected, Equals, int64(0))
+}
+
+// closeRead should half-close a TCPConn, and fully close anything else
+func (s *BasicSuite) TestCloseRead(c *C) {
+	a, b := net.Pipe()
+	c.Assert(closeRead(a), IsNil)
+	_, err := b.Write([]byte("x"))
+	c.Assert(err, NotNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	cliConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer cliConn.Close()
+
+	srvConn, err := l.Accept()
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer srvConn.Close()
+
+	// wrapped connections are half-closed through to the TCPConn
+	wrapped := &shuttleConn{Conn: srvConn, read: new(int64), written: new(int64)}
+	c.Assert(closeRead(wrapped), IsNil)
+
+	// the write side is still open
+	if _, err := io.WriteString(wrapped, "testing\n"); err != nil {
+		c.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	n, err := cliConn.Read(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(buff[:n]), Equals, "testing\n")
+}
+
+// Connections from health checker networks are answered without a backend
+func (s *BasicSuite) TestHealthCheckCIDRs(c *C) {
+	s.AddBackend(c)
+
+	svcCfg := s.service.Config()
+	svcCfg.HealthCheckCIDRs = []string{"127.0.0.0/8"}
+	svcCfg.HealthCheckResponse = "OK\n"
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(resp), Equals, "OK\n")
+
+	stats := s.service.Stats()
+	c.Assert(stats.HealthChecks, Equals, int64(1))
+	c.Assert(stats.Conns, Equals, int64(0))
+
+	// other clients are proxied as usual
+	svcCfg.HealthCheckCIDRs = []string{"10.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	c.Assert(s.service.Stats().HealthChecks, Equals, int64(1))
+
+	svcCfg.HealthCheckCIDRs = []string{"10.0.0.1"}
+	c.Assert(svcCfg.Validate(), NotNil)
+}
+
+// Services and backends are reported in name order, however they were added
+func (s *BasicSuite) TestSortedOutput(c *C) {
+	for _, name := range []string{"sortC", "sortA", "sortB"} {
+		svcCfg := client.ServiceConfig{
+			Name: name,
+			Addr: "127.0.0.1:0",
+			Backends: []client.BackendConfig{
+				{Name: "b2", Addr: s.servers[0].addr},
+				{Name: "b1", Addr: s.servers[1].addr},
+			},
+		}
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+		defer Registry.RemoveService(name)
+	}
+	Registry.AddBackend("sortA", client.BackendConfig{Name: "b0", Addr: s.servers[2].addr})
+
+	names := []string{}
+	for _, svc := range Registry.Config().Services {
+		names = append(names, svc.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"sortA", "sortB", "sortC", "testService"})
+
+	names = []string{}
+	for _, svc := range Registry.Stats() {
+		names = append(names, svc.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"sortA", "sortB", "sortC", "testService"})
+
+	svc := Registry.GetService("sortA")
+	names = []string{}
+	for _, b := range svc.Config().Backends {
+		names = append(names, b.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"b0", "b1", "b2"})
+
+	names = []string{}
+	for _, b := range svc.Stats().Backends {
+		names = append(names, b.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"b0", "b1", "b2"})
+}
+
+// Concurrent connections from a client IP are limited, using the PROXY
+// protocol address from a trusted proxy.
+func (s *BasicSuite) TestMaxConnsPerClient(c *C) {
+	s.AddBackend(c)
+
+	svcCfg := s.service.Config()
+	svcCfg.MaxConnsPerClient = 2
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	connect := func(header string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+
+		io.WriteString(conn, header+"testing\n")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buff := make([]byte, 1024)
+		n, _ := conn.Read(buff)
+		return conn, string(buff[:n])
+	}
+
+	conn1, resp := connect("")
+	defer conn1.Close()
+	c.Assert(resp, Equals, s.servers[0].addr)
+	conn2, resp := connect("")
+	defer conn2.Close()
+	c.Assert(resp, Equals, s.servers[0].addr)
+
+	conn3, resp := connect("")
+	conn3.Close()
+	c.Assert(resp, Equals, "")
+
+	stats := s.service.Stats()
+	c.Assert(stats.PerClientRefused, Equals, int64(1))
+	c.Assert(stats.Clients, Equals, 1)
+
+	// clients behind a trusted proxy are counted separately, and the header
+	// is passed through
+	svcCfg.TrustedProxies = []string{"127.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, resp := connect("PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\n")
+		defer conn.Close()
+		c.Assert(resp, Equals, s.servers[0].addr)
+	}
+	c.Assert(s.service.Stats().Clients, Equals, 2)
+
+	conn, resp := connect("PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\n")
+	conn.Close()
+	c.Assert(resp, Equals, "")
+	c.Assert(s.service.Stats().PerClientRefused, Equals, int64(2))
+
+	// a closed connection frees its slot
+	conn1.Close()
+	localConns := func() int {
+		s.service.clientLock.Lock()
+		defer s.service.clientLock.Unlock()
+		return s.service.clientConns["127.0.0.1"]
+	}
+	for i := 0; i < 20 && localConns() > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(localConns(), Equals, 1)
+	conn4, resp := connect("")
+	defer conn4.Close()
+	c.Assert(resp, Equals, s.servers[0].addr)
+
+	// X-Forwarded-For is only used from a trusted proxy
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "10.0.0.3, 10.0.0.1")
+	c.Assert(requestClientIP(req, parseCIDRs([]string{"127.0.0.0/8"})), Equals, "10.0.0.1")
+	c.Assert(requestClientIP(req, nil), Equals, "127.0.0.1")
+}
+
+// A backend which accepts and immediately closes is counted, and with
+// RetryEmpty the client is moved on to the next backend.
+func (s *BasicSuite) TestEmptyResponses(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	addr := l.Addr().String()
+	s.service.add(NewBackend(client.BackendConfig{Name: "empty", Addr: addr, CheckAddr: addr}))
+
+	// give the backend time to close before the client sends anything
+	request := func() string {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(conn, "testing\n")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buff := make([]byte, 1024)
+		n, _ := conn.Read(buff)
+		return string(buff[:n])
+	}
+
+	empty := func() int64 {
+		return s.service.get("empty").Stats().EmptyResponses
+	}
+
+	c.Assert(request(), Equals, "")
+	for i := 0; i < 20 && empty() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(empty(), Equals, int64(1))
+
+	svcCfg := s.service.Config()
+	svcCfg.RetryEmpty = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	s.AddBackend(c)
+
+	// every connection reaches the working backend, whichever is tried first
+	for i := 0; i < 4; i++ {
+		c.Assert(request(), Equals, s.servers[1].addr)
+	}
+	c.Assert(empty() > 1, Equals, true)
+}
+
+// TCP connections without timeouts are copied with splice, and still counted
+func (s *BasicSuite) TestSplice(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	dial := func() (net.Conn, net.Conn) {
+		cliConn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			c.Fatal(err)
+		}
+		srvConn, err := l.Accept()
+		if err != nil {
+			c.Fatal(err)
+		}
+		return cliConn, srvConn
+	}
+
+	srcCli, srcSrv := dial()
+	defer srcCli.Close()
+	defer srcSrv.Close()
+	dstCli, dstSrv := dial()
+	defer dstCli.Close()
+	defer dstSrv.Close()
+
+	src := &countingConn{Conn: &shuttleConn{Conn: srcSrv, read: new(int64), written: new(int64)}}
+	dst := &shuttleConn{Conn: dstCli, read: new(int64), written: new(int64)}
+	c.Assert(spliceConn(src), Equals, srcSrv)
+	c.Assert(spliceConn(dst), Equals, dstCli)
+
+	// connections with deadlines, or buffered data, can't be spliced
+	c.Assert(spliceConn(&shuttleConn{Conn: srcSrv, rwTimeout: time.Second}), IsNil)
+	buffered := &bufferedConn{Conn: srcSrv, r: bufio.NewReader(strings.NewReader("x"))}
+	c.Assert(spliceConn(buffered), IsNil)
+
+	size := 3*spliceChunkSize + 100
+	go func() {
+		srcCli.Write(make([]byte, size))
+		srcCli.Close()
+	}()
+
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, dstSrv)
+		received <- n
+	}()
+
+	n, err := copyConn(dst, src)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(size))
+	dst.CloseWrite()
+
+	c.Assert(<-received, Equals, int64(size))
+	c.Assert(src.read, Equals, int64(size))
+	c.Assert(*src.Conn.(*shuttleConn).read, Equals, int64(size))
+	c.Assert(*dst.written, Equals, int64(size))
+}
+
+// A half-close from the client is passed through to the backend with
+// AllowHalfOpen, so a backend can respond after reading to EOF.
+func (s *BasicSuite) TestAllowHalfOpen(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	// respond with the number of bytes read once the client is done writing
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(ioutil.Discard, conn)
+				fmt.Fprintf(conn, "%d", n)
+			}()
+		}
+	}()
+
+	addr := l.Addr().String()
+	s.service.add(NewBackend(client.BackendConfig{Name: "halfOpen", Addr: addr, CheckAddr: addr}))
+
+	count := func() string {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, "testing"); err != nil {
+			c.Fatal(err)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, _ := ioutil.ReadAll(conn)
+		return string(resp)
+	}
+
+	// the connection is closed as soon as the client closes its write side
+	c.Assert(count(), Equals, "")
+
+	svcCfg := s.service.Config()
+	svcCfg.AllowHalfOpen = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().AllowHalfOpen, Equals, true)
+
+	c.Assert(count(), Equals, "7")
+}
+
+// Accepting connections faster than AcceptRateAlert is counted once per window
+func (s *BasicSuite) TestAcceptRateAlert(c *C) {
+	s.AddBackend(c)
+
+	svcCfg := s.service.Config()
+	svcCfg.AcceptRateAlert = 1
+	svcCfg.AcceptRateWindow = 2000
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	// 2 connections are allowed in the window
+	for i := 0; i < 5; i++ {
+		checkResp(s.service.Addr, s.servers[0].addr, c)
+	}
+
+	stats := s.service.Stats()
+	c.Assert(stats.AcceptRateAlerts, Equals, int64(1))
+
+	r, err := newStatsdReporter("127.0.0.1:8125", "", time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(r.metrics([]ServiceStat{stats})[0], Equals, "testService.accept_rate_alerts:1|c")
+
+	// the rate is measured from the last complete window
+	start := time.Now()
+	rate := &acceptRate{}
+	for i := 0; i < 10; i++ {
+		_, alert := rate.Add(start, time.Second, 10)
+		c.Assert(alert, Equals, false)
+	}
+	c.Assert(rate.Rate(start, time.Second), Equals, float64(0))
+
+	// a new window starts the count again
+	next := start.Add(time.Second)
+	for i := 0; i < 6; i++ {
+		_, alert := rate.Add(next, time.Second, 5)
+		c.Assert(alert, Equals, i == 5)
+	}
+	c.Assert(rate.Rate(next, time.Second), Equals, float64(10))
+	c.Assert(rate.Rate(next.Add(time.Second), time.Second), Equals, float64(6))
+	c.Assert(rate.Rate(next.Add(2*time.Second), time.Second), Equals, float64(0))
+}
+
+// A backend refusing connections raises an alert once its dial failure rate
+// reaches DialFailureAlert
+func (s *BasicSuite) TestDialFailureAlert(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	svcCfg := s.service.Config()
+	svcCfg.DialFailureAlert = 0.5
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "refused", Addr: refused},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	for i := 0; i < dialAlertMinDials+2; i++ {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+
+	stats := s.service.get("refused").Stats()
+	c.Assert(stats.DialFailureRate, Equals, float64(1))
+	c.Assert(stats.DialFailureAlerts, Equals, int64(1))
+
+	// the rate slides with the window, one bucket at a time
+	start := time.Now()
+	window := 10 * time.Second
+	bucket := window / failureRateBuckets
+	rate := &failureRate{}
+	for i := 0; i < 5; i++ {
+		_, _, alert := rate.Add(start, window, i < 3, 0.5, dialAlertMinDials)
+		c.Assert(alert, Equals, i == 4)
+	}
+	c.Assert(rate.Rate(start, window), Equals, 0.6)
+
+	next := start.Add(window / 2)
+	for i := 0; i < 5; i++ {
+		rate.Add(next, window, false, 0.5, dialAlertMinDials)
+	}
+	c.Assert(rate.Rate(next, window), Equals, 0.3)
+
+	// the failed dials expire with the first bucket
+	c.Assert(rate.Rate(start.Add(window-bucket), window), Equals, 0.3)
+	c.Assert(rate.Rate(start.Add(window), window), Equals, float64(0))
+
+	// another alert needs the rate to drop and cross the alert again
+	later := next.Add(2 * window)
+	for i := 0; i < 5; i++ {
+		_, _, alert := rate.Add(later, window, true, 0.5, dialAlertMinDials)
+		c.Assert(alert, Equals, i == 4)
+	}
+}
+
+// Backend stats are sent to statsd in packets under the MTU
+func (s *BasicSuite) TestStatsd(c *C) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	r, err := newStatsdReporter(l.LocalAddr().String(), "shuttle.", time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	s.AddBackend(c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	time.Sleep(50 * time.Millisecond)
+
+	stats := []ServiceStat{s.service.Stats()}
+	r.Flush(stats)
+
+	buff := make([]byte, 65536)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFrom(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	name := "shuttle.testService." + statsdName(s.service.Backends[0].Name) + "."
+	lines := strings.Split(string(buff[:n]), "\n")
+	c.Assert(lines, DeepEquals, []string{
+		name + "active:0|g",
+		name + "up:1|g",
+		name + fmt.Sprintf("sent:%d|c", len("testing\n")),
+		name + fmt.Sprintf("received:%d|c", len(s.servers[0].addr)),
+		name + "errors:0|c",
+		name + "connections:1|c",
+	})
+
+	// counters only send the change since the last flush
+	for _, line := range r.metrics(stats) {
+		if strings.HasSuffix(line, "|c") {
+			c.Assert(strings.HasSuffix(line, ":0|c"), Equals, true)
+		}
+	}
+
+	// many backends are split into multiple packets
+	for i := 0; i < 100; i++ {
+		stats[0].Backends = append(stats[0].Backends, BackendStat{Name: fmt.Sprintf("backend-%d", i)})
+	}
+	r.Flush(stats)
+
+	lineCount := 0
+	for lineCount < 6*101 {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buff)
+		if err != nil {
+			c.Fatal(err)
+		}
+		c.Assert(n <= statsdMaxPacket, Equals, true)
+		lineCount += len(strings.Split(string(buff[:n]), "\n"))
+	}
+	c.Assert(lineCount, Equals, 6*101)
+}
+
+// Services are sent to statsd on their own StatsInterval
+func (s *BasicSuite) TestStatsdInterval(c *C) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	r, err := newStatsdReporter(l.LocalAddr().String(), "", time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	stats := []ServiceStat{
+		{Name: "fast", StatsInterval: 100, Backends: []BackendStat{{Name: "b"}}},
+		{Name: "slow", Backends: []BackendStat{{Name: "b"}}},
+	}
+
+	// return the services sent in a tick
+	tick := func(now time.Time, stats []ServiceStat, wait time.Duration) []string {
+		c.Assert(r.Tick(now, stats), Equals, wait)
+
+		sent := map[string]bool{}
+		buff := make([]byte, 65536)
+		for {
+			l.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			n, _, err := l.ReadFrom(buff)
+			if err != nil {
+				break
+			}
+			for _, line := range strings.Split(string(buff[:n]), "\n") {
+				sent[r.serviceName(line)] = true
+			}
+		}
+
+		names := []string{}
+		for _, svc := range stats {
+			if sent[svc.Name] {
+				names = append(names, svc.Name)
+			}
+		}
+		return names
+	}
+
+	start := time.Now()
+	c.Assert(tick(start, stats, 100*time.Millisecond), HasLen, 0)
+	c.Assert(tick(start.Add(100*time.Millisecond), stats, 100*time.Millisecond), DeepEquals, []string{"fast"})
+	c.Assert(tick(start.Add(150*time.Millisecond), stats, 50*time.Millisecond), HasLen, 0)
+	c.Assert(tick(start.Add(time.Second), stats, 100*time.Millisecond), DeepEquals, []string{"fast", "slow"})
+
+	// a removed service is forgotten
+	c.Assert(tick(start.Add(1100*time.Millisecond), stats[:1], 100*time.Millisecond), DeepEquals, []string{"fast"})
+	_, ok := r.next["slow"]
+	c.Assert(ok, Equals, false)
+	for key := range r.last {
+		c.Assert(strings.HasPrefix(key, "slow."), Equals, false)
+	}
+}
+
+// ConnHooks which record each call
+type recordHooks struct {
+	sync.Mutex
+	calls []string
+	infos []ConnInfo
+}
+
+func (h *recordHooks) record(call string, info *ConnInfo) {
+	h.Lock()
+	defer h.Unlock()
+	h.calls = append(h.calls, call)
+	h.infos = append(h.infos, *info)
+}
+
+func (h *recordHooks) Accepted(info *ConnInfo)        { h.record("accepted", info) }
+func (h *recordHooks) BackendSelected(info *ConnInfo) { h.record("selected", info) }
+func (h *recordHooks) Dialed(info *ConnInfo)          { h.record("dialed", info) }
+func (h *recordHooks) Closed(info *ConnInfo)          { h.record("closed", info) }
+
+func (h *recordHooks) Calls() ([]string, []ConnInfo) {
+	h.Lock()
+	defer h.Unlock()
+	return append([]string{}, h.calls...), append([]ConnInfo{}, h.infos...)
+}
+
+// Hooks are called for each stage of a connection
+func (s *BasicSuite) TestConnHooks(c *C) {
+	hooks := &recordHooks{}
+	SetConnHooks(hooks)
+	defer SetConnHooks(nil)
+
+	// the first backend is down, so it's tried and skipped
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	if err := Registry.AddBackend("testService", client.BackendConfig{Name: "closed", Addr: closedAddr}); err != nil {
+		c.Fatal(err)
+	}
+	s.AddBackend(c)
+
+	checkResp(s.service.Addr, s.servers[1].addr, c)
+
+	var calls []string
+	var infos []ConnInfo
+	for i := 0; i < 20; i++ {
+		calls, infos = hooks.Calls()
+		if len(calls) > 0 && calls[len(calls)-1] == "closed" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	c.Assert(calls, DeepEquals, []string{"accepted", "selected", "dialed", "selected", "dialed", "closed"})
+	c.Assert(infos[0].Service, Equals, "testService")
+	c.Assert(infos[1].Backend, Equals, "closed")
+	c.Assert(infos[2].Err, NotNil)
+	c.Assert(infos[3].BackendAddr, Equals, s.servers[1].addr)
+	c.Assert(infos[4].Err, IsNil)
+
+	closed := infos[5]
+	c.Assert(closed.Connected, Equals, true)
+	c.Assert(closed.Backend, Equals, s.service.Backends[1].Name)
+	c.Assert(closed.Rcvd, Equals, int64(len("testing\n")))
+	c.Assert(closed.Sent, Equals, int64(len(s.servers[1].addr)))
+	c.Assert(closed.Duration > 0, Equals, true)
+}
+
+// A bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// Sampled connections are logged when closed
+func (s *BasicSuite) TestConnLogSample(c *C) {
+	// replace only the output, since the logger is shared with running
+	// health checks
+	logged := &syncBuffer{}
+	defer log.DefaultLogger.SetOutput(log.DefaultLogger.Writer())
+	log.DefaultLogger.SetOutput(logged)
+
+	s.AddBackend(c)
+
+	// nothing logged by default
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(strings.Contains(logged.String(), "conn service="), Equals, false)
+
+	svcCfg := s.service.Config()
+	svcCfg.ConnLogSample = 1
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().ConnLogSample, Equals, 1.0)
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	backend := s.service.Backends[0].Name
+	expected := fmt.Sprintf("conn service=%s ", s.service.Name)
+	for i := 0; ; i++ {
+		if strings.Contains(logged.String(), expected) {
+			break
+		}
+		if i > 20 {
+			c.Fatal("connection not logged")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	line := logged.String()
+	c.Assert(strings.Contains(line, "backend="+backend+" "), Equals, true)
+	c.Assert(strings.Contains(line, fmt.Sprintf("rcvd=%d ", len("testing\n"))), Equals, true)
+	c.Assert(strings.Contains(line, fmt.Sprintf("sent=%d ", len(s.servers[0].addr))), Equals, true)
+
+	svcCfg.ConnLogSample = 2
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+}
+
+// Backend selections are logged with the reason for the choice
+func (s *BasicSuite) TestLogBalance(c *C) {
+	// replace only the output, since the logger is shared with running
+	// health checks
+	logged := &syncBuffer{}
+	defer log.DefaultLogger.SetOutput(log.DefaultLogger.Writer())
+	log.DefaultLogger.SetOutput(logged)
+
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	// nothing logged by default
+	c.Assert(s.service.next()[0].Name, Equals, "backend_0")
+	c.Assert(strings.Contains(logged.String(), "Balancing"), Equals, false)
+
+	svcCfg := s.service.Config()
+	svcCfg.LogBalance = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().LogBalance, Equals, true)
+
+	c.Assert(s.service.next()[0].Name, Equals, "backend_1")
+	c.Assert(strings.Contains(logged.String(), "Balancing testService RR: chose backend_1, index 1, turn 1 of 1"), Equals, true)
+
+	svcCfg.Balance = "LC"
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	atomic.AddInt64(&s.service.Backends[0].Active, 1)
+	defer atomic.AddInt64(&s.service.Backends[0].Active, -1)
+
+	c.Assert(s.service.next()[0].Name, Equals, "backend_1")
+	c.Assert(strings.Contains(logged.String(), "Balancing testService LC: chose backend_1, fewest active connections, backend_1=0 backend_0=1"), Equals, true)
+}
+
+// write a message and verify the response on an existing connection
+func checkConnResp(conn net.Conn, expected string, c Tester) {
+	if _, err := io.WriteString(conn, expected); err != nil {
+		c.Fatal(err)
+	}
+
+	buff := make([]byte, 1024)
+	n, err := conn.Read(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(buff[:n]), Equals, expected)
+}
+
+// Add backends and run response tests in parallel
+func (s *BasicSuite) TestParallel(c *C) {
+	var wg sync.WaitGroup
+
+	client := func(i int) {
+		s.AddBackend(c)
+		// do a bunch of new connections in unison
+		for i := 0; i < 100; i++ {
+			checkResp(s.service.Addr, "", c)
+		}
+
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			// we should still get an initial connection
+			c.Fatal(err)
+		}
+		defer conn.Close()
+
+		// now do some more continuous ping-pongs with the server
+		buff := make([]byte, 1024)
+
+		for i := 0; i < 1000; i++ {
+			n, err := io.WriteString(conn, "Testing testing\n")
+			if err != nil || n == 0 {
+				c.Fatal("couldn't write:", err)
+			}
+
+			n, err = conn.Read(buff)
+			if err != nil || n == 0 {
+				c.Fatal("no response:", err)
+			}
+		}
+		wg.Done()
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go client(i)
+	}
+
+	wg.Wait()
+}
+
+type UDPSuite struct {
+	servers []*udpTestServer
+	service *Service
+}
+
+var _ = Suite(&UDPSuite{})
+
+func (s *UDPSuite) SetUpTest(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:    "testService",
+		Addr:    "127.0.0.1:11110",
+		Network: "udp",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	s.service = Registry.GetService(svcCfg.Name)
+}
+
+func (s *UDPSuite) TearDownTest(c *C) {
+	for _, s := range s.servers {
+		s.Stop()
+	}
+
+	// get rid of the servers refs too!
+	s.servers = nil
+
+	// clear global defaults in Registry
+	Registry.cfg.Balance = ""
+	Registry.cfg.CheckInterval = 0
+	Registry.cfg.Fall = 0
+	Registry.cfg.Rise = 0
+	Registry.cfg.ClientTimeout = 0
+	Registry.cfg.ServerTimeout = 0
+	Registry.cfg.DialTimeout = 0
+
+	err := Registry.RemoveService(s.service.Name)
+	if err != nil {
+		c.Fatalf("could not remove service '%s': %s", s.service.Name, err)
+	}
+}
+
+// Add a UDP service, make sure it works, and remove it
+func (s *UDPSuite) TestAddRemove(c *C) {
+	bckCfg := client.BackendConfig{
+		Name:    "UDPServer",
+		Addr:    "127.0.0.1:11111",
+		Network: "udp",
+	}
+
+	s.service.add(NewBackend(bckCfg))
+
+	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	conn, err := net.ListenUDP("udp", lAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	n, err := conn.WriteToUDP([]byte("TEST"), rAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	// try to make sure packets were delivered and read
+	time.Sleep(100 * time.Millisecond)
+
+	stats := s.service.Stats()
+	c.Assert(stats.Rcvd, Equals, int64(n))
+
+	ok := s.service.remove("UDPServer")
+	c.Assert(ok, Equals, true)
+
+	stats = s.service.Stats()
+	c.Assert(len(stats.Backends), Equals, 0)
+
+}
+
+// UDP sessions should return replies to the client, and expire when idle
+func (s *UDPSuite) TestSessions(c *C) {
+	echoAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	echo, err := net.ListenUDP("udp", echoAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buff[:n], addr)
+		}
+	}()
+
+	svcCfg := client.ServiceConfig{
+		Name:              s.service.Name,
+		UDPSessionTimeout: 200,
+		Backends: []client.BackendConfig{
+			{Name: "UDPEcho", Addr: echo.LocalAddr().String(), Network: "udp"},
+		},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	conn, err := net.ListenUDP("udp", lAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping := func(msg string) {
+		if _, err := conn.WriteToUDP([]byte(msg), rAddr); err != nil {
+			c.Fatal(err)
+		}
+
+		buff := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			c.Fatal(err)
+		}
+		c.Assert(string(buff[:n]), Equals, msg)
+	}
+
+	ping("TEST_1")
+	ping("TEST_2")
+	c.Assert(s.service.Stats().UDPSessions, Equals, 1)
+
+	// wait for the session to expire
+	for i := 0; i < 20 && s.service.Stats().UDPSessions > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(s.service.Stats().UDPSessions, Equals, 0)
 
+	// a returning client gets a new session
+	ping("TEST_3")
+	c.Assert(s.service.Stats().UDPSessions, Equals, 1)
 }
 
 // Make sure UDP Services work, and check our WeightedRoundRobin since we're
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// Request methods which identify an HTTP connection, including the space
+// following the method.
+var httpMethods = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ",
+}
+
+// Peek at the start of the connection to see if it begins with an HTTP
+// request method. Reading stops as soon as the data can't be a method, so a
+// client sending a short binary message isn't held waiting for more.
+func sniffHTTP(r *bufio.Reader) (bool, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false, err
+		}
+
+		possible := false
+		for _, m := range httpMethods {
+			if string(b) == m {
+				return true, nil
+			}
+			if strings.HasPrefix(m, string(b)) {
+				possible = true
+			}
+		}
+		if !possible {
+			return false, nil
+		}
+	}
+}
+
+// Read the start of a TCP connection to decide whether it's HTTP, waiting up
+// to timeout for the client to send something. A client which sends nothing
+// in time is treated as TCP, since the protocol may expect the server to
+// speak first. The returned connection still reads the sniffed data.
+func sniffConn(conn net.Conn, timeout time.Duration) (net.Conn, bool, error) {
+	isHTTP := false
+	conn, err := readAhead(conn, timeout, func(r *bufio.Reader) (err error) {
+		isHTTP, err = sniffHTTP(r)
+		return err
+	})
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = nil
+	}
+	return conn, isHTTP, err
+}
+
+// Wait up to timeout for the client to send its first bytes, or for a TLS
+// client to complete the handshake. A client which doesn't returns a timeout
+// error. The returned connection still reads any data received.
+func awaitHandshake(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return readAhead(conn, timeout, func(r *bufio.Reader) error {
+			_, err := r.Peek(1)
+			return err
+		})
+	}
+
+	// The handshake reads through the client timeout wrapper, which would
+	// override a read deadline, so expire it from a timer instead.
+	raw := tc.NetConn()
+	if sc, ok := raw.(*shuttleConn); ok {
+		raw = sc.Conn
+	}
+	timer := time.AfterFunc(timeout, func() {
+		raw.SetReadDeadline(time.Now())
+	})
+
+	err := tc.Handshake()
+	if !timer.Stop() {
+		return conn, os.ErrDeadlineExceeded
+	}
+	return conn, err
+}
+
+// The longest PROXY protocol v1 header, including the CRLF.
+const maxProxyHeader = 107
+
+// Peek at a PROXY protocol v1 header at the start of the connection, waiting
+// up to timeout for it, and return the source address it reports. The header
+// is left to be read from the returned connection. Reading stops as soon as
+// the data can't be a header, as for sniffHTTP.
+func peekProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, string) {
+	const signature = "PROXY "
+
+	var ip string
+	conn, _ = readAhead(conn, timeout, func(r *bufio.Reader) error {
+		for n := 1; n <= maxProxyHeader; n++ {
+			b, err := r.Peek(n)
+			if err != nil {
+				return err
+			}
+
+			if n <= len(signature) {
+				if !strings.HasPrefix(signature, string(b)) {
+					return nil
+				}
+				continue
+			}
+
+			if bytes.HasSuffix(b, []byte("\r\n")) {
+				// PROXY TCP4|TCP6 src dst srcport dstport
+				fields := strings.Fields(string(b))
+				if len(fields) == 6 && (fields[1] == "TCP4" || fields[1] == "TCP6") && net.ParseIP(fields[2]) != nil {
+					ip = fields[2]
+				}
+				return nil
+			}
+		}
+		return nil
+	})
+	return conn, ip
+}
+
+// Read ahead on a connection with peek, which can wait up to timeout for
+// data. The returned connection replays whatever was read.
+func readAhead(conn net.Conn, timeout time.Duration, peek func(*bufio.Reader) error) (net.Conn, error) {
+	// The client timeout sets a read deadline before every read, which would
+	// override this one, so it's suspended while peeking. The connection
+	// isn't used anywhere else until it's returned.
+	if sc := clientShuttleConn(conn); sc != nil && sc.rwTimeout > 0 {
+		rwTimeout := sc.rwTimeout
+		sc.rwTimeout = 0
+		defer func() {
+			sc.rwTimeout = rwTimeout
+		}()
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	err := peek(r)
+	conn.SetReadDeadline(time.Time{})
+
+	peeked, _ := r.Peek(r.Buffered())
+	if len(peeked) > 0 {
+		conn = &bufferedConn{
+			Conn: conn,
+			r:    bufio.NewReader(io.MultiReader(bytes.NewReader(peeked), conn)),
+		}
+	}
+	return conn, err
+}
+
+// Return the shuttleConn under the wrappers added to a client connection as
+// it's accepted, or nil if there isn't one.
+func clientShuttleConn(conn net.Conn) *shuttleConn {
+	for {
+		switch c := conn.(type) {
+		case *shuttleConn:
+			return c
+		case *bufferedConn:
+			conn = c.Conn
+		case *countingConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// Serves the HTTP connections found by sniffing TCP services, routing them
+// by virtual host the same as the HTTP listener.
+var sniffRouter struct {
+	sync.Once
+	listener *connListener
+}
+
+// Hand a sniffed connection to the HTTP router.
+func serveSniffedHTTP(conn net.Conn) {
+	sniffRouter.Do(func() {
+		sniffRouter.listener = newConnListener()
+
+		// The server is shared by all sniffing services, so it has no
+		// timeouts of its own. Each connection keeps the client timeout of
+		// the service it was accepted by, set on every read and write.
+		server := &http.Server{
+			MaxHeaderBytes: 1 << 20,
+		}
+		NewHostRouter(server)
+
+		go func() {
+			log.Errorf("%s", server.Serve(sniffRouter.listener))
+		}()
+	})
+
+	sniffRouter.listener.conns <- conn
+}
+
+// A net.Listener which accepts connections handed to it from elsewhere.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
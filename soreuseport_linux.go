@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package main
+
+// The syscall package doesn't define SO_REUSEPORT for linux.
+const soReusePort = 0xf
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// The most bytes spliced between connections before the byte counts are
+// updated. A smaller chunk keeps the stats more current, at the cost of
+// more syscalls.
+const spliceChunkSize = 256 << 10
+
+// A connection wrapper which can be bypassed to copy directly between the
+// underlying TCPConns, letting the kernel splice the data on Linux.
+type splicer interface {
+	// Return the underlying TCPConn, or nil if the wrapper has to see every
+	// read and write, e.g. to set deadlines.
+	tcpConn() *net.TCPConn
+
+	// Count bytes transferred without going through the wrapper.
+	countRead(n int64)
+	countWritten(n int64)
+}
+
+// Return the TCPConn under any splicers, or nil if c can't be spliced.
+func spliceConn(c net.Conn) *net.TCPConn {
+	switch conn := c.(type) {
+	case *net.TCPConn:
+		return conn
+	case splicer:
+		return conn.tcpConn()
+	}
+	return nil
+}
+
+// Copy from src to dst until EOF or an error, like io.Copy. When both
+// connections are TCPConns, or splicers wrapping them, the copy is done with
+// TCPConn.ReadFrom so that it can be spliced, and the wrappers' byte counts
+// are updated after each spliceChunkSize.
+func copyConn(dst, src net.Conn) (int64, error) {
+	if !spliceConns {
+		return io.Copy(dst, src)
+	}
+
+	dstTCP, srcTCP := spliceConn(dst), spliceConn(src)
+	if dstTCP == nil || srcTCP == nil {
+		return io.Copy(dst, src)
+	}
+
+	var written int64
+	for {
+		n, err := dstTCP.ReadFrom(&io.LimitedReader{R: srcTCP, N: spliceChunkSize})
+		written += n
+		if s, ok := src.(splicer); ok {
+			s.countRead(n)
+		}
+		if s, ok := dst.(splicer); ok {
+			s.countWritten(n)
+		}
+
+		// a short chunk without an error is EOF
+		if err != nil || n < spliceChunkSize {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// Keep statsd packets under a typical ethernet MTU, less the IP and UDP
+// headers.
+const statsdMaxPacket = 1432
+
+// Periodically sends backend stats from the Registry to a statsd server.
+// Active connections and up status are sent as gauges, and the byte, error
+// and connection totals are sent as counters of the change since the last
+// flush, along with each service's accept rate alerts. Each service is sent
+// every StatsInterval, or every interval if it doesn't set one. As
+// ConnHooks, the duration of each proxied connection is sent as a timer.
+type statsdReporter struct {
+	NoopHooks
+
+	conn     net.Conn
+	prefix   string
+	interval time.Duration
+
+	// last counter values, to send the difference
+	last map[string]int64
+
+	// when each service's stats are next due, by statsdName
+	next map[string]time.Time
+}
+
+func newStatsdReporter(addr, prefix string, interval time.Duration) (*statsdReporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.Trim(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+
+	return &statsdReporter{
+		conn:     conn,
+		prefix:   prefix,
+		interval: interval,
+		last:     make(map[string]int64),
+		next:     make(map[string]time.Time),
+	}, nil
+}
+
+// Send stats forever. A single loop sends the services which are due, then
+// sleeps until the next one is.
+func (r *statsdReporter) Run() {
+	for {
+		time.Sleep(r.Tick(time.Now(), Registry.Stats()))
+	}
+}
+
+// Send the stats for the services which are due at now, and return the time
+// until the next is due. A service is first sent one interval after it's
+// seen, and removed services are forgotten.
+func (r *statsdReporter) Tick(now time.Time, stats []ServiceStat) time.Duration {
+	wait := r.interval
+	due := []ServiceStat{}
+	present := make(map[string]bool)
+
+	for _, svc := range stats {
+		name := statsdName(svc.Name)
+		present[name] = true
+
+		interval := r.interval
+		if svc.StatsInterval > 0 {
+			interval = time.Duration(svc.StatsInterval) * time.Millisecond
+		}
+
+		next, ok := r.next[name]
+		switch {
+		case !ok:
+			next = now.Add(interval)
+		case !now.Before(next):
+			due = append(due, svc)
+			// keep to the schedule, unless we've fallen behind
+			if next = next.Add(interval); !next.After(now) {
+				next = now.Add(interval)
+			}
+		}
+		r.next[name] = next
+
+		if d := next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+
+	for name := range r.next {
+		if !present[name] {
+			delete(r.next, name)
+		}
+	}
+	for key := range r.last {
+		if !present[r.serviceName(key)] {
+			delete(r.last, key)
+		}
+	}
+
+	r.Flush(due)
+	return wait
+}
+
+// Return the service part of a metric name.
+func (r *statsdReporter) serviceName(key string) string {
+	key = strings.TrimPrefix(key, r.prefix)
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Send the stats for all backends, batched into packets under
+// statsdMaxPacket.
+func (r *statsdReporter) Flush(stats []ServiceStat) {
+	var packet bytes.Buffer
+	for _, line := range r.metrics(stats) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacket {
+			r.send(packet.Bytes())
+			packet.Reset()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() > 0 {
+		r.send(packet.Bytes())
+	}
+}
+
+func (r *statsdReporter) send(packet []byte) {
+	if _, err := r.conn.Write(packet); err != nil {
+		log.Warnf("WARN: statsd write: %s", err)
+	}
+}
+
+// Format the statsd lines for each backend, and the accept rate alerts for
+// each service which has had any.
+func (r *statsdReporter) metrics(stats []ServiceStat) []string {
+	lines := []string{}
+	seen := make(map[string]bool)
+	sent := make(map[string]bool)
+
+	for _, svc := range stats {
+		sent[statsdName(svc.Name)] = true
+
+		if svc.AcceptRateAlerts > 0 {
+			key := r.prefix + statsdName(svc.Name) + ".accept_rate_alerts"
+			seen[key] = true
+
+			delta := svc.AcceptRateAlerts - r.last[key]
+			r.last[key] = svc.AcceptRateAlerts
+			if delta < 0 {
+				delta = svc.AcceptRateAlerts
+			}
+			lines = append(lines, fmt.Sprintf("%s:%d|c", key, delta))
+		}
+
+		for _, b := range svc.Backends {
+			name := r.prefix + statsdName(svc.Name) + "." + statsdName(b.Name) + "."
+
+			up := 0
+			if b.Up {
+				up = 1
+			}
+			lines = append(lines,
+				fmt.Sprintf("%sactive:%d|g", name, b.Active),
+				fmt.Sprintf("%sup:%d|g", name, up),
+			)
+
+			counters := []struct {
+				metric string
+				value  int64
+			}{
+				{"sent", b.Sent},
+				{"received", b.Rcvd},
+				{"errors", b.Errors},
+				{"connections", b.Conns},
+			}
+
+			for _, c := range counters {
+				key := name + c.metric
+				seen[key] = true
+
+				delta := c.value - r.last[key]
+				r.last[key] = c.value
+
+				// the backend was replaced, and the count restarted
+				if delta < 0 {
+					delta = c.value
+				}
+				lines = append(lines, fmt.Sprintf("%s:%d|c", key, delta))
+			}
+		}
+	}
+
+	// forget removed backends of the services sent
+	for key := range r.last {
+		if sent[r.serviceName(key)] && !seen[key] {
+			delete(r.last, key)
+		}
+	}
+
+	return lines
+}
+
+// Send the duration of each connected TCP connection.
+func (r *statsdReporter) Closed(info *ConnInfo) {
+	if !info.Connected {
+		return
+	}
+
+	name := r.prefix + statsdName(info.Service) + "." + statsdName(info.Backend)
+	r.send([]byte(fmt.Sprintf("%s.conn_duration:%d|ms", name, info.Duration/time.Millisecond)))
+}
+
+// Replace characters which have a meaning in a statsd metric name.
+func statsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func startStatsd() {
+	r, err := newStatsdReporter(statsdAddr, statsdPrefix, statsdInterval)
+	if err != nil {
+		log.Errorf("ERROR: statsd: %s", err)
+		return
+	}
+
+	log.Printf("Sending stats to statsd at %s", statsdAddr)
+	AddConnHooks(r)
+	r.Run()
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// A ConfigStore loads and saves shuttle's state config. The file store is the
+// default, while the consul and etcd stores keep the config under a key, where
+// it can be watched for changes made outside of shuttle.
+type ConfigStore interface {
+	// Load the config. A missing config returns an error matching
+	// os.ErrNotExist.
+	Load() (client.Config, error)
+
+	// Save the config, if it has changed.
+	Save(client.Config) error
+
+	// Watch returns a channel receiving the config each time it's changed in
+	// the store, or nil if the store can't be watched.
+	Watch() <-chan client.Config
+}
+
+// Time to wait before retrying a failed watch request
+var storeRetryDelay = time.Second
+
+// The store for the state config when it's kept in consul or etcd, set from
+// the -config-store flag.
+var remoteStore ConfigStore
+
+// Return the store for the state config, or nil if there's no state config.
+func stateStore() ConfigStore {
+	if remoteStore != nil {
+		return remoteStore
+	}
+	if stateConfig == "" {
+		return nil
+	}
+	return &fileStore{path: stateConfig}
+}
+
+// Create the remote store of the given kind, "consul" or "etcd", for the key
+// on the server at addr. The "file" kind uses the -state file, returning nil.
+func newRemoteStore(kind, addr, key string) (ConfigStore, error) {
+	switch kind {
+	case "file":
+		return nil, nil
+	case "consul":
+		return newConsulStore(addr, key), nil
+	case "etcd":
+		return newEtcdStore(addr, key), nil
+	}
+	return nil, fmt.Errorf("unknown config store %q", kind)
+}
+
+// Parse a config read from a store.
+func parseConfig(data []byte) (client.Config, error) {
+	var cfg client.Config
+	err := json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// A ConfigStore which reads and writes a json file.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) String() string {
+	return s.path
+}
+
+func (s *fileStore) Load() (client.Config, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return client.Config{}, err
+	}
+	return parseConfig(data)
+}
+
+func (s *fileStore) Save(cfg client.Config) error {
+	data := marshal(cfg)
+
+	last, _ := ioutil.ReadFile(s.path)
+	if bytes.Equal(data, last) {
+		log.Println("No change in config")
+		return nil
+	}
+
+	// We should probably write a temp file and mv for atomic update.
+	return ioutil.WriteFile(s.path, data, 0644)
+}
+
+// The file isn't watched, it's only changed through shuttle.
+func (s *fileStore) Watch() <-chan client.Config {
+	return nil
+}
+
+// Tracks the last config read from or written to a remote store, so an
+// unchanged config isn't written again, and shuttle's own writes aren't
+// applied again when they're seen by a watch.
+type lastConfig struct {
+	sync.Mutex
+	data []byte
+}
+
+// Return true if the config data differs from the last seen.
+func (l *lastConfig) changed(data []byte) bool {
+	l.Lock()
+	defer l.Unlock()
+	return !bytes.Equal(l.data, data)
+}
+
+func (l *lastConfig) set(data []byte) {
+	l.Lock()
+	defer l.Unlock()
+	l.data = data
+}
+
+// Send the config data from a watch if it has changed.
+func (l *lastConfig) send(configs chan<- client.Config, name string, data []byte) {
+	if data == nil || !l.changed(data) {
+		return
+	}
+	l.set(data)
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		log.Warnf("WARN: invalid config in %s: %s", name, err)
+		return
+	}
+	configs <- cfg
+}
+
+// Send configs from the watch loop fn, which is retried after any error.
+func watchStore(name string, fn func(chan<- client.Config) error) <-chan client.Config {
+	configs := make(chan client.Config)
+	go func() {
+		for {
+			err := fn(configs)
+			log.Warnf("WARN: watching %s: %s", name, err)
+			time.Sleep(storeRetryDelay)
+		}
+	}()
+	return configs
+}
+
+// A ConfigStore using a key in the consul KV store.
+type consulStore struct {
+	addr   string
+	key    string
+	client *http.Client
+	last   lastConfig
+}
+
+func newConsulStore(addr, key string) *consulStore {
+	return &consulStore{
+		addr:   strings.TrimRight(addr, "/"),
+		key:    strings.Trim(key, "/"),
+		client: &http.Client{},
+	}
+}
+
+func (s *consulStore) String() string {
+	return fmt.Sprintf("consul key %s", s.key)
+}
+
+func (s *consulStore) url(query string) string {
+	return fmt.Sprintf("%s/v1/kv/%s?%s", s.addr, s.key, query)
+}
+
+// Get the raw value of the key, and its index. A blocking query is made when
+// index is greater than 0, returning once the key changes or the wait ends.
+func (s *consulStore) get(index uint64) ([]byte, uint64, error) {
+	query := "raw"
+	if index > 0 {
+		query += fmt.Sprintf("&index=%d&wait=5m", index)
+	}
+
+	resp, err := s.client.Get(s.url(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var newIndex uint64
+	fmt.Sscan(resp.Header.Get("X-Consul-Index"), &newIndex)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, newIndex, fmt.Errorf("%s: %w", s, os.ErrNotExist)
+	default:
+		return nil, 0, fmt.Errorf("%s: %s", s, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, newIndex, err
+}
+
+func (s *consulStore) Load() (client.Config, error) {
+	data, _, err := s.get(0)
+	if err != nil {
+		return client.Config{}, err
+	}
+	s.last.set(data)
+	return parseConfig(data)
+}
+
+func (s *consulStore) Save(cfg client.Config) error {
+	data := marshal(cfg)
+	if !s.last.changed(data) {
+		log.Println("No change in config")
+		return nil
+	}
+
+	req, err := http.NewRequest("PUT", s.url(""), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("saving %s: %s", s, resp.Status)
+	}
+	s.last.set(data)
+	return nil
+}
+
+func (s *consulStore) Watch() <-chan client.Config {
+	return watchStore(s.String(), func(configs chan<- client.Config) error {
+		var index uint64
+		for {
+			data, newIndex, err := s.get(index)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+
+			// the index can go backwards, and has to be reset
+			if newIndex < index {
+				newIndex = 0
+			}
+			index = newIndex
+
+			s.last.send(configs, s.String(), data)
+		}
+	})
+}
+
+// A ConfigStore using a key in etcd, through the v3 json API.
+type etcdStore struct {
+	addr   string
+	key    string
+	client *http.Client
+	last   lastConfig
+}
+
+func newEtcdStore(addr, key string) *etcdStore {
+	return &etcdStore{
+		addr:   strings.TrimRight(addr, "/"),
+		key:    key,
+		client: &http.Client{},
+	}
+}
+
+func (s *etcdStore) String() string {
+	return fmt.Sprintf("etcd key %s", s.key)
+}
+
+type etcdKV struct {
+	Value []byte `json:"value"`
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	Kvs []etcdKV `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Events []struct {
+			Type string `json:"type"`
+			Kv   etcdKV `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// POST a json request to the etcd API.
+func (s *etcdStore) post(path string, body interface{}) (*http.Response, error) {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Post(s.addr+path, "application/json", bytes.NewReader(js))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", s, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Get the value of the key, and the store's revision.
+func (s *etcdStore) get() ([]byte, int64, error) {
+	resp, err := s.post("/v3/kv/range", map[string]interface{}{
+		"key": []byte(s.key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var rng etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rng); err != nil {
+		return nil, 0, err
+	}
+
+	if len(rng.Kvs) == 0 {
+		return nil, rng.Header.Revision, fmt.Errorf("%s: %w", s, os.ErrNotExist)
+	}
+	return rng.Kvs[0].Value, rng.Header.Revision, nil
+}
+
+func (s *etcdStore) Load() (client.Config, error) {
+	data, _, err := s.get()
+	if err != nil {
+		return client.Config{}, err
+	}
+	s.last.set(data)
+	return parseConfig(data)
+}
+
+func (s *etcdStore) Save(cfg client.Config) error {
+	data := marshal(cfg)
+	if !s.last.changed(data) {
+		log.Println("No change in config")
+		return nil
+	}
+
+	resp, err := s.post("/v3/kv/put", map[string]interface{}{
+		"key":   []byte(s.key),
+		"value": data,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.last.set(data)
+	return nil
+}
+
+func (s *etcdStore) Watch() <-chan client.Config {
+	return watchStore(s.String(), func(configs chan<- client.Config) error {
+		// start from the current value, so no change is missed between
+		// reconnecting and the watch starting
+		data, rev, err := s.get()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.last.send(configs, s.String(), data)
+
+		resp, err := s.post("/v3/watch", map[string]interface{}{
+			"create_request": map[string]interface{}{
+				"key":            []byte(s.key),
+				"start_revision": rev + 1,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var watch etcdWatchResponse
+			if err := dec.Decode(&watch); err != nil {
+				return err
+			}
+			if watch.Error != nil {
+				return fmt.Errorf("%s", watch.Error.Message)
+			}
+
+			for _, event := range watch.Result.Events {
+				if event.Type == "DELETE" {
+					continue
+				}
+				s.last.send(configs, s.String(), event.Kv.Value)
+			}
+		}
+	})
+}
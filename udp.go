@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// A UDP client mapped to a backend. Replies from the backend are returned to
+// the client through the service's listener.
+type udpSession struct {
+	client  *net.UDPAddr
+	backend *Backend
+	conn    *net.UDPConn
+
+	lastActive time.Time
+	elem       *list.Element
+}
+
+// The UDP sessions for a service listener, keyed by the client address.
+// Sessions are kept in order of last activity, so expired sessions can be
+// removed from the front without scanning the whole table.
+type udpSessionTable struct {
+	sync.Mutex
+	timeout  time.Duration
+	listener *net.UDPConn
+	sessions map[string]*udpSession
+	active   *list.List
+	done     chan struct{}
+	closed   bool
+}
+
+func newUDPSessionTable(listener *net.UDPConn, timeout time.Duration) *udpSessionTable {
+	t := &udpSessionTable{
+		timeout:  timeout,
+		listener: listener,
+		sessions: make(map[string]*udpSession),
+		active:   list.New(),
+		done:     make(chan struct{}),
+	}
+	go t.expireLoop()
+	return t
+}
+
+// Change the idle timeout. A timeout of 0 disables sessions, and any
+// existing sessions are removed on the next sweep.
+func (t *udpSessionTable) SetTimeout(timeout time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.timeout = timeout
+}
+
+func (t *udpSessionTable) Timeout() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.timeout
+}
+
+// The number of active sessions
+func (t *udpSessionTable) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.sessions)
+}
+
+// Return the session for the client, creating a new one to a backend chosen
+// by pick if there isn't one. Returns nil if no backend is available.
+func (t *udpSessionTable) Get(client *net.UDPAddr, pick func() *Backend) (*udpSession, error) {
+	key := client.String()
+
+	t.Lock()
+	if sess, ok := t.sessions[key]; ok {
+		t.touch(sess)
+		t.Unlock()
+		return sess, nil
+	}
+	t.Unlock()
+
+	backend := pick()
+	if backend == nil {
+		return nil, nil
+	}
+
+	conn, err := net.DialUDP(backend.Network, nil, backend.udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &udpSession{
+		client:  client,
+		backend: backend,
+		conn:    conn,
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		conn.Close()
+		return nil, nil
+	}
+
+	// another packet from this client may have beaten us here
+	if existing, ok := t.sessions[key]; ok {
+		conn.Close()
+		t.touch(existing)
+		return existing, nil
+	}
+
+	sess.lastActive = time.Now()
+	sess.elem = t.active.PushBack(sess)
+	t.sessions[key] = sess
+	go t.reply(sess)
+
+	return sess, nil
+}
+
+// Mark the session as active, moving it to the back of the expiry list.
+// The table must be locked.
+func (t *udpSessionTable) touch(sess *udpSession) {
+	sess.lastActive = time.Now()
+	if sess.elem != nil {
+		t.active.MoveToBack(sess.elem)
+	}
+}
+
+// Remove the session from the table and close its backend socket.
+// The table must be locked.
+func (t *udpSessionTable) remove(sess *udpSession) {
+	if sess.elem == nil {
+		return
+	}
+	t.active.Remove(sess.elem)
+	sess.elem = nil
+	delete(t.sessions, sess.client.String())
+	sess.conn.Close()
+}
+
+// Return packets from the backend to the client until the session is closed.
+func (t *udpSessionTable) reply(sess *udpSession) {
+	buff := make([]byte, 65536)
+	for {
+		n, err := sess.conn.Read(buff)
+		if err != nil {
+			t.Lock()
+			t.remove(sess)
+			t.Unlock()
+			return
+		}
+
+		atomic.AddInt64(&sess.backend.Rcvd, int64(n))
+
+		t.Lock()
+		if sess.elem != nil {
+			t.touch(sess)
+		}
+		t.Unlock()
+
+		if _, err := t.listener.WriteToUDP(buff[:n], sess.client); err != nil {
+			log.Warnf("WARN: udp reply to %s: %s", sess.client, err)
+			atomic.AddInt64(&sess.backend.Errors, 1)
+		}
+	}
+}
+
+// Periodically remove sessions which have been idle longer than the timeout.
+func (t *udpSessionTable) expireLoop() {
+	for {
+		interval := t.Timeout() / 2
+		if interval <= 0 || interval > time.Second {
+			interval = time.Second
+		}
+
+		select {
+		case <-t.done:
+			return
+		case <-time.After(interval):
+		}
+
+		t.expire(time.Now())
+	}
+}
+
+// Remove sessions idle since before now-timeout.
+func (t *udpSessionTable) expire(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for e := t.active.Front(); e != nil; e = t.active.Front() {
+		sess := e.Value.(*udpSession)
+		if now.Sub(sess.lastActive) < t.timeout {
+			// everything after this is more recent
+			return
+		}
+		log.Debugf("Expiring UDP session %s->%s", sess.client, sess.backend.Name)
+		t.remove(sess)
+	}
+}
+
+// Close all sessions and stop the expiry loop.
+func (t *udpSessionTable) Close() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.done)
+
+	for e := t.active.Front(); e != nil; e = t.active.Front() {
+		t.remove(e.Value.(*udpSession))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"runtime"
 	"strings"
 )
 
@@ -39,3 +40,9 @@ func filterEmpty(a []string) []string {
 	}
 	return a[:len(a)-removed]
 }
+
+// return the stack trace of the current goroutine
+func stack() []byte {
+	buf := make([]byte, 16384)
+	return buf[:runtime.Stack(buf, false)]
+}